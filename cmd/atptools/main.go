@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/ericvolp12/atproto.tools/pkg/commands/checkoutcmd"
+	"github.com/ericvolp12/atproto.tools/pkg/commands/parqtoolcmd"
+	"github.com/ericvolp12/atproto.tools/pkg/commands/plccmd"
+	"github.com/ericvolp12/atproto.tools/pkg/commands/streamcmd"
+	"github.com/ericvolp12/atproto.tools/pkg/envfile"
+	"github.com/ericvolp12/atproto.tools/pkg/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+// debugEnvVars are the env vars the subcommands read their debug flags from
+var debugEnvVars = []string{"LG_DEBUG", "PLC_EXPORTER_DEBUG"}
+
+// metricsCommands are the subcommands without an http server of their own, which --metrics-addr
+// serves metrics for. The others serve /metrics on their own listeners.
+var metricsCommands = map[string]bool{"checkout": true, "parqtool": true}
+
+func main() {
+	app := cli.App{
+		Name:    "atptools",
+		Usage:   "atproto tools: the looking glass consumer, PLC exporter, repo checkout, and Parquet inspection",
+		Version: version.Version,
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "file of KEY=VALUE lines setting the env vars subcommand flags are read from, without overriding vars already set",
+			EnvVars: []string{"ATPTOOLS_CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    "debug",
+			Usage:   "enable debug logging in every subcommand",
+			EnvVars: []string{"ATPTOOLS_DEBUG"},
+		},
+		&cli.StringFlag{
+			Name:    "metrics-addr",
+			Usage:   "address to serve Prometheus metrics on for the checkout and parqtool subcommands, which have no http server of their own (empty to disable)",
+			EnvVars: []string{"ATPTOOLS_METRICS_ADDR"},
+		},
+	}
+
+	app.Before = func(cctx *cli.Context) error {
+		if path := cctx.String("config"); path != "" {
+			if err := envfile.Load(path); err != nil {
+				return fmt.Errorf("failed to load config %q: %w", path, err)
+			}
+			// Lets stream find the file again when it's told to reload
+			if _, set := os.LookupEnv("LG_CONFIG"); !set {
+				os.Setenv("LG_CONFIG", path)
+			}
+		}
+
+		if cctx.Bool("debug") {
+			for _, name := range debugEnvVars {
+				os.Setenv(name, "true")
+			}
+		}
+
+		if addr := cctx.String("metrics-addr"); addr != "" && metricsCommands[cctx.Args().First()] {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			go func() {
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					slog.Error("metrics server failed", "addr", addr, "err", err)
+				}
+			}()
+		}
+		return nil
+	}
+
+	app.Commands = []*cli.Command{
+		command("stream", streamcmd.App()),
+		command("plc", plccmd.App()),
+		command("checkout", checkoutcmd.App()),
+		command("parqtool", parqtoolcmd.App()),
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// command mounts a standalone tool's app as a subcommand, keeping its flags and subcommands
+func command(name string, app *cli.App) *cli.Command {
+	return &cli.Command{
+		Name:        name,
+		Usage:       app.Usage,
+		UsageText:   app.UsageText,
+		ArgsUsage:   app.ArgsUsage,
+		Flags:       app.Flags,
+		Before:      app.Before,
+		After:       app.After,
+		Action:      app.Action,
+		Subcommands: app.Commands,
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ericvolp12/atproto.tools/pkg/commands/parqtoolcmd"
+)
+
+func main() {
+	if err := parqtoolcmd.App().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,17 @@
+// Command gen regenerates the CBOR codecs for the firehose frames the pinned indigo can't decode.
+// Run it from the repository root with `go run ./gen`.
+package main
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/stream"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func main() {
+	if err := cbg.WriteMapEncodersToFile("pkg/stream/cbor_gen.go", "stream",
+		stream.FirehoseAccount{},
+		stream.FirehoseSync{},
+	); err != nil {
+		panic(err)
+	}
+}
@@ -2,41 +2,113 @@ package bq
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 )
 
+// insertBatchSize caps how many rows are inserted into a table at once
+const insertBatchSize = 10_000
+
+// closeTimeout bounds how long Close waits for buffered rows to be inserted
+const closeTimeout = time.Minute
+
+// ErrClosed is returned for rows inserted once the client has started shutting down
+var ErrClosed = errors.New("bigquery client is shutting down")
+
 type BQ struct {
-	logger       *slog.Logger
-	recordSchema bigquery.Schema
-	client       *bigquery.Client
-	dataset      *bigquery.Dataset
+	logger  *slog.Logger
+	client  *bigquery.Client
+	dataset *bigquery.Dataset
+
+	records    *table
+	events     *table
+	identities *table
+
+	// storage is set once rows are written through the Storage Write API
+	storage atomic.Pointer[storageClient]
+
+	// intakeLk is held to buffer rows, and locked exclusively to stop intake
+	intakeLk sync.RWMutex
+	closed   bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	clock clock.Clock
+}
+
+// table buffers the rows bound for a BigQuery table and inserts them in batches
+type table struct {
+	// name is the table's name, or the prefix of its daily tables if it's sharded
+	name   string
+	schema bigquery.Schema
+	// sharded tables get a new table each day named name_YYYYMMDD, otherwise a single table is
+	// partitioned by day on its created_at column
+	sharded bool
 
-	tablePrefix string
+	buf chan any
 
 	tableDate string
 	inserter  *bigquery.Inserter
-
-	recordBuf chan *Record
+	writer    *storageWriter
+	insertLk  sync.Mutex
 }
 
 var tracer = otel.Tracer("bq")
 
+func newTable(name string, row any, sharded bool) (*table, error) {
+	schema, err := bigquery.InferSchema(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to infer %s schema: %w", name, err)
+	}
+	return &table{
+		name:    name,
+		schema:  schema,
+		sharded: sharded,
+		buf:     make(chan any, 100_000),
+	}, nil
+}
+
+// NewBQ creates a client writing records to daily tables prefixed with tablePrefix, and events
+// and identities to the day partitioned eventsTable and identitiesTable. Leaving either of those
+// empty skips exporting it.
 func NewBQ(
 	ctx context.Context,
 	projectID string,
 	dataset string,
 	tablePrefix string,
+	eventsTable string,
+	identitiesTable string,
 	logger *slog.Logger,
+	clk clock.Clock,
 ) (*BQ, error) {
-	recordSchema, err := bigquery.InferSchema(Record{})
+	records, err := newTable(tablePrefix, Record{}, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to infer schema: %w", err)
+		return nil, err
+	}
+
+	var events, identities *table
+	if eventsTable != "" {
+		if events, err = newTable(eventsTable, Event{}, false); err != nil {
+			return nil, err
+		}
+	}
+	if identitiesTable != "" {
+		if identities, err = newTable(identitiesTable, Identity{}, false); err != nil {
+			return nil, err
+		}
 	}
 
 	bqClient, err := bigquery.NewClient(ctx, projectID)
@@ -51,22 +123,33 @@ func NewBQ(
 	}
 
 	bq := &BQ{
-		recordSchema: recordSchema,
-		client:       bqClient,
-		dataset:      bqDataset,
-		logger:       logger,
-		tablePrefix:  tablePrefix,
-		recordBuf:    make(chan *Record, 100_000),
+		client:     bqClient,
+		dataset:    bqDataset,
+		logger:     logger,
+		records:    records,
+		events:     events,
+		identities: identities,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		clock:      clk,
 	}
 
-	// Start a routine to batch insert records every 5 seconds
+	// Start a routine to batch insert rows every 5 seconds, until Shutdown takes over draining
+	// the buffers. It outlives ctx so a batch taken from a buffer isn't lost to a cancelled insert.
+	insertCtx := context.WithoutCancel(ctx)
 	go func() {
-		t := time.NewTicker(5 * time.Second)
+		defer close(bq.stopped)
+		t := clk.NewTicker(5 * time.Second)
+		defer t.Stop()
 		for {
 			select {
-			case <-t.C:
-				if err := bq.insertRecords(ctx); err != nil {
-					logger.Error("failed to insert records", "error", err)
+			case <-bq.stop:
+				return
+			case <-t.C():
+				for _, tbl := range bq.tables() {
+					if err := bq.insert(insertCtx, tbl); err != nil {
+						logger.Error("failed to insert rows", "table", tbl.name, "error", err)
+					}
 				}
 			}
 		}
@@ -75,6 +158,28 @@ func NewBQ(
 	return bq, nil
 }
 
+// tables returns the tables being exported to
+func (bq *BQ) tables() []*table {
+	tables := []*table{bq.records}
+	if bq.events != nil {
+		tables = append(tables, bq.events)
+	}
+	if bq.identities != nil {
+		tables = append(tables, bq.identities)
+	}
+	return tables
+}
+
+// ExportsEvents reports whether events are exported
+func (bq *BQ) ExportsEvents() bool {
+	return bq.events != nil
+}
+
+// ExportsIdentities reports whether identities are exported
+func (bq *BQ) ExportsIdentities() bool {
+	return bq.identities != nil
+}
+
 func (bq *BQ) InsertRecord(ctx context.Context, record *Record) error {
 	ctx, span := tracer.Start(ctx, "InsertRecord")
 	defer span.End()
@@ -87,78 +192,214 @@ func (bq *BQ) InsertRecord(ctx context.Context, record *Record) error {
 		attribute.Int64("firehose_seq", record.FirehoseSeq),
 	)
 
-	bq.recordBuf <- record
+	return bq.enqueue(bq.records, record)
+}
+
+// InsertEvent buffers a firehose event's metadata, if events are exported
+func (bq *BQ) InsertEvent(ctx context.Context, event *Event) error {
+	if bq.events == nil {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "InsertEvent")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("repo", event.Repo),
+		attribute.String("event_type", event.EventType),
+		attribute.Int64("firehose_seq", event.FirehoseSeq),
+	)
+
+	return bq.enqueue(bq.events, event)
+}
+
+// InsertIdentity buffers a DID's resolved identity, if identities are exported
+func (bq *BQ) InsertIdentity(ctx context.Context, identity *Identity) error {
+	if bq.identities == nil {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "InsertIdentity")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("did", identity.DID))
 
-	recordsProcessed.WithLabelValues(bq.tablePrefix).Inc()
-	queueDepth.WithLabelValues(bq.tablePrefix).Inc()
+	return bq.enqueue(bq.identities, identity)
+}
 
+func (bq *BQ) enqueue(t *table, row any) error {
+	bq.intakeLk.RLock()
+	defer bq.intakeLk.RUnlock()
+	if bq.closed {
+		return ErrClosed
+	}
+
+	t.buf <- row
+
+	recordsProcessed.WithLabelValues(t.name).Inc()
+	queueDepth.WithLabelValues(t.name).Inc()
 	return nil
 }
 
-func (bq *BQ) insertRecords(ctx context.Context) error {
-	ctx, span := tracer.Start(ctx, "insertRecords")
+// Flush inserts all buffered rows
+func (bq *BQ) Flush(ctx context.Context) error {
+	for _, t := range bq.tables() {
+		for len(t.buf) > 0 {
+			if err := bq.insert(ctx, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insert inserts up to a batch of a table's buffered rows
+func (bq *BQ) insert(ctx context.Context, t *table) error {
+	ctx, span := tracer.Start(ctx, "insert")
 	defer span.End()
 
+	span.SetAttributes(attribute.String("table", t.name))
+
+	t.insertLk.Lock()
+	defer t.insertLk.Unlock()
+
 	// Create table if it doesn't exist
-	if err := bq.CreateTableIfNotExists(ctx); err != nil {
+	if err := bq.createTableIfNotExists(ctx, t); err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
 
-	// Grab up to 10_000 records from the buffer
-	batchSize := 10_000
-
-	records := make([]*Record, 0, batchSize)
-	for i := 0; i < batchSize; i++ {
+	rows := make([]any, 0, insertBatchSize)
+drain:
+	for len(rows) < insertBatchSize {
 		select {
-		case record := <-bq.recordBuf:
-			records = append(records, record)
-			queueDepth.WithLabelValues(bq.tablePrefix).Dec()
+		case row := <-t.buf:
+			rows = append(rows, row)
+			queueDepth.WithLabelValues(t.name).Dec()
 		default:
-			break
+			break drain
 		}
 	}
 
-	// If there are no records, return early
-	if len(records) == 0 {
+	// If there are no rows, return early
+	if len(rows) == 0 {
 		return nil
 	}
 
-	start := time.Now()
+	start := bq.clock.Now()
 	defer func() {
-		elapsed := time.Since(start)
-		batchSubmissionDuration.WithLabelValues(bq.tablePrefix).Observe(float64(elapsed.Milliseconds()))
-		batchSizeHist.WithLabelValues(bq.tablePrefix).Observe(float64(batchSize))
+		elapsed := bq.clock.Since(start)
+		batchSubmissionDuration.WithLabelValues(t.name).Observe(float64(elapsed.Milliseconds()))
+		batchSizeHist.WithLabelValues(t.name).Observe(float64(len(rows)))
 	}()
 
-	// Insert the records
-	if err := bq.inserter.Put(ctx, records); err != nil {
-		return fmt.Errorf("failed to insert records: %w", err)
+	// Insert the rows
+	if t.writer != nil {
+		if err := t.writer.append(ctx, rows); err != nil {
+			return fmt.Errorf("failed to write rows: %w", err)
+		}
+		return nil
+	}
+	if err := t.inserter.Put(ctx, rows); err != nil {
+		return fmt.Errorf("failed to insert rows: %w", err)
 	}
 
 	return nil
 }
 
-func (bq *BQ) CreateTableIfNotExists(ctx context.Context) error {
-	today := time.Now().Format("20060102")
+// createTableIfNotExists creates a table, or today's table if it's sharded, and points its
+// inserter, or its writer if the Storage Write API is used, at it
+func (bq *BQ) createTableIfNotExists(ctx context.Context, t *table) error {
+	today := bq.clock.Now().Format("20060102")
 
-	if bq.tableDate == today && bq.inserter != nil {
+	if t.inserter != nil && (!t.sharded || t.tableDate == today) {
 		return nil
 	}
 
-	table := bq.dataset.Table(fmt.Sprintf("%s_%s", bq.tablePrefix, today))
-	_, err := table.Metadata(ctx)
+	name := t.name
+	meta := &bigquery.TableMetadata{Schema: t.schema}
+	if t.sharded {
+		name = fmt.Sprintf("%s_%s", t.name, today)
+	} else {
+		meta.TimePartitioning = &bigquery.TimePartitioning{
+			Type:  bigquery.DayPartitioningType,
+			Field: "created_at",
+		}
+	}
+
+	tbl := bq.dataset.Table(name)
+	_, err := tbl.Metadata(ctx)
 	if err != nil {
-		bq.logger.Info("table does not exist, creating", "table", table.FullyQualifiedName())
-		if err := table.Create(ctx, &bigquery.TableMetadata{Schema: bq.recordSchema}); err != nil {
+		bq.logger.Info("table does not exist, creating", "table", tbl.FullyQualifiedName())
+		if err := tbl.Create(ctx, meta); err != nil {
 			return fmt.Errorf("failed to create table: %w", err)
 		}
 	}
 
-	bq.inserter = table.Inserter()
+	if sc := bq.storage.Load(); sc != nil {
+		if t.writer != nil {
+			if err := t.writer.close(); err != nil {
+				bq.logger.Warn("failed to close write stream", "table", t.name, "error", err)
+			}
+		}
+		w, err := sc.openWriter(ctx, name, t.schema)
+		if err != nil {
+			return fmt.Errorf("failed to open write stream: %w", err)
+		}
+		t.writer = w
+	}
+
+	t.inserter = tbl.Inserter()
+	t.tableDate = today
 
 	return nil
 }
 
+// Shutdown stops accepting rows, inserts everything still buffered, and then closes the client.
+// Only the first call does anything, later ones return its result.
+func (bq *BQ) Shutdown(ctx context.Context) error {
+	bq.shutdownOnce.Do(func() {
+		bq.shutdownErr = bq.shutdown(ctx)
+	})
+	return bq.shutdownErr
+}
+
+func (bq *BQ) shutdown(ctx context.Context) error {
+	// Wait out rows being buffered, which the insert routine keeps draining until it's stopped
+	bq.intakeLk.Lock()
+	bq.closed = true
+	bq.intakeLk.Unlock()
+
+	close(bq.stop)
+	<-bq.stopped
+
+	var buffered int
+	for _, t := range bq.tables() {
+		buffered += len(t.buf)
+	}
+	bq.logger.Info("draining buffered rows", "rows", buffered)
+
+	flushErr := bq.Flush(ctx)
+	if flushErr != nil {
+		flushErr = fmt.Errorf("failed to drain buffered rows: %w", flushErr)
+	}
+
+	errs := []error{flushErr}
+	if sc := bq.storage.Load(); sc != nil {
+		for _, t := range bq.tables() {
+			if t.writer != nil {
+				errs = append(errs, t.writer.close())
+			}
+		}
+		errs = append(errs, sc.client.Close())
+	}
+	errs = append(errs, bq.client.Close())
+
+	return errors.Join(errs...)
+}
+
+// Close drains buffered rows, waiting up to a minute, and closes the client
 func (bq *BQ) Close() error {
-	return bq.client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return bq.Shutdown(ctx)
 }
@@ -1,28 +1,30 @@
 package bq
 
 import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-var queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "bq")
+
+var queueDepth = promFactory.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "bq_queue_depth",
-	Help: "The current depth of the BQ record buffer",
+	Help: "The current depth of the BQ row buffer",
 }, []string{"table"})
 
-var recordsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+var recordsProcessed = promFactory.NewCounterVec(prometheus.CounterOpts{
 	Name: "bq_records_processed",
-	Help: "The number of records processed",
+	Help: "The number of rows processed",
 }, []string{"table"})
 
-var batchSubmissionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+var batchSubmissionDuration = promFactory.NewHistogramVec(prometheus.HistogramOpts{
 	Name:    "bq_batch_submission_duration",
-	Help:    "The duration of time it takes to submit a batch of records to BQ",
+	Help:    "The duration of time it takes to submit a batch of rows to BQ",
 	Buckets: prometheus.DefBuckets,
 }, []string{"table"})
 
-var batchSizeHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
+var batchSizeHist = promFactory.NewHistogramVec(prometheus.HistogramOpts{
 	Name:    "bq_batch_size",
-	Help:    "The size of a batch of records submitted to BQ",
+	Help:    "The size of a batch of rows submitted to BQ",
 	Buckets: prometheus.ExponentialBuckets(1, 2, 20),
 }, []string{"table"})
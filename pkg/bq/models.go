@@ -24,3 +24,31 @@ type Record struct {
 
 	Error string `bigquery:"error"`
 }
+
+// Event is a firehose event's metadata
+type Event struct {
+	CreatedAt time.Time `bigquery:"created_at"`
+
+	FirehoseSeq int64               `bigquery:"firehose_seq"`
+	Repo        string              `bigquery:"repo"`
+	EventType   string              `bigquery:"event_type"`
+	Time        time.Time           `bigquery:"time"`
+	Since       bigquery.NullString `bigquery:"since"`
+
+	Creates     int64    `bigquery:"creates"`
+	Updates     int64    `bigquery:"updates"`
+	Deletes     int64    `bigquery:"deletes"`
+	Collections []string `bigquery:"collections"`
+
+	Error string `bigquery:"error"`
+}
+
+// Identity is a DID's identity as resolved at CreatedAt, so the table holds each DID's history
+type Identity struct {
+	CreatedAt time.Time `bigquery:"created_at"`
+
+	DID    string `bigquery:"did"`
+	Handle string `bigquery:"handle"`
+	PDS    string `bigquery:"pds"`
+	Status string `bigquery:"status"`
+}
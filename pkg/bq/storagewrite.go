@@ -0,0 +1,454 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxAppendBytes keeps each append under the Storage Write API's 10MB request limit
+const maxAppendBytes = 9 << 20
+
+// replayWindow is how far below the highest firehose seq written the keys of written rows are
+// kept. The stream's cursor is saved every minute, so events replayed after a restart start well
+// within it.
+const replayWindow = 1_000_000
+
+// WriteState is the committed Storage Write API stream a table is written through, and how far
+// it's been written, so appends can resume at the right offset after a restart
+type WriteState struct {
+	UpdatedAt time.Time
+
+	Name   string `gorm:"primarykey"` // Table name
+	Stream string
+	// Offset is where the next append is made in the stream
+	Offset int64
+	// LastSeq is the highest firehose seq written
+	LastSeq int64
+
+	// PendingRows is the size of an append that was started but not confirmed, whose rows are
+	// kept as PendingRows until it is
+	PendingRows int64
+}
+
+// WrittenRow is the key of a row from the firehose written to a table. Rows replayed after a
+// restart are checked against these rather than the highest seq written, since repos are
+// processed concurrently and their rows can be written out of seq order.
+type WrittenRow struct {
+	Name string `gorm:"primarykey"` // Table name
+	Seq  int64  `gorm:"primarykey"`
+	Key  string `gorm:"primarykey"`
+}
+
+// PendingRow is a row of an append that was started but not confirmed, kept so the append can be
+// retried at the same offset
+type PendingRow struct {
+	Name     string `gorm:"primarykey"` // Table name
+	Position int    `gorm:"primarykey"`
+	Seq      int64
+	Key      string
+	Data     []byte
+}
+
+// storageRow is a row that can be written with the Storage Write API
+type storageRow interface {
+	// firehoseSeq is the seq of the event the row came from, 0 if it has none
+	firehoseSeq() int64
+	// rowKey tells the row apart from others from the same event
+	rowKey() string
+	// columns returns the row's values by column name
+	columns() map[string]any
+}
+
+func (r *Record) firehoseSeq() int64 { return r.FirehoseSeq }
+
+func (r *Record) rowKey() string { return r.Repo + "/" + r.Collection + "/" + r.RKey }
+
+func (r *Record) columns() map[string]any {
+	cols := map[string]any{
+		"created_at":   r.CreatedAt,
+		"firehose_seq": r.FirehoseSeq,
+		"repo":         r.Repo,
+		"collection":   r.Collection,
+		"r_key":        r.RKey,
+		"action":       r.Action,
+		"error":        r.Error,
+	}
+	if r.Raw.Valid {
+		cols["raw"] = r.Raw.JSONVal
+	}
+	return cols
+}
+
+func (e *Event) firehoseSeq() int64 { return e.FirehoseSeq }
+
+func (e *Event) rowKey() string { return e.Repo }
+
+func (e *Event) columns() map[string]any {
+	cols := map[string]any{
+		"created_at":   e.CreatedAt,
+		"firehose_seq": e.FirehoseSeq,
+		"repo":         e.Repo,
+		"event_type":   e.EventType,
+		"time":         e.Time,
+		"creates":      e.Creates,
+		"updates":      e.Updates,
+		"deletes":      e.Deletes,
+		"collections":  e.Collections,
+		"error":        e.Error,
+	}
+	if e.Since.Valid {
+		cols["since"] = e.Since.StringVal
+	}
+	return cols
+}
+
+// Identities aren't tied to a firehose event, so they're written at least once
+func (i *Identity) firehoseSeq() int64 { return 0 }
+
+func (i *Identity) rowKey() string { return "" }
+
+func (i *Identity) columns() map[string]any {
+	return map[string]any{
+		"created_at": i.CreatedAt,
+		"did":        i.DID,
+		"handle":     i.Handle,
+		"pds":        i.PDS,
+		"status":     i.Status,
+	}
+}
+
+// storageClient writes tables through the Storage Write API, tracking each table's write state
+type storageClient struct {
+	client    *managedwriter.Client
+	db        *gorm.DB
+	projectID string
+	datasetID string
+}
+
+// UseStorageWrite switches from the legacy streaming inserter to the Storage Write API, writing
+// each table through a committed stream whose offsets are tracked in db. The keys of rows written
+// are kept in db too, so rows replayed after a restart are skipped whatever order they arrive in,
+// and an append interrupted by the restart is retried at its offset, which the stream rejects if
+// it had landed. Rows from the firehose are written exactly once, as long as they're replayed
+// within replayWindow seqs of the highest seq written and the table's stream can be resumed.
+func (bq *BQ) UseStorageWrite(ctx context.Context, db *gorm.DB) error {
+	if err := db.AutoMigrate(&WriteState{}, &WrittenRow{}, &PendingRow{}); err != nil {
+		return fmt.Errorf("failed to migrate bigquery write state: %w", err)
+	}
+
+	client, err := managedwriter.NewClient(ctx, bq.dataset.ProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery storage write client: %w", err)
+	}
+
+	bq.storage.Store(&storageClient{
+		client:    client,
+		db:        db,
+		projectID: bq.dataset.ProjectID,
+		datasetID: bq.dataset.DatasetID,
+	})
+	return nil
+}
+
+// storageWriter appends rows to a single table's committed stream
+type storageWriter struct {
+	sc     *storageClient
+	table  string
+	desc   protoreflect.MessageDescriptor
+	stream *managedwriter.ManagedStream
+	state  WriteState
+}
+
+// openWriter opens the committed stream a table was last written through, or a new one
+func (sc *storageClient) openWriter(ctx context.Context, table string, schema bigquery.Schema) (*storageWriter, error) {
+	storageSchema, err := adapt.BQSchemaToStorageTableSchema(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert schema: %w", err)
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(storageSchema, "root")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build row descriptor: %w", err)
+	}
+	desc, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("row descriptor isn't a message descriptor")
+	}
+	normalized, err := adapt.NormalizeDescriptor(desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize row descriptor: %w", err)
+	}
+
+	w := &storageWriter{sc: sc, table: table, desc: desc, state: WriteState{Name: table}}
+	err = sc.db.WithContext(ctx).Where("name = ?", table).First(&w.state).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load write state: %w", err)
+	}
+
+	if w.state.Stream != "" {
+		w.stream, err = sc.client.NewManagedStream(ctx,
+			managedwriter.WithStreamName(w.state.Stream),
+			managedwriter.WithSchemaDescriptor(normalized),
+		)
+		if err == nil {
+			return w, nil
+		}
+		// The stream can't be resumed, so start a new one. Replayed rows are still skipped by key,
+		// but an unconfirmed append is retried on the new stream even if it landed on the old one.
+		w.state.Offset = 0
+	}
+
+	w.stream, err = sc.client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(sc.projectID, sc.datasetID, table)),
+		managedwriter.WithType(managedwriter.CommittedStream),
+		managedwriter.WithSchemaDescriptor(normalized),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create write stream: %w", err)
+	}
+	w.state.Stream = w.stream.StreamName()
+
+	if err := sc.db.WithContext(ctx).Save(&w.state).Error; err != nil {
+		return nil, fmt.Errorf("failed to save write state: %w", err)
+	}
+	return w, nil
+}
+
+// skipReplayed drops rows whose keys show they were already written
+func (w *storageWriter) skipReplayed(ctx context.Context, rows []any) ([]any, error) {
+	var minSeq, maxSeq int64
+	for _, row := range rows {
+		seq := row.(storageRow).firehoseSeq()
+		if seq == 0 {
+			continue
+		}
+		if minSeq == 0 || seq < minSeq {
+			minSeq = seq
+		}
+		maxSeq = max(maxSeq, seq)
+	}
+	// Nothing past the highest seq written has a key yet
+	if minSeq == 0 || minSeq > w.state.LastSeq {
+		return rows, nil
+	}
+
+	var written []WrittenRow
+	err := w.sc.db.WithContext(ctx).
+		Where("name = ? AND seq BETWEEN ? AND ?", w.table, minSeq, maxSeq).
+		Find(&written).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load written rows: %w", err)
+	}
+	if len(written) == 0 {
+		return rows, nil
+	}
+
+	seen := make(map[WrittenRow]struct{}, len(written))
+	for _, k := range written {
+		seen[k] = struct{}{}
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		r := row.(storageRow)
+		if seq := r.firehoseSeq(); seq != 0 {
+			if _, ok := seen[WrittenRow{Name: w.table, Seq: seq, Key: r.rowKey()}]; ok {
+				continue
+			}
+		}
+		kept = append(kept, row)
+	}
+	return kept, nil
+}
+
+// append writes rows to the table, split into appends under the request size limit
+func (w *storageWriter) append(ctx context.Context, rows []any) error {
+	// Rows from an earlier append that wasn't confirmed are written first, so replays of them
+	// are recognized
+	if w.state.PendingRows > 0 {
+		if err := w.resolvePending(ctx); err != nil {
+			return err
+		}
+	}
+
+	rows, err := w.skipReplayed(ctx, rows)
+	if err != nil {
+		return err
+	}
+
+	for len(rows) > 0 {
+		var pending []PendingRow
+		var size int
+		for _, row := range rows {
+			r := row.(storageRow)
+			b, err := encodeRow(w.desc, r.columns())
+			if err != nil {
+				return err
+			}
+			if size+len(b) > maxAppendBytes && len(pending) > 0 {
+				break
+			}
+			pending = append(pending, PendingRow{
+				Name:     w.table,
+				Position: len(pending),
+				Seq:      r.firehoseSeq(),
+				Key:      r.rowKey(),
+				Data:     b,
+			})
+			size += len(b)
+		}
+
+		if err := w.appendChunk(ctx, pending); err != nil {
+			return err
+		}
+		rows = rows[len(pending):]
+	}
+	return nil
+}
+
+// appendChunk appends rows at the stream's next offset, saving them before making the append so
+// it can be retried if it isn't confirmed
+func (w *storageWriter) appendChunk(ctx context.Context, rows []PendingRow) error {
+	state := w.state
+	state.PendingRows = int64(len(rows))
+	err := w.sc.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(rows, 1000).Error; err != nil {
+			return err
+		}
+		return tx.Save(&state).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save pending rows: %w", err)
+	}
+	w.state = state
+
+	if err := w.appendRows(ctx, rows); err != nil {
+		return err
+	}
+	return w.commitPending(ctx, rows)
+}
+
+// resolvePending retries the append that wasn't confirmed, at the offset it was made at. If it
+// had landed the stream rejects the offset, and either way its rows are then written.
+func (w *storageWriter) resolvePending(ctx context.Context) error {
+	var rows []PendingRow
+	if err := w.sc.db.WithContext(ctx).Where("name = ?", w.table).Order("position").Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to load pending rows: %w", err)
+	}
+
+	if len(rows) > 0 {
+		err := w.appendRows(ctx, rows)
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			return err
+		}
+	}
+	return w.commitPending(ctx, rows)
+}
+
+// appendRows appends rows at the stream's next offset. Rows the stream rejects as invalid would
+// fail every retry, so they're dropped along with the error.
+func (w *storageWriter) appendRows(ctx context.Context, rows []PendingRow) error {
+	encoded := make([][]byte, len(rows))
+	for i, r := range rows {
+		encoded[i] = r.Data
+	}
+
+	res, err := w.stream.AppendRows(ctx, encoded, managedwriter.WithOffset(w.state.Offset))
+	if err == nil {
+		_, err = res.GetResult(ctx)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if status.Code(err) == codes.InvalidArgument {
+		if dropErr := w.commitPending(ctx, nil); dropErr != nil {
+			return errors.Join(fmt.Errorf("failed to append rows: %w", err), dropErr)
+		}
+		return fmt.Errorf("dropped %d rows the stream rejected: %w", len(rows), err)
+	}
+	return fmt.Errorf("failed to append rows: %w", err)
+}
+
+// commitPending records that the pending append's rows were written, moving the offset past them
+// and keeping their keys. With no rows the pending append is dropped.
+func (w *storageWriter) commitPending(ctx context.Context, rows []PendingRow) error {
+	state := w.state
+	state.Offset += int64(len(rows))
+	state.PendingRows = 0
+
+	var written []WrittenRow
+	for _, r := range rows {
+		if r.Seq == 0 {
+			continue
+		}
+		written = append(written, WrittenRow{Name: w.table, Seq: r.Seq, Key: r.Key})
+		state.LastSeq = max(state.LastSeq, r.Seq)
+	}
+
+	err := w.sc.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(written) > 0 {
+			err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(written, 1000).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("name = ? AND seq < ?", w.table, state.LastSeq-replayWindow).Delete(&WrittenRow{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("name = ?", w.table).Delete(&PendingRow{}).Error; err != nil {
+			return err
+		}
+		return tx.Save(&state).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save write state: %w", err)
+	}
+
+	w.state = state
+	return nil
+}
+
+func (w *storageWriter) close() error {
+	return w.stream.Close()
+}
+
+// encodeRow encodes a row's columns as the table's proto message
+func encodeRow(desc protoreflect.MessageDescriptor, cols map[string]any) ([]byte, error) {
+	msg := dynamicpb.NewMessage(desc)
+	for name, v := range cols {
+		fd := desc.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			return nil, fmt.Errorf("row has unknown column %q", name)
+		}
+		switch v := v.(type) {
+		case string:
+			msg.Set(fd, protoreflect.ValueOfString(v))
+		case int64:
+			msg.Set(fd, protoreflect.ValueOfInt64(v))
+		case time.Time:
+			// Timestamps are written as microseconds since the epoch
+			msg.Set(fd, protoreflect.ValueOfInt64(v.UnixMicro()))
+		case []string:
+			list := msg.Mutable(fd).List()
+			for _, s := range v {
+				list.Append(protoreflect.ValueOfString(s))
+			}
+		default:
+			return nil, fmt.Errorf("column %q has unsupported type %T", name, v)
+		}
+	}
+	return proto.Marshal(msg)
+}
@@ -0,0 +1,178 @@
+package bq
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// seqs returns the firehose seqs of rows
+func seqs(rows []any) []int64 {
+	var out []int64
+	for _, row := range rows {
+		out = append(out, row.(storageRow).firehoseSeq())
+	}
+	return out
+}
+
+// recordRows returns a record row for each seq, each in a different repo
+func recordRows(seqs ...int64) []any {
+	var rows []any
+	for _, seq := range seqs {
+		rows = append(rows, &Record{FirehoseSeq: seq, Repo: fmt.Sprintf("did:plc:%d", seq), Collection: "app.bsky.feed.post", RKey: "a"})
+	}
+	return rows
+}
+
+// pendingRows returns rows as they're saved for an append
+func pendingRows(rows []any) []PendingRow {
+	var out []PendingRow
+	for i, row := range rows {
+		r := row.(storageRow)
+		out = append(out, PendingRow{Name: "records", Position: i, Seq: r.firehoseSeq(), Key: r.rowKey(), Data: []byte("row")})
+	}
+	return out
+}
+
+// testWriter returns a writer for the records table backed by a fresh database
+func testWriter(t *testing.T) *storageWriter {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "bq.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	if err := db.AutoMigrate(&WriteState{}, &WrittenRow{}, &PendingRow{}); err != nil {
+		t.Fatalf("failed to migrate write state: %v", err)
+	}
+	return &storageWriter{sc: &storageClient{db: db}, table: "records", state: WriteState{Name: "records", Stream: "stream"}}
+}
+
+func TestSkipReplayed(t *testing.T) {
+	ctx := context.Background()
+	w := testWriter(t)
+
+	// Repos are processed concurrently, so seq 6 was written before seq 5, and then the
+	// process restarted before seq 5 was
+	if err := w.commitPending(ctx, pendingRows(recordRows(3, 4, 6))); err != nil {
+		t.Fatalf("commitPending: %v", err)
+	}
+
+	kept, err := w.skipReplayed(ctx, append(recordRows(3, 4, 5, 6, 7), &Identity{}))
+	if err != nil {
+		t.Fatalf("skipReplayed: %v", err)
+	}
+	if want := []int64{5, 7, 0}; !slices.Equal(seqs(kept), want) {
+		t.Errorf("kept seqs %v, want %v", seqs(kept), want)
+	}
+
+	// Replays can arrive out of order too, and a row already written is skipped even after one
+	// that wasn't
+	kept, err = w.skipReplayed(ctx, recordRows(7, 4, 5, 3))
+	if err != nil {
+		t.Fatalf("skipReplayed: %v", err)
+	}
+	if want := []int64{7, 5}; !slices.Equal(seqs(kept), want) {
+		t.Errorf("kept out of order seqs %v, want %v", seqs(kept), want)
+	}
+
+	// Other rows from a written event aren't skipped
+	other := &Record{FirehoseSeq: 6, Repo: "did:plc:6", Collection: "app.bsky.feed.like", RKey: "a"}
+	kept, err = w.skipReplayed(ctx, []any{other})
+	if err != nil {
+		t.Fatalf("skipReplayed: %v", err)
+	}
+	if len(kept) != 1 {
+		t.Errorf("kept %d rows of another record from a written event, want 1", len(kept))
+	}
+}
+
+func TestCommitPending(t *testing.T) {
+	ctx := context.Background()
+	w := testWriter(t)
+	w.state.Offset = 10
+	w.state.LastSeq = 10
+	if err := w.commitPending(ctx, pendingRows(recordRows(10))); err != nil {
+		t.Fatalf("commitPending: %v", err)
+	}
+
+	// The process stopped after saving an append of seqs 12 and 11, before it was confirmed
+	rows := pendingRows(recordRows(12, 11))
+	state := w.state
+	state.PendingRows = int64(len(rows))
+	if err := w.sc.db.Create(&rows).Error; err != nil {
+		t.Fatalf("failed to save pending rows: %v", err)
+	}
+	if err := w.sc.db.Save(&state).Error; err != nil {
+		t.Fatalf("failed to save write state: %v", err)
+	}
+
+	// After the restart the pending rows aren't written yet, so their replays are kept
+	w = &storageWriter{sc: w.sc, table: "records", state: state}
+	kept, err := w.skipReplayed(ctx, recordRows(11, 12))
+	if err != nil {
+		t.Fatalf("skipReplayed: %v", err)
+	}
+	if want := []int64{11, 12}; !slices.Equal(seqs(kept), want) {
+		t.Errorf("kept seqs %v before resolving, want %v", seqs(kept), want)
+	}
+
+	// The retried append landed, or was rejected because it already had
+	var pending []PendingRow
+	if err := w.sc.db.Where("name = ?", "records").Order("position").Find(&pending).Error; err != nil {
+		t.Fatalf("failed to load pending rows: %v", err)
+	}
+	if err := w.commitPending(ctx, pending); err != nil {
+		t.Fatalf("commitPending: %v", err)
+	}
+
+	var stored WriteState
+	if err := w.sc.db.Where("name = ?", "records").First(&stored).Error; err != nil {
+		t.Fatalf("failed to load write state: %v", err)
+	}
+	if stored.Offset != 13 || stored.LastSeq != 12 || stored.PendingRows != 0 {
+		t.Errorf("saved state = offset %d, last seq %d, pending %d, want offset 13, last seq 12, pending 0",
+			stored.Offset, stored.LastSeq, stored.PendingRows)
+	}
+
+	var left int64
+	if err := w.sc.db.Model(&PendingRow{}).Count(&left).Error; err != nil {
+		t.Fatalf("failed to count pending rows: %v", err)
+	}
+	if left != 0 {
+		t.Errorf("%d pending rows left after committing, want 0", left)
+	}
+
+	// The landed rows are now skipped, and rows past them are kept
+	kept, err = w.skipReplayed(ctx, recordRows(12, 13, 11))
+	if err != nil {
+		t.Fatalf("skipReplayed: %v", err)
+	}
+	if want := []int64{13}; !slices.Equal(seqs(kept), want) {
+		t.Errorf("kept seqs %v after resolving, want %v", seqs(kept), want)
+	}
+}
+
+func TestCommitPendingPrunesKeys(t *testing.T) {
+	ctx := context.Background()
+	w := testWriter(t)
+
+	if err := w.commitPending(ctx, pendingRows(recordRows(5, replayWindow+10))); err != nil {
+		t.Fatalf("commitPending: %v", err)
+	}
+
+	var keys []WrittenRow
+	if err := w.sc.db.Find(&keys).Error; err != nil {
+		t.Fatalf("failed to load written rows: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Seq != replayWindow+10 {
+		t.Errorf("written rows %v, want only seq %d's", keys, replayWindow+10)
+	}
+}
@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when Advance is called, so tests can step periodic
+// routines through their ticks
+type Fake struct {
+	lk      sync.Mutex
+	waiters *sync.Cond
+	now     time.Time
+	timers  []*fakeTimer
+}
+
+// fakeTimer is a pending After or ticker, firing at at and then every period for tickers
+type fakeTimer struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFake returns a Fake clock set to now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.waiters = sync.NewCond(&f.lk)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	t := &fakeTimer{at: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t.c
+	}
+	f.add(t)
+	return t.c
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	t := &fakeTimer{at: f.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	f.add(t)
+	return &fakeTicker{f: f, t: t}
+}
+
+func (f *Fake) add(t *fakeTimer) {
+	f.timers = append(f.timers, t)
+	f.waiters.Broadcast()
+}
+
+// Advance moves the clock forward by d, firing the Afters and ticks that come due. Like a
+// time.Ticker, a ticker whose last tick hasn't been received drops the ticks it misses.
+func (f *Fake) Advance(d time.Duration) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default:
+		}
+		if t.period > 0 {
+			for !t.at.After(f.now) {
+				t.at = t.at.Add(t.period)
+			}
+			pending = append(pending, t)
+		}
+	}
+	f.timers = pending
+}
+
+// BlockUntil waits until n Afters or tickers are pending, so a test can Advance once the
+// routine it drives is waiting on the clock
+func (f *Fake) BlockUntil(n int) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	for len(f.timers) < n {
+		f.waiters.Wait()
+	}
+}
+
+type fakeTicker struct {
+	f *Fake
+	t *fakeTimer
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.t.c }
+
+func (t *fakeTicker) Stop() {
+	t.f.lk.Lock()
+	defer t.f.lk.Unlock()
+	for i, timer := range t.f.timers {
+		if timer == t.t {
+			t.f.timers = append(t.f.timers[:i], t.f.timers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package checkoutcmd
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+// blobsDir is where blobs are written, alongside the collection directories
+const blobsDir = "_blobs"
+
+// collectBlobs walks a decoded record, adding the CID and declared size of every blob it references to blobs
+func collectBlobs(v any, blobs map[string]int64) {
+	switch val := v.(type) {
+	case data.Blob:
+		if c := cid.Cid(val.Ref); c.Defined() {
+			blobs[c.String()] = val.Size
+		}
+	case *data.Blob:
+		if val != nil {
+			collectBlobs(*val, blobs)
+		}
+	case map[string]any:
+		// Legacy blobs carry the CID as a string and have no size
+		if raw, ok := val["cid"].(string); ok {
+			if _, isBlob := val["mimeType"]; isBlob {
+				if c, err := cid.Decode(raw); err == nil {
+					blobs[c.String()] = 0
+				}
+				return
+			}
+		}
+		for _, child := range val {
+			collectBlobs(child, blobs)
+		}
+	case []any:
+		for _, child := range val {
+			collectBlobs(child, blobs)
+		}
+	}
+}
+
+// fetchBlobs downloads the blobs in blobs from the repo's PDS into the checkout, honoring the blob flags
+func fetchBlobs(cctx *cli.Context, client *pdsfetch.Client, host string, did syntax.DID, outputDir string, tarWriter *tar.Writer, blobs map[string]int64) {
+	bf := &blobFetcher{
+		client:      client,
+		host:        host,
+		did:         did,
+		concurrency: cctx.Int("blob-concurrency"),
+		maxSize:     cctx.Int64("max-blob-size"),
+		maxTotal:    cctx.Int64("max-total-blob-size"),
+		outputDir:   outputDir,
+		tarWriter:   tarWriter,
+	}
+
+	log.Println("Fetching blobs", "Count", len(blobs), "Host", host)
+	bf.fetchAll(cctx.Context, blobs)
+	log.Println("Blobs fetched", "Fetched", bf.fetched.Load(), "Skipped", bf.skipped.Load(), "Failed", bf.failed.Load(), "Bytes", bf.total.Load())
+}
+
+// blobFetcher downloads a repo's blobs with bounded concurrency, skipping any over the size limits
+type blobFetcher struct {
+	client      *pdsfetch.Client
+	host        string
+	did         syntax.DID
+	concurrency int
+	maxSize     int64 // Per-blob limit, 0 for none
+	maxTotal    int64 // Limit across all blobs, 0 for none
+
+	// Exactly one of outputDir and tarWriter is set
+	outputDir string
+	tarWriter *tar.Writer
+	tarLk     sync.Mutex
+
+	total   atomic.Int64
+	fetched atomic.Int64
+	skipped atomic.Int64
+	failed  atomic.Int64
+}
+
+// fetchAll downloads every blob in blobs, logging (rather than returning) per-blob failures
+func (bf *blobFetcher) fetchAll(ctx context.Context, blobs map[string]int64) {
+	work := make(chan string)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < bf.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blobCID := range work {
+				if err := bf.fetch(ctx, blobCID, blobs[blobCID]); err != nil {
+					log.Println("Error fetching blob", "CID", blobCID, err)
+					bf.failed.Add(1)
+				}
+			}
+		}()
+	}
+
+	for blobCID := range blobs {
+		work <- blobCID
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (bf *blobFetcher) fetch(ctx context.Context, blobCID string, declaredSize int64) error {
+	if bf.maxSize > 0 && declaredSize > bf.maxSize {
+		log.Println("Skipping blob over size limit", "CID", blobCID, "Size", declaredSize)
+		bf.skipped.Add(1)
+		return nil
+	}
+
+	if bf.maxTotal > 0 && bf.total.Load() >= bf.maxTotal {
+		bf.skipped.Add(1)
+		return nil
+	}
+
+	body, err := bf.client.GetBlob(ctx, bf.host, bf.did, blobCID)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Declared sizes can't be trusted, so enforce the limit on what's actually sent
+	r := io.Reader(body)
+	if bf.maxSize > 0 {
+		r = io.LimitReader(body, bf.maxSize+1)
+	}
+
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	if bf.maxSize > 0 && int64(len(blob)) > bf.maxSize {
+		log.Println("Skipping blob over size limit", "CID", blobCID, "Size", fmt.Sprintf(">%d", bf.maxSize))
+		bf.skipped.Add(1)
+		return nil
+	}
+
+	if total := bf.total.Add(int64(len(blob))); bf.maxTotal > 0 && total > bf.maxTotal {
+		log.Println("Skipping blob over total size limit", "CID", blobCID)
+		bf.total.Add(-int64(len(blob)))
+		bf.skipped.Add(1)
+		return nil
+	}
+
+	if err := bf.write(blobCID, blob); err != nil {
+		return err
+	}
+
+	bf.fetched.Add(1)
+	return nil
+}
+
+func (bf *blobFetcher) write(blobCID string, blob []byte) error {
+	if bf.tarWriter != nil {
+		bf.tarLk.Lock()
+		defer bf.tarLk.Unlock()
+
+		hdr := &tar.Header{
+			Name: fmt.Sprintf("%s/%s", blobsDir, blobCID),
+			Mode: 0600,
+			Size: int64(len(blob)),
+		}
+		if err := bf.tarWriter.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
+		}
+		if _, err := bf.tarWriter.Write(blob); err != nil {
+			return fmt.Errorf("failed to write blob to tar file: %w", err)
+		}
+		return nil
+	}
+
+	blobPath := filepath.Join(bf.outputDir, blobsDir, blobCID)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+	if err := os.WriteFile(blobPath, blob, 0644); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package checkoutcmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
+	"github.com/urfave/cli/v2"
+)
+
+// bulkOutcome is a single repo's entry in the bulk checkout report
+type bulkOutcome struct {
+	Input  string          `json:"input"`
+	Result *checkoutResult `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Took   string          `json:"took"`
+}
+
+// bulkReport summarizes a bulk checkout
+type bulkReport struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Took      string        `json:"took"`
+	Repos     []bulkOutcome `json:"repos"`
+}
+
+// readInputs reads handles or DIDs from path (- for stdin), one per line, skipping blank lines,
+// # comments, and duplicates
+func readInputs(path string) ([]string, error) {
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var inputs []string
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := seen[line]; ok {
+			continue
+		}
+		seen[line] = struct{}{}
+		inputs = append(inputs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+
+	return inputs, nil
+}
+
+// checkoutBulk checks out every repo listed in --input with a pool of workers, printing a
+// summary of successes and failures and returning an error if any repo failed
+func checkoutBulk(cctx *cli.Context, client *pdsfetch.Client, net *network.Profile, format string) error {
+	if cctx.NArg() > 0 {
+		return fmt.Errorf("--input can't be combined with a handle or DID argument")
+	}
+	if !strings.Contains(cctx.String("output-dir"), repoDIDPlaceholder) {
+		return fmt.Errorf("--output-dir must contain %s in bulk mode so each repo gets its own directory", repoDIDPlaceholder)
+	}
+	if cctx.IsSet("since") {
+		return fmt.Errorf("--since can't be used in bulk mode")
+	}
+	workers := cctx.Int("workers")
+	if workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+
+	inputs, err := readInputs(cctx.String("input"))
+	if err != nil {
+		return err
+	}
+
+	log.Println("Starting bulk checkout", "Repos", len(inputs), "Workers", workers)
+	start := time.Now()
+
+	report := &bulkReport{
+		Total: len(inputs),
+		Repos: make([]bulkOutcome, len(inputs)),
+	}
+
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				repoStart := time.Now()
+				outcome := bulkOutcome{Input: inputs[idx]}
+
+				res, err := checkoutRepo(cctx, client, net, inputs[idx], format)
+				if err != nil {
+					outcome.Error = err.Error()
+				} else {
+					outcome.Result = res
+				}
+
+				outcome.Took = time.Since(repoStart).Round(time.Millisecond).String()
+				report.Repos[idx] = outcome
+			}
+		}()
+	}
+
+	for idx := range inputs {
+		if cctx.Context.Err() != nil {
+			break
+		}
+		work <- idx
+	}
+	close(work)
+	wg.Wait()
+
+	for i := range report.Repos {
+		outcome := &report.Repos[i]
+		outcome.Input = inputs[i]
+		switch {
+		case outcome.Result != nil:
+			report.Succeeded++
+		case outcome.Error == "":
+			// Never picked up by a worker before the checkout was interrupted
+			outcome.Error = "not attempted"
+			report.Failed++
+		default:
+			report.Failed++
+		}
+	}
+	report.Took = time.Since(start).Round(time.Millisecond).String()
+
+	fmt.Printf("Bulk checkout finished in %s: %d succeeded, %d failed of %d\n", report.Took, report.Succeeded, report.Failed, report.Total)
+	for _, outcome := range report.Repos {
+		if outcome.Result == nil {
+			fmt.Printf("  FAILED %s: %s\n", outcome.Input, outcome.Error)
+		}
+	}
+
+	if path := cctx.String("report"); path != "" {
+		raw, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal report: %w", err)
+		}
+		if err := os.WriteFile(path, raw, 0644); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d repos failed to check out", report.Failed, report.Total)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package checkoutcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Output formats
+const (
+	formatJSONDir = "json-dir"
+	formatNDJSON  = "ndjson"
+	formatCAR     = "car"
+	formatTarGz   = "tar.gz"
+)
+
+// stdoutPath as --output-dir writes single-file formats to stdout
+const stdoutPath = "-"
+
+// checkoutFormat returns the output format from --format, or --compress for older invocations
+func checkoutFormat(cctx *cli.Context) (string, error) {
+	format := cctx.String("format")
+	if cctx.Bool("compress") {
+		if cctx.IsSet("format") && format != formatTarGz {
+			return "", fmt.Errorf("--compress can't be combined with --format %s", format)
+		}
+		format = formatTarGz
+	}
+
+	switch format {
+	case formatJSONDir, formatNDJSON, formatCAR, formatTarGz:
+	default:
+		return "", fmt.Errorf("unknown format %q, expected %s, %s, %s, or %s", format, formatJSONDir, formatNDJSON, formatCAR, formatTarGz)
+	}
+
+	if cctx.String("output-dir") == stdoutPath {
+		if format != formatNDJSON && format != formatCAR {
+			return "", fmt.Errorf("only the %s and %s formats can be written to stdout", formatNDJSON, formatCAR)
+		}
+		if cctx.Bool("include-blobs") {
+			return "", fmt.Errorf("--include-blobs needs an output directory, not stdout")
+		}
+	}
+
+	if cctx.IsSet("since") && format != formatJSONDir {
+		return "", fmt.Errorf("--since only works with the %s format", formatJSONDir)
+	}
+
+	return format, nil
+}
+
+// ndjsonRecord is a line of the NDJSON format
+type ndjsonRecord struct {
+	URI        string          `json:"uri"`
+	CID        string          `json:"cid"`
+	Collection string          `json:"collection"`
+	RKey       string          `json:"rkey"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// outputFile is a single-file output that's written to a temporary file and moved into place
+// once complete, so a failed checkout doesn't leave a partial file behind
+type outputFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// createOutput creates the output file for outputDir with the format's extension, or wraps stdout
+func createOutput(outputDir, ext string) (*outputFile, error) {
+	if outputDir == stdoutPath {
+		return &outputFile{File: os.Stdout, path: stdoutPath}, nil
+	}
+
+	path := outputDir + ext
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{File: f, path: path}, nil
+}
+
+// Commit closes the file and moves it into place
+func (o *outputFile) Commit() error {
+	o.done = true
+	if o.path == stdoutPath {
+		return nil
+	}
+	if err := o.File.Close(); err != nil {
+		os.Remove(o.path + ".tmp")
+		return err
+	}
+	return os.Rename(o.path+".tmp", o.path)
+}
+
+// Abort discards the file unless it was committed
+func (o *outputFile) Abort() {
+	if o.done || o.path == stdoutPath {
+		return
+	}
+	o.File.Close()
+	os.Remove(o.path + ".tmp")
+}
@@ -0,0 +1,223 @@
+package checkoutcmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// stateDir holds the sync state of an uncompressed checkout, alongside the collection directories
+const stateDir = ".checkout"
+
+// syncState records what a checkout directory was last synced to, so a re-run only fetches the diff
+type syncState struct {
+	DID       string    `json:"did"`
+	Rev       string    `json:"rev"`
+	Root      string    `json:"root"`
+	Host      string    `json:"host"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadSyncState reads the sync state of a previous checkout of did into outputDir and loads the
+// blocks of the repo as it was then into bs. It returns nil if there's no previous checkout.
+func loadSyncState(ctx context.Context, outputDir, did string, bs blockstore.Blockstore) (*syncState, error) {
+	raw, err := os.ReadFile(filepath.Join(outputDir, stateDir, "state.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	}
+
+	var state syncState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state: %w", err)
+	}
+
+	if state.DID != did {
+		return nil, fmt.Errorf("%s holds a checkout of %s, not %s", outputDir, state.DID, did)
+	}
+
+	f, err := os.Open(filepath.Join(outputDir, stateDir, "repo.car"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stored repo: %w", err)
+	}
+	defer f.Close()
+
+	root, err := repo.IngestRepo(ctx, bs, bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored repo: %w", err)
+	}
+
+	if root.String() != state.Root {
+		return nil, fmt.Errorf("stored repo root %s does not match sync state root %s", root, state.Root)
+	}
+
+	return &state, nil
+}
+
+// saveSyncState writes the sync state for r, along with a CAR of only the blocks still reachable
+// from its commit so the stored repo doesn't grow with every diff applied to it
+func saveSyncState(ctx context.Context, outputDir, host string, r *repo.Repo, root cid.Cid) error {
+	dir := filepath.Join(outputDir, stateDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	carPath := filepath.Join(dir, "repo.car")
+	f, err := os.Create(carPath + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create stored repo: %w", err)
+	}
+	defer os.Remove(carPath + ".tmp")
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return fmt.Errorf("failed to write CAR header: %w", err)
+	}
+
+	if err := writeReachable(ctx, r.Blockstore(), w, root, make(map[cid.Cid]struct{})); err != nil {
+		return fmt.Errorf("failed to write stored repo: %w", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write stored repo: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close stored repo: %w", err)
+	}
+	if err := os.Rename(carPath+".tmp", carPath); err != nil {
+		return fmt.Errorf("failed to move stored repo into place: %w", err)
+	}
+
+	sc := r.SignedCommit()
+	state := syncState{
+		DID:       sc.Did,
+		Rev:       sc.Rev,
+		Root:      root.String(),
+		Host:      host,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync state: %w", err)
+	}
+
+	// The state is written last so an interrupted save leaves the previous state intact
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), raw, 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+
+	return nil
+}
+
+// writeReachable writes c and every block it links to as CAR sections. Links to blocks that
+// aren't in the repo (like blobs referenced by records) are skipped.
+func writeReachable(ctx context.Context, bs blockstore.Blockstore, w *bufio.Writer, c cid.Cid, seen map[cid.Cid]struct{}) error {
+	if _, ok := seen[c]; ok {
+		return nil
+	}
+	seen[c] = struct{}{}
+
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		if ipld.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := carutil.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
+		return err
+	}
+
+	var links []cid.Cid
+	if err := cbg.ScanForLinks(bytes.NewReader(blk.RawData()), func(l cid.Cid) {
+		links = append(links, l)
+	}); err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		if err := writeReachable(ctx, bs, w, l, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyDiff brings a checkout directory from the repo at oldRoot up to r, writing records that were
+// added or changed since and removing ones that were deleted. Blobs referenced by written records
+// are added to blobs if it's non-nil.
+func applyDiff(ctx context.Context, r *repo.Repo, oldRoot cid.Cid, outputDir string, blobs map[string]int64) (written, deleted int, err error) {
+	ops, err := r.DiffSince(ctx, oldRoot)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to diff repo against previous checkout: %w", err)
+	}
+
+	for _, op := range ops {
+		parts := strings.Split(op.Rpath, "/")
+		if len(parts) != 2 {
+			log.Println("Path does not have 2 parts", "path", op.Rpath)
+			continue
+		}
+		recordPath := filepath.Join(outputDir, parts[0], fmt.Sprintf("%s.json", parts[1]))
+
+		switch op.Op {
+		case "add", "mut":
+			_, rec, err := r.GetRecordBytes(ctx, op.Rpath)
+			if err != nil {
+				return written, deleted, fmt.Errorf("failed to get record %q: %w", op.Rpath, err)
+			}
+
+			asCbor, err := data.UnmarshalCBOR(*rec)
+			if err != nil {
+				return written, deleted, fmt.Errorf("failed to unmarshal record %q: %w", op.Rpath, err)
+			}
+
+			if blobs != nil {
+				collectBlobs(asCbor, blobs)
+			}
+
+			recJSON, err := json.Marshal(asCbor)
+			if err != nil {
+				return written, deleted, fmt.Errorf("failed to marshal record %q to JSON: %w", op.Rpath, err)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(recordPath), 0755); err != nil {
+				return written, deleted, fmt.Errorf("failed to create collection directory: %w", err)
+			}
+			if err := os.WriteFile(recordPath, recJSON, 0644); err != nil {
+				return written, deleted, fmt.Errorf("failed to write record %q: %w", op.Rpath, err)
+			}
+			written++
+		case "del":
+			if err := os.Remove(recordPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return written, deleted, fmt.Errorf("failed to remove record %q: %w", op.Rpath, err)
+			}
+			deleted++
+		}
+	}
+
+	return written, deleted, nil
+}
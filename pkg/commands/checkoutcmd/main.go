@@ -0,0 +1,503 @@
+package checkoutcmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/time/rate"
+)
+
+// repoDIDPlaceholder is replaced with the repo's DID in --output-dir
+const repoDIDPlaceholder = "<repo-did>"
+
+// App returns the command line app for the repo checkout tool
+func App() *cli.App {
+	app := cli.App{
+		Name:    "checkout",
+		Usage:   "atproto repo checkout",
+		Version: "0.0.3",
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "pds-host",
+			Usage:   "host of the PDS or Relay to fetch the repo from (with protocol), defaults to the repo's PDS from its DID document",
+			EnvVars: []string{"PDS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "plc-url",
+			Usage:   "PLC directory (or PLC mirror) used to resolve did:plc documents, defaults to the network's PLC directory",
+			EnvVars: []string{"PLC_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "network",
+			Usage:   "atproto network to resolve identities on: main, sandbox, or a custom network from --network-config",
+			Value:   network.Main.Name,
+			EnvVars: []string{"NETWORK"},
+		},
+		&cli.StringFlag{
+			Name:    "network-config",
+			Usage:   "JSON file defining custom networks, keyed by name",
+			EnvVars: []string{"NETWORK_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "output-dir",
+			Usage:   "directory to write the repo to, " + repoDIDPlaceholder + " is replaced with the repo's DID",
+			Value:   "./out/" + repoDIDPlaceholder,
+			EnvVars: []string{"OUTPUT_DIR"},
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format: json-dir (a JSON file per record), ndjson (a JSON line per record), car (the raw repo CAR), or tar.gz (json-dir in a gzipped tarball)",
+			Value: formatJSONDir,
+		},
+		&cli.BoolFlag{
+			Name:  "compress",
+			Usage: "compress the resulting directory into a gzip file (same as --format tar.gz)",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "fetch only what changed since this repo revision, applying it to a previous json-dir checkout (defaults to the revision that checkout was synced to)",
+		},
+		&cli.BoolFlag{
+			Name:  "full",
+			Usage: "re-download the whole repo even if the output directory holds a previous checkout",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "verify the repo's MST structure and commit signature before checking it out, printing a report",
+		},
+		&cli.BoolFlag{
+			Name:  "include-blobs",
+			Usage: "also download the blobs referenced by records into " + blobsDir + "/",
+		},
+		&cli.IntFlag{
+			Name:  "blob-concurrency",
+			Usage: "number of blobs to download at once",
+			Value: 4,
+		},
+		&cli.Int64Flag{
+			Name:  "max-blob-size",
+			Usage: "skip blobs larger than this many bytes (0 for no limit)",
+			Value: 100 << 20,
+		},
+		&cli.Int64Flag{
+			Name:  "max-total-blob-size",
+			Usage: "stop downloading blobs once this many bytes have been downloaded (0 for no limit)",
+		},
+		&cli.StringFlag{
+			Name:  "input",
+			Usage: "check out every handle or DID listed in this file, one per line (- for stdin)",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of repos to check out at once in bulk mode",
+			Value: 4,
+		},
+		&cli.Float64Flag{
+			Name:  "pds-rate-limit",
+			Usage: "maximum requests per second to each PDS",
+			Value: 10,
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "number of times a request is retried (with exponential backoff) after a transient failure",
+			Value: 3,
+		},
+		&cli.StringFlag{
+			Name:  "report",
+			Usage: "write a JSON report of each repo's outcome to this file in bulk mode",
+		},
+	}
+
+	app.ArgsUsage = "<handle-or-did> | --input <file>"
+
+	app.Action = Checkout
+
+	return &app
+}
+
+func Checkout(cctx *cli.Context) error {
+	if cctx.Int("blob-concurrency") < 1 {
+		return fmt.Errorf("blob-concurrency must be at least 1")
+	}
+	if cctx.Float64("pds-rate-limit") <= 0 {
+		return fmt.Errorf("pds-rate-limit must be positive")
+	}
+
+	client := pdsfetch.NewClient(fmt.Sprintf("atproto.tools.checkout/%s", cctx.App.Version))
+	client.MaxRetries = cctx.Int("max-retries")
+	client.HostLimit = rate.Limit(cctx.Float64("pds-rate-limit"))
+	client.HostBurst = max(1, int(cctx.Float64("pds-rate-limit")))
+
+	format, err := checkoutFormat(cctx)
+	if err != nil {
+		return err
+	}
+
+	net, err := network.Load(cctx.String("network"), cctx.String("network-config"))
+	if err != nil {
+		return err
+	}
+	if cctx.IsSet("plc-url") {
+		net.PLCHost = cctx.String("plc-url")
+	}
+
+	if cctx.IsSet("input") {
+		return checkoutBulk(cctx, client, net, format)
+	}
+
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected a handle or DID to check out (or --input for bulk mode)")
+	}
+
+	_, err = checkoutRepo(cctx, client, net, cctx.Args().First(), format)
+	return err
+}
+
+// checkoutResult summarizes a single repo's checkout
+type checkoutResult struct {
+	DID         string `json:"did"`
+	OutputDir   string `json:"output_dir"`
+	Incremental bool   `json:"incremental"`
+	Records     int    `json:"records"`
+	Deleted     int    `json:"deleted,omitempty"`
+	Collections int    `json:"collections,omitempty"`
+}
+
+// checkoutRepo checks out a single repo by handle or DID in the given output format,
+// resolving its identity on net
+func checkoutRepo(cctx *cli.Context, client *pdsfetch.Client, net *network.Profile, rawID, format string) (*checkoutResult, error) {
+	ctx := cctx.Context
+
+	// An explicit host (like a relay) overrides the PDS from the DID document,
+	// and lets a DID be checked out without resolving it at all (unless verifying its signature)
+	pdsHost := cctx.String("pds-host")
+
+	var id *identity.Identity
+	did, err := syntax.ParseDID(rawID)
+	if err != nil || pdsHost == "" || cctx.Bool("verify") {
+		id, err = resolveIdentity(ctx, rawID, net)
+		if err != nil {
+			log.Println("Error resolving repo", err)
+			return nil, fmt.Errorf("Error resolving repo: %v", err)
+		}
+		did = id.DID
+
+		if pdsHost == "" {
+			pdsHost = id.PDSEndpoint()
+			if pdsHost == "" {
+				return nil, fmt.Errorf("DID document for %s has no PDS endpoint", did)
+			}
+		}
+	}
+
+	outputDir := cctx.String("output-dir")
+	toStdout := outputDir == stdoutPath
+
+	if strings.Contains(outputDir, repoDIDPlaceholder) {
+		outputDir = strings.ReplaceAll(outputDir, repoDIDPlaceholder, did.String())
+		outputDir, err = filepath.Abs(outputDir)
+		if err != nil {
+			log.Println("Error getting absolute path", err)
+			return nil, fmt.Errorf("Error getting absolute path: %v", err)
+		}
+
+		if format == formatJSONDir {
+			// Create the directory if it doesn't exist and in uncompressed mode
+			err = os.MkdirAll(outputDir, 0755)
+			if err != nil {
+				log.Println("Error creating directory", err)
+				return nil, fmt.Errorf("Error creating directory: %v", err)
+			}
+		}
+	}
+
+	// Directory checkouts keep sync state so re-running into the same directory only fetches the diff
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	var state *syncState
+	if format == formatJSONDir && !cctx.Bool("full") {
+		state, err = loadSyncState(ctx, outputDir, did.String(), bs)
+		if err != nil {
+			log.Println("Error loading previous checkout", err)
+			return nil, fmt.Errorf("Error loading previous checkout (use --full to re-download): %v", err)
+		}
+	}
+
+	since := cctx.String("since")
+	if since != "" && state == nil {
+		return nil, fmt.Errorf("--since needs a previous %s checkout in %s to apply the diff to", formatJSONDir, outputDir)
+	}
+	if state != nil && since == "" {
+		since = state.Rev
+	}
+
+	log.Println("Fetching repo", "DID", did.String(), "Host", pdsHost, "Since", since)
+
+	body, err := client.GetRepo(ctx, pdsHost, did, since)
+	if err != nil {
+		log.Println("Error fetching repo", err)
+		return nil, fmt.Errorf("Error fetching repo: %v", err)
+	}
+
+	// The CAR format saves the repo exactly as it was sent while it's being read
+	src := io.Reader(body)
+	var carOut *outputFile
+	if format == formatCAR {
+		carOut, err = createOutput(outputDir, ".car")
+		if err != nil {
+			body.Close()
+			log.Println("Error creating CAR file", err)
+			return nil, fmt.Errorf("Error creating CAR file: %v", err)
+		}
+		defer carOut.Abort()
+		src = io.TeeReader(body, carOut)
+	}
+
+	// A diff is ingested on top of the previous checkout's blocks, giving the full current repo
+	root, err := repo.IngestRepo(ctx, bs, src)
+	body.Close()
+	if err != nil {
+		log.Println("Error reading repo", err)
+		return nil, fmt.Errorf("Error reading repo: %v", err)
+	}
+
+	r, err := repo.OpenRepo(ctx, bs, root)
+	if err != nil {
+		log.Println("Error opening repo", err)
+		return nil, fmt.Errorf("Error opening repo: %v", err)
+	}
+
+	if cctx.Bool("verify") {
+		// Keep the report out of the way of output written to stdout
+		reportOut := os.Stdout
+		if toStdout {
+			reportOut = os.Stderr
+		}
+
+		report := verifyRepo(ctx, r, id)
+		report.Print(reportOut)
+		if !report.OK() {
+			return nil, fmt.Errorf("repo failed verification")
+		}
+	}
+
+	if state != nil {
+		oldRoot, err := cid.Decode(state.Root)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing previous checkout root: %v", err)
+		}
+
+		var blobs map[string]int64
+		if cctx.Bool("include-blobs") {
+			blobs = make(map[string]int64)
+		}
+
+		written, deleted, err := applyDiff(ctx, r, oldRoot, outputDir, blobs)
+		if err != nil {
+			log.Println("Error applying diff", err)
+			return nil, fmt.Errorf("Error applying diff: %v", err)
+		}
+
+		if err := saveSyncState(ctx, outputDir, pdsHost, r, root); err != nil {
+			log.Println("Error saving sync state", err)
+			return nil, fmt.Errorf("Error saving sync state: %v", err)
+		}
+
+		if len(blobs) > 0 {
+			fetchBlobs(cctx, client, pdsHost, did, outputDir, nil, blobs)
+		}
+
+		log.Println("Incremental checkout complete", "Output directory", outputDir, "From rev", since, "To rev", r.SignedCommit().Rev, "Records written", written, "Records deleted", deleted)
+
+		return &checkoutResult{DID: did.String(), OutputDir: outputDir, Incremental: true, Records: written, Deleted: deleted}, nil
+	}
+
+	outputPath := outputDir
+	if carOut != nil {
+		if err := carOut.Commit(); err != nil {
+			log.Println("Error writing CAR file", err)
+			return nil, fmt.Errorf("Error writing CAR file: %v", err)
+		}
+		outputPath = carOut.path
+	}
+
+	var ndjsonOut *outputFile
+	var ndjsonWriter *bufio.Writer
+	if format == formatNDJSON {
+		ndjsonOut, err = createOutput(outputDir, ".ndjson")
+		if err != nil {
+			log.Println("Error creating NDJSON file", err)
+			return nil, fmt.Errorf("Error creating NDJSON file: %v", err)
+		}
+		defer ndjsonOut.Abort()
+		ndjsonWriter = bufio.NewWriter(ndjsonOut)
+		outputPath = ndjsonOut.path
+	}
+
+	var tarWriter *tar.Writer
+	var gzipWriter *gzip.Writer
+	var tarFile *os.File
+
+	if format == formatTarGz {
+		// Create the tar.gz file
+		tarGzPath := filepath.Join(outputDir + ".tar.gz")
+		outputPath = tarGzPath
+		tarFile, err = os.Create(tarGzPath)
+		if err != nil {
+			log.Println("Error creating tar.gz file", err)
+			return nil, fmt.Errorf("Error creating tar.gz file: %v", err)
+		}
+		defer tarFile.Close()
+
+		gzipWriter = gzip.NewWriter(tarFile)
+		defer gzipWriter.Close()
+
+		tarWriter = tar.NewWriter(gzipWriter)
+		defer tarWriter.Close()
+	}
+
+	numRecords := 0
+	collectionsSeen := make(map[string]struct{})
+	blobs := make(map[string]int64)
+
+	err = r.ForEach(ctx, "", func(path string, nodeCid cid.Cid) error {
+		recordCid, rec, err := r.GetRecordBytes(ctx, path)
+		if err != nil {
+			log.Println("Error getting record", err)
+			return nil
+		}
+
+		// Verify that the record CID matches the node CID
+		if recordCid != nodeCid {
+			log.Println("Mismatch in record and node CID", "recordCID", recordCid, "nodeCID", nodeCid)
+			return nil
+		}
+
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			log.Println("Path does not have 2 parts", "path", path)
+			return nil
+		}
+
+		collection := parts[0]
+		rkey := parts[1]
+
+		numRecords++
+		if _, ok := collectionsSeen[collection]; !ok {
+			collectionsSeen[collection] = struct{}{}
+		}
+
+		asCbor, err := data.UnmarshalCBOR(*rec)
+		if err != nil {
+			log.Println("Error unmarshalling record", err)
+			return fmt.Errorf("Failed to unmarshal record: %w", err)
+		}
+
+		if cctx.Bool("include-blobs") {
+			collectBlobs(asCbor, blobs)
+		}
+
+		recJSON, err := json.Marshal(asCbor)
+		if err != nil {
+			log.Println("Error marshalling record to JSON", err)
+			return fmt.Errorf("Failed to marshal record to JSON: %w", err)
+		}
+
+		switch format {
+		case formatTarGz:
+			// Write the record directly to the tar.gz file
+			hdr := &tar.Header{
+				Name: fmt.Sprintf("%s/%s.json", collection, rkey),
+				Mode: 0600,
+				Size: int64(len(recJSON)),
+			}
+			if err := tarWriter.WriteHeader(hdr); err != nil {
+				log.Println("Error writing tar header", err)
+				return err
+			}
+			if _, err := tarWriter.Write(recJSON); err != nil {
+				log.Println("Error writing record to tar file", err)
+				return err
+			}
+		case formatNDJSON:
+			line, err := json.Marshal(ndjsonRecord{
+				URI:        fmt.Sprintf("at://%s/%s", did, path),
+				CID:        recordCid.String(),
+				Collection: collection,
+				RKey:       rkey,
+				Value:      recJSON,
+			})
+			if err != nil {
+				log.Println("Error marshalling NDJSON line", err)
+				return fmt.Errorf("Failed to marshal NDJSON line: %w", err)
+			}
+			if _, err := ndjsonWriter.Write(append(line, '\n')); err != nil {
+				log.Println("Error writing record to NDJSON file", err)
+				return err
+			}
+		case formatJSONDir:
+			// Write the record to a file in uncompressed mode
+			recordPath := filepath.Join(outputDir, collection, fmt.Sprintf("%s.json", rkey))
+			err = os.MkdirAll(filepath.Dir(recordPath), 0755)
+			if err != nil {
+				log.Println("Error creating collection directory", err)
+				return nil // Continue processing other records
+			}
+			err = os.WriteFile(recordPath, recJSON, 0644)
+			if err != nil {
+				log.Println("Error writing record to file", err)
+				return nil // Continue processing other records
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error during ForEach", err)
+		return nil, fmt.Errorf("Error during ForEach: %v", err)
+	}
+
+	if ndjsonOut != nil {
+		if err := ndjsonWriter.Flush(); err != nil {
+			log.Println("Error writing NDJSON file", err)
+			return nil, fmt.Errorf("Error writing NDJSON file: %v", err)
+		}
+		if err := ndjsonOut.Commit(); err != nil {
+			log.Println("Error writing NDJSON file", err)
+			return nil, fmt.Errorf("Error writing NDJSON file: %v", err)
+		}
+	}
+
+	if format == formatJSONDir {
+		if err := saveSyncState(ctx, outputDir, pdsHost, r, root); err != nil {
+			log.Println("Error saving sync state", err)
+			return nil, fmt.Errorf("Error saving sync state: %v", err)
+		}
+	}
+
+	if cctx.Bool("include-blobs") && len(blobs) > 0 {
+		fetchBlobs(cctx, client, pdsHost, did, outputDir, tarWriter, blobs)
+	}
+
+	log.Println("Checkout complete", "Output", outputPath, "Number of records", numRecords, "Number of collections", len(collectionsSeen))
+
+	return &checkoutResult{DID: did.String(), OutputDir: outputPath, Records: numRecords, Collections: len(collectionsSeen)}, nil
+}
@@ -0,0 +1,37 @@
+package checkoutcmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+)
+
+// resolveIdentity resolves a handle or DID to its identity on net, looking up did:plc documents
+// in the network's PLC directory (or mirror)
+func resolveIdentity(ctx context.Context, raw string, net *network.Profile) (*identity.Identity, error) {
+	atid, err := syntax.ParseAtIdentifier(raw)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid handle or DID: %w", err)
+	}
+
+	dir := identity.BaseDirectory{
+		PLCURL: net.PLCHost,
+		HTTPClient: http.Client{
+			Timeout: 15 * time.Second,
+		},
+		TryAuthoritativeDNS:   true,
+		SkipDNSDomainSuffixes: net.SkipDNSDomainSuffixes,
+	}
+
+	id, err := dir.Lookup(ctx, *atid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", raw, err)
+	}
+
+	return id, nil
+}
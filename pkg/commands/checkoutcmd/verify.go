@@ -0,0 +1,148 @@
+package checkoutcmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/go-cid"
+)
+
+// verifyCheck is the outcome of a single verification check
+type verifyCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// verifyReport collects the checks run against a checked out repo
+type verifyReport struct {
+	Checks []verifyCheck
+}
+
+func (vr *verifyReport) add(name string, ok bool, detail string, args ...any) {
+	vr.Checks = append(vr.Checks, verifyCheck{Name: name, OK: ok, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// OK reports whether every check passed
+func (vr *verifyReport) OK() bool {
+	for _, c := range vr.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (vr *verifyReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "Verification report")
+	for _, c := range vr.Checks {
+		status := "PASS"
+		if !c.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "  [%s] %s: %s\n", status, c.Name, c.Detail)
+	}
+}
+
+// maxReportedMSTErrors caps how many individual MST problems are listed in the report
+const maxReportedMSTErrors = 10
+
+// verifyRepo checks a repo's signed commit against the identity's signing key and walks its MST,
+// checking that keys are valid record paths in strictly increasing order and that every record
+// block hashes to the CID its leaf points at
+func verifyRepo(ctx context.Context, r *repo.Repo, id *identity.Identity) *verifyReport {
+	report := &verifyReport{}
+
+	sc := r.SignedCommit()
+
+	report.add("commit did", sc.Did == id.DID.String(), "commit is for %s, expected %s", sc.Did, id.DID)
+	report.add("commit version", sc.Version == 3, "version %d", sc.Version)
+
+	if _, err := syntax.ParseTID(sc.Rev); err != nil {
+		report.add("commit rev", false, "rev %q is not a TID: %s", sc.Rev, err)
+	} else {
+		report.add("commit rev", true, "rev %s", sc.Rev)
+	}
+
+	if err := verifySignature(&sc, id); err != nil {
+		report.add("commit signature", false, "%s", err)
+	} else {
+		report.add("commit signature", true, "signed by the DID's current signing key")
+	}
+
+	var problems []string
+	numRecords := 0
+	lastKey := ""
+
+	err := r.ForEach(ctx, "", func(key string, leaf cid.Cid) error {
+		numRecords++
+
+		if key <= lastKey && lastKey != "" {
+			problems = append(problems, fmt.Sprintf("key %q is out of order after %q", key, lastKey))
+		}
+		lastKey = key
+
+		collection, rkey, ok := strings.Cut(key, "/")
+		if _, err := syntax.ParseNSID(collection); !ok || err != nil {
+			problems = append(problems, fmt.Sprintf("key %q has an invalid collection", key))
+		} else if _, err := syntax.ParseRecordKey(rkey); err != nil {
+			problems = append(problems, fmt.Sprintf("key %q has an invalid record key", key))
+		}
+
+		_, rec, err := r.GetRecordBytes(ctx, key)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("record %q is missing from the CAR: %s", key, err))
+			return nil
+		}
+
+		sum, err := leaf.Prefix().Sum(*rec)
+		if err != nil || !sum.Equals(leaf) {
+			problems = append(problems, fmt.Sprintf("record %q does not hash to its CID %s", key, leaf))
+		}
+
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("failed to walk MST: %s", err))
+	}
+
+	if len(problems) == 0 {
+		report.add("mst structure", true, "%d records, keys sorted and valid, all record CIDs match", numRecords)
+	} else {
+		detail := fmt.Sprintf("%d problems", len(problems))
+		for i, p := range problems {
+			if i == maxReportedMSTErrors {
+				detail += fmt.Sprintf("\n      ... and %d more", len(problems)-maxReportedMSTErrors)
+				break
+			}
+			detail += "\n      " + p
+		}
+		report.add("mst structure", false, "%s", detail)
+	}
+
+	return report
+}
+
+// verifySignature checks the commit's signature against the identity's atproto signing key
+func verifySignature(sc *repo.SignedCommit, id *identity.Identity) error {
+	pub, err := id.PublicKey()
+	if err != nil {
+		return fmt.Errorf("no usable signing key in DID document: %w", err)
+	}
+
+	unsigned, err := sc.Unsigned().BytesForSigning()
+	if err != nil {
+		return fmt.Errorf("failed to encode unsigned commit: %w", err)
+	}
+
+	if err := pub.HashAndVerify(unsigned, sc.Sig); err != nil {
+		return fmt.Errorf("signature does not match the DID's signing key: %w", err)
+	}
+
+	return nil
+}
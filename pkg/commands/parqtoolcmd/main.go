@@ -0,0 +1,312 @@
+package parqtoolcmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/parq"
+	"github.com/parquet-go/parquet-go"
+	"github.com/urfave/cli/v2"
+)
+
+// App returns the command line app for the Parquet inspection tool
+func App() *cli.App {
+	filterFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "repo",
+			Usage: "only records in this repo (DID)",
+		},
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only records in this collection",
+		},
+		&cli.StringFlag{
+			Name:  "rkey",
+			Usage: "only records with this record key",
+		},
+		&cli.TimestampFlag{
+			Name:   "since",
+			Usage:  "only records written at or after this RFC3339 time",
+			Layout: time.RFC3339,
+		},
+		&cli.TimestampFlag{
+			Name:   "until",
+			Usage:  "only records written before this RFC3339 time",
+			Layout: time.RFC3339,
+		},
+	}
+
+	app := cli.App{
+		Name:      "parqtool",
+		Usage:     "inspect the Parquet files the looking glass consumer writes",
+		Version:   "0.0.1",
+		ArgsUsage: "<file-or-dir>...",
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:      "ls",
+			Usage:     "list Parquet files with their row counts and sizes",
+			ArgsUsage: "<file-or-dir>...",
+			Action:    List,
+		},
+		{
+			Name:      "query",
+			Usage:     "print matching records as JSON lines",
+			ArgsUsage: "<file-or-dir>...",
+			Flags: append(slices.Clone(filterFlags),
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "stop after this many records (0 for no limit)",
+				},
+				&cli.BoolFlag{
+					Name:  "count",
+					Usage: "print only the number of matching records",
+				},
+			),
+			Action: Query,
+		},
+		{
+			Name:      "export",
+			Usage:     "write matching records to a new Parquet or JSON lines file",
+			ArgsUsage: "<file-or-dir>...",
+			Flags: append(slices.Clone(filterFlags),
+				&cli.StringFlag{
+					Name:     "output",
+					Usage:    "file to write, - for stdout",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "parquet or jsonl, defaults to the output file's extension",
+				},
+			),
+			Action: Export,
+		},
+	}
+
+	return &app
+}
+
+// jsonRecord is how records are printed, matching the consumer's JSON lines dumps
+type jsonRecord struct {
+	Seq        int64           `json:"seq"`
+	Repo       string          `json:"repo"`
+	Collection string          `json:"collection"`
+	RKey       string          `json:"rkey"`
+	Action     string          `json:"action"`
+	IngestedAt time.Time       `json:"ingested_at"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+func toJSONRecord(r *parq.Record) jsonRecord {
+	jr := jsonRecord{
+		Seq:        r.FirehoseSeq,
+		Repo:       r.Repo,
+		Collection: r.Collection,
+		RKey:       r.RKey,
+		Action:     r.Action,
+		IngestedAt: r.CreatedAt,
+		Error:      r.Error,
+	}
+	if r.Raw != "" {
+		jr.Record = json.RawMessage(r.Raw)
+	}
+	return jr
+}
+
+// parquetFiles expands the arguments into Parquet files, walking directories for *.parquet files
+func parquetFiles(cctx *cli.Context) ([]string, error) {
+	if cctx.NArg() == 0 {
+		return nil, fmt.Errorf("expected at least one Parquet file or directory")
+	}
+
+	var files []string
+	for _, arg := range cctx.Args().Slice() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(path, ".parquet") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", arg, err)
+		}
+	}
+
+	// Files are named by write time, so this reads them roughly in order
+	slices.Sort(files)
+	return files, nil
+}
+
+func parseFilter(cctx *cli.Context) parq.Filter {
+	f := parq.Filter{
+		Repo:       cctx.String("repo"),
+		Collection: cctx.String("collection"),
+		RKey:       cctx.String("rkey"),
+	}
+	if t := cctx.Timestamp("since"); t != nil {
+		f.Since = *t
+	}
+	if t := cctx.Timestamp("until"); t != nil {
+		f.Until = *t
+	}
+	return f
+}
+
+// scan runs fn over the matching records of every file, logging how much bloom filters skipped
+func scan(cctx *cli.Context, fn func(*parq.Record) error) error {
+	files, err := parquetFiles(cctx)
+	if err != nil {
+		return err
+	}
+	filter := parseFilter(cctx)
+
+	var total parq.ScanStats
+	stopped := false
+	for _, file := range files {
+		stats, err := parq.ScanFile(file, filter, func(r *parq.Record) error {
+			if err := fn(r); err != nil {
+				if err == io.EOF {
+					stopped = true
+				}
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		total.RowGroups += stats.RowGroups
+		total.RowGroupsSkipped += stats.RowGroupsSkipped
+		total.RowsRead += stats.RowsRead
+		total.RowsMatched += stats.RowsMatched
+		if stopped {
+			break
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "scanned %d files: %d of %d row groups skipped by bloom filters, %d rows read, %d matched\n",
+		len(files), total.RowGroupsSkipped, total.RowGroups, total.RowsRead, total.RowsMatched)
+	return nil
+}
+
+func List(cctx *cli.Context) error {
+	files, err := parquetFiles(cctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tROWS\tROW GROUPS\tSIZE\tBLOOM")
+	for _, file := range files {
+		info, err := parq.StatFile(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%t\n", file, info.Rows, info.RowGroups, info.Size, info.Bloom)
+	}
+	return tw.Flush()
+}
+
+func Query(cctx *cli.Context) error {
+	limit := cctx.Int("limit")
+	count := cctx.Bool("count")
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+
+	matched := 0
+	err := scan(cctx, func(r *parq.Record) error {
+		matched++
+		if !count {
+			if err := enc.Encode(toJSONRecord(r)); err != nil {
+				return err
+			}
+		}
+		if limit > 0 && matched >= limit {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if count {
+		fmt.Fprintln(out, matched)
+	}
+	return nil
+}
+
+func Export(cctx *cli.Context) error {
+	output := cctx.String("output")
+	format := cctx.String("format")
+	if format == "" {
+		switch {
+		case strings.HasSuffix(output, ".parquet"):
+			format = "parquet"
+		case strings.HasSuffix(output, ".jsonl"), output == "-":
+			format = "jsonl"
+		default:
+			return fmt.Errorf("can't tell the format of %q, set --format", output)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "parquet":
+		pw := parquet.NewGenericWriter[parq.Record](w, parquet.Compression(&parquet.Zstd), parq.BloomFilters)
+		err := scan(cctx, func(r *parq.Record) error {
+			_, err := pw.Write([]parq.Record{*r})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return pw.Close()
+	case "jsonl":
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := scan(cctx, func(r *parq.Record) error {
+			return enc.Encode(toJSONRecord(r))
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	default:
+		return fmt.Errorf("unsupported format %q, expected parquet or jsonl", format)
+	}
+}
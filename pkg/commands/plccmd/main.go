@@ -0,0 +1,409 @@
+package plccmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/httpcompress"
+	"github.com/ericvolp12/atproto.tools/pkg/lifecycle"
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+	"github.com/ericvolp12/atproto.tools/pkg/plc"
+	"github.com/ericvolp12/atproto.tools/pkg/slowlog"
+	"github.com/ericvolp12/atproto.tools/pkg/version"
+	"github.com/labstack/echo-contrib/echoprometheus"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+// App returns the command line app for the PLC directory exporter
+func App() *cli.App {
+	app := cli.App{
+		Name:    "plc-exporter",
+		Usage:   "plc exporter",
+		Version: "0.0.1",
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "debug",
+			Usage:   "enable debug logging",
+			EnvVars: []string{"PLC_EXPORTER_DEBUG"},
+		},
+		&cli.StringFlag{
+			Name:  "listen-addr",
+			Usage: "listen address for http server",
+			Value: ":3260",
+		},
+		&cli.StringFlag{
+			Name:    "data-dir",
+			Usage:   "path to data directory",
+			EnvVars: []string{"PLC_EXPORTER_DATA_DIR"},
+			Value:   "./data/plc-exporter",
+		},
+		&cli.StringFlag{
+			Name:    "db-driver",
+			Usage:   "database driver for the mirrored ops (sqlite or postgres)",
+			EnvVars: []string{"PLC_EXPORTER_DB_DRIVER"},
+			Value:   plc.DriverSQLite,
+		},
+		&cli.StringFlag{
+			Name:    "db-dsn",
+			Usage:   "database DSN, defaults to plc.db in --data-dir when using the sqlite driver",
+			EnvVars: []string{"PLC_EXPORTER_DB_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "upstream-host",
+			Usage:   "host to sync ops from, either a PLC directory or another mirror serving /export, defaults to the network's PLC directory",
+			EnvVars: []string{"PLC_EXPORTER_UPSTREAM_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "network",
+			Usage:   "atproto network whose PLC directory to mirror: main, sandbox, or a custom network from --network-config",
+			Value:   network.Main.Name,
+			EnvVars: []string{"PLC_EXPORTER_NETWORK"},
+		},
+		&cli.StringFlag{
+			Name:    "network-config",
+			Usage:   "JSON file defining custom networks, keyed by name",
+			EnvVars: []string{"PLC_EXPORTER_NETWORK_CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-upstream",
+			Usage:   "verify the CID and signature of every op synced from the upstream, stopping at the first that fails (always enabled when the upstream isn't the network's PLC directory)",
+			EnvVars: []string{"PLC_EXPORTER_VERIFY_UPSTREAM"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-signatures",
+			Usage:   "check the signature of every op synced against the rotation keys of the op before it, listing invalid ops at /invalid-ops",
+			Value:   true,
+			EnvVars: []string{"PLC_EXPORTER_VERIFY_SIGNATURES"},
+		},
+		&cli.DurationFlag{
+			Name:    "shutdown-budget",
+			Usage:   "how long shutdown may take in total",
+			EnvVars: []string{"PLC_EXPORTER_SHUTDOWN_BUDGET"},
+			Value:   30 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:    "check-interval",
+			Usage:   "interval to check for new data",
+			EnvVars: []string{"PLC_EXPORTER_CHECK_INTERVAL"},
+			Value:   5 * time.Second,
+		},
+		&cli.Float64Flag{
+			Name:    "ip-rate-limit",
+			Usage:   "requests per second allowed per client IP on mirror endpoints",
+			EnvVars: []string{"PLC_EXPORTER_IP_RATE_LIMIT"},
+			Value:   10,
+		},
+		&cli.Float64Flag{
+			Name:    "api-key-rate-limit",
+			Usage:   "requests per second allowed per API key on mirror endpoints",
+			EnvVars: []string{"PLC_EXPORTER_API_KEY_RATE_LIMIT"},
+			Value:   100,
+		},
+		&cli.StringSliceFlag{
+			Name:    "trusted-proxies",
+			Usage:   "CIDR ranges of proxies trusted to set X-Forwarded-For, otherwise clients are rate limited by their connection's IP",
+			EnvVars: []string{"PLC_EXPORTER_TRUSTED_PROXIES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "api-keys",
+			Usage:   "API keys granting the higher per-key rate limit",
+			EnvVars: []string{"PLC_EXPORTER_API_KEYS"},
+		},
+		&cli.BoolFlag{
+			Name:    "require-api-key",
+			Usage:   "reject mirror requests that don't present a valid API key",
+			EnvVars: []string{"PLC_EXPORTER_REQUIRE_API_KEY"},
+		},
+		&cli.IntFlag{
+			Name:    "batch-max-size",
+			Usage:   "max number of DIDs and handles a single /batch/resolve request can include",
+			EnvVars: []string{"PLC_EXPORTER_BATCH_MAX_SIZE"},
+			Value:   100,
+		},
+		&cli.BoolFlag{
+			Name:    "did-web",
+			Usage:   "resolve did:web DIDs by fetching their /.well-known/did.json",
+			EnvVars: []string{"PLC_EXPORTER_DID_WEB"},
+			Value:   true,
+		},
+		&cli.DurationFlag{
+			Name:    "did-web-cache-ttl",
+			Usage:   "how long fetched did:web documents are cached before being fetched again",
+			EnvVars: []string{"PLC_EXPORTER_DID_WEB_CACHE_TTL"},
+			Value:   5 * time.Minute,
+		},
+		&cli.StringFlag{
+			Name:    "webhooks-config",
+			Usage:   "path to a JSON file listing webhooks to notify when watched DIDs' documents change, re-read on SIGHUP",
+			EnvVars: []string{"PLC_EXPORTER_WEBHOOKS_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-token",
+			Usage:   "bearer token authorizing requests to the /admin endpoints, which are disabled without it",
+			EnvVars: []string{"PLC_EXPORTER_ADMIN_TOKEN"},
+		},
+		&cli.BoolFlag{
+			Name:    "stats",
+			Usage:   "keep daily op, DID, and PDS aggregates up to date as ops are synced, serving them at /stats",
+			EnvVars: []string{"PLC_EXPORTER_STATS"},
+			Value:   true,
+		},
+		&cli.DurationFlag{
+			Name:    "slow-query-threshold",
+			Usage:   "log reads slower than this at /admin/slow-queries (0 disables the slow query log)",
+			EnvVars: []string{"PLC_EXPORTER_SLOW_QUERY_THRESHOLD"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "cors-allowed-origins",
+			Usage:   "origins allowed to make cross-origin requests to mirror endpoints",
+			EnvVars: []string{"PLC_EXPORTER_CORS_ALLOWED_ORIGINS"},
+			Value:   cli.NewStringSlice("*"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "pds-aliases",
+			Usage:   "PDS endpoints that changed domains, as old-endpoint=new-endpoint pairs",
+			EnvVars: []string{"PLC_EXPORTER_PDS_ALIASES"},
+		},
+		&cli.IntFlag{
+			Name:    "compression-level",
+			Usage:   "gzip/deflate compression level for HTTP responses (1-9, -1 for default, 0 to disable)",
+			EnvVars: []string{"PLC_EXPORTER_COMPRESSION_LEVEL"},
+			Value:   -1,
+		},
+		&cli.DurationFlag{
+			Name:    "cache-max-age",
+			Usage:   "max-age for Cache-Control headers on DID resolution responses",
+			EnvVars: []string{"PLC_EXPORTER_CACHE_MAX_AGE"},
+			Value:   time.Minute,
+		},
+	}
+
+	app.Action = PLCExporter
+
+	return &app
+}
+
+func PLCExporter(cctx *cli.Context) error {
+	// Trap SIGINT and SIGTERM to trigger a shutdown
+	ctx, cancel := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	logLevel := slog.LevelInfo
+	if cctx.Bool("debug") {
+		logLevel = slog.LevelDebug
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level:     logLevel,
+		AddSource: true,
+	})))
+
+	logger := slog.Default()
+
+	// Make sure data directory exists
+	dataDir := cctx.String("data-dir")
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		logger.Error("failed to create data directory", "err", err)
+		return err
+	}
+
+	profile, err := network.Load(cctx.String("network"), cctx.String("network-config"))
+	if err != nil {
+		logger.Error("failed to load network profile", "err", err)
+		return err
+	}
+
+	upstream := profile.PLCHost
+	if cctx.IsSet("upstream-host") {
+		upstream = strings.TrimSuffix(cctx.String("upstream-host"), "/")
+	}
+	dbDSN := cctx.String("db-dsn")
+	if dbDSN == "" && cctx.String("db-driver") == plc.DriverSQLite {
+		dbDSN = filepath.Join(dataDir, "plc.db")
+	}
+
+	p, err := plc.NewPLC(ctx, upstream, cctx.String("db-driver"), dbDSN, logger, cctx.Duration("check-interval"))
+	if err != nil {
+		logger.Error("failed to create plc", "err", err)
+		return err
+	}
+
+	p.CacheMaxAge = cctx.Duration("cache-max-age")
+	p.BatchMaxSize = cctx.Int("batch-max-size")
+
+	var slowLog *slowlog.Log
+	if threshold := cctx.Duration("slow-query-threshold"); threshold > 0 {
+		slowLog = slowlog.New(threshold, 1000)
+		if err := p.DB.Use(slowLog); err != nil {
+			logger.Error("failed to enable slow query log", "err", err)
+			return err
+		}
+	}
+
+	webhooksPath := cctx.String("webhooks-config")
+	if webhooksPath != "" {
+		hooks, err := plc.LoadWebhooks(webhooksPath)
+		if err != nil {
+			logger.Error("failed to load webhooks", "err", err)
+			return err
+		}
+		p.SetWebhooks(hooks)
+		logger.Info("loaded webhooks", "count", len(hooks))
+
+		// Reload the webhooks on SIGHUP, which would otherwise stop the process
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				hooks, err := plc.LoadWebhooks(webhooksPath)
+				if err != nil {
+					logger.Error("failed to reload webhooks, keeping the current ones", "err", err)
+					continue
+				}
+				p.SetWebhooks(hooks)
+				logger.Info("reloaded webhooks", "count", len(hooks))
+			}
+		}()
+	}
+
+	if cctx.Bool("did-web") {
+		p.RegisterMethod("web", plc.NewWebResolver(cctx.Duration("did-web-cache-ttl")))
+	}
+
+	for _, alias := range cctx.StringSlice("pds-aliases") {
+		from, to, ok := strings.Cut(alias, "=")
+		if !ok {
+			logger.Error("invalid pds alias, expected old-endpoint=new-endpoint", "alias", alias)
+			return fmt.Errorf("invalid pds alias %q", alias)
+		}
+		if err := p.AddPDSAlias(from, to); err != nil {
+			logger.Error("failed to add pds alias", "err", err)
+			return err
+		}
+	}
+
+	p.VerifyOps = cctx.Bool("verify-upstream") || upstream != profile.PLCHost
+	if p.VerifyOps {
+		logger.Info("verifying ops synced from upstream", "upstream", upstream)
+	}
+	p.VerifySignatures = cctx.Bool("verify-signatures")
+	p.Stats = cctx.Bool("stats")
+	p.AdminToken = cctx.String("admin-token")
+
+	// Create a new echo instance
+	e := echo.New()
+
+	// Client IPs key the rate limiter, so X-Forwarded-For is only believed from trusted proxies
+	e.IPExtractor = echo.ExtractIPDirect()
+	if proxies := cctx.StringSlice("trusted-proxies"); len(proxies) > 0 {
+		opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, proxy := range proxies {
+			_, ipNet, err := net.ParseCIDR(proxy)
+			if err != nil {
+				logger.Error("invalid trusted proxy range", "range", proxy, "err", err)
+				return fmt.Errorf("invalid trusted proxy range %q: %w", proxy, err)
+			}
+			opts = append(opts, echo.TrustIPRange(ipNet))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(opts...)
+	}
+
+	// Add Prometheus middleware
+	echoProm := echoprometheus.NewMiddlewareWithConfig(echoprometheus.MiddlewareConfig{
+		Namespace: metrics.PLCMirror,
+		HistogramOptsFunc: func(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+			opts.Buckets = prometheus.ExponentialBuckets(0.00001, 2, 20)
+			return opts
+		},
+	})
+	e.Use(echoProm)
+
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  cctx.StringSlice("cors-allowed-origins"),
+		AllowMethods:  []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions},
+		AllowHeaders:  []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "If-None-Match", "X-API-Key"},
+		ExposeHeaders: []string{"ETag", "X-RateLimit-Limit", "Retry-After", version.Header},
+	}))
+
+	e.Use(version.Middleware())
+
+	if level := cctx.Int("compression-level"); level != 0 {
+		e.Use(httpcompress.Middleware(level))
+	}
+
+	// Rate limit and authenticate mirror endpoints
+	rateLimiter := plc.NewRateLimiter(
+		ctx,
+		cctx.Float64("ip-rate-limit"),
+		cctx.Float64("api-key-rate-limit"),
+		cctx.StringSlice("api-keys"),
+		cctx.Bool("require-api-key"),
+	)
+	e.Use(rateLimiter.Middleware)
+
+	// Add Prometheus metrics handler
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	// Mirror endpoints
+	e.GET("/export", p.HandleExport)
+	e.GET("/export/ops", p.HandleExportOps)
+	e.GET("/history/handle/:handle", p.HandleGetHandleHistory)
+	e.GET("/reverse/*", p.HandleReverseLookup)
+	e.POST("/batch/resolve", p.HandleBatchResolve)
+	e.GET("/invalid-ops", p.HandleGetInvalidOps)
+	e.GET("/stats", p.HandleGetStats)
+	e.GET("/stats/daily", p.HandleGetDailyStats)
+	e.GET("/stats/pds", p.HandleGetPDSStats)
+	if slowLog != nil {
+		e.GET("/admin/slow-queries", slowLog.HandleGetSlowQueries, p.RequireAdmin)
+	}
+	e.GET("/admin/webhooks/deliveries", p.HandleGetWebhookDeliveries, p.RequireAdmin)
+	e.GET("/:did/log", p.HandleGetOpLog)
+	e.GET("/:did/log/audit", p.HandleGetAuditLog)
+	e.GET("/:did", p.HandleGetDID)
+
+	// Components are shut down in the reverse of the order they're added
+	lm := lifecycle.NewManager(logger)
+	lm.Budget = lifecycle.NewBudget(logger, cctx.Duration("shutdown-budget"))
+
+	lm.Add("http_server", func(ctx context.Context) error {
+		if err := e.Start(cctx.String("listen-addr")); err != http.ErrServerClosed {
+			return fmt.Errorf("failed to start http server: %w", err)
+		}
+		return nil
+	}, e.Shutdown)
+
+	lm.Add("plc", p.Run, nil)
+
+	if webhooksPath != "" {
+		lm.Add("webhooks", p.RunWebhooks, nil)
+	}
+
+	e.GET("/_health", lm.HandleHealth)
+
+	err = lm.Run(ctx)
+	if err != nil {
+		logger.Error("shut down due to component failure", "err", err)
+	}
+
+	return nil
+}
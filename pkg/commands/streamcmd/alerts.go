@@ -0,0 +1,171 @@
+package streamcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/common/model"
+	"github.com/urfave/cli/v2"
+)
+
+// alertRule is a Prometheus alerting rule
+type alertRule struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type alertGroup struct {
+	Name  string      `json:"name"`
+	Rules []alertRule `json:"rules"`
+}
+
+type alertRules struct {
+	Groups []alertGroup `json:"groups"`
+}
+
+// promDuration formats a duration the way Prometheus expects in rules and range selectors
+func promDuration(d time.Duration) string {
+	return model.Duration(d).String()
+}
+
+func newAlert(name, severity, expr string, forDuration time.Duration, summary string) alertRule {
+	r := alertRule{
+		Alert:       name,
+		Expr:        expr,
+		Labels:      map[string]string{"severity": severity},
+		Annotations: map[string]string{"summary": summary},
+	}
+	if forDuration > 0 {
+		r.For = promDuration(forDuration)
+	}
+	return r
+}
+
+// GenAlerts writes Prometheus alerting rules for the consumer as configured by the same flags
+// and environment it runs with, so only the sinks and features it uses are alerted on
+func GenAlerts(cctx *cli.Context) error {
+	lg := func(name string) string { return metrics.LookingGlass + "_" + name }
+	forDuration := cctx.Duration("for")
+	queueDepth := cctx.Int("queue-depth-threshold")
+
+	consumer := alertGroup{Name: "looking-glass"}
+	consumer.Rules = append(consumer.Rules,
+		newAlert("LookingGlassLagging", "warning",
+			fmt.Sprintf(`time() - max by (instance, host) (%s) > %d`, lg("upstream_event_time_seconds"), int(cctx.Duration("lag-threshold").Seconds())),
+			forDuration,
+			fmt.Sprintf("Looking glass {{ $labels.instance }} is more than %s behind {{ $labels.host }}", cctx.Duration("lag-threshold"))),
+		newAlert("LookingGlassStalled", "critical",
+			fmt.Sprintf(`changes(%s[%s]) == 0`, lg("upstream_seq"), promDuration(2*cctx.Duration("liveness-window"))),
+			0,
+			"Looking glass {{ $labels.instance }} has seen no events from {{ $labels.host }} for two liveness windows"),
+		newAlert("LookingGlassLivenessEscalating", "warning",
+			fmt.Sprintf(`increase(%s[15m]) > 0`, lg("liveness_escalations_total")),
+			0,
+			"Looking glass {{ $labels.instance }} is {{ $labels.action }} to recover from a stalled firehose"),
+		newAlert("LookingGlassSinkWriteErrors", "warning",
+			fmt.Sprintf(`sum by (instance, sink) (rate(%s[5m])) > 0`, lg("sink_write_errors_total")),
+			forDuration,
+			"Looking glass {{ $labels.instance }} is failing to write to the {{ $labels.sink }} sink"),
+	)
+
+	if cctx.String("consistency-upstream") != "" {
+		consumer.Rules = append(consumer.Rules, newAlert("LookingGlassMissingCommits", "warning",
+			fmt.Sprintf(`increase(%s[30m]) > 0`, lg("consistency_missing_total")),
+			0,
+			"Looking glass {{ $labels.instance }} is missing commits seen on {{ $labels.host }}"))
+	}
+
+	if cctx.String("dump-url") != "" {
+		// Dumps are published daily, so two missed days is a failure rather than a slow day
+		consumer.Rules = append(consumer.Rules,
+			newAlert("LookingGlassDumpsFailing", "warning",
+				fmt.Sprintf(`increase(%s{result="failed"}[1h]) > 0`, lg("dumps_published_total")),
+				0,
+				"Looking glass {{ $labels.instance }} failed to publish a dataset dump"),
+			newAlert("LookingGlassDumpsStale", "warning",
+				fmt.Sprintf(`increase(%s{result="ok"}[2d]) == 0`, lg("dumps_published_total")),
+				0,
+				"Looking glass {{ $labels.instance }} hasn't published a dataset dump in two days"),
+		)
+	}
+
+	sinks := cctx.StringSlice("sinks")
+	if slices.Contains(sinks, "bigquery") || cctx.String("bigquery-project-id") != "" {
+		consumer.Rules = append(consumer.Rules, newAlert("LookingGlassBigQueryBacklog", "warning",
+			fmt.Sprintf(`max by (instance, table) (%s) > %d`, lg("bq_queue_depth"), queueDepth),
+			forDuration,
+			"Looking glass {{ $labels.instance }} has a BigQuery backlog for {{ $labels.table }}"))
+	}
+	if slices.Contains(sinks, "kafka") || len(cctx.StringSlice("kafka-brokers")) > 0 {
+		consumer.Rules = append(consumer.Rules,
+			newAlert("LookingGlassKafkaBacklog", "warning",
+				fmt.Sprintf(`%s > %d`, lg("kafka_queue_depth"), queueDepth),
+				forDuration,
+				"Looking glass {{ $labels.instance }} has a Kafka publishing backlog"),
+			newAlert("LookingGlassKafkaPublishErrors", "warning",
+				fmt.Sprintf(`increase(%s[10m]) > 0`, lg("kafka_publish_errors_total")),
+				0,
+				"Looking glass {{ $labels.instance }} is failing to publish to Kafka"),
+		)
+	}
+	if slices.Contains(sinks, "parquet") || cctx.String("parquet-dir") != "" {
+		// Files are written every batch, so a buffer past two batches means writes are failing
+		consumer.Rules = append(consumer.Rules, newAlert("LookingGlassParquetBacklog", "warning",
+			fmt.Sprintf(`%s > %d`, lg("parq_records_buffered"), 2*cctx.Int("parquet-batch-size")),
+			forDuration,
+			"Looking glass {{ $labels.instance }} is failing to write Parquet files"))
+	}
+	if cctx.String("parquet-upload-url") != "" {
+		// Uploads are retried every minute, so an hour behind means they're failing outright
+		consumer.Rules = append(consumer.Rules, newAlert("LookingGlassParquetUploadLagging", "warning",
+			fmt.Sprintf(`%s > 3600`, lg("parq_upload_lag_seconds")),
+			forDuration,
+			"Looking glass {{ $labels.instance }} is failing to upload Parquet files"))
+	}
+
+	rules := alertRules{Groups: []alertGroup{consumer}}
+
+	if cctx.Bool("plc-mirror") {
+		rules.Groups = append(rules.Groups, alertGroup{
+			Name: "plc-mirror",
+			Rules: []alertRule{
+				newAlert("PLCMirrorStale", "warning",
+					fmt.Sprintf(`time() - %s_last_op_time_seconds > %d`, metrics.PLCMirror, int(cctx.Duration("plc-freshness-threshold").Seconds())),
+					forDuration,
+					fmt.Sprintf("PLC mirror {{ $labels.instance }} hasn't mirrored an op in %s", cctx.Duration("plc-freshness-threshold"))),
+				newAlert("PLCMirrorFailedVerification", "warning",
+					fmt.Sprintf(`increase(%s_ops_failed_verification_total[1h]) > 0`, metrics.PLCMirror),
+					0,
+					"PLC mirror {{ $labels.instance }} received ops whose CIDs don't match their contents"),
+			},
+		})
+	}
+
+	// JSON is valid YAML, so the output can be loaded as a rule file as is
+	out, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode alert rules: %w", err)
+	}
+	out = append(out, '\n')
+
+	var w io.Writer = os.Stdout
+	if path := cctx.String("output"); path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = w.Write(out)
+	return err
+}
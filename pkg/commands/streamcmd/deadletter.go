@@ -0,0 +1,41 @@
+package streamcmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ericvolp12/atproto.tools/pkg/stream"
+	"github.com/urfave/cli/v2"
+)
+
+// ReplayDeadLetters retries the db sink's failed record writes, failing if any fail again
+func ReplayDeadLetters(cctx *cli.Context) error {
+	ctx, cancel := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	if cctx.Int("batch-size") < 1 {
+		return fmt.Errorf("batch-size must be at least 1")
+	}
+
+	dbDSN := cctx.String("db-dsn")
+	if dbDSN == "" && cctx.String("db-driver") == stream.DriverSQLite {
+		dbDSN = cctx.String("sqlite-path")
+	}
+
+	res, err := stream.ReplayDeadLetters(ctx, logger, cctx.String("db-driver"), dbDSN, cctx.String("spill-path"), cctx.Int("batch-size"))
+	if err != nil {
+		logger.Error("failed to replay dead letters", "error", err)
+		return err
+	}
+
+	logger.Info("dead letter replay complete", "imported", res.Imported, "replayed", res.Replayed, "failed", res.Failed)
+	if res.Failed > 0 {
+		return fmt.Errorf("%d dead letters failed to replay, see /deadletter?pending=true", res.Failed)
+	}
+	return nil
+}
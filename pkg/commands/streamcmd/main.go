@@ -0,0 +1,1480 @@
+package streamcmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "net/http/pprof"
+
+	"github.com/ericvolp12/atproto.tools/pkg/bq"
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/ericvolp12/atproto.tools/pkg/envfile"
+	"github.com/ericvolp12/atproto.tools/pkg/httpcompress"
+	"github.com/ericvolp12/atproto.tools/pkg/kafka"
+	"github.com/ericvolp12/atproto.tools/pkg/lifecycle"
+	"github.com/ericvolp12/atproto.tools/pkg/nats"
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+	"github.com/ericvolp12/atproto.tools/pkg/objstore"
+	"github.com/ericvolp12/atproto.tools/pkg/parq"
+	"github.com/ericvolp12/atproto.tools/pkg/slowlog"
+	"github.com/ericvolp12/atproto.tools/pkg/stream"
+	"github.com/ericvolp12/atproto.tools/pkg/version"
+	"github.com/ericvolp12/bsky-experiments/pkg/tracing"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	slogecho "github.com/samber/slog-echo"
+	echopprof "github.com/sevenNt/echo-pprof"
+	"go.opentelemetry.io/otel"
+
+	"github.com/urfave/cli/v2"
+)
+
+// App returns the command line app for the looking glass firehose consumer
+func App() *cli.App {
+	app := cli.App{
+		Name:    "stream",
+		Usage:   "atproto firehose stream consumer",
+		Version: "0.0.1",
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "file of KEY=VALUE lines setting the LG_* env vars flags are read from, re-read on SIGHUP or POST /admin/reload to apply filter and retention changes",
+			EnvVars: []string{"LG_CONFIG"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ws-url",
+			Usage:   "full websocket path to the ATProto SubscribeRepos XRPC endpoint, repeat to also consume other relays, PDSs, or labelers for comparison (only the first is stored), defaults to the network's relay",
+			EnvVars: []string{"LG_WS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "network",
+			Usage:   "atproto network to consume, setting the default relay, PLC directory, and DNS resolution settings: main, sandbox, or a custom network from --network-config",
+			Value:   network.Main.Name,
+			EnvVars: []string{"LG_NETWORK"},
+		},
+		&cli.StringFlag{
+			Name:    "network-config",
+			Usage:   "JSON file defining custom networks, keyed by name",
+			EnvVars: []string{"LG_NETWORK_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "ws-fallback-url",
+			Usage:   "websocket URL of a fallback relay to rotate to when the primary stops making progress",
+			EnvVars: []string{"LG_WS_FALLBACK_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "consistency-upstream",
+			Usage:   "host of an additional ws-url upstream to compare the primary relay's commits against, served at /consistency",
+			EnvVars: []string{"LG_CONSISTENCY_UPSTREAM"},
+		},
+		&cli.DurationFlag{
+			Name:    "consistency-window",
+			Usage:   "how long a commit may be seen on only one compared upstream before it's reported missing from the other",
+			Value:   time.Minute,
+			EnvVars: []string{"LG_CONSISTENCY_WINDOW"},
+		},
+		&cli.DurationFlag{
+			Name:    "shutdown-budget",
+			Usage:   "how long shutdown may take in total, split between draining the schedulers, flushing sinks, saving cursors, and stopping the http server",
+			Value:   30 * time.Second,
+			EnvVars: []string{"LG_SHUTDOWN_BUDGET"},
+		},
+		&cli.DurationFlag{
+			Name:    "liveness-window",
+			Usage:   "how often to check that the firehose is making progress",
+			Value:   15 * time.Second,
+			EnvVars: []string{"LG_LIVENESS_WINDOW"},
+		},
+		&cli.Int64Flag{
+			Name:    "liveness-min-progress",
+			Usage:   "minimum cursor advance required within each liveness window",
+			Value:   1,
+			EnvVars: []string{"LG_LIVENESS_MIN_PROGRESS"},
+		},
+		&cli.StringFlag{
+			Name:    "liveness-mode",
+			Usage:   "what to do when the firehose goes quiet: restart (reconnect, rotate relays, then exit) or warn (log only)",
+			Value:   stream.LivenessRestart,
+			EnvVars: []string{"LG_LIVENESS_MODE"},
+		},
+		&cli.IntFlag{
+			Name:    "liveness-max-failures",
+			Usage:   "consecutive quiet liveness windows tolerated (reconnecting, then rotating relays) before exiting",
+			Value:   3,
+			EnvVars: []string{"LG_LIVENESS_MAX_FAILURES"},
+		},
+		&cli.DurationFlag{
+			Name:    "reconnect-max-backoff",
+			Usage:   "longest wait between attempts to reconnect to a relay, backing off exponentially from 1s",
+			Value:   2 * time.Minute,
+			EnvVars: []string{"LG_RECONNECT_MAX_BACKOFF"},
+		},
+		&cli.Int64Flag{
+			Name:    "gap-min-size",
+			Usage:   "how many consecutive seqs the relay must skip to be recorded as a gap at /gaps",
+			Value:   1,
+			EnvVars: []string{"LG_GAP_MIN_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "gap-fill",
+			Usage:   "re-backfill repos whose commits after a gap show they missed one in it (requires --backfill-workers)",
+			EnvVars: []string{"LG_GAP_FILL"},
+		},
+		&cli.DurationFlag{
+			Name:    "gap-fill-window",
+			Usage:   "how long after a gap repos' commits are checked for missed ones",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"LG_GAP_FILL_WINDOW"},
+		},
+		&cli.StringFlag{
+			Name:    "identity-export-path",
+			Usage:   "file to periodically export the identity table (DID, handle, PDS, updated time) to",
+			EnvVars: []string{"LG_IDENTITY_EXPORT_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "identity-export-format",
+			Usage:   "format of the identity export: csv or parquet",
+			Value:   stream.IdentityExportCSV,
+			EnvVars: []string{"LG_IDENTITY_EXPORT_FORMAT"},
+		},
+		&cli.DurationFlag{
+			Name:    "identity-export-interval",
+			Usage:   "how often to export the identity table",
+			Value:   time.Hour,
+			EnvVars: []string{"LG_IDENTITY_EXPORT_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "cursor-publish-url",
+			Usage:   "URL to periodically POST the consumer's firehose cursor to",
+			EnvVars: []string{"LG_CURSOR_PUBLISH_URL"},
+		},
+		&cli.DurationFlag{
+			Name:    "cursor-publish-interval",
+			Usage:   "how often to publish the firehose cursor",
+			Value:   10 * time.Second,
+			EnvVars: []string{"LG_CURSOR_PUBLISH_INTERVAL"},
+		},
+		&cli.IntFlag{
+			Name:    "event-cache-size",
+			Usage:   "number of recent events kept in memory to serve exact-seq lookups (0 to disable)",
+			Value:   10_000,
+			EnvVars: []string{"LG_EVENT_CACHE_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "at-uri-cache-size",
+			Usage:   "number of records fetched from PDSes by /at lookups kept in memory (0 to disable)",
+			Value:   10_000,
+			EnvVars: []string{"LG_AT_URI_CACHE_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "at-uri-cache-ttl",
+			Usage:   "how long records fetched from PDSes by /at lookups are cached",
+			Value:   5 * time.Minute,
+			EnvVars: []string{"LG_AT_URI_CACHE_TTL"},
+		},
+		&cli.IntFlag{
+			Name:    "subscribe-buffer-size",
+			Usage:   "number of events buffered for each /subscribe client",
+			Value:   1000,
+			EnvVars: []string{"LG_SUBSCRIBE_BUFFER_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    "subscribe-drop-policy",
+			Usage:   "what to do when a /subscribe client falls behind: disconnect, drop_newest, or drop_oldest",
+			Value:   stream.SubscribeDisconnect,
+			EnvVars: []string{"LG_SUBSCRIBE_DROP_POLICY"},
+		},
+		&cli.Int64Flag{
+			Name:    "subscribe-max-drops",
+			Usage:   "events a /subscribe client may miss under a drop policy before being disconnected (0 for no limit)",
+			Value:   10_000,
+			EnvVars: []string{"LG_SUBSCRIBE_MAX_DROPS"},
+		},
+		&cli.BoolFlag{
+			Name:    "subscribe-compression",
+			Usage:   "compress /subscribe messages with permessage-deflate for clients that offer it",
+			Value:   true,
+			EnvVars: []string{"LG_SUBSCRIBE_COMPRESSION"},
+		},
+		&cli.IntFlag{
+			Name:    "subscribe-compression-level",
+			Usage:   "flate level for compressed /subscribe messages, from 1 (fastest) to 9 (smallest)",
+			Value:   1,
+			EnvVars: []string{"LG_SUBSCRIBE_COMPRESSION_LEVEL"},
+		},
+		&cli.BoolFlag{
+			Name:    "subscribe-zstd",
+			Usage:   "let /subscribe clients ask for Jetstream-style zstd compressed messages with compress=true",
+			Value:   true,
+			EnvVars: []string{"LG_SUBSCRIBE_ZSTD"},
+		},
+		&cli.StringFlag{
+			Name:    "subscribe-zstd-dictionary",
+			Usage:   "path to a zstd dictionary (such as Jetstream's) to compress /subscribe messages with, served at /subscribe/dictionary",
+			EnvVars: []string{"LG_SUBSCRIBE_ZSTD_DICTIONARY"},
+		},
+		&cli.BoolFlag{
+			Name:    "firehose-compression",
+			Usage:   "offer permessage-deflate compression when dialing relays, used if the relay supports it",
+			Value:   true,
+			EnvVars: []string{"LG_FIREHOSE_COMPRESSION"},
+		},
+		&cli.BoolFlag{
+			Name:    "search-index",
+			Usage:   "maintain a full-text index over record payloads and serve /records/search",
+			Value:   false,
+			EnvVars: []string{"LG_SEARCH_INDEX"},
+		},
+		&cli.DurationFlag{
+			Name:    "quarantine-retention",
+			Usage:   "how long to keep the payloads of records that failed to decode (0 to keep them forever)",
+			Value:   7 * 24 * time.Hour,
+			EnvVars: []string{"LG_QUARANTINE_RETENTION"},
+		},
+		&cli.DurationFlag{
+			Name:    "pds-scoreboard-interval",
+			Usage:   "how often to rebuild the PDS conformance scoreboard served at /pds/scoreboard (0 to disable it)",
+			Value:   15 * time.Minute,
+			EnvVars: []string{"LG_PDS_SCOREBOARD_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "dump-url",
+			Usage:   "object storage URL to publish daily dataset dumps to (gs://bucket/prefix, an https URL accepting PUTs, or a local directory), listed at /dumps",
+			EnvVars: []string{"LG_DUMP_URL"},
+		},
+		&cli.DurationFlag{
+			Name:    "dump-interval",
+			Usage:   "how often to check for finished days to publish dumps of",
+			Value:   time.Hour,
+			EnvVars: []string{"LG_DUMP_INTERVAL"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "dump-collections",
+			Usage:   "collections to include in dumps, all collections if unset",
+			EnvVars: []string{"LG_DUMP_COLLECTIONS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "dump-formats",
+			Usage:   "formats to write each dump in: parquet, jsonl, or both",
+			Value:   cli.NewStringSlice(stream.DumpFormatParquet, stream.DumpFormatJSONL),
+			EnvVars: []string{"LG_DUMP_FORMATS"},
+		},
+		&cli.BoolFlag{
+			Name:    "dump-deidentify",
+			Usage:   "replace DIDs in dumps with salted pseudonyms and strip handles and identifying fields, keeping the mapping in the local database only",
+			EnvVars: []string{"LG_DUMP_DEIDENTIFY"},
+		},
+		&cli.DurationFlag{
+			Name:    "dump-salt-rotation",
+			Usage:   "how long a de-identification salt is used, so pseudonyms only link a repo's records within that period",
+			Value:   7 * 24 * time.Hour,
+			EnvVars: []string{"LG_DUMP_SALT_ROTATION"},
+		},
+		&cli.BoolFlag{
+			Name:    "track-usage",
+			Usage:   "account requests, rows returned, and bytes served to each API key at /admin/usage, implied by --api-keys",
+			EnvVars: []string{"LG_TRACK_USAGE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "api-keys",
+			Usage:   "API keys whose usage is tracked, as name=key pairs or bare keys",
+			EnvVars: []string{"LG_API_KEYS"},
+		},
+		&cli.BoolFlag{
+			Name:    "require-api-key",
+			Usage:   "reject requests that don't present a valid API key",
+			EnvVars: []string{"LG_REQUIRE_API_KEY"},
+		},
+		&cli.Int64Flag{
+			Name:    "api-key-daily-quota",
+			Usage:   "max requests each API key can make per UTC day (0 for no limit)",
+			EnvVars: []string{"LG_API_KEY_DAILY_QUOTA"},
+		},
+		&cli.BoolFlag{
+			Name:    "actives",
+			Usage:   "estimate the distinct repos committing and created each hour, served at /stats/actives",
+			Value:   true,
+			EnvVars: []string{"LG_ACTIVES"},
+		},
+		&cli.DurationFlag{
+			Name:    "actives-retention",
+			Usage:   "how long hourly active repo sketches are kept (0 to keep them forever)",
+			Value:   90 * 24 * time.Hour,
+			EnvVars: []string{"LG_ACTIVES_RETENTION"},
+		},
+		&cli.StringFlag{
+			Name:    "computed-fields",
+			Usage:   "JSON file declaring computed fields extracted from records at ingest and filterable with kv.<name> on /records, keyed by name",
+			EnvVars: []string{"LG_COMPUTED_FIELDS"},
+		},
+		&cli.IntFlag{
+			Name:    "repo-record-cap",
+			Usage:   "maximum number of records kept per repo, evicting the oldest past it every 5 minutes (0 for no limit)",
+			EnvVars: []string{"LG_REPO_RECORD_CAP"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "include-collections",
+			Usage:   "only store records in these collections, NSIDs or prefixes like app.bsky.feed.* (default all)",
+			EnvVars: []string{"LG_INCLUDE_COLLECTIONS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "exclude-collections",
+			Usage:   "don't store records in these collections, NSIDs or prefixes like app.bsky.graph.*",
+			EnvVars: []string{"LG_EXCLUDE_COLLECTIONS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "include-dids",
+			Usage:   "only store records from these repos (default all)",
+			EnvVars: []string{"LG_INCLUDE_DIDS"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-token",
+			Usage:   "bearer token authorizing requests to the /admin endpoints, which are disabled if unset",
+			EnvVars: []string{"LG_ADMIN_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:    "deadletter-spill-path",
+			Usage:   "NDJSON file to append dead letters to when the database can't store them, imported by replay-deadletters",
+			EnvVars: []string{"LG_DEADLETTER_SPILL_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "scheduler",
+			Usage:   "how firehose events are scheduled: parallel (fixed workers) or autoscale (workers scale with the event rate)",
+			Value:   stream.SchedulerParallel,
+			EnvVars: []string{"LG_SCHEDULER"},
+		},
+		&cli.IntFlag{
+			Name:    "scheduler-workers",
+			Usage:   "events processed at once, or the most the autoscale scheduler scales up to",
+			Value:   100,
+			EnvVars: []string{"LG_SCHEDULER_WORKERS"},
+		},
+		&cli.IntFlag{
+			Name:    "scheduler-queue-depth",
+			Usage:   "events the scheduler queues per repo",
+			Value:   10,
+			EnvVars: []string{"LG_SCHEDULER_QUEUE_DEPTH"},
+		},
+		&cli.IntFlag{
+			Name:    "backpressure-limit",
+			Usage:   "events queued or processing per upstream before reading from the websocket pauses (0 buffers without limit)",
+			EnvVars: []string{"LG_BACKPRESSURE_LIMIT"},
+		},
+		&cli.DurationFlag{
+			Name:    "churn-window",
+			Usage:   "flag records deleted within this long of being created as churn, served at /stats/churn (0 disables churn detection)",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"LG_CHURN_WINDOW"},
+		},
+		&cli.DurationFlag{
+			Name:    "slow-query-threshold",
+			Usage:   "log reads slower than this at /admin/slow-queries (0 disables the slow query log)",
+			EnvVars: []string{"LG_SLOW_QUERY_THRESHOLD"},
+		},
+		&cli.BoolFlag{
+			Name:    "bot-scoring",
+			Usage:   "score repos on posting regularity, duplicate content, and burstiness at /repos/:did/score and /repos/scores",
+			EnvVars: []string{"LG_BOT_SCORING"},
+		},
+		&cli.IntFlag{
+			Name:    "backfill-workers",
+			Usage:   "number of workers backfilling the full history of repos seen on the firehose (0 disables backfill)",
+			Value:   0,
+			EnvVars: []string{"LG_BACKFILL_WORKERS"},
+		},
+		&cli.IntFlag{
+			Name:    "port",
+			Usage:   "port to serve the http server on",
+			Value:   8080,
+			EnvVars: []string{"LG_PORT"},
+		},
+		&cli.BoolFlag{
+			Name:    "debug",
+			Usage:   "enable debug logging",
+			Value:   false,
+			EnvVars: []string{"LG_DEBUG"},
+		},
+		&cli.StringFlag{
+			Name:    "dual-write-dsn",
+			Usage:   "Postgres connection string to also write events, records, and identities to while cutting over with migrate-storage",
+			EnvVars: []string{"LG_DUAL_WRITE_DSN"},
+		},
+		&cli.StringFlag{
+			Name:    "sqlite-path",
+			Usage:   "path to the sqlite database",
+			Value:   "/data/looking-glass.db",
+			EnvVars: []string{"LG_SQLITE_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "db-driver",
+			Usage:   "database driver for the event and record store (sqlite or postgres)",
+			Value:   stream.DriverSQLite,
+			EnvVars: []string{"LG_DB_DRIVER"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "sinks",
+			Usage:   "outputs to write ingested data to (db, bigquery, parquet, kafka, nats), the others are also enabled by setting --bigquery-project-id, --parquet-dir, --kafka-brokers, or --nats-url",
+			Value:   cli.NewStringSlice("db"),
+			EnvVars: []string{"LG_SINKS"},
+		},
+		&cli.StringFlag{
+			Name:    "db-dsn",
+			Usage:   "database DSN, defaults to --sqlite-path when using the sqlite driver",
+			EnvVars: []string{"LG_DB_DSN"},
+		},
+		&cli.IntFlag{
+			Name:    "db-batch-size",
+			Usage:   "events and records written to the database per transaction (1 to write each as it arrives)",
+			Value:   1,
+			EnvVars: []string{"LG_DB_BATCH_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "db-batch-interval",
+			Usage:   "longest a partial database batch waits before being written",
+			Value:   100 * time.Millisecond,
+			EnvVars: []string{"LG_DB_BATCH_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:    "migrate-db",
+			Usage:   "run database migrations",
+			Value:   true,
+			EnvVars: []string{"LG_MIGRATE_DB"},
+		},
+		&cli.DurationFlag{
+			Name:    "evt-record-ttl",
+			Usage:   "time to live for events and records in the DB",
+			Value:   72 * time.Hour,
+			EnvVars: []string{"LG_EVT_RECORD_TTL"},
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-project-id",
+			Usage:   "Google Cloud project ID for BigQuery",
+			EnvVars: []string{"LG_BIGQUERY_PROJECT_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-dataset",
+			Usage:   "BigQuery dataset name",
+			EnvVars: []string{"LG_BIGQUERY_DATASET"},
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-table-prefix",
+			Usage:   "BigQuery table name prefix",
+			EnvVars: []string{"LG_BIGQUERY_TABLE_PREFIX"},
+			Value:   "records",
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-events-table",
+			Usage:   "BigQuery table firehose event metadata is exported to, partitioned by day (empty to skip exporting events)",
+			EnvVars: []string{"LG_BIGQUERY_EVENTS_TABLE"},
+			Value:   "events",
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-identities-table",
+			Usage:   "BigQuery table identity history is exported to, partitioned by day (empty to skip exporting identities)",
+			EnvVars: []string{"LG_BIGQUERY_IDENTITIES_TABLE"},
+			Value:   "identities",
+		},
+		&cli.BoolFlag{
+			Name:    "bigquery-legacy-inserter",
+			Usage:   "write to BigQuery with the legacy streaming inserter instead of the Storage Write API, which may duplicate rows across restarts",
+			EnvVars: []string{"LG_BIGQUERY_LEGACY_INSERTER"},
+		},
+		&cli.StringFlag{
+			Name:    "parquet-dir",
+			Usage:   "directory to write Parquet files of ingested records to",
+			EnvVars: []string{"LG_PARQUET_DIR"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "kafka-brokers",
+			Usage:   "Kafka broker addresses to publish ingested data to",
+			EnvVars: []string{"LG_KAFKA_BROKERS"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-records-topic",
+			Usage:   "Kafka topic records are published to",
+			Value:   "records",
+			EnvVars: []string{"LG_KAFKA_RECORDS_TOPIC"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-events-topic",
+			Usage:   "Kafka topic firehose event metadata is published to (empty to skip publishing events)",
+			Value:   "events",
+			EnvVars: []string{"LG_KAFKA_EVENTS_TOPIC"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-identities-topic",
+			Usage:   "Kafka topic identity history is published to (empty to skip publishing identities)",
+			Value:   "identities",
+			EnvVars: []string{"LG_KAFKA_IDENTITIES_TOPIC"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-format",
+			Usage:   "encoding of Kafka messages (json or avro)",
+			Value:   kafka.FormatJSON,
+			EnvVars: []string{"LG_KAFKA_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "kafka-schema-registry",
+			Usage:   "URL of the schema registry Avro schemas are registered with",
+			EnvVars: []string{"LG_KAFKA_SCHEMA_REGISTRY"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server URLs, comma separated, to publish ingested data to with JetStream",
+			EnvVars: []string{"LG_NATS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-stream",
+			Usage:   "JetStream stream to create or update to capture the published subjects (empty to use existing streams)",
+			EnvVars: []string{"LG_NATS_STREAM"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-records-subject",
+			Usage:   "subject template records are published to, with {collection}, {action}, and {repo} placeholders",
+			Value:   "atproto.records.{collection}",
+			EnvVars: []string{"LG_NATS_RECORDS_SUBJECT"},
+		},
+		&cli.StringFlag{
+			Name:    "nats-identities-subject",
+			Usage:   "subject template identities are published to, with a {did} placeholder (empty to skip publishing identities)",
+			Value:   "atproto.identities",
+			EnvVars: []string{"LG_NATS_IDENTITIES_SUBJECT"},
+		},
+		&cli.IntFlag{
+			Name:    "parquet-batch-size",
+			Usage:   "number of records to write to each Parquet file",
+			Value:   100_000,
+			EnvVars: []string{"LG_PARQUET_BATCH_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "parquet-max-wait",
+			Usage:   "maximum time to buffer records before writing a partial Parquet file",
+			Value:   5 * time.Minute,
+			EnvVars: []string{"LG_PARQUET_MAX_WAIT"},
+		},
+		&cli.StringFlag{
+			Name:    "parquet-schema",
+			Usage:   "schema of written Parquet files: v1 (raw JSON only) or v2 (adding event time, CID, rev, and parsed record fields)",
+			Value:   parq.SchemaV1,
+			EnvVars: []string{"LG_PARQUET_SCHEMA"},
+		},
+		&cli.BoolFlag{
+			Name:    "parquet-partition-by-collection",
+			Usage:   "write each collection's records to separate Parquet files named after the collection",
+			EnvVars: []string{"LG_PARQUET_PARTITION_BY_COLLECTION"},
+		},
+		&cli.StringFlag{
+			Name:    "parquet-upload-url",
+			Usage:   "s3://bucket/prefix, gs://bucket/prefix, or other storage URL to upload written Parquet files to, deleting them locally once uploaded",
+			EnvVars: []string{"LG_PARQUET_UPLOAD_URL"},
+		},
+		&cli.Int64Flag{
+			Name:    "override-cursor",
+			Usage:   "firehose sequence number to resume from, takes precedence over the stored cursor",
+			EnvVars: []string{"LG_OVERRIDE_CURSOR"},
+		},
+		&cli.StringFlag{
+			Name:    "start-from",
+			Usage:   "RFC3339 timestamp or duration to rewind (e.g. 2h) to resume from, takes precedence over the stored cursor",
+			EnvVars: []string{"LG_START_FROM"},
+		},
+		&cli.DurationFlag{
+			Name:    "replay-window",
+			Usage:   "how far behind the stored cursor to resume from on startup to cover unclean shutdowns, only the database sink is sent the replayed events",
+			EnvVars: []string{"LG_REPLAY_WINDOW"},
+		},
+		&cli.IntFlag{
+			Name:    "max-field-bytes",
+			Usage:   "maximum size of any single string or bytes field in a stored record, longer fields are truncated (0 for no limit)",
+			Value:   100_000,
+			EnvVars: []string{"LG_MAX_FIELD_BYTES"},
+		},
+		&cli.IntFlag{
+			Name:    "max-record-bytes",
+			Usage:   "maximum size of a stored record's raw JSON, larger records are stored as a stub (0 for no limit)",
+			Value:   1_000_000,
+			EnvVars: []string{"LG_MAX_RECORD_BYTES"},
+		},
+		&cli.IntFlag{
+			Name:    "compression-level",
+			Usage:   "gzip/deflate compression level for HTTP responses (1-9, -1 for default, 0 to disable)",
+			Value:   -1,
+			EnvVars: []string{"LG_COMPRESSION_LEVEL"},
+		},
+	}
+
+	app.Before = func(cctx *cli.Context) error {
+		path := cctx.String("config")
+		if path == "" {
+			return nil
+		}
+		if err := envfile.Load(path); err != nil {
+			return fmt.Errorf("failed to load config %q: %w", path, err)
+		}
+		return envfile.ApplyFlags(cctx, app.Flags)
+	}
+
+	app.Action = LookingGlass
+
+	app.Commands = []*cli.Command{
+		{
+			Name:  "migrate-storage",
+			Usage: "copy an existing SQLite looking glass database into Postgres",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "sqlite-path",
+					Usage:   "path to the SQLite database to copy from",
+					Value:   "/data/looking-glass.db",
+					EnvVars: []string{"LG_SQLITE_PATH"},
+				},
+				&cli.StringFlag{
+					Name:     "postgres-dsn",
+					Usage:    "connection string of the Postgres database to copy into",
+					Required: true,
+					EnvVars:  []string{"LG_DB_DSN"},
+				},
+				&cli.IntFlag{
+					Name:    "batch-size",
+					Usage:   "number of rows read from SQLite at a time",
+					Value:   5000,
+					EnvVars: []string{"LG_MIGRATE_BATCH_SIZE"},
+				},
+			},
+			Action: MigrateStorage,
+		},
+		{
+			Name:  "replay-deadletters",
+			Usage: "retry writing records the db sink failed to write, importing any spilled to disk first",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "sqlite-path",
+					Usage:   "path to the sqlite database",
+					Value:   "/data/looking-glass.db",
+					EnvVars: []string{"LG_SQLITE_PATH"},
+				},
+				&cli.StringFlag{
+					Name:    "db-driver",
+					Usage:   "database driver (sqlite or postgres)",
+					Value:   stream.DriverSQLite,
+					EnvVars: []string{"LG_DB_DRIVER"},
+				},
+				&cli.StringFlag{
+					Name:    "db-dsn",
+					Usage:   "database DSN, defaults to --sqlite-path when using the sqlite driver",
+					EnvVars: []string{"LG_DB_DSN"},
+				},
+				&cli.StringFlag{
+					Name:    "spill-path",
+					Usage:   "NDJSON file of spilled dead letters to import before replaying",
+					EnvVars: []string{"LG_DEADLETTER_SPILL_PATH"},
+				},
+				&cli.IntFlag{
+					Name:  "batch-size",
+					Usage: "number of dead letters replayed at a time",
+					Value: 500,
+				},
+			},
+			Action: ReplayDeadLetters,
+		},
+		{
+			Name:  "gen-alerts",
+			Usage: "print Prometheus alerting rules for the consumer as configured by its flags and environment",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "file to write the rules to, - for stdout",
+					Value: "-",
+				},
+				&cli.DurationFlag{
+					Name:  "for",
+					Usage: "how long a threshold must be exceeded before alerts fire",
+					Value: 5 * time.Minute,
+				},
+				&cli.DurationFlag{
+					Name:  "lag-threshold",
+					Usage: "how far behind the firehose the consumer may fall before alerting",
+					Value: 5 * time.Minute,
+				},
+				&cli.IntFlag{
+					Name:  "queue-depth-threshold",
+					Usage: "buffered rows or messages a BigQuery or Kafka sink may hold before alerting",
+					Value: 50_000,
+				},
+				&cli.BoolFlag{
+					Name:  "plc-mirror",
+					Usage: "include rules for a PLC mirror",
+				},
+				&cli.DurationFlag{
+					Name:  "plc-freshness-threshold",
+					Usage: "how long the PLC mirror may go without mirroring an op before alerting",
+					Value: 15 * time.Minute,
+				},
+			},
+			Action: GenAlerts,
+		},
+	}
+
+	return &app
+}
+
+var tracer = otel.Tracer("LookingGlass")
+
+// LookingGlass is the main function for the stream consumer
+func LookingGlass(cctx *cli.Context) error {
+	// Trap SIGINT and SIGTERM to trigger a shutdown
+	ctx, cancel := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Logging
+	logLevel := slog.LevelInfo
+	if cctx.Bool("debug") {
+		logLevel = slog.LevelDebug
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel, AddSource: true}))
+	slog.SetDefault(slog.New(logger.Handler()))
+
+	logger.Info("starting up")
+
+	// Registers a tracer Provider globally if the exporter endpoint is set
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		logger.Info("registering global tracer provider")
+		shutdown, err := tracing.InstallExportPipeline(ctx, "atp-looking-glass", 1)
+		if err != nil {
+			logger.Error("failed to install export pipeline", "error", err)
+			return err
+		}
+		defer func() {
+			if err := shutdown(ctx); err != nil {
+				logger.Error("failed to shutdown export pipeline", "error", err)
+			}
+		}()
+	}
+
+	sinks := map[string]bool{}
+	for _, name := range cctx.StringSlice("sinks") {
+		switch name {
+		case "db", "bigquery", "parquet", "kafka", "nats":
+			sinks[name] = true
+		default:
+			return fmt.Errorf("unknown sink %q", name)
+		}
+	}
+
+	if cctx.String("bigquery-project-id") != "" {
+		sinks["bigquery"] = true
+	}
+	if cctx.String("parquet-dir") != "" {
+		sinks["parquet"] = true
+	}
+	if len(cctx.StringSlice("kafka-brokers")) > 0 {
+		sinks["kafka"] = true
+	}
+	if cctx.String("nats-url") != "" {
+		sinks["nats"] = true
+	}
+
+	var bqInstance *bq.BQ
+	var err error
+
+	if sinks["bigquery"] {
+		if cctx.String("bigquery-project-id") == "" {
+			return fmt.Errorf("the bigquery sink requires --bigquery-project-id")
+		}
+		logger.Info("bigquery sink enabled, starting bigquery client")
+		bqInstance, err = bq.NewBQ(
+			ctx,
+			cctx.String("bigquery-project-id"),
+			cctx.String("bigquery-dataset"),
+			cctx.String("bigquery-table-prefix"),
+			cctx.String("bigquery-events-table"),
+			cctx.String("bigquery-identities-table"),
+			logger,
+			clock.Real,
+		)
+		if err != nil {
+			logger.Error("failed to create bigquery client", "error", err)
+			return err
+		}
+		defer func() {
+			if err := bqInstance.Close(); err != nil {
+				logger.Error("failed to close bigquery client", "error", err)
+			}
+		}()
+	}
+
+	var parqInstance *parq.Parq
+	if sinks["parquet"] {
+		if cctx.String("parquet-dir") == "" {
+			return fmt.Errorf("the parquet sink requires --parquet-dir")
+		}
+		logger.Info("parquet sink enabled", "dir", cctx.String("parquet-dir"))
+		parqInstance, err = parq.NewParq(
+			ctx,
+			cctx.String("parquet-dir"),
+			cctx.Int("parquet-batch-size"),
+			cctx.Duration("parquet-max-wait"),
+			logger,
+			clock.Real,
+		)
+		if err != nil {
+			logger.Error("failed to create parquet writer", "error", err)
+			return err
+		}
+		parqInstance.PartitionByCollection = cctx.Bool("parquet-partition-by-collection")
+
+		switch schema := cctx.String("parquet-schema"); schema {
+		case parq.SchemaV1, parq.SchemaV2:
+			parqInstance.Schema = schema
+		default:
+			return fmt.Errorf("invalid parquet-schema %q, expected %s or %s", schema, parq.SchemaV1, parq.SchemaV2)
+		}
+	}
+
+	var parqUploadStore objstore.Store
+	if uploadURL := cctx.String("parquet-upload-url"); uploadURL != "" {
+		if parqInstance == nil {
+			return fmt.Errorf("--parquet-upload-url requires the parquet sink")
+		}
+		parqUploadStore, err = objstore.Open(ctx, uploadURL)
+		if err != nil {
+			logger.Error("failed to open parquet upload storage", "error", err)
+			return err
+		}
+	}
+
+	var kafkaInstance *kafka.Kafka
+	if sinks["kafka"] {
+		if len(cctx.StringSlice("kafka-brokers")) == 0 {
+			return fmt.Errorf("the kafka sink requires --kafka-brokers")
+		}
+		logger.Info("kafka sink enabled, starting kafka producer", "brokers", cctx.StringSlice("kafka-brokers"))
+		kafkaInstance, err = kafka.NewKafka(
+			ctx,
+			cctx.StringSlice("kafka-brokers"),
+			kafka.Topics{
+				Records:    cctx.String("kafka-records-topic"),
+				Events:     cctx.String("kafka-events-topic"),
+				Identities: cctx.String("kafka-identities-topic"),
+			},
+			cctx.String("kafka-format"),
+			cctx.String("kafka-schema-registry"),
+			logger,
+			clock.Real,
+		)
+		if err != nil {
+			logger.Error("failed to create kafka producer", "error", err)
+			return err
+		}
+	}
+
+	var natsInstance *nats.NATS
+	var natsSink *stream.NATSSink
+	if sinks["nats"] {
+		if cctx.String("nats-url") == "" {
+			return fmt.Errorf("the nats sink requires --nats-url")
+		}
+		recordsSubject, err := nats.ParseSubject(cctx.String("nats-records-subject"), stream.NATSRecordPlaceholders...)
+		if err != nil {
+			return fmt.Errorf("invalid nats-records-subject: %w", err)
+		}
+		subjects := []string{recordsSubject.Filter()}
+		var identitiesSubject *nats.Subject
+		if tmpl := cctx.String("nats-identities-subject"); tmpl != "" {
+			subject, err := nats.ParseSubject(tmpl, stream.NATSIdentityPlaceholders...)
+			if err != nil {
+				return fmt.Errorf("invalid nats-identities-subject: %w", err)
+			}
+			identitiesSubject = &subject
+			subjects = append(subjects, subject.Filter())
+		}
+
+		logger.Info("nats sink enabled, connecting to nats", "url", cctx.String("nats-url"))
+		natsInstance, err = nats.NewNATS(ctx, cctx.String("nats-url"), cctx.String("nats-stream"), subjects, logger)
+		if err != nil {
+			logger.Error("failed to create nats publisher", "error", err)
+			return err
+		}
+		defer func() {
+			if err := natsInstance.Close(); err != nil {
+				logger.Error("failed to close nats publisher", "error", err)
+			}
+		}()
+		natsSink = stream.NewNATSSink(natsInstance, recordsSubject, identitiesSubject, clock.Real)
+	}
+
+	dbDSN := cctx.String("db-dsn")
+	if dbDSN == "" && cctx.String("db-driver") == stream.DriverSQLite {
+		dbDSN = cctx.String("sqlite-path")
+	}
+
+	profile, err := network.Load(cctx.String("network"), cctx.String("network-config"))
+	if err != nil {
+		return err
+	}
+	logger.Info("using network profile", "network", profile.Name, "plc", profile.PLCHost)
+
+	wsURLs := cctx.StringSlice("ws-url")
+	if len(wsURLs) == 0 {
+		wsURLs = []string{profile.RelayURL}
+	}
+
+	s, err := stream.NewStream(
+		logger,
+		wsURLs[0],
+		profile,
+		cctx.String("db-driver"),
+		dbDSN,
+		cctx.Bool("migrate-db"),
+		cctx.Duration("evt-record-ttl"),
+	)
+	if err != nil {
+		logger.Error("failed to create stream", "error", err)
+		return err
+	}
+
+	for _, upstreamURL := range wsURLs[1:] {
+		if err := s.AddUpstream(upstreamURL); err != nil {
+			logger.Error("failed to add upstream", "error", err)
+			return err
+		}
+	}
+
+	if host := cctx.String("consistency-upstream"); host != "" {
+		if cctx.Duration("consistency-window") < time.Second {
+			return fmt.Errorf("consistency-window must be at least 1s")
+		}
+		if err := s.EnableConsistency(host, cctx.Duration("consistency-window")); err != nil {
+			logger.Error("failed to enable consistency checker", "error", err)
+			return err
+		}
+	}
+
+	if fallbackURL := cctx.String("ws-fallback-url"); fallbackURL != "" {
+		if err := s.AddFallbackRelay(fallbackURL); err != nil {
+			logger.Error("failed to add fallback relay", "error", err)
+			return err
+		}
+	}
+
+	switch mode := cctx.String("liveness-mode"); mode {
+	case stream.LivenessRestart, stream.LivenessWarn:
+		s.LivenessMode = mode
+	default:
+		return fmt.Errorf("invalid liveness-mode %q", mode)
+	}
+
+	if cctx.Duration("liveness-window") <= 0 {
+		return fmt.Errorf("liveness-window must be positive")
+	}
+
+	if cctx.Duration("shutdown-budget") <= 0 {
+		return fmt.Errorf("shutdown-budget must be positive")
+	}
+
+	switch policy := cctx.String("subscribe-drop-policy"); policy {
+	case stream.SubscribeDisconnect, stream.SubscribeDropNewest, stream.SubscribeDropOldest:
+		s.SubscribeDropPolicy = policy
+	default:
+		return fmt.Errorf("invalid subscribe-drop-policy %q", policy)
+	}
+
+	if cctx.Int("subscribe-buffer-size") < 1 {
+		return fmt.Errorf("subscribe-buffer-size must be at least 1")
+	}
+
+	if cctx.Int("event-cache-size") < 0 {
+		return fmt.Errorf("event-cache-size must not be negative")
+	}
+	s.SetEventCacheSize(cctx.Int("event-cache-size"))
+
+	if cctx.Int("at-uri-cache-size") < 0 {
+		return fmt.Errorf("at-uri-cache-size must not be negative")
+	}
+	s.SetLiveRecordCache(cctx.Int("at-uri-cache-size"), cctx.Duration("at-uri-cache-ttl"))
+
+	s.SubscribeBufferSize = cctx.Int("subscribe-buffer-size")
+	s.SubscribeMaxDrops = cctx.Int64("subscribe-max-drops")
+
+	if level := cctx.Int("subscribe-compression-level"); level < 1 || level > 9 {
+		return fmt.Errorf("subscribe-compression-level must be between 1 and 9")
+	}
+	s.SubscribeCompression = cctx.Bool("subscribe-compression")
+	s.SubscribeCompressionLevel = cctx.Int("subscribe-compression-level")
+	s.Dialer = stream.NewDialer(cctx.Bool("firehose-compression"))
+
+	if cctx.Bool("subscribe-zstd") {
+		var dict []byte
+		if path := cctx.String("subscribe-zstd-dictionary"); path != "" {
+			dict, err = os.ReadFile(path)
+			if err != nil {
+				logger.Error("failed to read zstd dictionary", "error", err)
+				return err
+			}
+		}
+		if err := s.EnableSubscribeZstd(dict); err != nil {
+			logger.Error("failed to enable zstd compression", "error", err)
+			return err
+		}
+	}
+
+	if cctx.Bool("search-index") {
+		logger.Info("enabling record search index")
+		if err := s.EnableSearch(ctx); err != nil {
+			logger.Error("failed to enable search", "error", err)
+			return err
+		}
+	}
+
+	if cctx.String("identity-export-path") != "" {
+		switch format := cctx.String("identity-export-format"); format {
+		case stream.IdentityExportCSV, stream.IdentityExportParquet:
+		default:
+			return fmt.Errorf("invalid identity-export-format %q", format)
+		}
+		if cctx.Duration("identity-export-interval") <= 0 {
+			return fmt.Errorf("identity-export-interval must be positive")
+		}
+	}
+
+	s.BackfillWorkers = cctx.Int("backfill-workers")
+	s.BotScoring = cctx.Bool("bot-scoring")
+	s.QuarantineRetention = cctx.Duration("quarantine-retention")
+	s.ScoreboardInterval = cctx.Duration("pds-scoreboard-interval")
+	s.ChurnWindow = cctx.Duration("churn-window")
+
+	s.SchedulerMode = cctx.String("scheduler")
+	s.SchedulerWorkers = cctx.Int("scheduler-workers")
+	s.SchedulerQueueDepth = cctx.Int("scheduler-queue-depth")
+	s.BackpressureLimit = cctx.Int("backpressure-limit")
+	if err := s.ValidateScheduler(); err != nil {
+		return err
+	}
+
+	if configPath := cctx.String("computed-fields"); configPath != "" {
+		fields, err := stream.LoadComputedFields(configPath)
+		if err != nil {
+			logger.Error("failed to load computed fields", "error", err)
+			return err
+		}
+		s.EnableComputedFields(fields)
+	}
+
+	if cctx.Int("repo-record-cap") < 0 {
+		return fmt.Errorf("repo-record-cap must not be negative")
+	}
+	s.RepoRecordCap = cctx.Int("repo-record-cap")
+
+	includeCollections := cctx.StringSlice("include-collections")
+	excludeCollections := cctx.StringSlice("exclude-collections")
+	includeDIDs := cctx.StringSlice("include-dids")
+	if len(includeCollections) > 0 || len(excludeCollections) > 0 || len(includeDIDs) > 0 {
+		if err := s.EnableRecordFilter(includeCollections, excludeCollections, includeDIDs); err != nil {
+			logger.Error("failed to set up record filter", "error", err)
+			return err
+		}
+		logger.Info("record filter enabled", "include_collections", includeCollections, "exclude_collections", excludeCollections, "include_dids", len(includeDIDs))
+	}
+
+	s.AdminToken = cctx.String("admin-token")
+	if err := s.EnableBlocklist(ctx); err != nil {
+		logger.Error("failed to load ingest blocks", "error", err)
+		return err
+	}
+
+	if spillPath := cctx.String("deadletter-spill-path"); spillPath != "" {
+		s.EnableDeadLetterSpill(spillPath)
+		logger.Info("dead letter spill enabled", "path", spillPath)
+	}
+
+	trackUsage := cctx.Bool("track-usage") || len(cctx.StringSlice("api-keys")) > 0
+	if trackUsage {
+		err := s.EnableUsageTracking(ctx, cctx.StringSlice("api-keys"), cctx.Bool("require-api-key"), cctx.Int64("api-key-daily-quota"))
+		if err != nil {
+			logger.Error("failed to enable usage tracking", "error", err)
+			return err
+		}
+	}
+
+	if cctx.Bool("actives") {
+		s.EnableActives(cctx.Duration("actives-retention"))
+	}
+
+	if configPath := cctx.String("config"); configPath != "" {
+		s.EnableReload(func() (stream.ReloadSettings, error) {
+			return reloadSettings(cctx, configPath)
+		})
+
+		// Reload on SIGHUP, which would otherwise stop the process
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				logger.Info("reloading settings", "config", configPath)
+				if err := s.Reload(); err != nil {
+					logger.Error("failed to reload settings", "error", err)
+				}
+			}
+		}()
+	}
+
+	var slowLog *slowlog.Log
+	if threshold := cctx.Duration("slow-query-threshold"); threshold > 0 {
+		slowLog = slowlog.New(threshold, 1000)
+		if err := s.UseSlowQueryLog(slowLog); err != nil {
+			logger.Error("failed to enable slow query log", "error", err)
+			return err
+		}
+	}
+
+	if dumpURL := cctx.String("dump-url"); dumpURL != "" {
+		for _, format := range cctx.StringSlice("dump-formats") {
+			switch format {
+			case stream.DumpFormatParquet, stream.DumpFormatJSONL:
+			default:
+				return fmt.Errorf("invalid dump-formats %q", format)
+			}
+		}
+		if len(cctx.StringSlice("dump-formats")) == 0 {
+			return fmt.Errorf("dump-formats must include at least one format")
+		}
+		if cctx.Duration("dump-interval") <= 0 {
+			return fmt.Errorf("dump-interval must be positive")
+		}
+
+		store, err := objstore.Open(ctx, dumpURL)
+		if err != nil {
+			logger.Error("failed to open dump storage", "error", err)
+			return err
+		}
+		s.DumpStore = store
+		s.DumpInterval = cctx.Duration("dump-interval")
+		s.DumpCollections = cctx.StringSlice("dump-collections")
+		s.DumpFormats = cctx.StringSlice("dump-formats")
+		s.DumpDeidentify = cctx.Bool("dump-deidentify")
+		s.DumpSaltRotation = cctx.Duration("dump-salt-rotation")
+	}
+
+	s.LivenessWindow = cctx.Duration("liveness-window")
+	s.LivenessMinProgress = cctx.Int64("liveness-min-progress")
+	s.LivenessMaxFailures = cctx.Int("liveness-max-failures")
+	if cctx.Duration("reconnect-max-backoff") < time.Second {
+		return fmt.Errorf("reconnect-max-backoff must be at least 1s")
+	}
+	s.ReconnectMaxBackoff = cctx.Duration("reconnect-max-backoff")
+
+	if cctx.Int64("gap-min-size") < 1 {
+		return fmt.Errorf("gap-min-size must be at least 1")
+	}
+	if cctx.Bool("gap-fill") && cctx.Int("backfill-workers") < 1 {
+		return fmt.Errorf("gap-fill requires backfill-workers")
+	}
+	s.GapMinSize = cctx.Int64("gap-min-size")
+	s.GapFill = cctx.Bool("gap-fill")
+	s.GapFillWindow = cctx.Duration("gap-fill-window")
+
+	if cctx.Duration("db-batch-interval") <= 0 {
+		return fmt.Errorf("db-batch-interval must be positive")
+	}
+	s.DBBatchSize = cctx.Int("db-batch-size")
+	s.DBBatchInterval = cctx.Duration("db-batch-interval")
+
+	if sinks["db"] {
+		s.AddSink(s.DBSink())
+	}
+	if dsn := cctx.String("dual-write-dsn"); dsn != "" {
+		if !sinks["db"] {
+			return fmt.Errorf("dual-write-dsn requires the db sink")
+		}
+		// The dual-write sink copies the IDs the db sink assigns, which batching defers
+		if s.DBBatchSize > 1 {
+			return fmt.Errorf("dual-write-dsn can't be combined with db-batch-size")
+		}
+		if err := s.AddDualWrite(stream.DriverPostgres, dsn); err != nil {
+			logger.Error("failed to add dual-write sink", "error", err)
+			return err
+		}
+	}
+	if bqInstance != nil {
+		if !cctx.Bool("bigquery-legacy-inserter") {
+			if err := s.UseBQStorageWrite(ctx, bqInstance); err != nil {
+				logger.Error("failed to enable bigquery storage write", "error", err)
+				return err
+			}
+		}
+		s.AddSink(stream.NewBQSink(bqInstance, clock.Real))
+	}
+	if parqInstance != nil {
+		s.AddSink(stream.NewParqSink(parqInstance, clock.Real))
+	}
+	if kafkaInstance != nil {
+		s.AddSink(stream.NewKafkaSink(kafkaInstance, clock.Real))
+	}
+	if natsSink != nil {
+		s.AddSink(natsSink)
+	}
+
+	if cctx.IsSet("override-cursor") {
+		seq := cctx.Int64("override-cursor")
+		s.CursorOverride = &seq
+	}
+
+	if startFrom := cctx.String("start-from"); startFrom != "" {
+		t, err := time.Parse(time.RFC3339, startFrom)
+		if err != nil {
+			rewind, durErr := time.ParseDuration(startFrom)
+			if durErr != nil {
+				logger.Error("failed to parse start-from as a timestamp or duration", "error", err)
+				return fmt.Errorf("invalid start-from %q: %w", startFrom, err)
+			}
+			t = time.Now().Add(-rewind)
+		}
+		s.StartFrom = t
+	}
+
+	s.ReplayWindow = cctx.Duration("replay-window")
+	s.MaxFieldBytes = cctx.Int("max-field-bytes")
+	s.MaxRecordBytes = cctx.Int("max-record-bytes")
+
+	lm := lifecycle.NewManager(logger)
+
+	// The stream's phases run as part of stopping it, and the http server is stopped after it so
+	// queries are served while the stream drains
+	lm.Budget = lifecycle.NewBudget(logger, cctx.Duration("shutdown-budget"),
+		append(slices.Clone(stream.ShutdownPhases), lifecycle.Phase{Name: "http_server", Share: 0.2})...)
+	s.ShutdownBudget = lm.Budget
+
+	e := echo.New()
+	e.HideBanner = true
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  []string{"*"},
+		AllowHeaders:  []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "If-None-Match"},
+		ExposeHeaders: []string{"ETag", version.Header},
+	}))
+	e.Use(version.Middleware())
+	e.Use(slogecho.New(logger))
+	e.Use(stream.MetricsMiddleware)
+	e.Use(s.UsageMiddleware)
+	e.Use(middleware.Recover())
+	if level := cctx.Int("compression-level"); level != 0 {
+		e.Use(httpcompress.Middleware(level))
+	}
+
+	// OpenMetrics is required for ingest latency exemplars to be exposed
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})))
+	e.GET("/records", s.HandleGetRecords)
+	e.GET("/records/search", s.HandleSearchRecords)
+	e.GET("/records/diff", s.HandleGetRecordDiff)
+	e.GET("/at/*", s.HandleGetAtURI)
+	e.GET("/events", s.HandleGetEvents)
+	e.GET("/events/:seq/records", s.HandleGetEventRecords)
+	e.GET("/identities", s.HandleGetIdentities)
+	e.GET("/accounts", s.HandleGetAccounts)
+	e.GET("/syncs", s.HandleGetSyncs)
+	e.GET("/stats/frames", s.HandleGetFrameStats)
+	e.GET("/stats/skew", s.HandleGetSkewStats)
+	e.GET("/stats/lint", s.HandleGetLintStats)
+	e.GET("/stats/rkeys", s.HandleGetRKeyStats)
+	e.GET("/stats/actives", s.HandleGetActives)
+	e.GET("/stats/churn", s.HandleGetChurnStats)
+	e.GET("/lints", s.HandleGetLints)
+	e.GET("/repos/:did/activity", s.HandleGetRepoActivity)
+	e.GET("/repos/:did/score", s.HandleGetRepoScore)
+	e.GET("/repos/scores", s.HandleGetRepoScores)
+	e.GET("/thread", s.HandleGetThread)
+	e.GET("/quarantine", s.HandleGetQuarantine)
+	e.GET("/deadletter", s.HandleGetDeadLetters)
+	e.GET("/gaps", s.HandleGetGaps)
+	e.GET("/pds/scoreboard", s.HandleGetScoreboard)
+	e.GET("/dumps", s.HandleGetDumps)
+	e.POST("/quarantine/:id/reprocess", s.HandleReprocessQuarantined)
+	e.GET("/subscribe", s.HandleSubscribe)
+	e.GET("/subscribe/dictionary", s.HandleGetSubscribeDictionary)
+	e.GET("/cursor", s.HandleGetCursor)
+	e.GET("/consistency", s.HandleGetConsistency)
+	e.GET("/about", s.HandleGetAbout)
+	e.GET("/backfill/status", s.HandleGetBackfillStatus)
+	e.GET("/admin/usage", s.HandleGetUsage)
+	e.GET("/admin/blocks", s.HandleGetBlocks)
+	e.POST("/admin/blocks", s.HandleAddBlock)
+	e.GET("/admin/blocks/audit", s.HandleGetBlockAudit)
+	e.POST("/admin/reload", s.HandleReload)
+	e.DELETE("/admin/blocks/:id", s.HandleDeleteBlock)
+	if slowLog != nil {
+		e.GET("/admin/slow-queries", slowLog.HandleGetSlowQueries, s.RequireAdmin)
+	}
+	e.GET("/_health", lm.HandleHealth)
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, "Looking Glass")
+	})
+	echopprof.Wrap(e)
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cctx.Int("port")),
+		Handler: e,
+	}
+
+	// Components are shut down in the reverse of the order they're added
+	if parqUploadStore != nil {
+		// Shut down after the stream has flushed its last file, which gets one final upload
+		lm.Add("parquet_upload", func(ctx context.Context) error {
+			return parqInstance.RunUploader(ctx, parqUploadStore)
+		}, func(ctx context.Context) error {
+			return parqInstance.UploadPending(ctx, parqUploadStore)
+		})
+	}
+	if bqInstance != nil {
+		// Added first so BigQuery is drained only once nothing else is writing to it
+		lm.Add("bigquery", func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}, bqInstance.Shutdown)
+	}
+	if kafkaInstance != nil {
+		// Likewise drained once nothing else is publishing to it
+		lm.Add("kafka", func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}, kafkaInstance.Shutdown)
+	}
+	if natsInstance != nil {
+		lm.Add("nats", func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}, natsInstance.Shutdown)
+	}
+
+	lm.Add("http_server", func(ctx context.Context) error {
+		logger.Info("http server listening on port", "source", "http_server", "port", cctx.Int("port"))
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			return fmt.Errorf("failed to start http server: %w", err)
+		}
+		return nil
+	}, httpServer.Shutdown)
+
+	if s.DBBatchSize > 1 && sinks["db"] {
+		// Keeps flushing until the stream has stopped, which writes the final batch itself
+		lm.Add("db_batches", s.RunDBBatches, nil)
+	}
+
+	lm.Add("stream", s.Start, nil)
+
+	// Reconnect, then rotate relays, then shut down if the firehose stops making progress
+	lm.Add("liveness_checker", s.RunLivenessChecker, nil)
+
+	if s.BackfillWorkers > 0 {
+		lm.Add("backfill", s.RunBackfill, nil)
+	}
+
+	if exportPath := cctx.String("identity-export-path"); exportPath != "" {
+		lm.Add("identity_export", func(ctx context.Context) error {
+			return s.RunIdentityExport(ctx, exportPath, cctx.String("identity-export-format"), cctx.Duration("identity-export-interval"))
+		}, nil)
+	}
+
+	if cctx.String("consistency-upstream") != "" {
+		lm.Add("consistency_checker", s.RunConsistencyChecker, nil)
+	}
+
+	if s.ScoreboardInterval > 0 {
+		lm.Add("pds_scoreboard", s.RunScoreboard, nil)
+	}
+
+	if s.DumpStore != nil {
+		lm.Add("dumps", s.RunDumps, nil)
+	}
+
+	if trackUsage {
+		lm.Add("usage", s.RunUsage, nil)
+	}
+
+	if cctx.Bool("actives") {
+		lm.Add("actives", s.RunActives, nil)
+	}
+
+	if s.RepoRecordCap > 0 {
+		lm.Add("repo_quota", s.RunRepoQuota, nil)
+	}
+
+	if publishURL := cctx.String("cursor-publish-url"); publishURL != "" {
+		lm.Add("cursor_publisher", func(ctx context.Context) error {
+			return s.RunCursorPublisher(ctx, publishURL, cctx.Duration("cursor-publish-interval"))
+		}, nil)
+	}
+
+	err = lm.Run(ctx)
+	if err != nil {
+		logger.Error("shut down due to component failure", "error", err)
+	}
+
+	logger.Info("shutdown complete")
+
+	return nil
+}
+
+// reloadSettings reads the stream's reloadable settings from its config file. Settings the file
+// leaves out keep the values the stream started with, and those it sets win over the environment,
+// as the file is what's edited before a reload.
+func reloadSettings(cctx *cli.Context, path string) (stream.ReloadSettings, error) {
+	rs := stream.ReloadSettings{
+		IncludeCollections:  cctx.StringSlice("include-collections"),
+		ExcludeCollections:  cctx.StringSlice("exclude-collections"),
+		IncludeDIDs:         cctx.StringSlice("include-dids"),
+		TTL:                 cctx.Duration("evt-record-ttl"),
+		QuarantineRetention: cctx.Duration("quarantine-retention"),
+		ActivesRetention:    cctx.Duration("actives-retention"),
+	}
+
+	vars, err := envfile.Read(path)
+	if err != nil {
+		return rs, fmt.Errorf("failed to read config %q: %w", path, err)
+	}
+
+	lists := map[string]*[]string{
+		"LG_INCLUDE_COLLECTIONS": &rs.IncludeCollections,
+		"LG_EXCLUDE_COLLECTIONS": &rs.ExcludeCollections,
+		"LG_INCLUDE_DIDS":        &rs.IncludeDIDs,
+	}
+	for env, dst := range lists {
+		if value, ok := vars[env]; ok {
+			*dst = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"LG_EVT_RECORD_TTL":       &rs.TTL,
+		"LG_QUARANTINE_RETENTION": &rs.QuarantineRetention,
+		"LG_ACTIVES_RETENTION":    &rs.ActivesRetention,
+	}
+	for env, dst := range durations {
+		if value, ok := vars[env]; ok {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return rs, fmt.Errorf("invalid %s: %w", env, err)
+			}
+			*dst = d
+		}
+	}
+
+	return rs, nil
+}
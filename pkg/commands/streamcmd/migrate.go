@@ -0,0 +1,50 @@
+package streamcmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ericvolp12/atproto.tools/pkg/stream"
+	"github.com/urfave/cli/v2"
+)
+
+// MigrateStorage copies a SQLite looking glass database into Postgres, failing if any table
+// ends up with fewer rows in Postgres than in SQLite
+func MigrateStorage(cctx *cli.Context) error {
+	ctx, cancel := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	if cctx.Int("batch-size") < 1 {
+		return fmt.Errorf("batch-size must be at least 1")
+	}
+
+	logger.Info("migrating storage", "sqlite_path", cctx.String("sqlite-path"))
+
+	results, err := stream.MigrateStorage(ctx, logger, cctx.String("sqlite-path"), cctx.String("postgres-dsn"), cctx.Int("batch-size"))
+	if err != nil {
+		logger.Error("failed to migrate storage", "error", err)
+		return err
+	}
+
+	unverified := 0
+	for _, tc := range results {
+		if !tc.Verified() {
+			unverified++
+			logger.Error("table verification failed", "table", tc.Table, "source", tc.Source, "missing", tc.Missing, "destination", tc.Destination)
+			continue
+		}
+		logger.Info("table verified", "table", tc.Table, "source", tc.Source, "destination", tc.Destination)
+	}
+
+	if unverified > 0 {
+		return fmt.Errorf("%d tables have rows missing from postgres", unverified)
+	}
+
+	logger.Info("storage migration complete")
+	return nil
+}
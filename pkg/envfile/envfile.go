@@ -0,0 +1,85 @@
+// Package envfile reads config files of KEY=VALUE lines naming the env vars command line flags
+// are read from, so a deployment's settings can live in one file that can be re-read later
+package envfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Read parses a file of KEY=VALUE lines, skipping blank lines and # comments. Keys may be
+// prefixed with export and values may be quoted, as in a shell script.
+func Read(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", n)
+		}
+		vars[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// Load sets env vars from a file. Vars already set in the environment win, so the file holds
+// defaults a deployment can override.
+func Load(path string) error {
+	vars, err := Read(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range vars {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("failed to set %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ApplyFlags sets flags that weren't given a value from their env vars. Flags read their env vars
+// when they're parsed, so this picks up vars a Before hook loaded afterwards.
+func ApplyFlags(cctx *cli.Context, flags []cli.Flag) error {
+	for _, flag := range flags {
+		envFlag, ok := flag.(cli.DocGenerationFlag)
+		if !ok || flag.IsSet() {
+			continue
+		}
+		for _, env := range envFlag.GetEnvVars() {
+			value, set := os.LookupEnv(env)
+			if !set {
+				continue
+			}
+			if err := cctx.Set(flag.Names()[0], value); err != nil {
+				return fmt.Errorf("invalid %s: %w", env, err)
+			}
+			break
+		}
+	}
+	return nil
+}
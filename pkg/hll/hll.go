@@ -0,0 +1,82 @@
+// Package hll implements HyperLogLog sketches for estimating the number of distinct strings in
+// a stream in constant space, with sketches that merge losslessly so they can be kept at a fine
+// granularity and rolled up when queried
+package hll
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Precision is the number of hash bits used to pick a register. 2^12 registers give a standard
+// error of about 1.6% in 4KiB.
+const Precision = 12
+
+// Registers is the number of registers, and bytes, in a sketch
+const Registers = 1 << Precision
+
+// Sketch is a HyperLogLog sketch
+type Sketch []byte
+
+// New returns an empty sketch
+func New() Sketch {
+	return make(Sketch, Registers)
+}
+
+// FromBytes loads a sketch serialized with Bytes
+func FromBytes(b []byte) (Sketch, error) {
+	if len(b) != Registers {
+		return nil, fmt.Errorf("sketch has %d registers, expected %d", len(b), Registers)
+	}
+	return Sketch(append([]byte(nil), b...)), nil
+}
+
+// Bytes serializes the sketch
+func (s Sketch) Bytes() []byte {
+	return []byte(s)
+}
+
+// Add adds a string to the sketch
+func (s Sketch) Add(v string) {
+	x := xxhash.Sum64String(v)
+	idx := x >> (64 - Precision)
+	// The rank is the position of the first set bit after the index bits, capped by a sentinel bit
+	rank := uint8(bits.LeadingZeros64(x<<Precision|1<<(Precision-1))) + 1
+	if rank > s[idx] {
+		s[idx] = rank
+	}
+}
+
+// Merge folds another sketch into this one, so it estimates the union of both
+func (s Sketch) Merge(other Sketch) {
+	for i, r := range other {
+		if r > s[i] {
+			s[i] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct strings added to the sketch
+func (s Sketch) Estimate() uint64 {
+	m := float64(Registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	var sum float64
+	var zeros int
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
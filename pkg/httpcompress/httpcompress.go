@@ -0,0 +1,156 @@
+package httpcompress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware compresses responses with gzip or deflate based on the request's
+// Accept-Encoding. Compressed output is flushed through on Flush so streaming
+// responses keep working, and SSE and websocket responses are left alone.
+func Middleware(level int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method == http.MethodHead ||
+				strings.EqualFold(req.Header.Get(echo.HeaderUpgrade), "websocket") ||
+				strings.Contains(req.Header.Get(echo.HeaderAccept), "text/event-stream") {
+				return next(c)
+			}
+
+			encoding := negotiate(req.Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" {
+				return next(c)
+			}
+
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			cw := &compressWriter{
+				ResponseWriter: res.Writer,
+				encoding:       encoding,
+				level:          level,
+			}
+			res.Writer = cw
+			defer func() {
+				if err := cw.Close(); err != nil {
+					c.Logger().Errorf("failed to close compressed response: %v", err)
+				}
+				res.Writer = cw.ResponseWriter
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+// negotiate picks the encoding to use, preferring gzip over deflate
+func negotiate(acceptEncoding string) string {
+	gzipOK, deflateOK := false, false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			gzipOK = true
+		case "deflate":
+			deflateOK = true
+		}
+	}
+
+	switch {
+	case gzipOK:
+		return "gzip"
+	case deflateOK:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter lazily starts compressing once it knows the response has a body
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+
+	wroteHeader bool
+	compressor  flushWriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.ResponseWriter.Header()
+	bodyless := code == http.StatusNoContent || code == http.StatusNotModified || code < http.StatusOK
+	alreadyEncoded := h.Get(echo.HeaderContentEncoding) != ""
+	sse := strings.HasPrefix(h.Get(echo.HeaderContentType), "text/event-stream")
+
+	if !bodyless && !alreadyEncoded && !sse {
+		h.Set(echo.HeaderContentEncoding, w.encoding)
+		h.Del(echo.HeaderContentLength)
+
+		var err error
+		switch w.encoding {
+		case "gzip":
+			w.compressor, err = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+		case "deflate":
+			w.compressor, err = flate.NewWriter(w.ResponseWriter, w.level)
+		}
+		if err != nil {
+			// Fall back to an uncompressed response on a bad level
+			h.Del(echo.HeaderContentEncoding)
+			w.compressor = nil
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get(echo.HeaderContentType) == "" {
+			w.Header().Set(echo.HeaderContentType, http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compressor == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.compressor.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Close() error {
+	if w.compressor == nil {
+		return nil
+	}
+	return w.compressor.Close()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,268 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/segmentio/kafka-go"
+)
+
+// Message encodings
+const (
+	FormatJSON = "json"
+	FormatAvro = "avro"
+)
+
+// publishBatchSize caps how many messages are written to the brokers at once
+const publishBatchSize = 10_000
+
+// ErrClosed is returned for messages published once the producer has started shutting down
+var ErrClosed = errors.New("kafka producer is shutting down")
+
+// Topics are the topics each kind of message is published to, empty to skip publishing it
+type Topics struct {
+	Records    string
+	Events     string
+	Identities string
+}
+
+type Kafka struct {
+	logger *slog.Logger
+	writer *kafka.Writer
+	topics Topics
+	format string
+
+	// schemaIDs are the registered Avro schema of each topic
+	schemaIDs map[string]int32
+
+	buf chan kafka.Message
+
+	// intakeLk is held to buffer messages, and locked exclusively to stop intake
+	intakeLk sync.RWMutex
+	closed   bool
+	// publishLk serializes writes to the brokers so a flush waits out the routine's
+	publishLk sync.Mutex
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	clock clock.Clock
+}
+
+// NewKafka creates a producer publishing to the given brokers, keyed by repo DID so each repo's
+// messages land on the same partition in order. Avro messages have their schemas registered with
+// the schema registry at registryURL under the topic's value subject.
+func NewKafka(
+	ctx context.Context,
+	brokers []string,
+	topics Topics,
+	format string,
+	registryURL string,
+	logger *slog.Logger,
+	clk clock.Clock,
+) (*Kafka, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no kafka brokers given")
+	}
+
+	k := &Kafka{
+		logger: logger,
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(brokers...),
+			// Murmur2 matches the default partitioner of the Java client, so consumers can find a
+			// repo's partition the same way
+			Balancer:     &kafka.Murmur2Balancer{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    1000,
+			BatchTimeout: 100 * time.Millisecond,
+			Compression:  kafka.Zstd,
+		},
+		topics:    topics,
+		format:    format,
+		schemaIDs: make(map[string]int32),
+		buf:       make(chan kafka.Message, 100_000),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		clock:     clk,
+	}
+
+	switch format {
+	case FormatJSON:
+	case FormatAvro:
+		if registryURL == "" {
+			return nil, fmt.Errorf("avro messages require a schema registry")
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		schemas := map[string]string{
+			topics.Records:    recordSchema,
+			topics.Events:     eventSchema,
+			topics.Identities: identitySchema,
+		}
+		for topic, schema := range schemas {
+			if topic == "" {
+				continue
+			}
+			id, err := registerSchema(ctx, client, registryURL, topic+"-value", schema)
+			if err != nil {
+				return nil, err
+			}
+			k.schemaIDs[topic] = id
+		}
+	default:
+		return nil, fmt.Errorf("unknown kafka message format %q", format)
+	}
+
+	// Start a routine to publish buffered messages every second, until Shutdown takes over
+	// draining the buffer
+	publishCtx := context.WithoutCancel(ctx)
+	go func() {
+		defer close(k.stopped)
+		t := clk.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-k.stop:
+				return
+			case <-t.C():
+				if err := k.publish(publishCtx); err != nil {
+					logger.Error("failed to publish messages", "error", err)
+				}
+			}
+		}
+	}()
+
+	return k, nil
+}
+
+// PublishesEvents reports whether events are published
+func (k *Kafka) PublishesEvents() bool {
+	return k.topics.Events != ""
+}
+
+// PublishesIdentities reports whether identities are published
+func (k *Kafka) PublishesIdentities() bool {
+	return k.topics.Identities != ""
+}
+
+func (k *Kafka) PublishRecord(ctx context.Context, record *Record) error {
+	return k.enqueue(k.topics.Records, record.Repo, record)
+}
+
+// PublishEvent buffers a firehose event's metadata, if events are published
+func (k *Kafka) PublishEvent(ctx context.Context, event *Event) error {
+	return k.enqueue(k.topics.Events, event.Repo, event)
+}
+
+// PublishIdentity buffers a DID's resolved identity, if identities are published
+func (k *Kafka) PublishIdentity(ctx context.Context, identity *Identity) error {
+	return k.enqueue(k.topics.Identities, identity.DID, identity)
+}
+
+func (k *Kafka) enqueue(topic, key string, msg avroEncodable) error {
+	if topic == "" {
+		return nil
+	}
+
+	var value []byte
+	if k.format == FormatAvro {
+		value = encodeAvro(k.schemaIDs[topic], msg)
+	} else {
+		var err error
+		if value, err = json.Marshal(msg); err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+	}
+
+	k.intakeLk.RLock()
+	defer k.intakeLk.RUnlock()
+	if k.closed {
+		return ErrClosed
+	}
+
+	k.buf <- kafka.Message{Topic: topic, Key: []byte(key), Value: value}
+
+	messagesProcessed.WithLabelValues(topic).Inc()
+	queueDepth.Inc()
+	return nil
+}
+
+// Flush publishes all buffered messages
+func (k *Kafka) Flush(ctx context.Context) error {
+	for len(k.buf) > 0 {
+		if err := k.publish(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish writes up to a batch of buffered messages to the brokers
+func (k *Kafka) publish(ctx context.Context) error {
+	k.publishLk.Lock()
+	defer k.publishLk.Unlock()
+
+	msgs := make([]kafka.Message, 0, publishBatchSize)
+drain:
+	for len(msgs) < publishBatchSize {
+		select {
+		case msg := <-k.buf:
+			msgs = append(msgs, msg)
+			queueDepth.Dec()
+		default:
+			break drain
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	start := k.clock.Now()
+	defer func() {
+		batchSubmissionDuration.Observe(float64(k.clock.Since(start).Milliseconds()))
+		batchSizeHist.Observe(float64(len(msgs)))
+	}()
+
+	if err := k.writer.WriteMessages(ctx, msgs...); err != nil {
+		publishErrors.Inc()
+		return fmt.Errorf("failed to write messages: %w", err)
+	}
+	return nil
+}
+
+// Shutdown stops accepting messages, publishes everything still buffered, and then closes the
+// writer. Only the first call does anything, later ones return its result.
+func (k *Kafka) Shutdown(ctx context.Context) error {
+	k.shutdownOnce.Do(func() {
+		k.shutdownErr = k.shutdown(ctx)
+	})
+	return k.shutdownErr
+}
+
+func (k *Kafka) shutdown(ctx context.Context) error {
+	k.intakeLk.Lock()
+	k.closed = true
+	k.intakeLk.Unlock()
+
+	close(k.stop)
+	<-k.stopped
+
+	k.logger.Info("draining buffered messages", "messages", len(k.buf))
+
+	flushErr := k.Flush(ctx)
+	if flushErr != nil {
+		flushErr = fmt.Errorf("failed to drain buffered messages: %w", flushErr)
+	}
+
+	return errors.Join(flushErr, k.writer.Close())
+}
@@ -0,0 +1,35 @@
+package kafka
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "kafka")
+
+var queueDepth = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "kafka_queue_depth",
+	Help: "The current depth of the Kafka message buffer",
+})
+
+var messagesProcessed = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "kafka_messages_processed",
+	Help: "The number of messages buffered for publishing",
+}, []string{"topic"})
+
+var publishErrors = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "kafka_publish_errors_total",
+	Help: "The number of batches of messages that failed to publish",
+})
+
+var batchSubmissionDuration = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "kafka_batch_submission_duration",
+	Help:    "The duration of time it takes to publish a batch of messages",
+	Buckets: prometheus.DefBuckets,
+})
+
+var batchSizeHist = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "kafka_batch_size",
+	Help:    "The size of a batch of messages published",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 20),
+})
@@ -0,0 +1,126 @@
+package kafka
+
+import "time"
+
+// Record is a record op, keyed by its repo
+type Record struct {
+	CreatedAt time.Time `json:"created_at"`
+
+	FirehoseSeq int64   `json:"firehose_seq"`
+	Repo        string  `json:"repo"`
+	Collection  string  `json:"collection"`
+	RKey        string  `json:"r_key"`
+	Action      string  `json:"action"`
+	Raw         *string `json:"raw,omitempty"` // Raw JSON of the record, nil for deletes
+
+	Error string `json:"error,omitempty"`
+}
+
+// Event is a firehose event's metadata, keyed by its repo
+type Event struct {
+	CreatedAt time.Time `json:"created_at"`
+
+	FirehoseSeq int64     `json:"firehose_seq"`
+	Repo        string    `json:"repo"`
+	EventType   string    `json:"event_type"`
+	Time        time.Time `json:"time"`
+	Since       *string   `json:"since,omitempty"`
+
+	Creates     int64    `json:"creates"`
+	Updates     int64    `json:"updates"`
+	Deletes     int64    `json:"deletes"`
+	Collections []string `json:"collections"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Identity is a DID's identity as resolved at CreatedAt, keyed by the DID
+type Identity struct {
+	CreatedAt time.Time `json:"created_at"`
+
+	DID    string `json:"did"`
+	Handle string `json:"handle"`
+	PDS    string `json:"pds"`
+	Status string `json:"status"`
+}
+
+const recordSchema = `{
+	"type": "record",
+	"name": "Record",
+	"namespace": "tools.atproto.lookingglass",
+	"fields": [
+		{"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "firehose_seq", "type": "long"},
+		{"name": "repo", "type": "string"},
+		{"name": "collection", "type": "string"},
+		{"name": "r_key", "type": "string"},
+		{"name": "action", "type": "string"},
+		{"name": "raw", "type": ["null", "string"], "default": null},
+		{"name": "error", "type": "string"}
+	]
+}`
+
+func (r *Record) encodeAvro(w *avroWriter) {
+	w.timestamp(r.CreatedAt)
+	w.long(r.FirehoseSeq)
+	w.string(r.Repo)
+	w.string(r.Collection)
+	w.string(r.RKey)
+	w.string(r.Action)
+	w.optionalString(r.Raw)
+	w.string(r.Error)
+}
+
+const eventSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "tools.atproto.lookingglass",
+	"fields": [
+		{"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "firehose_seq", "type": "long"},
+		{"name": "repo", "type": "string"},
+		{"name": "event_type", "type": "string"},
+		{"name": "time", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "since", "type": ["null", "string"], "default": null},
+		{"name": "creates", "type": "long"},
+		{"name": "updates", "type": "long"},
+		{"name": "deletes", "type": "long"},
+		{"name": "collections", "type": {"type": "array", "items": "string"}},
+		{"name": "error", "type": "string"}
+	]
+}`
+
+func (e *Event) encodeAvro(w *avroWriter) {
+	w.timestamp(e.CreatedAt)
+	w.long(e.FirehoseSeq)
+	w.string(e.Repo)
+	w.string(e.EventType)
+	w.timestamp(e.Time)
+	w.optionalString(e.Since)
+	w.long(e.Creates)
+	w.long(e.Updates)
+	w.long(e.Deletes)
+	w.stringArray(e.Collections)
+	w.string(e.Error)
+}
+
+const identitySchema = `{
+	"type": "record",
+	"name": "Identity",
+	"namespace": "tools.atproto.lookingglass",
+	"fields": [
+		{"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "did", "type": "string"},
+		{"name": "handle", "type": "string"},
+		{"name": "pds", "type": "string"},
+		{"name": "status", "type": "string"}
+	]
+}`
+
+func (i *Identity) encodeAvro(w *avroWriter) {
+	w.timestamp(i.CreatedAt)
+	w.string(i.DID)
+	w.string(i.Handle)
+	w.string(i.PDS)
+	w.string(i.Status)
+}
@@ -0,0 +1,111 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Phase is a named step of shutdown and the share of the budget reserved for it
+type Phase struct {
+	Name  string
+	Share float64
+}
+
+// Budget apportions a total shutdown time across phases. A phase may use its own share plus
+// whatever the phases before it left unspent, but never the shares reserved for phases that
+// haven't run yet, so a slow scheduler drain can't leave nothing for flushing sinks.
+type Budget struct {
+	logger *slog.Logger
+	total  time.Duration
+	phases []Phase
+
+	startOnce sync.Once
+	deadline  time.Time
+
+	lk  sync.Mutex
+	ran map[string]bool
+}
+
+// NewBudget creates a budget of total split across phases by their shares, which are
+// normalized so they needn't sum to 1
+func NewBudget(logger *slog.Logger, total time.Duration, phases ...Phase) *Budget {
+	return &Budget{
+		logger: logger.With("source", "shutdown"),
+		total:  total,
+		phases: phases,
+		ran:    make(map[string]bool),
+	}
+}
+
+// Begin starts the budget's clock. It's called when shutdown starts, later calls do nothing.
+func (b *Budget) Begin() {
+	b.startOnce.Do(func() {
+		b.deadline = time.Now().Add(b.total)
+		b.logger.Info("shutting down", "budget", b.total)
+	})
+}
+
+// Remaining is how much of the budget is left, starting the clock if it hasn't been
+func (b *Budget) Remaining() time.Duration {
+	b.Begin()
+	return max(time.Until(b.deadline), 0)
+}
+
+// Has reports whether name is one of the budget's phases
+func (b *Budget) Has(name string) bool {
+	for _, p := range b.phases {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowance is how long the named phase may run: the time remaining less the shares of the
+// phases still to come. Names that aren't phases reserve nothing and may use all of it.
+func (b *Budget) allowance(name string) time.Duration {
+	remaining := b.Remaining()
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	var total, reserved float64
+	for _, p := range b.phases {
+		total += p.Share
+		if p.Name != name && !b.ran[p.Name] {
+			reserved += p.Share
+		}
+	}
+	b.ran[name] = true
+
+	if total == 0 {
+		return remaining
+	}
+	return max(remaining-time.Duration(float64(b.total)*reserved/total), 0)
+}
+
+// Run runs a shutdown phase with a context bounded by its allowance, logging how long it took
+// and whether it gave up with data left behind. fn should return an error describing what it
+// abandoned if its context ends before it's done.
+func (b *Budget) Run(name string, fn func(ctx context.Context) error) error {
+	allowance := b.allowance(name)
+	logger := b.logger.With("phase", name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), allowance)
+	defer cancel()
+
+	start := time.Now()
+	err := fn(ctx)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		logger.Error("shutdown phase abandoned data", "elapsed", elapsed, "allowance", allowance, "abandoned", true, "error", err)
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	logger.Info("shutdown phase complete", "elapsed", elapsed, "allowance", allowance, "abandoned", false)
+	return nil
+}
@@ -0,0 +1,226 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+// RunFunc runs a component until its context is cancelled or it fails
+type RunFunc func(ctx context.Context) error
+
+// ShutdownFunc asks a component to stop, returning once it has
+type ShutdownFunc func(ctx context.Context) error
+
+// Status is the lifecycle state of a component
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusRunning  Status = "running"
+	StatusStopping Status = "stopping"
+	StatusStopped  Status = "stopped"
+	StatusFailed   Status = "failed"
+)
+
+type component struct {
+	name     string
+	run      RunFunc
+	shutdown ShutdownFunc
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	status Status
+	err    error
+}
+
+// Manager runs a set of named components, shutting all of them down in reverse
+// order once any of them exits or the parent context is cancelled
+type Manager struct {
+	logger *slog.Logger
+
+	// Budget bounds how long shutdown may take in total. Components named after one of its
+	// phases get that phase's share, others may use whatever is left.
+	Budget *Budget
+
+	components []*component
+	lk         sync.RWMutex
+}
+
+func NewManager(logger *slog.Logger) *Manager {
+	return &Manager{
+		logger: logger.With("source", "lifecycle"),
+		Budget: NewBudget(logger, 30*time.Second),
+	}
+}
+
+// Add registers a component. Components are started in the order they're added
+// and shut down in reverse. shutdown may be nil if cancelling the run context is enough.
+func (m *Manager) Add(name string, run RunFunc, shutdown ShutdownFunc) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.components = append(m.components, &component{
+		name:     name,
+		run:      run,
+		shutdown: shutdown,
+		done:     make(chan struct{}),
+		status:   StatusPending,
+	})
+}
+
+func (m *Manager) setStatus(c *component, status Status, err error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	// Don't let a clean exit during shutdown mask an earlier failure
+	if c.status == StatusFailed {
+		return
+	}
+	c.status = status
+	c.err = err
+}
+
+// Run starts all components and blocks until they've all shut down,
+// returning the first error any of them returned
+func (m *Manager) Run(ctx context.Context) error {
+	m.lk.RLock()
+	components := make([]*component, len(m.components))
+	copy(components, m.components)
+	m.lk.RUnlock()
+
+	var g errgroup.Group
+	exited := make(chan string, len(components))
+
+	for _, c := range components {
+		c := c
+		cctx, cancel := context.WithCancel(context.Background())
+		c.cancel = cancel
+
+		m.setStatus(c, StatusRunning, nil)
+		m.logger.Info("starting component", "component", c.name)
+
+		g.Go(func() error {
+			defer close(c.done)
+			err := c.run(cctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				m.logger.Error("component failed", "component", c.name, "error", err)
+				m.setStatus(c, StatusFailed, err)
+				exited <- c.name
+				return fmt.Errorf("%s: %w", c.name, err)
+			}
+			m.logger.Info("component exited", "component", c.name)
+			m.setStatus(c, StatusStopped, nil)
+			exited <- c.name
+			return nil
+		})
+	}
+
+	select {
+	case <-ctx.Done():
+		m.logger.Info("context cancelled, shutting down")
+	case name := <-exited:
+		m.logger.Info("component exited, shutting down", "component", name)
+	}
+
+	m.Budget.Begin()
+
+	for i := len(components) - 1; i >= 0; i-- {
+		m.stop(components[i])
+	}
+
+	return g.Wait()
+}
+
+func (m *Manager) stop(c *component) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	logger := m.logger.With("component", c.name)
+	logger.Info("shutting down component")
+	m.setStatus(c, StatusStopping, nil)
+	start := time.Now()
+
+	stop := func(ctx context.Context) error {
+		if c.shutdown != nil {
+			if err := c.shutdown(ctx); err != nil {
+				logger.Error("failed to shut down component", "error", err)
+			}
+		}
+		c.cancel()
+
+		select {
+		case <-c.done:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("component still running: %w", ctx.Err())
+		}
+	}
+
+	// Components that are phases of the budget log their own progress
+	if m.Budget.Has(c.name) {
+		m.Budget.Run(c.name, stop)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Budget.Remaining())
+	defer cancel()
+
+	if err := stop(ctx); err != nil {
+		logger.Error("timed out waiting for component to shut down", "elapsed", time.Since(start))
+		return
+	}
+	logger.Info("component shut down", "elapsed", time.Since(start))
+}
+
+// ComponentHealth is the reported state of a single component
+type ComponentHealth struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Healthy    bool                       `json:"healthy"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// Health returns the state of every component
+func (m *Manager) Health() HealthResponse {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	resp := HealthResponse{
+		Healthy:    true,
+		Components: make(map[string]ComponentHealth, len(m.components)),
+	}
+	for _, c := range m.components {
+		h := ComponentHealth{Status: c.status}
+		if c.err != nil {
+			h.Error = c.err.Error()
+		}
+		if c.status != StatusRunning {
+			resp.Healthy = false
+		}
+		resp.Components[c.name] = h
+	}
+
+	return resp
+}
+
+// HandleHealth handles the GET /_health endpoint
+func (m *Manager) HandleHealth(c echo.Context) error {
+	resp := m.Health()
+	if !resp.Healthy {
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
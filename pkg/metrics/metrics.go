@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Namespaces for each service's collectors
+const (
+	LookingGlass = "lookingglass"
+	PLCMirror    = "plcmirror"
+)
+
+// Instance is the value of the "instance" label on every collector.
+// Collectors are registered at init, so it's read from METRICS_INSTANCE
+// (falling back to the hostname) rather than a flag.
+var Instance = instanceName()
+
+func instanceName() string {
+	if instance := os.Getenv("METRICS_INSTANCE"); instance != "" {
+		return instance
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// Factory registers collectors under a namespace with the common instance and source labels
+type Factory struct {
+	namespace string
+	source    string
+}
+
+// NewFactory creates a Factory for collectors in the given namespace, labeled with
+// the source (the package or subsystem) they come from
+func NewFactory(namespace, source string) Factory {
+	return Factory{
+		namespace: namespace,
+		source:    source,
+	}
+}
+
+func (f Factory) constLabels(labels prometheus.Labels) prometheus.Labels {
+	merged := prometheus.Labels{
+		"instance": Instance,
+		"source":   f.source,
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (f Factory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewCounter(opts)
+}
+
+func (f Factory) NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewCounterVec(opts, labelNames)
+}
+
+func (f Factory) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewGauge(opts)
+}
+
+func (f Factory) NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewGaugeVec(opts, labelNames)
+}
+
+func (f Factory) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewHistogram(opts)
+}
+
+func (f Factory) NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
+	opts.Namespace = f.namespace
+	opts.ConstLabels = f.constLabels(opts.ConstLabels)
+	return promauto.NewHistogramVec(opts, labelNames)
+}
@@ -0,0 +1,18 @@
+package nats
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "nats")
+
+var messagesPublished = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "nats_messages_published_total",
+	Help: "The number of messages published to JetStream",
+})
+
+var publishErrors = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "nats_publish_errors_total",
+	Help: "The number of messages that failed to publish or weren't acked",
+})
@@ -0,0 +1,196 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// maxPending caps how many publishes may await acks before publishing blocks
+const maxPending = 10_000
+
+// ErrClosed is returned for messages published once the publisher has started shutting down
+var ErrClosed = errors.New("nats publisher is shutting down")
+
+// Subject is a subject template, with {placeholders} filled in from each message's fields
+type Subject struct {
+	template string
+}
+
+// ParseSubject parses a subject template such as atproto.records.{collection}. Placeholders fill
+// in whole tokens or parts of them, and values containing dots (like collection NSIDs) span
+// several tokens, so consumers can subscribe with wildcards like atproto.records.app.bsky.feed.>
+func ParseSubject(template string, placeholders ...string) (Subject, error) {
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return Subject{}, fmt.Errorf("subject %q has an unclosed placeholder", template)
+		}
+		name := rest[start+1 : start+end]
+		if !slices.Contains(placeholders, name) {
+			return Subject{}, fmt.Errorf("subject %q has unknown placeholder {%s}, expected one of %s", template, name, strings.Join(placeholders, ", "))
+		}
+		rest = rest[start+end+1:]
+	}
+	if strings.ContainsAny(template, " \t*>") || strings.Contains(template, "..") || strings.HasPrefix(template, ".") || strings.HasSuffix(template, ".") {
+		return Subject{}, fmt.Errorf("subject %q isn't a valid subject", template)
+	}
+	return Subject{template: template}, nil
+}
+
+// Render fills in the subject's placeholders, replacing characters not allowed in subjects
+func (s Subject) Render(values map[string]string) string {
+	out := s.template
+	for name, v := range values {
+		v = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '*', '>':
+				return '_'
+			}
+			return r
+		}, v)
+		out = strings.ReplaceAll(out, "{"+name+"}", v)
+	}
+	return out
+}
+
+// Filter is the subject filter matching every subject the template renders to, its literal
+// tokens followed by > from the first placeholder on
+func (s Subject) Filter() string {
+	tokens := strings.Split(s.template, ".")
+	for i, tok := range tokens {
+		if strings.Contains(tok, "{") {
+			return strings.Join(append(tokens[:i:i], ">"), ".")
+		}
+	}
+	return s.template
+}
+
+type NATS struct {
+	logger *slog.Logger
+	conn   *nats.Conn
+	js     jetstream.JetStream
+
+	// intakeLk is held to publish, and locked exclusively to stop intake
+	intakeLk sync.RWMutex
+	closed   bool
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// NewNATS connects to the NATS servers at url and publishes to JetStream. If stream is set, a
+// stream by that name capturing subjects is created, or updated to capture them.
+func NewNATS(ctx context.Context, url string, stream string, subjects []string, logger *slog.Logger) (*NATS, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("looking-glass"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("disconnected from nats", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logger.Info("reconnected to nats", "url", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+
+	js, err := jetstream.New(conn,
+		jetstream.WithPublishAsyncMaxPending(maxPending),
+		jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, msg *nats.Msg, err error) {
+			publishErrors.Inc()
+			logger.Error("failed to publish message", "subject", msg.Subject, "error", err)
+		}),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	if stream != "" {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     stream,
+			Subjects: subjects,
+			Storage:  jetstream.FileStorage,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create stream %q: %w", stream, err)
+		}
+	}
+
+	return &NATS{logger: logger, conn: conn, js: js}, nil
+}
+
+// Publish publishes a message without waiting for its ack. A non-empty msgID lets JetStream drop
+// the message as a duplicate if it was published within the stream's duplicate window, so events
+// replayed after a restart aren't published twice.
+func (n *NATS) Publish(ctx context.Context, subject, msgID string, data []byte) error {
+	n.intakeLk.RLock()
+	defer n.intakeLk.RUnlock()
+	if n.closed {
+		return ErrClosed
+	}
+
+	var opts []jetstream.PublishOpt
+	if msgID != "" {
+		opts = append(opts, jetstream.WithMsgID(msgID))
+	}
+	if _, err := n.js.PublishAsync(subject, data, opts...); err != nil {
+		publishErrors.Inc()
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	messagesPublished.Inc()
+	return nil
+}
+
+// Flush waits for every published message to be acked
+func (n *NATS) Flush(ctx context.Context) error {
+	select {
+	case <-n.js.PublishAsyncComplete():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d messages still awaiting acks: %w", n.js.PublishAsyncPending(), ctx.Err())
+	}
+}
+
+// Shutdown stops accepting messages, waits for the ones published to be acked, and then closes
+// the connection. Only the first call does anything, later ones return its result.
+func (n *NATS) Shutdown(ctx context.Context) error {
+	n.shutdownOnce.Do(func() {
+		n.intakeLk.Lock()
+		n.closed = true
+		n.intakeLk.Unlock()
+
+		n.logger.Info("waiting for published messages to be acked", "messages", n.js.PublishAsyncPending())
+		n.shutdownErr = n.Flush(ctx)
+		if err := n.conn.Drain(); err != nil {
+			n.shutdownErr = errors.Join(n.shutdownErr, err)
+		}
+	})
+	return n.shutdownErr
+}
+
+// Close waits up to a minute for published messages to be acked and closes the connection
+func (n *NATS) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return n.Shutdown(ctx)
+}
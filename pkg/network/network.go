@@ -0,0 +1,85 @@
+// Package network holds profiles bundling the endpoints of an atproto network, so the tools
+// can be pointed at a test network with one setting
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Profile is the set of endpoints and resolution settings for an atproto network
+type Profile struct {
+	Name string `json:"-"`
+	// RelayURL is the websocket URL of the network relay's subscribeRepos endpoint
+	RelayURL string `json:"relay_url"`
+	// PLCHost is the PLC directory DIDs are resolved against, with protocol
+	PLCHost string `json:"plc_host"`
+	// SkipDNSDomainSuffixes are handle suffixes only resolved over HTTP, for large PDSs that don't serve DNS records
+	SkipDNSDomainSuffixes []string `json:"skip_dns_domain_suffixes,omitempty"`
+}
+
+// Main is the production atproto network
+var Main = Profile{
+	Name:     "main",
+	RelayURL: "wss://bsky.network/xrpc/com.atproto.sync.subscribeRepos",
+	PLCHost:  "https://plc.directory",
+	// primary Bluesky PDS instance only supports HTTP resolution method
+	SkipDNSDomainSuffixes: []string{".bsky.social"},
+}
+
+// Sandbox is the Bluesky federation sandbox network
+var Sandbox = Profile{
+	Name:     "sandbox",
+	RelayURL: "wss://bgs.bsky-sandbox.dev/xrpc/com.atproto.sync.subscribeRepos",
+	PLCHost:  "https://plc.bsky-sandbox.dev",
+}
+
+var builtin = map[string]Profile{
+	Main.Name:    Main,
+	Sandbox.Name: Sandbox,
+}
+
+// Load returns the named profile. Profiles defined in the JSON config file at configPath, an object
+// keyed by profile name, take precedence over the built-in main and sandbox profiles.
+func Load(name, configPath string) (*Profile, error) {
+	profiles := make(map[string]Profile, len(builtin))
+	for n, p := range builtin {
+		profiles[n] = p
+	}
+
+	if configPath != "" {
+		raw, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network config: %w", err)
+		}
+
+		var custom map[string]Profile
+		if err := json.Unmarshal(raw, &custom); err != nil {
+			return nil, fmt.Errorf("failed to parse network config: %w", err)
+		}
+
+		for n, p := range custom {
+			if p.RelayURL == "" || p.PLCHost == "" {
+				return nil, fmt.Errorf("network %q in config must set relay_url and plc_host", n)
+			}
+			p.Name = n
+			p.PLCHost = strings.TrimSuffix(p.PLCHost, "/")
+			profiles[n] = p
+		}
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown network %q, expected one of %s (custom networks are defined in the network config)", name, strings.Join(names, ", "))
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,153 @@
+// Package objstore uploads files to object storage, picked by URL:
+//
+//	gs://bucket/prefix         Google Cloud Storage, using application default credentials
+//	s3://bucket/prefix         Amazon S3 or a compatible store, using credentials from the environment
+//	https://host/prefix        any server accepting HTTP PUTs, like a presigned bucket or WebDAV share
+//	file:///path or /path      a local directory
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// Store uploads objects under a common prefix
+type Store interface {
+	// Put uploads size bytes read from r to key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// URL returns where the object at key can be read from
+	URL(key string) string
+}
+
+// Open returns the Store for a storage URL
+func Open(ctx context.Context, rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "gs":
+		client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %w", err)
+		}
+		return &gcsStore{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "s3":
+		return newS3Store(u.Host, strings.Trim(u.Path, "/"))
+	case "http", "https":
+		return &httpStore{client: &http.Client{Timeout: 10 * time.Minute}, base: strings.TrimSuffix(rawURL, "/")}, nil
+	case "file", "":
+		if err := os.MkdirAll(u.Path, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+		return &dirStore{dir: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+	}
+}
+
+// gcsStore uploads to a Google Cloud Storage bucket with the JSON API's simple upload
+type gcsStore struct {
+	client *http.Client
+	bucket string
+	prefix string
+}
+
+func (g *gcsStore) object(key string) string {
+	return path.Join(g.prefix, key)
+}
+
+func (g *gcsStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(g.bucket), url.QueryEscape(g.object(key)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return do(g.client, req)
+}
+
+func (g *gcsStore) URL(key string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", g.bucket, g.object(key))
+}
+
+// httpStore PUTs objects to URLs under a base URL
+type httpStore struct {
+	client *http.Client
+	base   string
+}
+
+func (h *httpStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.URL(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return do(h.client, req)
+}
+
+func (h *httpStore) URL(key string) string {
+	return h.base + "/" + key
+}
+
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload %s: %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// dirStore copies objects into a local directory, writing to a temporary file first so
+// readers never see a partial object
+type dirStore struct {
+	dir string
+}
+
+func (d *dirStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dst := filepath.Join(d.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	f, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create object: %w", err)
+	}
+	defer os.Remove(dst + ".tmp")
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close object: %w", err)
+	}
+
+	return os.Rename(dst+".tmp", dst)
+}
+
+func (d *dirStore) URL(key string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.Join(d.dir, filepath.FromSlash(key))}).String()
+}
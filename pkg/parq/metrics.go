@@ -0,0 +1,50 @@
+package parq
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "parq")
+
+var recordsBuffered = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "parq_records_buffered",
+	Help: "The number of records waiting to be written to a Parquet file",
+})
+
+var recordsWritten = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "parq_records_written",
+	Help: "The number of records written to Parquet files",
+})
+
+var filesWritten = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "parq_files_written",
+	Help: "The number of Parquet files written, by result",
+}, []string{"result"})
+
+var fileWriteDuration = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "parq_file_write_duration_seconds",
+	Help:    "The duration of time it takes to write a Parquet file",
+	Buckets: prometheus.DefBuckets,
+})
+
+var filesUploaded = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "parq_files_uploaded",
+	Help: "The number of attempts to upload a Parquet file to object storage, by result",
+}, []string{"result"})
+
+var fileUploadDuration = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "parq_file_upload_duration_seconds",
+	Help:    "The duration of time it takes to upload a Parquet file",
+	Buckets: prometheus.DefBuckets,
+})
+
+var filesPendingUpload = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "parq_files_pending_upload",
+	Help: "The number of written Parquet files waiting to be uploaded",
+})
+
+var uploadLag = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "parq_upload_lag_seconds",
+	Help: "How long ago the oldest Parquet file waiting to be uploaded was written",
+})
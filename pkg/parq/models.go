@@ -0,0 +1,128 @@
+package parq
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Record struct {
+	CreatedAt time.Time `parquet:"created_at,timestamp"`
+
+	FirehoseSeq int64  `parquet:"firehose_seq,delta"`
+	Repo        string `parquet:"repo,dict"`
+	Collection  string `parquet:"collection,dict"`
+	RKey        string `parquet:"r_key"`
+	Action      string `parquet:"action,dict"`
+	Raw         string `parquet:"raw,optional"` // Raw JSON data, empty for deletes
+
+	Error string `parquet:"error,optional"`
+}
+
+// Schema versions of the files Parq writes
+const (
+	// SchemaV1 stores each record's content as a single raw JSON string
+	SchemaV1 = "v1"
+	// SchemaV2 adds the commit's event time, the record's CID and rev, and commonly queried
+	// fields parsed out of the record as a nested group. Its columns are a superset of v1's,
+	// so readers of v1 files can read v2 files unchanged.
+	SchemaV2 = "v2"
+)
+
+// RecordV2 is a record in the v2 schema
+type RecordV2 struct {
+	CreatedAt time.Time  `parquet:"created_at,timestamp"`
+	EventTime *time.Time `parquet:"event_time,timestamp,optional"`
+
+	FirehoseSeq int64  `parquet:"firehose_seq,delta"`
+	Repo        string `parquet:"repo,dict"`
+	Collection  string `parquet:"collection,dict"`
+	RKey        string `parquet:"r_key"`
+	Action      string `parquet:"action,dict"`
+	CID         string `parquet:"cid,optional"` // Empty for deletes
+	Rev         string `parquet:"rev,optional"` // Empty for backfilled records
+	Raw         string `parquet:"raw,optional"` // Raw JSON data, empty for deletes
+
+	Fields *RecordFields `parquet:"fields,optional"` // Parsed from Raw, empty for deletes
+
+	Error string `parquet:"error,optional"`
+}
+
+// RecordFields are the fields parsed out of a record's JSON for v2 files, each empty if the
+// record doesn't have it
+type RecordFields struct {
+	Type      string     `parquet:"type,dict"`
+	CreatedAt *time.Time `parquet:"created_at,timestamp,optional"`
+	Text      string     `parquet:"text,optional"`
+	Langs     []string   `parquet:"langs,list"`
+	// Subject is the AT-URI of the record a like or repost is of, or the DID a follow or block is of
+	Subject     string `parquet:"subject,optional"`
+	ReplyRoot   string `parquet:"reply_root,optional"`
+	ReplyParent string `parquet:"reply_parent,optional"`
+	EmbedType   string `parquet:"embed_type,optional,dict"`
+}
+
+// V1 returns the record in the v1 schema
+func (r *RecordV2) V1() Record {
+	return Record{
+		CreatedAt:   r.CreatedAt,
+		FirehoseSeq: r.FirehoseSeq,
+		Repo:        r.Repo,
+		Collection:  r.Collection,
+		RKey:        r.RKey,
+		Action:      r.Action,
+		Raw:         r.Raw,
+		Error:       r.Error,
+	}
+}
+
+type strongRef struct {
+	URI string `json:"uri"`
+}
+
+// ParseFields parses the v2 fields out of a record's JSON, returning nil if it isn't a JSON object
+func ParseFields(raw []byte) *RecordFields {
+	var rec struct {
+		Type      string          `json:"$type"`
+		CreatedAt string          `json:"createdAt"`
+		Text      string          `json:"text"`
+		Langs     []string        `json:"langs"`
+		Subject   json.RawMessage `json:"subject"`
+		Reply     *struct {
+			Root   strongRef `json:"root"`
+			Parent strongRef `json:"parent"`
+		} `json:"reply"`
+		Embed *struct {
+			Type string `json:"$type"`
+		} `json:"embed"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &rec) != nil {
+		return nil
+	}
+
+	f := &RecordFields{
+		Type:  rec.Type,
+		Text:  rec.Text,
+		Langs: rec.Langs,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, rec.CreatedAt); err == nil {
+		f.CreatedAt = &t
+	}
+	if rec.Reply != nil {
+		f.ReplyRoot = rec.Reply.Root.URI
+		f.ReplyParent = rec.Reply.Parent.URI
+	}
+	if rec.Embed != nil {
+		f.EmbedType = rec.Embed.Type
+	}
+
+	// Subjects are DIDs for follows and blocks, and strong refs for likes and reposts
+	var did string
+	var ref strongRef
+	if json.Unmarshal(rec.Subject, &did) == nil {
+		f.Subject = did
+	} else if json.Unmarshal(rec.Subject, &ref) == nil {
+		f.Subject = ref.URI
+	}
+
+	return f
+}
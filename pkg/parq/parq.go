@@ -0,0 +1,265 @@
+package parq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/parquet-go/parquet-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Parq batches records and writes them out as Parquet files in a local directory
+type Parq struct {
+	logger *slog.Logger
+	dir    string
+
+	batchSize int
+	maxWait   time.Duration
+
+	// PartitionByCollection keeps a batch per collection and writes each to its own files named
+	// after the collection, so queries over one collection don't read the others. It must be set
+	// before any records are inserted.
+	PartitionByCollection bool
+
+	// Schema is the schema files are written in, SchemaV1 (the default) or SchemaV2
+	Schema string
+
+	// batches are keyed by collection if partitioned, otherwise everything is under ""
+	batches map[string][]*RecordV2
+	batchLk sync.Mutex
+
+	// Serializes file writes so batches land in order
+	writeLk sync.Mutex
+
+	// written wakes the uploader when a file has been written
+	written chan struct{}
+	// Serializes upload scans so a file isn't uploaded twice
+	uploadLk sync.Mutex
+
+	clock clock.Clock
+}
+
+var tracer = otel.Tracer("parq")
+
+// NewParq creates a Parquet writer that writes a file to dir whenever batchSize records
+// have been buffered or maxWait has passed with records waiting, whichever comes first
+func NewParq(
+	ctx context.Context,
+	dir string,
+	batchSize int,
+	maxWait time.Duration,
+	logger *slog.Logger,
+	clk clock.Clock,
+) (*Parq, error) {
+	if batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be at least 1")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create parquet dir: %w", err)
+	}
+
+	p := &Parq{
+		logger:    logger.With("source", "parq"),
+		dir:       dir,
+		batchSize: batchSize,
+		maxWait:   maxWait,
+		batches:   make(map[string][]*RecordV2),
+		Schema:    SchemaV1,
+		written:   make(chan struct{}, 1),
+		clock:     clk,
+	}
+
+	// Start a routine to write out partial batches every maxWait
+	go func() {
+		t := clk.NewTicker(maxWait)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C():
+				if err := p.Flush(ctx); err != nil {
+					p.logger.Error("failed to flush records", "error", err)
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// InsertRecord buffers a record, writing out a file if the batch is full. Records are
+// buffered with every v2 field and cut down to v1 when written in that schema.
+func (p *Parq) InsertRecord(ctx context.Context, record *RecordV2) error {
+	ctx, span := tracer.Start(ctx, "InsertRecord")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("repo", record.Repo),
+		attribute.String("collection", record.Collection),
+		attribute.String("r_key", record.RKey),
+		attribute.String("action", record.Action),
+		attribute.Int64("firehose_seq", record.FirehoseSeq),
+	)
+
+	key := ""
+	if p.PartitionByCollection {
+		key = record.Collection
+	}
+
+	p.batchLk.Lock()
+	p.batches[key] = append(p.batches[key], record)
+	recordsBuffered.Inc()
+	if len(p.batches[key]) < p.batchSize {
+		p.batchLk.Unlock()
+		return nil
+	}
+	batch := p.takeBatch(key)
+	p.batchLk.Unlock()
+
+	return p.writeBatch(ctx, key, batch)
+}
+
+// Flush writes out any buffered records
+func (p *Parq) Flush(ctx context.Context) error {
+	p.batchLk.Lock()
+	keys := make([]string, 0, len(p.batches))
+	for key := range p.batches {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	batches := make([][]*RecordV2, len(keys))
+	for i, key := range keys {
+		batches[i] = p.takeBatch(key)
+	}
+	p.batchLk.Unlock()
+
+	var errs []error
+	for i, key := range keys {
+		if err := p.writeBatch(ctx, key, batches[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// takeBatch removes the batch for key, batchLk must be held
+func (p *Parq) takeBatch(key string) []*RecordV2 {
+	batch := p.batches[key]
+	delete(p.batches, key)
+	recordsBuffered.Sub(float64(len(batch)))
+	return batch
+}
+
+// writeBatch writes a batch of records to a new Parquet file, named after the collection the
+// batch holds if partitioned, writing to a temporary file first so readers never see a partial file
+func (p *Parq) writeBatch(ctx context.Context, key string, batch []*RecordV2) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "writeBatch")
+	defer span.End()
+
+	p.writeLk.Lock()
+	defer p.writeLk.Unlock()
+
+	start := p.clock.Now()
+	defer func() {
+		fileWriteDuration.Observe(p.clock.Since(start).Seconds())
+	}()
+
+	prefix := "records"
+	if key != "" {
+		prefix = fileSafe(key)
+	}
+	name := fmt.Sprintf("%s_%d_%d.parquet", prefix, start.UnixNano(), batch[0].FirehoseSeq)
+	path := filepath.Join(p.dir, name)
+	tmpPath := path + ".tmp"
+
+	span.SetAttributes(
+		attribute.String("path", path),
+		attribute.Int("records", len(batch)),
+	)
+
+	if err := writeFile(tmpPath, p.Schema, batch); err != nil {
+		filesWritten.WithLabelValues("failed").Inc()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write parquet file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		filesWritten.WithLabelValues("failed").Inc()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move parquet file into place: %w", err)
+	}
+
+	filesWritten.WithLabelValues("ok").Inc()
+	recordsWritten.Add(float64(len(batch)))
+	p.logger.Info("wrote parquet file", "path", path, "records", len(batch))
+
+	select {
+	case p.written <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// fileSafe replaces characters that aren't valid in an NSID, so a malformed collection can't
+// escape the output directory
+func fileSafe(collection string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, collection)
+}
+
+func writeFile(path string, schema string, batch []*RecordV2) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if schema == SchemaV2 {
+		rows := make([]RecordV2, len(batch))
+		for i, r := range batch {
+			rows[i] = *r
+		}
+		if err := writeRows(f, rows); err != nil {
+			return err
+		}
+	} else {
+		rows := make([]Record, len(batch))
+		for i, r := range batch {
+			rows[i] = r.V1()
+		}
+		if err := writeRows(f, rows); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func writeRows[T any](f *os.File, rows []T) error {
+	w := parquet.NewGenericWriter[T](f, BloomFilters)
+	if _, err := w.Write(rows); err != nil {
+		return err
+	}
+	return w.Close()
+}
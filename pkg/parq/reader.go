@@ -0,0 +1,190 @@
+package parq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// bloomColumns are the columns written with bloom filters, so readers looking for a
+// particular repo, collection, or record key can skip row groups that can't contain it
+var bloomColumns = []string{"repo", "collection", "r_key"}
+
+// BloomFilters is the writer option adding bloom filters to bloomColumns
+var BloomFilters = func() parquet.WriterOption {
+	filters := make([]parquet.BloomFilterColumn, len(bloomColumns))
+	for i, col := range bloomColumns {
+		filters[i] = parquet.SplitBlockFilter(10, col)
+	}
+	return parquet.BloomFilters(filters...)
+}()
+
+// Filter selects records when scanning files. Empty fields match everything.
+type Filter struct {
+	Repo       string
+	Collection string
+	RKey       string
+	// Since and Until bound the time records were written, Until exclusive
+	Since time.Time
+	Until time.Time
+}
+
+func (f *Filter) match(r *Record) bool {
+	if f.Repo != "" && r.Repo != f.Repo {
+		return false
+	}
+	if f.Collection != "" && r.Collection != f.Collection {
+		return false
+	}
+	if f.RKey != "" && r.RKey != f.RKey {
+		return false
+	}
+	if !f.Since.IsZero() && r.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// mayContain checks a row group's bloom filters, returning false only if it can't hold a match
+func (f *Filter) mayContain(schema *parquet.Schema, rg parquet.RowGroup) (bool, error) {
+	wanted := map[string]string{"repo": f.Repo, "collection": f.Collection, "r_key": f.RKey}
+	chunks := rg.ColumnChunks()
+	for _, col := range bloomColumns {
+		v := wanted[col]
+		if v == "" {
+			continue
+		}
+		leaf, ok := schema.Lookup(col)
+		if !ok {
+			continue
+		}
+		bf := chunks[leaf.ColumnIndex].BloomFilter()
+		if bf == nil {
+			// Written without bloom filters
+			continue
+		}
+		found, err := bf.Check(parquet.ValueOf(v))
+		if err != nil {
+			return false, fmt.Errorf("failed to check %s bloom filter: %w", col, err)
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ScanStats counts the work a scan did
+type ScanStats struct {
+	RowGroups        int
+	RowGroupsSkipped int
+	RowsRead         int64
+	RowsMatched      int64
+}
+
+// ScanFile calls fn with every record in a Parquet file written by this package that matches
+// filter, skipping row groups whose bloom filters rule out a match. Returning io.EOF from fn
+// stops the scan early without an error.
+func ScanFile(path string, filter Filter, fn func(*Record) error) (ScanStats, error) {
+	var stats ScanStats
+
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return stats, err
+	}
+
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return stats, fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	buf := make([]Record, 1024)
+	for _, rg := range pf.RowGroups() {
+		stats.RowGroups++
+
+		ok, err := filter.mayContain(pf.Schema(), rg)
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			stats.RowGroupsSkipped++
+			continue
+		}
+
+		r := parquet.NewGenericRowGroupReader[Record](rg)
+		for {
+			n, err := r.Read(buf)
+			for i := 0; i < n; i++ {
+				stats.RowsRead++
+				if !filter.match(&buf[i]) {
+					continue
+				}
+				stats.RowsMatched++
+				if err := fn(&buf[i]); err != nil {
+					r.Close()
+					if errors.Is(err, io.EOF) {
+						return stats, nil
+					}
+					return stats, err
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return stats, fmt.Errorf("failed to read rows: %w", err)
+			}
+		}
+		r.Close()
+	}
+
+	return stats, nil
+}
+
+// FileInfo summarizes a Parquet file
+type FileInfo struct {
+	Rows      int64
+	RowGroups int
+	Size      int64
+	// Bloom is set if the file was written with bloom filters
+	Bloom bool
+}
+
+// StatFile reads a Parquet file's metadata
+func StatFile(path string) (FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	fi := FileInfo{Rows: pf.NumRows(), RowGroups: len(pf.RowGroups()), Size: info.Size()}
+	if leaf, ok := pf.Schema().Lookup("repo"); ok && len(pf.RowGroups()) > 0 {
+		fi.Bloom = pf.RowGroups()[0].ColumnChunks()[leaf.ColumnIndex].BloomFilter() != nil
+	}
+	return fi, nil
+}
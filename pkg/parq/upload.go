@@ -0,0 +1,163 @@
+package parq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/objstore"
+)
+
+const (
+	// uploadScanInterval is how often the directory is checked for files that still need uploading
+	uploadScanInterval = time.Minute
+	// uploadAttempts is how many times each upload is tried per scan before it's left for the next
+	uploadAttempts = 5
+)
+
+// RunUploader uploads the Parquet files in the output directory to store until ctx is cancelled,
+// deleting each one once it's uploaded. Files are keyed dt=YYYY-MM-DD/<name> by the UTC day they
+// were written, so the bucket can be queried as a Hive-partitioned table. Files that fail to
+// upload stay on disk and are retried on the next scan, including ones left by an earlier run.
+func (p *Parq) RunUploader(ctx context.Context, store objstore.Store) error {
+	p.logger.Info("uploading parquet files", "store", store.URL(""))
+
+	t := p.clock.NewTicker(uploadScanInterval)
+	defer t.Stop()
+	for {
+		p.UploadPending(ctx, store)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C():
+		case <-p.written:
+		}
+	}
+}
+
+// UploadPending uploads every Parquet file currently in the output directory, oldest first
+func (p *Parq) UploadPending(ctx context.Context, store objstore.Store) error {
+	p.uploadLk.Lock()
+	defer p.uploadLk.Unlock()
+
+	files, err := p.pendingUploads()
+	if err != nil {
+		p.logger.Error("failed to list parquet files to upload", "error", err)
+		return err
+	}
+	filesPendingUpload.Set(float64(len(files)))
+	if len(files) > 0 {
+		uploadLag.Set(p.clock.Since(files[0].modTime).Seconds())
+	} else {
+		uploadLag.Set(0)
+	}
+
+	for i, f := range files {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d parquet files left to upload: %w", len(files)-i, ctx.Err())
+		}
+
+		if err := p.uploadWithRetry(ctx, store, f); err != nil {
+			// Later files are still tried, this one is retried on the next scan
+			p.logger.Error("failed to upload parquet file, leaving it for the next scan", "path", f.path, "error", err)
+			continue
+		}
+
+		filesPendingUpload.Dec()
+		if i+1 < len(files) {
+			uploadLag.Set(p.clock.Since(files[i+1].modTime).Seconds())
+		} else {
+			uploadLag.Set(0)
+		}
+	}
+
+	return nil
+}
+
+type pendingFile struct {
+	path    string
+	modTime time.Time
+}
+
+// pendingUploads lists the complete Parquet files in the output directory, oldest first.
+// Files are renamed into place once written, so anything ending in .parquet is complete.
+func (p *Parq) pendingUploads() ([]pendingFile, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []pendingFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".parquet") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			continue
+		}
+		files = append(files, pendingFile{path: filepath.Join(p.dir, e.Name()), modTime: info.ModTime()})
+	}
+
+	slices.SortFunc(files, func(a, b pendingFile) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	return files, nil
+}
+
+// uploadWithRetry uploads a file, backing off exponentially between attempts, and deletes it once uploaded
+func (p *Parq) uploadWithRetry(ctx context.Context, store objstore.Store, f pendingFile) error {
+	key := fmt.Sprintf("dt=%s/%s", f.modTime.UTC().Format(time.DateOnly), filepath.Base(f.path))
+
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		start := p.clock.Now()
+		if err = p.upload(ctx, store, key, f.path); err == nil {
+			filesUploaded.WithLabelValues("ok").Inc()
+			fileUploadDuration.Observe(p.clock.Since(start).Seconds())
+			break
+		}
+		filesUploaded.WithLabelValues("failed").Inc()
+		p.logger.Warn("failed to upload parquet file", "path", f.path, "attempt", attempt, "error", err)
+
+		if attempt == uploadAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	if err := os.Remove(f.path); err != nil {
+		return fmt.Errorf("uploaded but failed to delete local file: %w", err)
+	}
+	p.logger.Info("uploaded parquet file", "path", f.path, "url", store.URL(key))
+
+	return nil
+}
+
+func (p *Parq) upload(ctx context.Context, store objstore.Store, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, key, f, info.Size())
+}
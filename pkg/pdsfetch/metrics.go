@@ -0,0 +1,18 @@
+package pdsfetch
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "pdsfetch")
+
+var requests = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdsfetch_requests_total",
+	Help: "The number of requests made to PDS hosts, by host and status code",
+}, []string{"host", "status"})
+
+var requestRetries = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "pdsfetch_request_retries_total",
+	Help: "The number of retried requests to PDS hosts, by host",
+}, []string{"host"})
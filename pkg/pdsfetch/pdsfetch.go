@@ -0,0 +1,282 @@
+package pdsfetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+var tracer = otel.Tracer("pdsfetch")
+
+// ErrNotFound is returned when a PDS reports that a repo or record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// Client fetches data from PDS hosts politely: requests to each host are rate limited,
+// and transient failures are retried with jittered exponential backoff
+type Client struct {
+	HTTPClient *http.Client
+	UserAgent  string
+
+	// MaxRetries is how many times a request is retried after a transient failure
+	MaxRetries int
+	// RetryBaseDelay is the backoff before the first retry, doubling on each attempt
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the backoff between retries
+	RetryMaxDelay time.Duration
+
+	// HostLimit and HostBurst configure the per-host rate limiter
+	HostLimit rate.Limit
+	HostBurst int
+
+	limiters map[string]*rate.Limiter
+	lk       sync.Mutex
+}
+
+// NewClient creates a Client with defaults suitable for fetching whole repos
+func NewClient(userAgent string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+		UserAgent:      userAgent,
+		MaxRetries:     3,
+		RetryBaseDelay: time.Second,
+		RetryMaxDelay:  30 * time.Second,
+		HostLimit:      rate.Limit(10),
+		HostBurst:      10,
+		limiters:       make(map[string]*rate.Limiter),
+	}
+}
+
+func (c *Client) limiter(host string) *rate.Limiter {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	lim, ok := c.limiters[host]
+	if !ok {
+		lim = rate.NewLimiter(c.HostLimit, c.HostBurst)
+		c.limiters[host] = lim
+	}
+	return lim
+}
+
+// Get performs a GET request against a PDS, retrying transient failures (network errors,
+// 429s, and 5xxs). The caller must close the returned response's body.
+func (c *Client) Get(ctx context.Context, rawURL string, accept string) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "Get")
+	defer span.End()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	span.SetAttributes(attribute.String("host", u.Host), attribute.String("path", u.Path))
+
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt, lastErr)
+			requestRetries.WithLabelValues(u.Host).Inc()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		if err := c.limiter(u.Host).Wait(ctx); err != nil {
+			return nil, fmt.Errorf("failed waiting for rate limiter: %w", err)
+		}
+
+		resp, err := c.do(ctx, u, accept)
+		if err == nil {
+			return resp, nil
+		}
+
+		lastErr = err
+		var re *retryableError
+		if !errors.As(err, &re) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("giving up after %d attempts: %w", c.MaxRetries+1, lastErr)
+}
+
+// retryableError marks a failure worth retrying, optionally with a server-requested delay
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+func (c *Client) do(ctx context.Context, u *url.URL, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		requests.WithLabelValues(u.Host, "error").Inc()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrNonPublicHost) {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		return nil, &retryableError{err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	requests.WithLabelValues(u.Host, strconv.Itoa(resp.StatusCode)).Inc()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		resp.Body.Close()
+		return nil, &retryableError{
+			err:        fmt.Errorf("unexpected status code: %d", resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		// XRPC errors come back as 400s with a JSON body naming the error
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		var xrpcErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &xrpcErr) == nil && (xrpcErr.Error == "RecordNotFound" || xrpcErr.Error == "RepoNotFound") {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, body)
+	}
+}
+
+// backoff returns the delay before a retry, honoring any Retry-After the server sent
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	var re *retryableError
+	if errors.As(lastErr, &re) && re.retryAfter > 0 {
+		return min(re.retryAfter, c.RetryMaxDelay)
+	}
+
+	delay := c.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > c.RetryMaxDelay {
+		delay = c.RetryMaxDelay
+	}
+
+	// Full jitter between half and all of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// GetRepo streams a repo's CAR file from a PDS or Relay. If since is set,
+// only blocks changed since that revision are returned.
+// The caller must close the returned reader.
+func (c *Client) GetRepo(ctx context.Context, host string, did syntax.DID, since string) (io.ReadCloser, error) {
+	q := url.Values{"did": []string{did.String()}}
+	if since != "" {
+		q.Set("since", since)
+	}
+
+	resp, err := c.Get(ctx, fmt.Sprintf("%s/xrpc/com.atproto.sync.getRepo?%s", host, q.Encode()), "application/vnd.ipld.car")
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// GetBlob fetches a blob by CID from a repo's PDS, the caller must close the returned body
+func (c *Client) GetBlob(ctx context.Context, host string, did syntax.DID, blobCID string) (io.ReadCloser, error) {
+	q := url.Values{"did": []string{did.String()}, "cid": []string{blobCID}}
+
+	resp, err := c.Get(ctx, fmt.Sprintf("%s/xrpc/com.atproto.sync.getBlob?%s", host, q.Encode()), "*/*")
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Record is a record as served by com.atproto.repo.getRecord
+type Record struct {
+	URI   string          `json:"uri"`
+	CID   string          `json:"cid"`
+	Value json.RawMessage `json:"value"`
+}
+
+// GetRecord fetches the current version of a record from its repo's PDS, returning ErrNotFound
+// if the record or repo doesn't exist
+func (c *Client) GetRecord(ctx context.Context, host string, did syntax.DID, collection syntax.NSID, rkey syntax.RecordKey) (*Record, error) {
+	q := url.Values{
+		"repo":       []string{did.String()},
+		"collection": []string{collection.String()},
+		"rkey":       []string{rkey.String()},
+	}
+
+	resp, err := c.Get(ctx, fmt.Sprintf("%s/xrpc/com.atproto.repo.getRecord?%s", host, q.Encode()), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rec Record
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return nil, fmt.Errorf("failed to decode record: %w", err)
+	}
+	return &rec, nil
+}
+
+// ReadRepo fetches and parses a full repo from a PDS or Relay
+func (c *Client) ReadRepo(ctx context.Context, host string, did syntax.DID) (*repo.Repo, error) {
+	body, err := c.GetRepo(ctx, host, did, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r, err := repo.ReadRepoFromCar(ctx, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repo from CAR: %w", err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,76 @@
+package pdsfetch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNonPublicHost is returned for PDS endpoints that aren't public https hosts, which clients
+// made with NewPublicClient refuse to fetch from
+var ErrNonPublicHost = errors.New("PDS endpoint is not a public https host")
+
+// NewPublicClient creates a Client for fetching from PDS endpoints taken from DID documents
+// on behalf of API requests. It only connects to public addresses, checked when dialing so
+// redirects and DNS answers can't point it at loopback, private, or link-local hosts.
+func NewPublicClient(userAgent string) *Client {
+	c := NewClient(userAgent)
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !publicAddr(addr) {
+				return fmt.Errorf("%w: %s", ErrNonPublicHost, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	c.HTTPClient = &http.Client{
+		Timeout:   c.HTTPClient.Timeout,
+		Transport: transport,
+	}
+	return c
+}
+
+// CheckPublicEndpoint checks a PDS endpoint is an https URL that doesn't name a loopback,
+// private, or link-local host
+func CheckPublicEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNonPublicHost, err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("%w: %s", ErrNonPublicHost, endpoint)
+	}
+	host := u.Hostname()
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrNonPublicHost, host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddr(addr) {
+		return fmt.Errorf("%w: %s", ErrNonPublicHost, host)
+	}
+	return nil
+}
+
+// publicAddr reports whether an address is routable on the public internet
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddrSpace.Contains(addr)
+}
+
+// sharedAddrSpace is the carrier-grade NAT range, which netip doesn't count as private
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
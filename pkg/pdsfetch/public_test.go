@@ -0,0 +1,31 @@
+package pdsfetch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPublicEndpoint(t *testing.T) {
+	for endpoint, public := range map[string]bool{
+		"https://morel.us-east.host.bsky.network": true,
+		"https://8.8.8.8":                         true,
+		"http://morel.us-east.host.bsky.network":  false,
+		"https://localhost:2583":                  false,
+		"https://pds.localhost":                   false,
+		"https://127.0.0.1":                       false,
+		"https://10.0.0.5":                        false,
+		"https://169.254.169.254":                 false,
+		"https://100.64.0.1":                      false,
+		"https://[::1]":                           false,
+		"https://[::ffff:192.168.0.1]":            false,
+		"file:///etc/passwd":                      false,
+	} {
+		err := CheckPublicEndpoint(endpoint)
+		if public && err != nil {
+			t.Errorf("CheckPublicEndpoint(%q) = %v, want nil", endpoint, err)
+		}
+		if !public && !errors.Is(err, ErrNonPublicHost) {
+			t.Errorf("CheckPublicEndpoint(%q) = %v, want ErrNonPublicHost", endpoint, err)
+		}
+	}
+}
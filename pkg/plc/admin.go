@@ -0,0 +1,24 @@
+package plc
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequireAdmin is middleware rejecting requests that don't bear the admin token in an
+// Authorization: Bearer header. Admin endpoints answer 501 when no token is configured.
+func (plc *PLC) RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if plc.AdminToken == "" {
+			return c.JSON(http.StatusNotImplemented, ErrorResponse{Error: "admin endpoints are not enabled on this instance"})
+		}
+		token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(plc.AdminToken)) != 1 {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid admin token"})
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,89 @@
+package plc
+
+import (
+	"fmt"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Supported database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// DBMaxOpenConns caps the Postgres connection pool
+const DBMaxOpenConns = 50
+
+// openDB opens the mirror's database for the given driver. SQLite runs in WAL mode so reads
+// don't block the sync loop's writes, while Postgres gets a connection pool so it can serve
+// reads and writes concurrently for deployments that outgrow SQLite.
+func openDB(driver, dsn string) (*gorm.DB, error) {
+	switch driver {
+	case DriverSQLite:
+		db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite db: %w", err)
+		}
+
+		// Set Pragmas
+		err = db.Exec("PRAGMA journal_mode=WAL;").Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to set journal mode: %w", err)
+		}
+
+		err = db.Exec("PRAGMA synchronous=normal;").Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to set synchronous mode: %w", err)
+		}
+
+		return db, nil
+	case DriverPostgres:
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open postgres db: %w", err)
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sql db: %w", err)
+		}
+
+		sqlDB.SetMaxOpenConns(DBMaxOpenConns)
+		sqlDB.SetMaxIdleConns(DBMaxOpenConns / 2)
+
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unsupported db driver %q", driver)
+	}
+}
+
+// renameColumns renames a model's columns that were created under GORM's default naming before
+// their fields were given explicit names, e.g. DID's default d_id, so existing databases keep
+// their data and indexes. Columns already renamed, or tables not yet created, are left alone.
+func renameColumns(db *gorm.DB, model any, renames map[string]string) error {
+	m := db.Migrator()
+	if !m.HasTable(model) {
+		return nil
+	}
+	for from, to := range renames {
+		if !m.HasColumn(model, from) || m.HasColumn(model, to) {
+			continue
+		}
+		if err := m.RenameColumn(model, from, to); err != nil {
+			return fmt.Errorf("failed to rename column %s to %s: %w", from, to, err)
+		}
+	}
+	return nil
+}
+
+// insertBatchSize is how many ops are inserted per statement. SQLite caps the number of bound
+// parameters per statement far lower than Postgres does.
+func insertBatchSize(driver string) int {
+	if driver == DriverPostgres {
+		return 1000
+	}
+	return 100
+}
@@ -0,0 +1,146 @@
+package plc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+)
+
+// HandleResolver resolves a handle to the DID it points at, satisfied by *identity.BaseDirectory
+type HandleResolver interface {
+	ResolveHandle(ctx context.Context, handle syntax.Handle) (syntax.DID, error)
+}
+
+// Directory serves identities from the mirror as an indigo identity.Directory, so indigo-based
+// services running alongside it can resolve DIDs and handles without a round trip to a PLC
+// directory. DIDs are resolved with the mirror's registered methods, and handles are found by
+// the DIDs currently claiming them.
+type Directory struct {
+	plc *PLC
+
+	// handles verifies that a DID's declared handle points back at it, as the atproto spec
+	// requires. Without it every handle is invalid, as the mirror can't check them itself.
+	handles HandleResolver
+}
+
+var _ identity.Directory = (*Directory)(nil)
+
+// Directory returns an identity.Directory backed by the mirror, verifying declared handles with
+// handles, e.g. an *identity.BaseDirectory. If handles is nil, identities are returned with
+// syntax.HandleInvalid and handle lookups fail.
+func (plc *PLC) Directory(handles HandleResolver) *Directory {
+	return &Directory{plc: plc, handles: handles}
+}
+
+func (d *Directory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	res, err := d.plc.resolveDID(ctx, did)
+	if err != nil {
+		if errors.Is(err, ErrDIDNotFound) || errors.Is(err, ErrTombstoned) {
+			return nil, fmt.Errorf("%w: %w", identity.ErrDIDNotFound, err)
+		}
+		return nil, err
+	}
+
+	ident := identity.ParseIdentity(res.Document.identityDocument())
+	ident.Handle = syntax.HandleInvalid
+	if declared, err := ident.DeclaredHandle(); err == nil {
+		ok, err := d.verifyHandle(ctx, declared, did)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ident.Handle = declared
+		}
+	}
+
+	if pk, err := ident.PublicKey(); err == nil {
+		ident.ParsedPublicKey = pk
+	}
+	return &ident, nil
+}
+
+func (d *Directory) LookupHandle(ctx context.Context, h syntax.Handle) (*identity.Identity, error) {
+	h = h.Normalize()
+
+	op, err := d.plc.currentClaim(h.String())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, identity.ErrHandleNotFound
+		}
+		return nil, fmt.Errorf("failed to look up handle: %w", err)
+	}
+
+	did, err := syntax.ParseDID(op.DID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DID claiming handle: %w", err)
+	}
+
+	ident, err := d.LookupDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if ident.Handle.Normalize() != h {
+		return nil, identity.ErrHandleMismatch
+	}
+	return ident, nil
+}
+
+func (d *Directory) Lookup(ctx context.Context, a syntax.AtIdentifier) (*identity.Identity, error) {
+	if handle, err := a.AsHandle(); err == nil {
+		return d.LookupHandle(ctx, handle)
+	}
+	if did, err := a.AsDID(); err == nil {
+		return d.LookupDID(ctx, did)
+	}
+	return nil, fmt.Errorf("at-identifier neither a handle nor a DID")
+}
+
+// Purge is a no-op, as identities are read from the mirror on every lookup
+func (d *Directory) Purge(ctx context.Context, a syntax.AtIdentifier) error {
+	return nil
+}
+
+// verifyHandle reports whether a handle resolves back to the DID declaring it, never trusting
+// it if there's no handle resolver
+func (d *Directory) verifyHandle(ctx context.Context, handle syntax.Handle, did syntax.DID) (bool, error) {
+	if d.handles == nil {
+		return false, nil
+	}
+
+	resolved, err := d.handles.ResolveHandle(ctx, handle.Normalize())
+	if err != nil {
+		if errors.Is(err, identity.ErrHandleNotFound) || errors.Is(err, identity.ErrHandleResolutionFailed) {
+			return false, nil
+		}
+		return false, err
+	}
+	return resolved == did, nil
+}
+
+// identityDocument converts a document to indigo's representation of one
+func (doc *DIDDocument) identityDocument() *identity.DIDDocument {
+	out := &identity.DIDDocument{
+		DID:         syntax.DID(doc.ID),
+		AlsoKnownAs: doc.AlsoKnownAs,
+	}
+	for _, vm := range doc.VerificationMethod {
+		out.VerificationMethod = append(out.VerificationMethod, identity.DocVerificationMethod{
+			ID:                 vm.ID,
+			Type:               vm.Type,
+			Controller:         vm.Controller,
+			PublicKeyMultibase: vm.PublicKeyMultibase,
+		})
+	}
+	for _, svc := range doc.Service {
+		out.Service = append(out.Service, identity.DocService{
+			ID:              svc.ID,
+			Type:            svc.Type,
+			ServiceEndpoint: svc.ServiceEndpoint,
+		})
+	}
+	return out
+}
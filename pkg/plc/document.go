@@ -0,0 +1,123 @@
+package plc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Operation is a decoded PLC operation, covering both current and legacy formats
+type Operation struct {
+	Type                string               `json:"type"`
+	RotationKeys        []string             `json:"rotationKeys,omitempty"`
+	VerificationMethods map[string]string    `json:"verificationMethods,omitempty"`
+	AlsoKnownAs         []string             `json:"alsoKnownAs,omitempty"`
+	Services            map[string]OpService `json:"services,omitempty"`
+	Prev                *string              `json:"prev"`
+	Sig                 string               `json:"sig"`
+
+	// Legacy "create" operation fields
+	SigningKey  string `json:"signingKey,omitempty"`
+	RecoveryKey string `json:"recoveryKey,omitempty"`
+	Handle      string `json:"handle,omitempty"`
+	Service     string `json:"service,omitempty"`
+}
+
+type OpService struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+}
+
+// ParseOperation decodes the raw operation JSON stored on a DBOp
+func ParseOperation(raw []byte) (*Operation, error) {
+	var op Operation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal operation: %w", err)
+	}
+	return &op, nil
+}
+
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Service            []DocService         `json:"service"`
+}
+
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+type DocService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// ErrTombstoned is returned when building a document for a tombstoned DID
+var ErrTombstoned = errors.New("DID has been tombstoned")
+
+// DIDDocument builds the DID document described by an operation, matching plc.directory's output
+func (op *Operation) DIDDocument(did string) (*DIDDocument, error) {
+	doc := &DIDDocument{
+		Context: []string{
+			"https://www.w3.org/ns/did/v1",
+			"https://w3id.org/security/multikey/v1",
+			"https://w3id.org/security/suites/secp256k1-2019/v1",
+		},
+		ID:                 did,
+		AlsoKnownAs:        []string{},
+		VerificationMethod: []VerificationMethod{},
+		Service:            []DocService{},
+	}
+
+	switch op.Type {
+	case "plc_tombstone":
+		return nil, ErrTombstoned
+	case "create":
+		// Legacy genesis operations use a fixed shape
+		if op.Handle != "" {
+			doc.AlsoKnownAs = append(doc.AlsoKnownAs, "at://"+op.Handle)
+		}
+		if op.SigningKey != "" {
+			doc.VerificationMethod = append(doc.VerificationMethod, verificationMethod(did, "atproto", op.SigningKey))
+		}
+		if op.Service != "" {
+			doc.Service = append(doc.Service, DocService{
+				ID:              "#atproto_pds",
+				Type:            "AtprotoPersonalDataServer",
+				ServiceEndpoint: op.Service,
+			})
+		}
+	case "plc_operation":
+		doc.AlsoKnownAs = append(doc.AlsoKnownAs, op.AlsoKnownAs...)
+		for id, key := range op.VerificationMethods {
+			doc.VerificationMethod = append(doc.VerificationMethod, verificationMethod(did, id, key))
+		}
+		for id, svc := range op.Services {
+			doc.Service = append(doc.Service, DocService{
+				ID:              "#" + id,
+				Type:            svc.Type,
+				ServiceEndpoint: svc.Endpoint,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown operation type %q", op.Type)
+	}
+
+	return doc, nil
+}
+
+func verificationMethod(did, id, key string) VerificationMethod {
+	return VerificationMethod{
+		ID:                 fmt.Sprintf("%s#%s", did, id),
+		Type:               "Multikey",
+		Controller:         did,
+		PublicKeyMultibase: strings.TrimPrefix(key, "did:key:"),
+	}
+}
@@ -0,0 +1,578 @@
+package plc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type ReverseResponse struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle"`
+}
+
+// checkCache sets caching headers keyed on the given op CID and reports
+// whether the client already has the current version
+func (plc *PLC) checkCache(c echo.Context, cid string) bool {
+	etag := fmt.Sprintf("%q", cid)
+	c.Response().Header().Set("ETag", etag)
+	if plc.CacheMaxAge > 0 {
+		c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(plc.CacheMaxAge.Seconds())))
+	} else {
+		c.Response().Header().Set("Cache-Control", "no-cache")
+	}
+
+	for _, match := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// latestOp returns the most recent op for a DID that took effect, skipping nullified and
+// invalid ones
+func (plc *PLC) latestOp(did string) (*DBOp, error) {
+	var op DBOp
+	err := plc.DB.Where("did = ? AND nullified = ? AND invalid = ?", did, false, false).Order("created_at DESC").First(&op).Error
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// HandleGetDID handles the GET /:did endpoint, returning the DID document
+func (plc *PLC) HandleGetDID(c echo.Context) error {
+	did, err := syntax.ParseDID(c.Param("did"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid DID"})
+	}
+
+	res, err := plc.resolveDID(c.Request().Context(), did)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrUnsupportedDIDMethod):
+			return c.JSON(http.StatusNotImplemented, ErrorResponse{Error: err.Error()})
+		case errors.Is(err, ErrDIDNotFound):
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("DID not registered: %s", did)})
+		case errors.Is(err, ErrTombstoned):
+			return c.JSON(http.StatusGone, ErrorResponse{Error: fmt.Sprintf("DID not available: %s", did)})
+		}
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+
+	if plc.checkCache(c, res.Version) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.JSON(http.StatusOK, res.Document)
+}
+
+// opLog returns the ops stored for a DID in the order they were created, including nullified
+// and invalid ones if includeNullified is set, or ErrDIDNotFound if there are none
+func (plc *PLC) opLog(did string, includeNullified bool) ([]DBOp, error) {
+	q := plc.DB.Where("did = ?", did)
+	if !includeNullified {
+		q = q.Where("nullified = ? AND invalid = ?", false, false)
+	}
+
+	var ops []DBOp
+	if err := q.Order("created_at ASC, id ASC").Find(&ops).Error; err != nil {
+		return nil, err
+	}
+
+	if len(ops) == 0 {
+		return nil, ErrDIDNotFound
+	}
+
+	return ops, nil
+}
+
+// getOpLog parses the DID in the request path and loads its op log, writing an error response
+// and returning nil ops if that fails
+func (plc *PLC) getOpLog(c echo.Context, includeNullified bool) ([]DBOp, error) {
+	did, err := syntax.ParseDID(c.Param("did"))
+	if err != nil || did.Method() != "plc" {
+		return nil, c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid did:plc"})
+	}
+
+	ops, err := plc.opLog(did.String(), includeNullified)
+	if err != nil {
+		if errors.Is(err, ErrDIDNotFound) {
+			return nil, c.JSON(http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("DID not registered: %s", did)})
+		}
+		plc.Logger.Error("failed to get ops", "err", err, "did", did)
+		return nil, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get ops"})
+	}
+
+	return ops, nil
+}
+
+// HandleGetOpLog handles the GET /:did/log endpoint, returning the operations in a DID's
+// current chain, oldest first
+func (plc *PLC) HandleGetOpLog(c echo.Context) error {
+	ops, err := plc.getOpLog(c, false)
+	if ops == nil {
+		return err
+	}
+
+	if plc.checkCache(c, ops[len(ops)-1].CID) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	log := make([]json.RawMessage, len(ops))
+	for i := range ops {
+		log[i] = ops[i].Operation
+	}
+
+	return c.JSON(http.StatusOK, log)
+}
+
+// HandleGetAuditLog handles the GET /:did/log/audit endpoint, returning every op stored for
+// a DID, including nullified ones, with their CIDs and timestamps
+func (plc *PLC) HandleGetAuditLog(c echo.Context) error {
+	ops, err := plc.getOpLog(c, true)
+	if ops == nil {
+		return err
+	}
+
+	if plc.checkCache(c, ops[len(ops)-1].CID) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	log := make([]*PLCOp, len(ops))
+	for i := range ops {
+		op, err := ops[i].ToOp()
+		if err != nil {
+			plc.Logger.Error("failed to convert op", "err", err, "seq", ops[i].ID)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to convert op"})
+		}
+		log[i] = op
+	}
+
+	return c.JSON(http.StatusOK, log)
+}
+
+// documentFromOp builds the DID document described by a DID's latest op
+func (plc *PLC) documentFromOp(did string, op *DBOp) (*DIDDocument, error) {
+	parsed, err := ParseOperation(op.Operation)
+	if err != nil {
+		plc.Logger.Error("failed to parse op", "err", err, "did", did, "cid", op.CID)
+		return nil, fmt.Errorf("failed to parse op")
+	}
+
+	doc, err := parsed.DIDDocument(did)
+	if err != nil {
+		if errors.Is(err, ErrTombstoned) {
+			return nil, err
+		}
+		plc.Logger.Error("failed to build DID document", "err", err, "did", did, "cid", op.CID)
+		return nil, fmt.Errorf("failed to build DID document")
+	}
+
+	return doc, nil
+}
+
+// currentClaim returns the latest op of the DID currently claiming a normalized handle,
+// or gorm.ErrRecordNotFound if no DID's latest op claims it
+func (plc *PLC) currentClaim(handle string) (*DBOp, error) {
+	// Find the DIDs that have claimed this handle, newest first, and return the
+	// first one whose latest op still claims it
+	var candidates []string
+	err := plc.DB.Model(&DBOp{}).
+		Where("handle = ? AND nullified = ? AND invalid = ?", handle, false, false).
+		Group("did").
+		Order("MAX(created_at) DESC").
+		Pluck("did", &candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, did := range candidates {
+		op, err := plc.latestOp(did)
+		if err != nil {
+			plc.Logger.Error("failed to get latest op", "err", err, "did", did)
+			continue
+		}
+		if op.Handle == handle {
+			return op, nil
+		}
+	}
+
+	return nil, gorm.ErrRecordNotFound
+}
+
+// HandleReverseLookup handles the GET /reverse/* endpoint, returning the DID currently claiming a handle
+func (plc *PLC) HandleReverseLookup(c echo.Context) error {
+	handle, err := syntax.ParseHandle(strings.TrimPrefix(c.Param("*"), "at://"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid handle: %s", err)})
+	}
+	handle = handle.Normalize()
+
+	op, err := plc.currentClaim(handle.String())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("handle not found: %s", handle)})
+		}
+		plc.Logger.Error("failed to look up handle", "err", err, "handle", handle)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to look up handle"})
+	}
+
+	if plc.checkCache(c, op.CID) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.JSON(http.StatusOK, ReverseResponse{DID: op.DID, Handle: handle.String()})
+}
+
+type BatchResolveRequest struct {
+	DIDs    []string `json:"dids"`
+	Handles []string `json:"handles"`
+}
+
+type BatchResolveResponse struct {
+	// Documents maps each resolved DID to its DID document
+	Documents map[string]*DIDDocument `json:"documents"`
+	// Handles maps each resolved handle to the DID currently claiming it
+	Handles map[string]string `json:"handles"`
+	// Errors maps each DID or handle that couldn't be resolved to the reason why
+	Errors map[string]string `json:"errors"`
+}
+
+// HandleBatchResolve handles the POST /batch/resolve endpoint, resolving up to BatchMaxSize
+// DIDs and handles in one request
+func (plc *PLC) HandleBatchResolve(c echo.Context) error {
+	var req BatchResolveRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid request body: %s", err)})
+	}
+
+	size := len(req.DIDs) + len(req.Handles)
+	if size == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "no DIDs or handles to resolve"})
+	}
+	if plc.BatchMaxSize > 0 && size > plc.BatchMaxSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+			Error: fmt.Sprintf("batch of %d exceeds the limit of %d DIDs and handles", size, plc.BatchMaxSize),
+		})
+	}
+	batchResolveSize.Observe(float64(size))
+
+	resp := BatchResolveResponse{
+		Documents: make(map[string]*DIDDocument),
+		Handles:   make(map[string]string),
+		Errors:    make(map[string]string),
+	}
+
+	for _, raw := range req.DIDs {
+		did, err := syntax.ParseDID(raw)
+		if err != nil {
+			resp.Errors[raw] = "invalid DID"
+			continue
+		}
+
+		res, err := plc.resolveDID(c.Request().Context(), did)
+		if err != nil {
+			if errors.Is(err, ErrTombstoned) {
+				resp.Errors[raw] = "DID not available"
+				continue
+			}
+			resp.Errors[raw] = err.Error()
+			continue
+		}
+		resp.Documents[raw] = res.Document
+	}
+
+	for _, raw := range req.Handles {
+		handle, err := syntax.ParseHandle(strings.TrimPrefix(raw, "at://"))
+		if err != nil {
+			resp.Errors[raw] = fmt.Sprintf("invalid handle: %s", err)
+			continue
+		}
+
+		op, err := plc.currentClaim(handle.Normalize().String())
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				resp.Errors[raw] = "handle not found"
+				continue
+			}
+			plc.Logger.Error("failed to look up handle", "err", err, "handle", handle)
+			resp.Errors[raw] = "failed to look up handle"
+			continue
+		}
+		resp.Handles[raw] = op.DID
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// SeqOp is an op along with its local sequence number
+type SeqOp struct {
+	Seq uint `json:"seq"`
+	*PLCOp
+}
+
+// HandleExportOps handles the GET /export/ops endpoint, returning ops as JSONLines
+// strictly ordered by their local sequence number so consumers can resume exactly. Invalid ops
+// are left out, so the sequence numbers of a page may have gaps.
+func (plc *PLC) HandleExportOps(c echo.Context) error {
+	afterSeq := uint64(0)
+	if afterParam := c.QueryParam("after_seq"); afterParam != "" {
+		after, err := strconv.ParseUint(afterParam, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid after_seq: %s", err)})
+		}
+		afterSeq = after
+	}
+
+	count := 1000
+	if countParam := c.QueryParam("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid count: %s", err)})
+		}
+		count = n
+	}
+
+	if count < 1 || count > 1000 {
+		count = 1000
+	}
+
+	var ops []DBOp
+	err := plc.DB.Where("id > ? AND invalid = ?", afterSeq, false).Order("id ASC").Limit(count).Find(&ops).Error
+	if err != nil {
+		plc.Logger.Error("failed to get ops", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get ops"})
+	}
+
+	// Convert the whole page before writing the status, so a bad op fails the request rather
+	// than truncating a 200 that a syncing consumer would take as complete
+	seqOps := make([]SeqOp, len(ops))
+	for i := range ops {
+		op, err := ops[i].ToOp()
+		if err != nil {
+			plc.Logger.Error("failed to convert op", "err", err, "seq", ops[i].ID)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to convert ops"})
+		}
+		seqOps[i] = SeqOp{Seq: ops[i].ID, PLCOp: op}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/jsonl")
+	c.Response().WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(c.Response())
+	for i := range seqOps {
+		if err := enc.Encode(seqOps[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HandleExport handles the GET /export endpoint, returning ops created after the `after`
+// timestamp as JSONLines, matching plc.directory so other mirrors can sync from this one.
+// Invalid ops are left out, as they never took effect.
+func (plc *PLC) HandleExport(c echo.Context) error {
+	q := plc.DB.Where("invalid = ?", false).Order("created_at ASC, id ASC")
+
+	if afterParam := c.QueryParam("after"); afterParam != "" {
+		after, err := time.Parse(time.RFC3339Nano, afterParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid after: %s", err)})
+		}
+		q = q.Where("created_at > ?", after)
+	}
+
+	count := 10
+	if countParam := c.QueryParam("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid count: %s", err)})
+		}
+		count = n
+	}
+
+	if count < 1 || count > 1000 {
+		count = 1000
+	}
+
+	var ops []DBOp
+	if err := q.Limit(count).Find(&ops).Error; err != nil {
+		plc.Logger.Error("failed to get ops", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get ops"})
+	}
+
+	// Convert the whole page first, since a truncated 200 would look complete to a syncing mirror
+	plcOps := make([]*PLCOp, len(ops))
+	for i := range ops {
+		op, err := ops[i].ToOp()
+		if err != nil {
+			plc.Logger.Error("failed to convert op", "err", err, "seq", ops[i].ID)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to convert ops"})
+		}
+		plcOps[i] = op
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/jsonl")
+	c.Response().WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(c.Response())
+	for _, op := range plcOps {
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type HandleClaim struct {
+	DID     string     `json:"did"`
+	From    time.Time  `json:"from"`
+	Until   *time.Time `json:"until,omitempty"`
+	Current bool       `json:"current"`
+}
+
+type HandleHistoryResponse struct {
+	Handle string        `json:"handle"`
+	Claims []HandleClaim `json:"claims"`
+}
+
+// HandleGetHandleHistory handles the GET /history/handle/:handle endpoint,
+// listing every DID that has claimed a handle and when
+func (plc *PLC) HandleGetHandleHistory(c echo.Context) error {
+	handle, err := syntax.ParseHandle(strings.TrimPrefix(c.Param("handle"), "at://"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid handle: %s", err)})
+	}
+	handle = handle.Normalize()
+
+	var dids []string
+	err = plc.DB.Model(&DBOp{}).
+		Where("handle = ? AND nullified = ? AND invalid = ?", handle.String(), false, false).
+		Distinct().
+		Pluck("did", &dids).Error
+	if err != nil {
+		plc.Logger.Error("failed to look up handle", "err", err, "handle", handle)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to look up handle"})
+	}
+
+	resp := HandleHistoryResponse{
+		Handle: handle.String(),
+		Claims: []HandleClaim{},
+	}
+
+	for _, did := range dids {
+		var ops []DBOp
+		err := plc.DB.Where("did = ? AND nullified = ? AND invalid = ?", did, false, false).Order("created_at ASC").Find(&ops).Error
+		if err != nil {
+			plc.Logger.Error("failed to get ops", "err", err, "did", did)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get ops"})
+		}
+
+		// Walk the DID's ops to find each span of time it held the handle
+		var claim *HandleClaim
+		for i := range ops {
+			held := ops[i].Handle == handle.String()
+			switch {
+			case held && claim == nil:
+				claim = &HandleClaim{DID: did, From: ops[i].CreatedAt}
+			case !held && claim != nil:
+				until := ops[i].CreatedAt
+				claim.Until = &until
+				resp.Claims = append(resp.Claims, *claim)
+				claim = nil
+			}
+		}
+		if claim != nil {
+			claim.Current = true
+			resp.Claims = append(resp.Claims, *claim)
+		}
+	}
+
+	slices.SortFunc(resp.Claims, func(a, b HandleClaim) int {
+		return a.From.Compare(b.From)
+	})
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type InvalidOp struct {
+	Seq    uint   `json:"seq"`
+	Reason string `json:"reason"`
+	*PLCOp
+}
+
+type InvalidOpsResponse struct {
+	Ops []InvalidOp `json:"ops"`
+}
+
+// HandleGetInvalidOps handles the GET /invalid-ops endpoint, listing ops whose signatures didn't
+// match the rotation keys of the op before them, or that forked the chain without a valid recovery,
+// newest first. Pass the last seq returned as before_seq to page through older ones.
+func (plc *PLC) HandleGetInvalidOps(c echo.Context) error {
+	q := plc.DB.Where("invalid = ?", true)
+
+	if beforeParam := c.QueryParam("before_seq"); beforeParam != "" {
+		before, err := strconv.ParseUint(beforeParam, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid before_seq: %s", err)})
+		}
+		q = q.Where("id < ?", before)
+	}
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid did: %s", err)})
+		}
+		q = q.Where("did = ?", did.String())
+	}
+
+	count := 100
+	if countParam := c.QueryParam("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid count: %s", err)})
+		}
+		count = n
+	}
+
+	if count < 1 || count > 1000 {
+		count = 1000
+	}
+
+	var ops []DBOp
+	if err := q.Order("id DESC").Limit(count).Find(&ops).Error; err != nil {
+		plc.Logger.Error("failed to get invalid ops", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get invalid ops"})
+	}
+
+	resp := InvalidOpsResponse{Ops: make([]InvalidOp, 0, len(ops))}
+	for i := range ops {
+		op, err := ops[i].ToOp()
+		if err != nil {
+			plc.Logger.Error("failed to convert op", "err", err, "seq", ops[i].ID)
+			return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to convert op"})
+		}
+		resp.Ops = append(resp.Ops, InvalidOp{Seq: ops[i].ID, Reason: ops[i].InvalidReason, PLCOp: op})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
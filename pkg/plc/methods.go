@@ -0,0 +1,68 @@
+package plc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+)
+
+// ErrUnsupportedDIDMethod is returned when no resolver is registered for a DID's method
+var ErrUnsupportedDIDMethod = errors.New("unsupported DID method")
+
+// ErrDIDNotFound is returned when a DID isn't known to its method's resolver
+var ErrDIDNotFound = errors.New("DID not registered")
+
+// Resolution is a DID's current document
+type Resolution struct {
+	Document *DIDDocument
+	// Version changes whenever the document does, and is used as its ETag
+	Version string
+}
+
+// MethodResolver resolves DIDs of a single method to their current document.
+// It returns ErrDIDNotFound for unknown DIDs and ErrTombstoned for deactivated ones.
+type MethodResolver interface {
+	Resolve(ctx context.Context, did syntax.DID) (*Resolution, error)
+}
+
+// RegisterMethod sets the resolver used for DIDs of a method, replacing any existing one.
+// Methods must be registered before the mirror starts serving requests.
+func (plc *PLC) RegisterMethod(method string, r MethodResolver) {
+	plc.methods[method] = r
+}
+
+// resolveDID resolves a DID with the resolver registered for its method
+func (plc *PLC) resolveDID(ctx context.Context, did syntax.DID) (*Resolution, error) {
+	r, ok := plc.methods[did.Method()]
+	if !ok {
+		unsupportedDIDMethodRequests.Inc()
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDIDMethod, did.Method())
+	}
+	return r.Resolve(ctx, did)
+}
+
+// plcMethod resolves did:plc DIDs from the mirrored ops
+type plcMethod struct {
+	plc *PLC
+}
+
+func (m *plcMethod) Resolve(ctx context.Context, did syntax.DID) (*Resolution, error) {
+	op, err := m.plc.latestOp(did.String())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDIDNotFound
+		}
+		m.plc.Logger.Error("failed to get latest op", "err", err, "did", did)
+		return nil, fmt.Errorf("failed to get latest op")
+	}
+
+	doc, err := m.plc.documentFromOp(did.String(), op)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resolution{Document: doc, Version: op.CID}, nil
+}
@@ -0,0 +1,49 @@
+package plc
+
+import (
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promFactory = metrics.NewFactory(metrics.PLCMirror, "plc")
+
+var lastOpTime = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "last_op_time_seconds",
+	Help: "The unix time of the newest op mirrored from the upstream directory",
+})
+
+var rateLimitedRequests = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "rate_limited_requests_total",
+	Help: "The number of mirror requests rejected by the rate limiter or for bad API keys",
+}, []string{"reason"})
+
+var batchResolveSize = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "batch_resolve_size",
+	Help:    "The number of DIDs and handles in each batch resolve request",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+})
+
+var unsupportedDIDMethodRequests = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "unsupported_did_method_requests_total",
+	Help: "The number of DIDs requested whose method has no registered resolver",
+})
+
+var webCacheLookups = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "did_web_cache_lookups_total",
+	Help: "The number of did:web resolutions served from the document cache (hit) or fetched from the host (miss)",
+}, []string{"result"})
+
+var webhookDeliveries = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhook_deliveries_total",
+	Help: "The number of webhook delivery attempts, by whether they were delivered, will be retried, or failed for good",
+}, []string{"result"})
+
+var opSignatureChecks = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "op_signature_checks_total",
+	Help: "The number of op signatures checked against the rotation keys of the op before them, by result",
+}, []string{"result"})
+
+var opsFailedVerification = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "ops_failed_verification_total",
+	Help: "The number of ops from the upstream whose CID didn't match their contents or whose signature was invalid",
+})
@@ -0,0 +1,102 @@
+package plc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/clause"
+)
+
+// PDSAlias maps a PDS endpoint that changed domains to its current endpoint
+type PDSAlias struct {
+	From string `gorm:"primarykey"`
+	To   string
+}
+
+type pdsAliases struct {
+	aliases map[string]string
+	lk      sync.RWMutex
+}
+
+// NormalizePDSEndpoint normalizes the scheme, case, port, and trailing slash of a PDS endpoint
+// so trivially different strings for the same host compare equal
+func NormalizePDSEndpoint(endpoint string) string {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return ""
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(strings.TrimSuffix(endpoint, "/"))
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		port = ""
+	}
+	if port != "" {
+		host = fmt.Sprintf("%s:%s", host, port)
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, host, strings.TrimSuffix(u.EscapedPath(), "/"))
+}
+
+// loadPDSAliases loads the alias table into memory
+func (plc *PLC) loadPDSAliases() error {
+	var aliases []PDSAlias
+	if err := plc.DB.Find(&aliases).Error; err != nil {
+		return fmt.Errorf("failed to load pds aliases: %w", err)
+	}
+
+	plc.pdsAliases.lk.Lock()
+	defer plc.pdsAliases.lk.Unlock()
+	plc.pdsAliases.aliases = make(map[string]string, len(aliases))
+	for _, a := range aliases {
+		plc.pdsAliases.aliases[a.From] = a.To
+	}
+
+	return nil
+}
+
+// AddPDSAlias records that the from endpoint is now known as to, rewriting existing ops to match
+func (plc *PLC) AddPDSAlias(from, to string) error {
+	alias := PDSAlias{From: NormalizePDSEndpoint(from), To: NormalizePDSEndpoint(to)}
+	if alias.From == "" || alias.To == "" || alias.From == alias.To {
+		return fmt.Errorf("invalid pds alias %q -> %q", from, to)
+	}
+
+	err := plc.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&alias).Error
+	if err != nil {
+		return fmt.Errorf("failed to save pds alias: %w", err)
+	}
+
+	err = plc.DB.Model(&DBOp{}).Where("pds = ?", alias.From).Update("pds", alias.To).Error
+	if err != nil {
+		return fmt.Errorf("failed to rewrite ops for pds alias: %w", err)
+	}
+
+	plc.pdsAliases.lk.Lock()
+	defer plc.pdsAliases.lk.Unlock()
+	plc.pdsAliases.aliases[alias.From] = alias.To
+
+	return nil
+}
+
+// resolvePDS returns the canonical endpoint for an already normalized PDS endpoint
+func (plc *PLC) resolvePDS(endpoint string) string {
+	plc.pdsAliases.lk.RLock()
+	defer plc.pdsAliases.lk.RUnlock()
+	if to, ok := plc.pdsAliases.aliases[endpoint]; ok {
+		return to
+	}
+	return endpoint
+}
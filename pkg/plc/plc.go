@@ -8,14 +8,14 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/time/rate"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -35,37 +35,63 @@ type PLC struct {
 	CheckInterval time.Duration
 	DB            *gorm.DB
 	Limiter       *rate.Limiter
+	CacheMaxAge   time.Duration
 
-	Client   *http.Client
+	// BatchMaxSize caps how many DIDs and handles a single batch resolve request can include
+	BatchMaxSize int
+
+	// VerifyOps checks each op before ingesting it, for syncing from untrusted mirrors: its CID
+	// is recomputed and its signature is checked as with VerifySignatures, and the sync stops at
+	// the first op that fails rather than storing it
+	VerifyOps bool
+	// VerifySignatures checks each op's signature against the rotation keys of the op before it,
+	// flagging invalid ops and forks rather than rejecting them
+	VerifySignatures bool
+
+	// webhooks are notified when watched DIDs' documents change, see SetWebhooks
+	webhooks atomic.Pointer[[]*Webhook]
+	// WebhookClient delivers webhook notifications
+	WebhookClient HTTPClient
+
+	// Stats keeps the aggregates served at /stats up to date as ops are ingested
+	Stats bool
+
+	// AdminToken authorizes requests to the /admin endpoints, which are disabled while it's empty
+	AdminToken string
+
+	Client   HTTPClient
+	Clock    clock.Clock
 	shutdown chan chan error
+
+	dbDriver   string
+	pdsAliases pdsAliases
+	methods    map[string]MethodResolver
 }
 
 var tracer = otel.Tracer("plc")
 
-func NewPLC(ctx context.Context, host, dataDir string, logger *slog.Logger, checkInterval time.Duration) (*PLC, error) {
+// HTTPClient makes requests to the upstream directory, satisfied by *http.Client
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+func NewPLC(ctx context.Context, host, dbDriver, dbDSN string, logger *slog.Logger, checkInterval time.Duration) (*PLC, error) {
 	logger = logger.With("module", "plc")
 
-	// Initialize a SQLite database
-	db, err := gorm.Open(sqlite.Open(filepath.Join(dataDir, "plc.db")), &gorm.Config{})
+	db, err := openDB(dbDriver, dbDSN)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
 	// Migrate the database schema
-	err = db.AutoMigrate(&Cursor{}, &DBOp{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
-	}
-
-	// Set Pragmas
-	err = db.Exec("PRAGMA journal_mode=WAL;").Error
-	if err != nil {
-		return nil, fmt.Errorf("failed to set journal mode: %w", err)
+	for _, model := range []any{&DBOp{}, &WebhookDelivery{}} {
+		if err := renameColumns(db, model, map[string]string{"d_id": "did", "c_id": "cid"}); err != nil {
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
 	}
-
-	err = db.Exec("PRAGMA synchronous=normal;").Error
+	err = db.AutoMigrate(&Cursor{}, &DBOp{}, &PDSAlias{}, &WebhookDelivery{}, &DailyStats{}, &PDSStats{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to set synchronous mode: %w", err)
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	client := &http.Client{
@@ -83,17 +109,30 @@ func NewPLC(ctx context.Context, host, dataDir string, logger *slog.Logger, chec
 		}
 	}
 
-	return &PLC{
+	plc := &PLC{
 		Logger:        logger,
 		Host:          host,
 		PageSize:      1000,
+		BatchMaxSize:  100,
 		CheckInterval: checkInterval,
 		DB:            db,
+		dbDriver:      dbDriver,
 		Client:        client,
+		WebhookClient: &http.Client{Timeout: 10 * time.Second},
+		Clock:         clock.Real,
 		Cursor:        cursor,
 		Limiter:       limiter,
 		shutdown:      make(chan chan error),
-	}, nil
+		methods:       make(map[string]MethodResolver),
+	}
+
+	plc.RegisterMethod("plc", &plcMethod{plc: plc})
+
+	if err := plc.loadPDSAliases(); err != nil {
+		return nil, err
+	}
+
+	return plc, nil
 }
 
 func (plc *PLC) Shutdown(ctx context.Context) error {
@@ -122,12 +161,13 @@ func (plc *PLC) Run(ctx context.Context) error {
 		opsSeen, err = plc.GetNextPage(ctx)
 		if err != nil {
 			plc.Logger.Error("failed to get next page", "err", err)
+			wait := 5 * time.Second
 			if err == ErrRateLimited {
-				plc.Logger.Info("rate limited, waiting 2 minutes")
-				<-time.After(2 * time.Minute)
-			} else {
-				plc.Logger.Info("waiting 5 seconds before retrying")
-				<-time.After(5 * time.Second)
+				wait = 2 * time.Minute
+			}
+			plc.Logger.Info("waiting before retrying", "wait", wait)
+			if err := plc.sleep(ctx, wait); err != nil {
+				return err
 			}
 			continue
 		}
@@ -135,13 +175,25 @@ func (plc *PLC) Run(ctx context.Context) error {
 		plc.Logger.Info("got next page", "opsSeen", opsSeen)
 
 		if opsSeen < plc.PageSize {
-			<-time.After(plc.CheckInterval)
+			if err := plc.sleep(ctx, plc.CheckInterval); err != nil {
+				return err
+			}
 		}
 	}
 }
 
 var ErrRateLimited = errors.New("rate limited")
 
+// sleep waits for d or until ctx is cancelled
+func (plc *PLC) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-plc.Clock.After(d):
+		return nil
+	}
+}
+
 func (plc *PLC) GetNextPage(ctx context.Context) (int, error) {
 	ctx, span := tracer.Start(ctx, "GetNextPage")
 	defer span.End()
@@ -189,6 +241,11 @@ func (plc *PLC) GetNextPage(ctx context.Context) (int, error) {
 
 	dbOps := make([]*DBOp, 0)
 
+	var verifier *opVerifier
+	if plc.VerifySignatures || plc.VerifyOps {
+		verifier = newOpVerifier(plc)
+	}
+
 	// Response is JSONLines
 	dec := json.NewDecoder(resp.Body)
 	for dec.More() {
@@ -198,11 +255,41 @@ func (plc *PLC) GetNextPage(ctx context.Context) (int, error) {
 			return 0, fmt.Errorf("failed to decode JSON: %w", err)
 		}
 
+		if plc.VerifyOps {
+			if err := VerifyOpCID(&op); err != nil {
+				opsFailedVerification.Inc()
+				return 0, fmt.Errorf("failed to verify op from upstream: %w", err)
+			}
+		}
+
 		dbOp, err := op.ToDBOp()
 		if err != nil {
 			return 0, fmt.Errorf("failed to convert op to dbOp: %w", err)
 		}
 
+		dbOp.PDS = plc.resolvePDS(dbOp.PDS)
+
+		if verifier != nil {
+			reason, err := verifier.verify(&op)
+			if err != nil {
+				return 0, fmt.Errorf("failed to verify op signature: %w", err)
+			}
+			dbOp.Verified = true
+			if reason != "" && plc.VerifyOps {
+				opsFailedVerification.Inc()
+				return 0, fmt.Errorf("op %s from upstream failed signature verification: %s", op.CID, reason)
+			}
+			if reason != "" {
+				dbOp.Invalid = true
+				dbOp.InvalidReason = reason
+				opSignatureChecks.WithLabelValues("invalid").Inc()
+				plc.Logger.Warn("invalid op", "did", op.DID, "cid", op.CID, "reason", reason)
+			} else {
+				opSignatureChecks.WithLabelValues("valid").Inc()
+			}
+			verifier.add(dbOp)
+		}
+
 		dbOps = append(dbOps, dbOp)
 
 		newOps++
@@ -216,28 +303,107 @@ func (plc *PLC) GetNextPage(ctx context.Context) (int, error) {
 		return 0, nil
 	}
 
-	err = plc.DB.CreateInBatches(dbOps, 100).Error
+	var prevs map[*DBOp]*DBOp
+	if len(plc.Webhooks()) > 0 || plc.Stats {
+		prevs, err = plc.pagePrevs(dbOps)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	deliveries, err := plc.queueWebhooks(dbOps, prevs)
 	if err != nil {
-		return 0, fmt.Errorf("failed to save ops: %w", err)
+		return 0, fmt.Errorf("failed to build webhook deliveries: %w", err)
 	}
 
-	err = plc.DB.Save(plc.Cursor).Error
+	var stats *pageStats
+	if plc.Stats {
+		stats, err = newPageStats(dbOps, prevs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compute stats: %w", err)
+		}
+	}
+
+	// Save the page, its webhook deliveries, its stats, and the cursor together, so a failed write
+	// doesn't skip or duplicate ops
+	err = plc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(dbOps, insertBatchSize(plc.dbDriver)).Error; err != nil {
+			return fmt.Errorf("failed to save ops: %w", err)
+		}
+		if len(deliveries) > 0 {
+			if err := tx.CreateInBatches(deliveries, insertBatchSize(plc.dbDriver)).Error; err != nil {
+				return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+			}
+		}
+		if stats != nil {
+			if err := stats.save(tx); err != nil {
+				return fmt.Errorf("failed to save stats: %w", err)
+			}
+		}
+		if err := tx.Save(plc.Cursor).Error; err != nil {
+			return fmt.Errorf("failed to save cursor: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to save cursor: %w", err)
+		return 0, err
 	}
+	lastOpTime.Set(float64(plc.Cursor.LastCreatedAt.UnixMilli()) / 1000)
 
 	return newOps, nil
 }
 
+// pagePrevs returns the op each op in a page follows, for ops that have one
+func (plc *PLC) pagePrevs(page []*DBOp) (map[*DBOp]*DBOp, error) {
+	// Earlier ops in the page aren't saved yet, so look there for an op's prev first
+	byCID := make(map[string]*DBOp, len(page))
+	for _, op := range page {
+		byCID[op.DID+"/"+op.CID] = op
+	}
+
+	prevs := make(map[*DBOp]*DBOp, len(page))
+	for _, op := range page {
+		parsed, err := ParseOperation(op.Operation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse op: %w", err)
+		}
+		if parsed.Prev == nil {
+			continue
+		}
+
+		if prev, ok := byCID[op.DID+"/"+*parsed.Prev]; ok {
+			prevs[op] = prev
+			continue
+		}
+
+		var found DBOp
+		err = plc.DB.Where("did = ? AND cid = ?", op.DID, *parsed.Prev).First(&found).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get previous op: %w", err)
+		}
+		prevs[op] = &found
+	}
+
+	return prevs, nil
+}
+
 type DBOp struct {
 	gorm.Model
-	DID       string    `gorm:"index:idx_did_cid;index:idx_did_created_at"`
-	CID       string    `gorm:"index:idx_did_cid"`
-	CreatedAt time.Time `gorm:"index:idx_did_created_at,sort:desc"`
+	DID       string    `gorm:"column:did;index:idx_did_cid;index:idx_did_created_at"`
+	CID       string    `gorm:"column:cid;index:idx_did_cid"`
+	CreatedAt time.Time `gorm:"index:idx_did_created_at,sort:desc;index:idx_created_at"`
 	Nullified bool
 	Operation []byte
 	PDS       string `gorm:"index:idx_pds"`
 	Handle    string `gorm:"index:idx_handle"`
+
+	// Verified is set once the op's signature has been checked, and Invalid if the check failed
+	Verified      bool
+	Invalid       bool `gorm:"index:idx_invalid"`
+	InvalidReason string
 }
 
 type PLCOp struct {
@@ -286,6 +452,11 @@ func (op *PLCOp) ToDBOp() (*DBOp, error) {
 				}
 			}
 		}
+
+		// Legacy create ops have a top-level "handle" key instead
+		if legacyHandle, ok := opMap["handle"].(string); ok && handle == "" {
+			handle = legacyHandle
+		}
 	}
 
 	// Extract PDS from the operation "services.atproto_pds.endpoint" key
@@ -298,6 +469,11 @@ func (op *PLCOp) ToDBOp() (*DBOp, error) {
 				}
 			}
 		}
+
+		// Legacy create ops have a top-level "service" key instead
+		if legacyService, ok := opMap["service"].(string); ok && pds == "" {
+			pds = legacyService
+		}
 	}
 
 	return &DBOp{
@@ -306,8 +482,8 @@ func (op *PLCOp) ToDBOp() (*DBOp, error) {
 		CreatedAt: op.CreatedAt,
 		Nullified: op.Nullified,
 		Operation: opJSON,
-		Handle:    handle,
-		PDS:       pds,
+		Handle:    strings.ToLower(handle),
+		PDS:       NormalizePDSEndpoint(pds),
 	}, nil
 }
 
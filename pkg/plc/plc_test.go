@@ -0,0 +1,390 @@
+package plc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	testDID   = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	otherDID  = "did:plc:44ybard66vv44zksje25o7dz"
+	testEpoch = "2024-01-01T00:00:00Z"
+)
+
+func newTestPLC(t *testing.T, dsn string) *PLC {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	plc, err := NewPLC(context.Background(), "https://plc.directory", DriverSQLite, dsn, logger, time.Minute)
+	if err != nil {
+		t.Fatalf("NewPLC: %v", err)
+	}
+	return plc
+}
+
+func testOp(did, cid string, at time.Time, nullified bool, handle, operation string) *DBOp {
+	return &DBOp{
+		DID:       did,
+		CID:       cid,
+		CreatedAt: at,
+		Nullified: nullified,
+		Handle:    handle,
+		Operation: []byte(operation),
+	}
+}
+
+// seedOps stores a DID whose second op was nullified by a fork and whose latest op is a forgery,
+// and another DID that later claimed the first's handle
+func seedOps(t *testing.T, plc *PLC) {
+	t.Helper()
+	epoch, _ := time.Parse(time.RFC3339, testEpoch)
+	ops := []*DBOp{
+		testOp(testDID, "cid-1", epoch, false, "alice.test", `{"type":"plc_operation","prev":null}`),
+		testOp(testDID, "cid-2", epoch.Add(time.Hour), true, "alice.test", `{"type":"plc_operation","prev":"cid-1"}`),
+		testOp(testDID, "cid-3", epoch.Add(2*time.Hour), false, "alice2.test", `{"type":"plc_operation","prev":"cid-1"}`),
+		testOp(otherDID, "cid-4", epoch.Add(3*time.Hour), false, "alice.test", `{"type":"plc_operation","prev":null}`),
+		testOp(testDID, "cid-forged", epoch.Add(4*time.Hour), false, "mallory.test", `{"type":"plc_operation","prev":"cid-3"}`),
+	}
+	ops[4].Invalid = true
+	ops[4].InvalidReason = "test"
+	if err := plc.DB.Create(ops).Error; err != nil {
+		t.Fatalf("failed to seed ops: %v", err)
+	}
+}
+
+func TestLatestOp(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	latest, err := plc.latestOp(testDID)
+	if err != nil {
+		t.Fatalf("latestOp: %v", err)
+	}
+	if latest.CID != "cid-3" {
+		t.Errorf("latestOp CID = %s, want cid-3", latest.CID)
+	}
+
+	claim, err := plc.currentClaim("alice.test")
+	if err != nil {
+		t.Fatalf("currentClaim: %v", err)
+	}
+	if claim.DID != otherDID {
+		t.Errorf("currentClaim DID = %s, want %s", claim.DID, otherDID)
+	}
+
+	// The forged op never took effect, so its handle isn't claimed
+	if claim, err := plc.currentClaim("mallory.test"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("currentClaim of a forged op's handle = %v, %v, want not found", claim, err)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	e := echo.New()
+	e.GET("/history/handle/:handle", plc.HandleGetHandleHistory)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history/handle/alice.test", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /history/handle/alice.test = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp HandleHistoryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Claims) != 2 {
+		t.Errorf("got %d claims, want 2", len(resp.Claims))
+	}
+}
+
+func TestOpLog(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	ops, err := plc.opLog(testDID, false)
+	if err != nil {
+		t.Fatalf("opLog: %v", err)
+	}
+	if len(ops) != 2 {
+		t.Errorf("opLog returned %d ops, want 2", len(ops))
+	}
+	if ops, err = plc.opLog(testDID, true); err != nil || len(ops) != 4 {
+		t.Errorf("opLog with nullified returned %d ops, err %v, want 4", len(ops), err)
+	}
+
+	e := echo.New()
+	e.GET("/:did/log", plc.HandleGetOpLog)
+	e.GET("/:did/log/audit", plc.HandleGetAuditLog)
+	for _, path := range []string{"/" + testDID + "/log", "/" + testDID + "/log/audit"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestVerifierQueries(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	v := newOpVerifier(plc)
+	found, err := v.findOp(testDID, "cid-2")
+	if err != nil || found == nil {
+		t.Fatalf("findOp = %v, %v, want the stored op", found, err)
+	}
+	epoch, _ := time.Parse(time.RFC3339, testEpoch)
+	next, err := v.nextAfter(testDID, epoch)
+	if err != nil || next == nil || next.CID != "cid-3" {
+		t.Errorf("nextAfter = %v, %v, want cid-3", next, err)
+	}
+
+	e := echo.New()
+	e.GET("/invalid-ops", plc.HandleGetInvalidOps)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/invalid-ops?did="+testDID, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /invalid-ops = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp InvalidOpsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Ops) != 1 {
+		t.Errorf("got %d invalid ops, want 1", len(resp.Ops))
+	}
+}
+
+func TestExportSkipsInvalidOps(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	e := echo.New()
+	e.GET("/export", plc.HandleExport)
+	e.GET("/export/ops", plc.HandleExportOps)
+	for _, path := range []string{"/export?count=100", "/export/ops"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, rec.Code, rec.Body.String())
+		}
+		if strings.Contains(rec.Body.String(), "cid-forged") {
+			t.Errorf("GET %s exported the invalid op", path)
+		}
+		if lines := strings.Count(rec.Body.String(), "\n"); lines != 4 {
+			t.Errorf("GET %s returned %d ops, want 4", path, lines)
+		}
+	}
+}
+
+func TestPagePrevs(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	seedOps(t, plc)
+
+	epoch, _ := time.Parse(time.RFC3339, testEpoch)
+	page := []*DBOp{testOp(testDID, "cid-5", epoch.Add(4*time.Hour), false, "", `{"type":"plc_operation","prev":"cid-3"}`)}
+	prevs, err := plc.pagePrevs(page)
+	if err != nil {
+		t.Fatalf("pagePrevs: %v", err)
+	}
+	if prev := prevs[page[0]]; prev == nil || prev.CID != "cid-3" {
+		t.Errorf("pagePrevs found %v, want cid-3", prev)
+	}
+}
+
+// legacyOp is DBOp as stored before its DID and CID columns were named explicitly
+type legacyOp struct {
+	gorm.Model
+	DID       string
+	CID       string
+	Nullified bool
+	Operation []byte
+	PDS       string
+	Handle    string
+}
+
+func (legacyOp) TableName() string { return "db_ops" }
+
+func TestRenameLegacyColumns(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "plc.db")
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	if err := db.AutoMigrate(&legacyOp{}); err != nil {
+		t.Fatalf("failed to create legacy table: %v", err)
+	}
+	if !db.Migrator().HasColumn(&legacyOp{}, "d_id") {
+		t.Fatal("legacy table has no d_id column")
+	}
+	if err := db.Create(&legacyOp{DID: testDID, CID: "cid-1"}).Error; err != nil {
+		t.Fatalf("failed to insert legacy op: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	plc := newTestPLC(t, dsn)
+	op, err := plc.latestOp(testDID)
+	if err != nil {
+		t.Fatalf("latestOp after migration: %v", err)
+	}
+	if op.CID != "cid-1" {
+		t.Errorf("migrated op CID = %q, want cid-1", op.CID)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	deliveries := []*WebhookDelivery{
+		{Webhook: "test", DID: testDID, CID: "cid-1", Status: DeliveryPending},
+		{Webhook: "test", DID: otherDID, CID: "cid-4", Status: DeliveryDelivered},
+	}
+	if err := plc.DB.Create(deliveries).Error; err != nil {
+		t.Fatalf("failed to seed deliveries: %v", err)
+	}
+
+	e := echo.New()
+	e.GET("/admin/webhooks/deliveries", plc.HandleGetWebhookDeliveries, plc.RequireAdmin)
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/webhooks/deliveries?did="+testDID, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("without an admin token configured got %d, want 501", rec.Code)
+	}
+
+	plc.AdminToken = "secret"
+	if rec := get("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("with the wrong token got %d, want 401", rec.Code)
+	}
+
+	rec := get("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/webhooks/deliveries = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp WebhookDeliveriesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Deliveries) != 1 || resp.Deliveries[0].DID != testDID {
+		t.Errorf("got deliveries %+v, want the one for %s", resp.Deliveries, testDID)
+	}
+}
+
+// handleMap resolves handles from a map, standing in for DNS and well-known lookups
+type handleMap map[syntax.Handle]syntax.DID
+
+func (m handleMap) ResolveHandle(ctx context.Context, handle syntax.Handle) (syntax.DID, error) {
+	if did, ok := m[handle]; ok {
+		return did, nil
+	}
+	return "", identity.ErrHandleNotFound
+}
+
+func TestDirectoryHandles(t *testing.T) {
+	plc := newTestPLC(t, filepath.Join(t.TempDir(), "plc.db"))
+	epoch, _ := time.Parse(time.RFC3339, testEpoch)
+	op := testOp(testDID, "cid-1", epoch, false, "carol.test", `{
+		"type": "plc_operation",
+		"prev": null,
+		"rotationKeys": ["did:key:zQ3shhCGUqDKjStzuDxPkTxN6ujddP4RkEKJJouJGRRkaLGbg"],
+		"verificationMethods": {"atproto": "did:key:zQ3shhCGUqDKjStzuDxPkTxN6ujddP4RkEKJJouJGRRkaLGbg"},
+		"alsoKnownAs": ["at://carol.test"],
+		"services": {"atproto_pds": {"type": "AtprotoPersonalDataServer", "endpoint": "https://pds.example.com"}}
+	}`)
+	if err := plc.DB.Create(op).Error; err != nil {
+		t.Fatalf("failed to seed op: %v", err)
+	}
+	ctx := context.Background()
+	did := syntax.DID(testDID)
+
+	// Without a resolver the declared handle can't be verified
+	ident, err := plc.Directory(nil).LookupDID(ctx, did)
+	if err != nil {
+		t.Fatalf("LookupDID: %v", err)
+	}
+	if ident.Handle != syntax.HandleInvalid {
+		t.Errorf("handle without a resolver = %s, want %s", ident.Handle, syntax.HandleInvalid)
+	}
+	if _, err := plc.Directory(nil).LookupHandle(ctx, "carol.test"); err == nil {
+		t.Error("LookupHandle without a resolver succeeded")
+	}
+
+	// A handle pointing elsewhere isn't trusted
+	ident, err = plc.Directory(handleMap{"carol.test": otherDID}).LookupDID(ctx, did)
+	if err != nil {
+		t.Fatalf("LookupDID: %v", err)
+	}
+	if ident.Handle != syntax.HandleInvalid {
+		t.Errorf("mismatched handle = %s, want %s", ident.Handle, syntax.HandleInvalid)
+	}
+
+	ident, err = plc.Directory(handleMap{"carol.test": did}).LookupHandle(ctx, "carol.test")
+	if err != nil {
+		t.Fatalf("LookupHandle: %v", err)
+	}
+	if ident.DID != did || ident.Handle != "carol.test" {
+		t.Errorf("LookupHandle = %s %s, want %s carol.test", ident.DID, ident.Handle, did)
+	}
+}
+
+func TestRateLimiterThrottlesInvalidKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl := NewRateLimiter(ctx, 2, 100, []string{"good-key"}, false)
+
+	e := echo.New()
+	e.Use(rl.Middleware)
+	e.GET("/ok", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	get := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		codes = append(codes, get("bad-key").Code)
+	}
+	if want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}; !slices.Equal(codes, want) {
+		t.Errorf("invalid key codes = %v, want %v", codes, want)
+	}
+
+	rec := get("bad-key")
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Errorf("rate limited body %q isn't an ErrorResponse", rec.Body.String())
+	}
+
+	if rec := get("good-key"); rec.Code != http.StatusOK {
+		t.Errorf("valid key = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
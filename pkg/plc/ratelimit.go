@@ -0,0 +1,158 @@
+package plc
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter limits requests per client IP, with separate (usually higher)
+// limits for clients that present a known API key
+type RateLimiter struct {
+	ipLimit    rate.Limit
+	keyLimit   rate.Limit
+	apiKeys    [][]byte
+	requireKey bool
+
+	limiters map[string]*limiterEntry
+	lk       sync.Mutex
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a rate limiter allowing ipLimit requests per second per IP
+// and keyLimit requests per second per API key. If requireKey is set, requests
+// without a valid API key are rejected.
+func NewRateLimiter(ctx context.Context, ipLimit, keyLimit float64, apiKeys []string, requireKey bool) *RateLimiter {
+	var keys [][]byte
+	for _, k := range apiKeys {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			keys = append(keys, []byte(k))
+		}
+	}
+
+	rl := &RateLimiter{
+		ipLimit:    rate.Limit(ipLimit),
+		keyLimit:   rate.Limit(keyLimit),
+		apiKeys:    keys,
+		requireKey: requireKey,
+		limiters:   make(map[string]*limiterEntry),
+	}
+
+	// Start a routine to forget about clients we haven't seen in a while
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rl.cleanup(5 * time.Minute)
+			}
+		}
+	}()
+
+	return rl
+}
+
+func (rl *RateLimiter) cleanup(maxIdle time.Duration) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	for k, entry := range rl.limiters {
+		if time.Since(entry.lastSeen) > maxIdle {
+			delete(rl.limiters, k)
+		}
+	}
+}
+
+func (rl *RateLimiter) allow(key string, limit rate.Limit) bool {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	entry, ok := rl.limiters[key]
+	if !ok {
+		burst := int(limit)
+		if burst < 1 {
+			burst = 1
+		}
+		entry = &limiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		rl.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+
+	return entry.limiter.Allow()
+}
+
+// validKey reports whether key is a configured API key, comparing it against every key in
+// constant time so the comparison doesn't leak how much of a key was guessed
+func (rl *RateLimiter) validKey(key string) bool {
+	valid := 0
+	for _, k := range rl.apiKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), k)
+	}
+	return valid == 1
+}
+
+// apiKeyFromRequest returns the API key from the Authorization or X-API-Key headers
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Middleware enforces authentication and rate limits, skipping the metrics endpoint. Requests
+// with an invalid or missing API key are charged to the IP limiter before they're rejected, so
+// guessing keys is throttled like any other anonymous traffic.
+func (rl *RateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Path() == "/metrics" {
+			return next(c)
+		}
+
+		key := apiKeyFromRequest(c.Request())
+		valid := key != "" && rl.validKey(key)
+
+		limiterKey := "ip:" + c.RealIP()
+		limit := rl.ipLimit
+		if valid {
+			limiterKey = "key:" + key
+			limit = rl.keyLimit
+		}
+
+		c.Response().Header().Set("X-RateLimit-Limit", fmt.Sprintf("%g", float64(limit)))
+
+		if !rl.allow(limiterKey, limit) {
+			if valid {
+				rateLimitedRequests.WithLabelValues("key").Inc()
+			} else {
+				rateLimitedRequests.WithLabelValues("ip").Inc()
+			}
+			c.Response().Header().Set("Retry-After", "1")
+			return c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "rate limit exceeded"})
+		}
+
+		switch {
+		case key != "" && !valid:
+			rateLimitedRequests.WithLabelValues("invalid_key").Inc()
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid API key"})
+		case key == "" && rl.requireKey:
+			rateLimitedRequests.WithLabelValues("missing_key").Inc()
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "API key required"})
+		}
+
+		return next(c)
+	}
+}
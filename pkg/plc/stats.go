@@ -0,0 +1,280 @@
+package plc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// statsDayFormat is the layout of the UTC days stats are aggregated by
+const statsDayFormat = "2006-01-02"
+
+// DailyStats aggregates the ops ingested for each UTC day, by the day the op was created
+type DailyStats struct {
+	Day           string `gorm:"primaryKey" json:"day"`
+	Ops           int64  `json:"ops"`
+	NewDIDs       int64  `gorm:"column:new_dids" json:"new_dids"`
+	HandleChanges int64  `json:"handle_changes"`
+	PDSChanges    int64  `json:"pds_changes"`
+	KeyRotations  int64  `json:"key_rotations"`
+	Tombstones    int64  `json:"tombstones"`
+}
+
+// PDSStats counts the DIDs currently hosted on each PDS
+type PDSStats struct {
+	PDS  string `gorm:"primaryKey" json:"pds"`
+	DIDs int64  `gorm:"column:dids" json:"dids"`
+}
+
+// pageStats holds the changes a page of ops makes to the aggregates
+type pageStats struct {
+	days map[string]*DailyStats
+	pds  map[string]int64
+}
+
+// newPageStats tallies a page of ops against the ops they follow
+func newPageStats(page []*DBOp, prevs map[*DBOp]*DBOp) (*pageStats, error) {
+	s := &pageStats{
+		days: make(map[string]*DailyStats),
+		pds:  make(map[string]int64),
+	}
+
+	for _, op := range page {
+		day := op.CreatedAt.UTC().Format(statsDayFormat)
+		d, ok := s.days[day]
+		if !ok {
+			d = &DailyStats{Day: day}
+			s.days[day] = d
+		}
+		d.Ops++
+
+		// Nullified and invalid ops never took effect, so they don't change any DID
+		if op.Nullified || op.Invalid {
+			continue
+		}
+
+		prev := prevs[op]
+		changes, err := opChanges(op, prev)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, change := range changes {
+			switch change {
+			case ChangeCreate:
+				d.NewDIDs++
+				s.movePDS("", op.PDS)
+			case ChangeTombstone:
+				d.Tombstones++
+				if prev != nil {
+					s.movePDS(prev.PDS, "")
+				}
+			case ChangeHandle:
+				d.HandleChanges++
+			case ChangePDS:
+				d.PDSChanges++
+				s.movePDS(prev.PDS, op.PDS)
+			case ChangeKeys:
+				d.KeyRotations++
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// movePDS moves a DID from one PDS to another, either of which may be empty
+func (s *pageStats) movePDS(from, to string) {
+	if from != "" {
+		s.pds[from]--
+	}
+	if to != "" {
+		s.pds[to]++
+	}
+}
+
+// save adds the page's stats to the aggregate tables
+func (s *pageStats) save(tx *gorm.DB) error {
+	days := make([]DailyStats, 0, len(s.days))
+	for _, d := range s.days {
+		days = append(days, *d)
+	}
+	if len(days) > 0 {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"ops":            gorm.Expr("daily_stats.ops + excluded.ops"),
+				"new_dids":       gorm.Expr("daily_stats.new_dids + excluded.new_dids"),
+				"handle_changes": gorm.Expr("daily_stats.handle_changes + excluded.handle_changes"),
+				"pds_changes":    gorm.Expr("daily_stats.pds_changes + excluded.pds_changes"),
+				"key_rotations":  gorm.Expr("daily_stats.key_rotations + excluded.key_rotations"),
+				"tombstones":     gorm.Expr("daily_stats.tombstones + excluded.tombstones"),
+			}),
+		}).Create(&days).Error
+		if err != nil {
+			return fmt.Errorf("failed to save daily stats: %w", err)
+		}
+	}
+
+	pds := make([]PDSStats, 0, len(s.pds))
+	for endpoint, delta := range s.pds {
+		if delta != 0 {
+			pds = append(pds, PDSStats{PDS: endpoint, DIDs: delta})
+		}
+	}
+	if len(pds) > 0 {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "pds"}},
+			DoUpdates: clause.Assignments(map[string]any{"dids": gorm.Expr("pds_stats.dids + excluded.dids")}),
+		}).Create(&pds).Error
+		if err != nil {
+			return fmt.Errorf("failed to save pds stats: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type StatsResponse struct {
+	// DIDs is the number of DIDs created, and ActiveDIDs those of them not tombstoned
+	DIDs          int64 `gorm:"column:dids" json:"dids"`
+	ActiveDIDs    int64 `json:"active_dids"`
+	Ops           int64 `json:"ops"`
+	HandleChanges int64 `json:"handle_changes"`
+	PDSChanges    int64 `json:"pds_changes"`
+	KeyRotations  int64 `json:"key_rotations"`
+	Tombstones    int64 `json:"tombstones"`
+	// PDSes is the number of PDSes hosting at least one DID
+	PDSes int64 `json:"pdses"`
+	// FirstDay and LastDay are the range of days the stats cover
+	FirstDay string `json:"first_day,omitempty"`
+	LastDay  string `json:"last_day,omitempty"`
+	Days     int64  `json:"days"`
+}
+
+// HandleGetStats handles the GET /stats endpoint, summarizing the DIDs and ops in the mirror
+func (plc *PLC) HandleGetStats(c echo.Context) error {
+	if !plc.Stats {
+		return c.JSON(http.StatusNotImplemented, ErrorResponse{Error: "stats are not enabled on this mirror"})
+	}
+
+	var resp StatsResponse
+	err := plc.DB.Model(&DailyStats{}).Select(
+		"COALESCE(SUM(ops), 0) AS ops",
+		"COALESCE(SUM(new_dids), 0) AS dids",
+		"COALESCE(SUM(handle_changes), 0) AS handle_changes",
+		"COALESCE(SUM(pds_changes), 0) AS pds_changes",
+		"COALESCE(SUM(key_rotations), 0) AS key_rotations",
+		"COALESCE(SUM(tombstones), 0) AS tombstones",
+		"COALESCE(MIN(day), '') AS first_day",
+		"COALESCE(MAX(day), '') AS last_day",
+		"COUNT(*) AS days",
+	).Scan(&resp).Error
+	if err != nil {
+		plc.Logger.Error("failed to get stats", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get stats"})
+	}
+	resp.ActiveDIDs = resp.DIDs - resp.Tombstones
+
+	if err := plc.DB.Model(&PDSStats{}).Where("dids > 0").Count(&resp.PDSes).Error; err != nil {
+		plc.Logger.Error("failed to count pdses", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get stats"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type DailyStatsResponse struct {
+	Days []DailyStats `json:"days"`
+}
+
+// HandleGetDailyStats handles the GET /stats/daily endpoint, listing the ops, new DIDs, handle and
+// PDS changes, key rotations, and tombstones of each UTC day, newest first
+// Query params:
+// since - only return days on or after this day (YYYY-MM-DD)
+// until - only return days on or before this day (YYYY-MM-DD)
+// count - max number of days to return (default 100, max 1000)
+func (plc *PLC) HandleGetDailyStats(c echo.Context) error {
+	if !plc.Stats {
+		return c.JSON(http.StatusNotImplemented, ErrorResponse{Error: "stats are not enabled on this mirror"})
+	}
+
+	q := plc.DB.Model(&DailyStats{})
+
+	for _, bound := range []struct{ param, cond string }{{"since", "day >= ?"}, {"until", "day <= ?"}} {
+		if v := c.QueryParam(bound.param); v != "" {
+			if _, err := time.Parse(statsDayFormat, v); err != nil {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid %s, expected YYYY-MM-DD", bound.param)})
+			}
+			q = q.Where(bound.cond, v)
+		}
+	}
+
+	count, err := parseStatsCount(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	resp := DailyStatsResponse{Days: []DailyStats{}}
+	if err := q.Order("day DESC").Limit(count).Find(&resp.Days).Error; err != nil {
+		plc.Logger.Error("failed to get daily stats", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get daily stats"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type PDSStatsResponse struct {
+	// DIDs is the number of DIDs hosted across every PDS
+	DIDs  int64      `json:"dids"`
+	PDSes []PDSStats `json:"pdses"`
+}
+
+// HandleGetPDSStats handles the GET /stats/pds endpoint, listing the PDSes hosting the most DIDs
+// Query params:
+// count - max number of PDSes to return (default 100, max 1000)
+func (plc *PLC) HandleGetPDSStats(c echo.Context) error {
+	if !plc.Stats {
+		return c.JSON(http.StatusNotImplemented, ErrorResponse{Error: "stats are not enabled on this mirror"})
+	}
+
+	count, err := parseStatsCount(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	resp := PDSStatsResponse{PDSes: []PDSStats{}}
+	err = plc.DB.Model(&PDSStats{}).Where("dids > 0").Select("COALESCE(SUM(dids), 0)").Scan(&resp.DIDs).Error
+	if err != nil {
+		plc.Logger.Error("failed to sum pds stats", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get pds stats"})
+	}
+
+	if err := plc.DB.Where("dids > 0").Order("dids DESC").Limit(count).Find(&resp.PDSes).Error; err != nil {
+		plc.Logger.Error("failed to get pds stats", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get pds stats"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func parseStatsCount(c echo.Context) (int, error) {
+	count := 100
+	if countParam := c.QueryParam("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil {
+			return 0, fmt.Errorf("invalid count: %s", err)
+		}
+		count = n
+	}
+
+	if count < 1 || count > 1000 {
+		count = 1000
+	}
+	return count, nil
+}
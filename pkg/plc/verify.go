@@ -0,0 +1,259 @@
+package plc
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	"gorm.io/gorm"
+)
+
+// VerifyOpCID checks that an op's CID matches the hash of its DAG-CBOR encoded
+// contents, catching ops that were altered by an intermediate mirror
+func VerifyOpCID(op *PLCOp) error {
+	node, err := cbornode.WrapObject(op.Operation, multihash.SHA2_256, -1)
+	if err != nil {
+		return fmt.Errorf("failed to encode operation: %w", err)
+	}
+
+	if node.Cid().String() != op.CID {
+		return fmt.Errorf("cid mismatch for op of %s: expected %s, computed %s", op.DID, op.CID, node.Cid())
+	}
+
+	return nil
+}
+
+// recoveryWindow is how long after an op a higher priority rotation key can fork the chain to nullify it
+const recoveryWindow = 72 * time.Hour
+
+// rotationKeys returns the did:key rotation keys of an op, highest priority first.
+// Legacy create ops are controlled by their recovery key, then their signing key.
+func rotationKeys(op map[string]any) []string {
+	if op["type"] == "create" {
+		var keys []string
+		for _, field := range []string{"recoveryKey", "signingKey"} {
+			if k, ok := op[field].(string); ok {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+
+	raw, _ := op["rotationKeys"].([]any)
+	keys := make([]string, 0, len(raw))
+	for _, k := range raw {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+		}
+	}
+	return keys
+}
+
+// signerIndex returns the index of the key in keys that signed op
+func signerIndex(op map[string]any, keys []string) (int, error) {
+	rawSig, ok := op["sig"].(string)
+	if !ok {
+		return -1, fmt.Errorf("op has no signature")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rawSig, "="))
+	if err != nil {
+		return -1, fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	unsigned := make(map[string]any, len(op))
+	for k, v := range op {
+		if k != "sig" {
+			unsigned[k] = v
+		}
+	}
+	content, err := cbornode.DumpObject(unsigned)
+	if err != nil {
+		return -1, fmt.Errorf("failed to encode unsigned op: %w", err)
+	}
+
+	for i, k := range keys {
+		pub, err := crypto.ParsePublicDIDKey(k)
+		if err != nil {
+			continue
+		}
+		if pub.HashAndVerify(content, sig) == nil {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("signature doesn't match any rotation key")
+}
+
+// genesisDID returns the DID a genesis op creates, derived from the hash of the signed op
+func genesisDID(op map[string]any) (string, error) {
+	raw, err := cbornode.DumpObject(op)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode genesis op: %w", err)
+	}
+	hash := sha256.Sum256(raw)
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:]))
+	return "did:plc:" + encoded[:24], nil
+}
+
+// opVerifier checks the signatures of a page of ops against the ops already stored, and the
+// ops earlier in the page that haven't been saved yet
+type opVerifier struct {
+	plc   *PLC
+	byDID map[string][]*DBOp
+}
+
+func newOpVerifier(plc *PLC) *opVerifier {
+	return &opVerifier{plc: plc, byDID: make(map[string][]*DBOp)}
+}
+
+// add makes an op visible to the ops after it in the page
+func (v *opVerifier) add(op *DBOp) {
+	v.byDID[op.DID] = append(v.byDID[op.DID], op)
+}
+
+// findOp returns the op of a DID with a CID, or nil if there isn't one
+func (v *opVerifier) findOp(did, cid string) (*DBOp, error) {
+	for _, op := range v.byDID[did] {
+		if op.CID == cid {
+			return op, nil
+		}
+	}
+
+	var op DBOp
+	err := v.plc.DB.Where("did = ? AND cid = ?", did, cid).First(&op).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &op, nil
+}
+
+// head returns the latest op of a DID that took effect, or nil if it has none. Nullified and
+// invalid ops are skipped, so a forged op can't become the head the next op is checked against.
+func (v *opVerifier) head(did string) (*DBOp, error) {
+	pending := v.byDID[did]
+	for i := len(pending) - 1; i >= 0; i-- {
+		if !pending[i].Nullified && !pending[i].Invalid {
+			return pending[i], nil
+		}
+	}
+
+	op, err := v.plc.latestOp(did)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return op, nil
+}
+
+// nextAfter returns the earliest valid, non-nullified op of a DID created after t, which a fork
+// back to an op created at t nullifies
+func (v *opVerifier) nextAfter(did string, t time.Time) (*DBOp, error) {
+	var op DBOp
+	err := v.plc.DB.Where("did = ? AND nullified = ? AND invalid = ? AND created_at > ?", did, false, false, t).Order("created_at ASC").First(&op).Error
+	if err == nil {
+		return &op, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	for _, pending := range v.byDID[did] {
+		if !pending.Nullified && !pending.Invalid && pending.CreatedAt.After(t) {
+			return pending, nil
+		}
+	}
+	return nil, nil
+}
+
+// verify checks an op's signature against the rotation keys of the op before it, and that a
+// fork of the chain is a valid recovery. It returns why the op is invalid, or an empty string
+// if it's valid.
+func (v *opVerifier) verify(op *PLCOp) (string, error) {
+	opMap, ok := op.Operation.(map[string]any)
+	if !ok {
+		return "operation is not an object", nil
+	}
+
+	prevCID, _ := opMap["prev"].(string)
+	if prevCID == "" {
+		if _, err := signerIndex(opMap, rotationKeys(opMap)); err != nil {
+			return fmt.Sprintf("genesis op: %s", err), nil
+		}
+		did, err := genesisDID(opMap)
+		if err != nil {
+			return err.Error(), nil
+		}
+		if did != op.DID {
+			return fmt.Sprintf("genesis op creates %s, not %s", did, op.DID), nil
+		}
+		return "", nil
+	}
+
+	prev, err := v.findOp(op.DID, prevCID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get prev op: %w", err)
+	}
+	if prev == nil {
+		return fmt.Sprintf("prev op %s not found", prevCID), nil
+	}
+
+	var prevMap map[string]any
+	if err := json.Unmarshal(prev.Operation, &prevMap); err != nil {
+		return "", fmt.Errorf("failed to parse prev op: %w", err)
+	}
+	if prevMap["type"] == "plc_tombstone" {
+		return "op follows a tombstone", nil
+	}
+
+	keys := rotationKeys(prevMap)
+	signer, err := signerIndex(opMap, keys)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	head, err := v.head(op.DID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get latest op: %w", err)
+	}
+	if head == nil || head.CID == prevCID {
+		return "", nil
+	}
+
+	// The op forks the chain, which is only allowed to recover from a recent op
+	// signed by a lower priority rotation key
+	nullified, err := v.nextAfter(op.DID, prev.CreatedAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to get forked op: %w", err)
+	}
+	if nullified == nil {
+		return "", nil
+	}
+
+	if op.CreatedAt.Sub(nullified.CreatedAt) > recoveryWindow {
+		return fmt.Sprintf("fork nullifies %s outside the %s recovery window", nullified.CID, recoveryWindow), nil
+	}
+
+	var nullifiedMap map[string]any
+	if err := json.Unmarshal(nullified.Operation, &nullifiedMap); err != nil {
+		return "", fmt.Errorf("failed to parse forked op: %w", err)
+	}
+	nullifiedSigner, err := signerIndex(nullifiedMap, keys)
+	if err == nil && signer >= nullifiedSigner {
+		return fmt.Sprintf("fork nullifies %s without a higher priority rotation key", nullified.CID), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,173 @@
+package plc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+)
+
+// maxWebDocumentSize caps how much of a did:web document is read
+const maxWebDocumentSize = 64 << 10
+
+// maxWebCacheEntries caps how many did:web documents are cached
+const maxWebCacheEntries = 100_000
+
+// errPrivateAddress is returned when a did:web host resolves to an address that isn't publicly routable
+var errPrivateAddress = errors.New("did:web host resolves to a private address")
+
+type webCacheEntry struct {
+	res       *Resolution
+	fetchedAt time.Time
+}
+
+// WebResolver resolves did:web DIDs by fetching their /.well-known/did.json over HTTPS,
+// caching documents for TTL
+type WebResolver struct {
+	TTL    time.Duration
+	Client *http.Client
+	Clock  clock.Clock
+
+	cache map[string]webCacheEntry
+	lk    sync.Mutex
+}
+
+// NewWebResolver creates a did:web resolver that caches documents for ttl. Hosts resolving to
+// loopback, private, or link-local addresses are refused, so the mirror can't be used to reach
+// its own network.
+func NewWebResolver(ttl time.Duration) *WebResolver {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	return &WebResolver{
+		TTL: ttl,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+		},
+		Clock: clock.Real,
+		cache: make(map[string]webCacheEntry),
+	}
+}
+
+// webDocumentURL returns the URL of a did:web's document. atproto only allows did:web
+// DIDs for a bare hostname, without a path, though the port may be given percent-encoded.
+func webDocumentURL(did syntax.DID) (string, error) {
+	if strings.Contains(did.Identifier(), ":") {
+		return "", fmt.Errorf("did:web with a path isn't supported: %s", did)
+	}
+	host, err := url.PathUnescape(did.Identifier())
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", fmt.Errorf("invalid did:web: %s", did)
+	}
+	return fmt.Sprintf("https://%s/.well-known/did.json", host), nil
+}
+
+func (w *WebResolver) Resolve(ctx context.Context, did syntax.DID) (*Resolution, error) {
+	w.lk.Lock()
+	entry, ok := w.cache[did.String()]
+	w.lk.Unlock()
+	if ok && w.Clock.Since(entry.fetchedAt) < w.TTL {
+		webCacheLookups.WithLabelValues("hit").Inc()
+		return entry.res, nil
+	}
+	webCacheLookups.WithLabelValues("miss").Inc()
+
+	res, err := w.fetch(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if len(w.cache) >= maxWebCacheEntries {
+		// Evict expired entries, or an arbitrary one if none have expired
+		for k, e := range w.cache {
+			if w.Clock.Since(e.fetchedAt) >= w.TTL {
+				delete(w.cache, k)
+			}
+		}
+		for k := range w.cache {
+			if len(w.cache) < maxWebCacheEntries {
+				break
+			}
+			delete(w.cache, k)
+		}
+	}
+	w.cache[did.String()] = webCacheEntry{res: res, fetchedAt: w.Clock.Now()}
+
+	return res, nil
+}
+
+func (w *WebResolver) fetch(ctx context.Context, did syntax.DID) (*Resolution, error) {
+	u, err := webDocumentURL(did)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/did+json, application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch did:web document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, ErrDIDNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch did:web document: unexpected status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxWebDocumentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read did:web document: %w", err)
+	}
+	if len(raw) > maxWebDocumentSize {
+		return nil, fmt.Errorf("did:web document is larger than %d bytes", maxWebDocumentSize)
+	}
+
+	var doc DIDDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse did:web document: %w", err)
+	}
+	if doc.ID != did.String() {
+		return nil, fmt.Errorf("did:web document is for %q, not %s", doc.ID, did)
+	}
+
+	hash := sha256.Sum256(raw)
+	return &Resolution{Document: &doc, Version: hex.EncodeToString(hash[:16])}, nil
+}
@@ -0,0 +1,518 @@
+package plc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Changes to a DID's document that webhooks can watch for
+const (
+	ChangeCreate    = "create"
+	ChangeHandle    = "handle"
+	ChangePDS       = "pds"
+	ChangeKeys      = "keys"
+	ChangeTombstone = "tombstone"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 100
+	// webhookMaxAttempts is how many times a delivery is tried before it's marked failed
+	webhookMaxAttempts = 10
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of a webhook body, keyed by the webhook's secret
+const SignatureHeader = "X-PLC-Mirror-Signature"
+
+// Webhook is an operator-configured URL notified when watched DIDs' documents change
+type Webhook struct {
+	// Name identifies the webhook in the delivery table, defaulting to its URL
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret, if set, signs each delivery's body in the SignatureHeader
+	Secret string `json:"secret,omitempty"`
+	// DIDs are the DIDs watched, empty to watch every DID
+	DIDs []string `json:"dids,omitempty"`
+	// Changes are the kinds of change delivered, empty for all of them
+	Changes []string `json:"changes,omitempty"`
+
+	dids map[string]bool
+}
+
+// LoadWebhooks reads the webhooks configured in a JSON file holding a list of webhooks
+func LoadWebhooks(path string) ([]*Webhook, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks config: %w", err)
+	}
+
+	var hooks []*Webhook
+	if err := json.Unmarshal(raw, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks config: %w", err)
+	}
+
+	for _, h := range hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("webhook %q has no url", h.Name)
+		}
+		if h.Name == "" {
+			h.Name = h.URL
+		}
+		for _, change := range h.Changes {
+			switch change {
+			case ChangeCreate, ChangeHandle, ChangePDS, ChangeKeys, ChangeTombstone:
+			default:
+				return nil, fmt.Errorf("webhook %q has unknown change %q", h.Name, change)
+			}
+		}
+		if len(h.DIDs) > 0 {
+			h.dids = make(map[string]bool, len(h.DIDs))
+			for _, did := range h.DIDs {
+				h.dids[did] = true
+			}
+		}
+	}
+
+	return hooks, nil
+}
+
+// watches returns the changes to a DID the webhook is notified of
+func (h *Webhook) watches(did string, changes []string) []string {
+	if h.dids != nil && !h.dids[did] {
+		return nil
+	}
+	if len(h.Changes) == 0 {
+		return changes
+	}
+
+	var wanted []string
+	for _, change := range changes {
+		if slices.Contains(h.Changes, change) {
+			wanted = append(wanted, change)
+		}
+	}
+	return wanted
+}
+
+// WebhookDelivery is a notification queued for, or delivered to, a webhook
+type WebhookDelivery struct {
+	gorm.Model
+	Webhook        string `gorm:"index"`
+	URL            string
+	DID            string `gorm:"column:did;index"`
+	CID            string `gorm:"column:cid"`
+	Changes        string // comma-separated
+	Payload        []byte
+	Status         string    `gorm:"index:idx_delivery_status_next,priority:1"`
+	NextAttemptAt  time.Time `gorm:"index:idx_delivery_status_next,priority:2"`
+	Attempts       int
+	LastStatusCode int
+	LastError      string
+	DeliveredAt    *time.Time
+}
+
+// WebhookPayload is the body POSTed to webhooks
+type WebhookPayload struct {
+	DID       string    `json:"did"`
+	CID       string    `json:"cid"`
+	CreatedAt time.Time `json:"createdAt"`
+	Changes   []string  `json:"changes"`
+	// Handle and PDS are the values before and after the change
+	PreviousHandle string `json:"previousHandle,omitempty"`
+	Handle         string `json:"handle,omitempty"`
+	PreviousPDS    string `json:"previousPds,omitempty"`
+	PDS            string `json:"pds,omitempty"`
+	// Document is the DID's new document, omitted when it's been tombstoned
+	Document *DIDDocument `json:"document,omitempty"`
+}
+
+// opKeys returns the signing and rotation keys of an op, in a comparable form
+func opKeys(op *Operation) string {
+	if op.Type == "create" {
+		return op.SigningKey + "|" + op.RecoveryKey
+	}
+
+	ids := make([]string, 0, len(op.VerificationMethods))
+	for id := range op.VerificationMethods {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(id + "=" + op.VerificationMethods[id] + ",")
+	}
+	b.WriteString("|" + strings.Join(op.RotationKeys, ","))
+	return b.String()
+}
+
+// opChanges returns how an op changed its DID's document from the op before it
+func opChanges(op, prev *DBOp) ([]string, error) {
+	parsed, err := ParseOperation(op.Operation)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Type == "plc_tombstone" {
+		return []string{ChangeTombstone}, nil
+	}
+	if prev == nil {
+		return []string{ChangeCreate}, nil
+	}
+
+	prevParsed, err := ParseOperation(prev.Operation)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	if op.Handle != prev.Handle {
+		changes = append(changes, ChangeHandle)
+	}
+	if op.PDS != prev.PDS {
+		changes = append(changes, ChangePDS)
+	}
+	if opKeys(parsed) != opKeys(prevParsed) {
+		changes = append(changes, ChangeKeys)
+	}
+	return changes, nil
+}
+
+// SetWebhooks replaces the webhooks notified of document changes. It can be called while the
+// mirror runs, and deliveries already queued for webhooks no longer configured are dropped.
+func (plc *PLC) SetWebhooks(hooks []*Webhook) {
+	plc.webhooks.Store(&hooks)
+}
+
+// Webhooks returns the webhooks notified of document changes
+func (plc *PLC) Webhooks() []*Webhook {
+	if hooks := plc.webhooks.Load(); hooks != nil {
+		return *hooks
+	}
+	return nil
+}
+
+// queueWebhooks builds the deliveries for a page of ops about to be saved
+func (plc *PLC) queueWebhooks(page []*DBOp, prevs map[*DBOp]*DBOp) ([]WebhookDelivery, error) {
+	hooks := plc.Webhooks()
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	now := plc.Clock.Now()
+
+	var deliveries []WebhookDelivery
+	for _, op := range page {
+		if op.Nullified || op.Invalid {
+			continue
+		}
+
+		watched := false
+		for _, h := range hooks {
+			if h.dids == nil || h.dids[op.DID] {
+				watched = true
+				break
+			}
+		}
+		if !watched {
+			continue
+		}
+
+		parsed, err := ParseOperation(op.Operation)
+		if err != nil {
+			return nil, err
+		}
+
+		prev := prevs[op]
+		changes, err := opChanges(op, prev)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		payload := WebhookPayload{
+			DID:       op.DID,
+			CID:       op.CID,
+			CreatedAt: op.CreatedAt,
+			Handle:    op.Handle,
+			PDS:       op.PDS,
+		}
+		if prev != nil {
+			payload.PreviousHandle = prev.Handle
+			payload.PreviousPDS = prev.PDS
+		}
+		if doc, err := parsed.DIDDocument(op.DID); err == nil {
+			payload.Document = doc
+		}
+
+		for _, h := range hooks {
+			wanted := h.watches(op.DID, changes)
+			if len(wanted) == 0 {
+				continue
+			}
+
+			payload.Changes = wanted
+			body, err := json.Marshal(payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal webhook payload: %w", err)
+			}
+
+			deliveries = append(deliveries, WebhookDelivery{
+				Webhook:       h.Name,
+				URL:           h.URL,
+				DID:           op.DID,
+				CID:           op.CID,
+				Changes:       strings.Join(wanted, ","),
+				Payload:       body,
+				Status:        DeliveryPending,
+				NextAttemptAt: now,
+			})
+		}
+	}
+
+	return deliveries, nil
+}
+
+// webhookBackoff is how long to wait before retrying a delivery that has failed attempts times
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+// errWebhookRemoved fails deliveries queued for a webhook that's since been removed from the config
+var errWebhookRemoved = errors.New("webhook is no longer configured")
+
+// deliver POSTs a delivery to its webhook, returning the response status
+func (plc *PLC) deliver(ctx context.Context, d *WebhookDelivery) (int, error) {
+	var hook *Webhook
+	for _, h := range plc.Webhooks() {
+		if h.Name == d.Webhook {
+			hook = h
+			break
+		}
+	}
+	if hook == nil {
+		return 0, errWebhookRemoved
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jaz-plc-mirror")
+	req.Header.Set("X-PLC-Mirror-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(d.Payload)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := plc.WebhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverPending attempts the deliveries that are due, returning how many were attempted
+func (plc *PLC) deliverPending(ctx context.Context) (int, error) {
+	var due []WebhookDelivery
+	err := plc.DB.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", DeliveryPending, plc.Clock.Now()).
+		Order("id ASC").
+		Limit(webhookBatchSize).
+		Find(&due).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending deliveries: %w", err)
+	}
+
+	for i := range due {
+		d := &due[i]
+		status, err := plc.deliver(ctx, d)
+		if ctx.Err() != nil {
+			return i, nil
+		}
+
+		d.Attempts++
+		d.LastStatusCode = status
+		if err == nil {
+			now := plc.Clock.Now()
+			d.Status = DeliveryDelivered
+			d.DeliveredAt = &now
+			d.LastError = ""
+			webhookDeliveries.WithLabelValues("delivered").Inc()
+		} else {
+			d.LastError = err.Error()
+			if d.Attempts >= webhookMaxAttempts || errors.Is(err, errWebhookRemoved) {
+				d.Status = DeliveryFailed
+				webhookDeliveries.WithLabelValues("failed").Inc()
+				plc.Logger.Warn("webhook delivery failed", "webhook", d.Webhook, "did", d.DID, "attempts", d.Attempts, "err", err)
+			} else {
+				d.NextAttemptAt = plc.Clock.Now().Add(webhookBackoff(d.Attempts))
+				webhookDeliveries.WithLabelValues("retry").Inc()
+			}
+		}
+
+		if err := plc.DB.WithContext(ctx).Save(d).Error; err != nil {
+			return i, fmt.Errorf("failed to save delivery: %w", err)
+		}
+	}
+
+	return len(due), nil
+}
+
+// RunWebhooks delivers queued webhook notifications, retrying failures with backoff. It keeps
+// polling while no webhooks are configured, as they may be added by SetWebhooks.
+func (plc *PLC) RunWebhooks(ctx context.Context) error {
+	logger := plc.Logger.With("source", "webhooks")
+
+	for {
+		n, err := plc.deliverPending(ctx)
+		if err != nil {
+			logger.Error("failed to deliver webhooks", "err", err)
+		}
+
+		// Keep going while there's a backlog
+		if n < webhookBatchSize {
+			if err := plc.sleep(ctx, webhookPollInterval); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []JSONWebhookDelivery `json:"deliveries"`
+}
+
+type JSONWebhookDelivery struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Webhook        string     `json:"webhook"`
+	DID            string     `json:"did"`
+	CID            string     `json:"cid"`
+	Changes        []string   `json:"changes"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// HandleGetWebhookDeliveries handles the GET /admin/webhooks/deliveries endpoint, listing webhook
+// deliveries and their status, newest first. Filter with status, webhook, and did, and pass the
+// last id returned as before_id to page through older ones.
+func (plc *PLC) HandleGetWebhookDeliveries(c echo.Context) error {
+	q := plc.DB.Model(&WebhookDelivery{})
+
+	if status := c.QueryParam("status"); status != "" {
+		switch status {
+		case DeliveryPending, DeliveryDelivered, DeliveryFailed:
+		default:
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid status %q", status)})
+		}
+		q = q.Where("status = ?", status)
+	}
+
+	if webhook := c.QueryParam("webhook"); webhook != "" {
+		q = q.Where("webhook = ?", webhook)
+	}
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid did: %s", err)})
+		}
+		q = q.Where("did = ?", did.String())
+	}
+
+	if beforeParam := c.QueryParam("before_id"); beforeParam != "" {
+		before, err := strconv.ParseUint(beforeParam, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid before_id: %s", err)})
+		}
+		q = q.Where("id < ?", before)
+	}
+
+	count := 100
+	if countParam := c.QueryParam("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("invalid count: %s", err)})
+		}
+		count = n
+	}
+
+	if count < 1 || count > 1000 {
+		count = 1000
+	}
+
+	var deliveries []WebhookDelivery
+	if err := q.Order("id DESC").Limit(count).Find(&deliveries).Error; err != nil {
+		plc.Logger.Error("failed to get webhook deliveries", "err", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "failed to get webhook deliveries"})
+	}
+
+	resp := WebhookDeliveriesResponse{Deliveries: make([]JSONWebhookDelivery, 0, len(deliveries))}
+	for _, d := range deliveries {
+		jd := JSONWebhookDelivery{
+			ID:             d.ID,
+			CreatedAt:      d.CreatedAt,
+			Webhook:        d.Webhook,
+			DID:            d.DID,
+			CID:            d.CID,
+			Changes:        strings.Split(d.Changes, ","),
+			Status:         d.Status,
+			Attempts:       d.Attempts,
+			LastStatusCode: d.LastStatusCode,
+			LastError:      d.LastError,
+			DeliveredAt:    d.DeliveredAt,
+		}
+		if d.Status == DeliveryPending {
+			next := d.NextAttemptAt
+			jd.NextAttemptAt = &next
+		}
+		resp.Deliveries = append(resp.Deliveries, jd)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
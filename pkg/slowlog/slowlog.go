@@ -0,0 +1,301 @@
+// Package slowlog records database queries slower than a threshold as a gorm plugin, and
+// serves them with their query plans so operators can see which query patterns need indexes
+package slowlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const startKey = "slowlog:start"
+
+// maxPatterns caps how many distinct statements are aggregated
+const maxPatterns = 1000
+
+// maxVarLength truncates long parameters so large blobs aren't held in memory
+const maxVarLength = 200
+
+// Query is a single slow query
+type Query struct {
+	At         time.Time `json:"at"`
+	SQL        string    `json:"sql"`
+	Vars       []string  `json:"vars"`
+	DurationMS float64   `json:"duration_ms"`
+	// Rows is the number of rows the query returned
+	Rows  int64  `json:"rows"`
+	Table string `json:"table,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Pattern aggregates the slow queries sharing the same SQL, differing only in their parameters
+type Pattern struct {
+	SQL             string    `json:"sql"`
+	Count           int64     `json:"count"`
+	TotalDurationMS float64   `json:"total_duration_ms"`
+	MaxDurationMS   float64   `json:"max_duration_ms"`
+	LastSeen        time.Time `json:"last_seen"`
+	// Plan is the database's query plan for the most recent parameters, when requested
+	Plan []string `json:"plan,omitempty"`
+
+	lastVars []any
+}
+
+// Log keeps the most recent slow queries in a ring buffer
+type Log struct {
+	// Threshold is how long a query must take to be recorded
+	Threshold time.Duration
+
+	db       *gorm.DB
+	queries  []Query
+	next     int
+	full     bool
+	patterns map[string]*Pattern
+	lk       sync.Mutex
+}
+
+// New creates a Log keeping the last size queries slower than threshold
+func New(threshold time.Duration, size int) *Log {
+	return &Log{
+		Threshold: threshold,
+		queries:   make([]Query, size),
+		patterns:  make(map[string]*Pattern),
+	}
+}
+
+func (l *Log) Name() string {
+	return "slowlog"
+}
+
+// Initialize registers the log's callbacks around gorm's read paths. It's called by db.Use.
+func (l *Log) Initialize(db *gorm.DB) error {
+	l.db = db
+
+	cb := db.Callback()
+	if err := cb.Query().Before("gorm:query").Register("slowlog:before_query", l.before); err != nil {
+		return err
+	}
+	if err := cb.Query().After("gorm:query").Register("slowlog:after_query", l.after); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register("slowlog:before_row", l.before); err != nil {
+		return err
+	}
+	if err := cb.Row().After("gorm:row").Register("slowlog:after_row", l.after); err != nil {
+		return err
+	}
+	if err := cb.Raw().Before("gorm:raw").Register("slowlog:before_raw", l.before); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("slowlog:after_raw", l.after)
+}
+
+func (l *Log) before(db *gorm.DB) {
+	db.InstanceSet(startKey, time.Now())
+}
+
+func (l *Log) after(db *gorm.DB) {
+	v, ok := db.InstanceGet(startKey)
+	if !ok {
+		return
+	}
+	start, ok := v.(time.Time)
+	if !ok {
+		return
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < l.Threshold {
+		return
+	}
+
+	q := Query{
+		At:         start,
+		SQL:        db.Statement.SQL.String(),
+		Vars:       make([]string, len(db.Statement.Vars)),
+		DurationMS: float64(elapsed.Microseconds()) / 1000,
+		Rows:       db.Statement.RowsAffected,
+		Table:      db.Statement.Table,
+	}
+	for i, v := range db.Statement.Vars {
+		q.Vars[i] = formatVar(v)
+	}
+	if db.Error != nil {
+		q.Error = db.Error.Error()
+	}
+
+	l.record(q, slices.Clone(db.Statement.Vars))
+}
+
+func formatVar(v any) string {
+	if b, ok := v.([]byte); ok {
+		return fmt.Sprintf("<%d bytes>", len(b))
+	}
+	s := fmt.Sprint(v)
+	if len(s) > maxVarLength {
+		s = s[:maxVarLength] + "..."
+	}
+	return s
+}
+
+func (l *Log) record(q Query, vars []any) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if len(l.queries) > 0 {
+		l.queries[l.next] = q
+		l.next = (l.next + 1) % len(l.queries)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	p, ok := l.patterns[q.SQL]
+	if !ok {
+		if len(l.patterns) >= maxPatterns {
+			return
+		}
+		p = &Pattern{SQL: q.SQL}
+		l.patterns[q.SQL] = p
+	}
+	p.Count++
+	p.TotalDurationMS += q.DurationMS
+	p.MaxDurationMS = max(p.MaxDurationMS, q.DurationMS)
+	p.LastSeen = q.At
+	p.lastVars = vars
+}
+
+// Queries returns up to limit of the most recent slow queries, newest first
+func (l *Log) Queries(limit int) []Query {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.queries)
+	}
+
+	queries := make([]Query, 0, min(n, limit))
+	for i := 0; i < n && len(queries) < limit; i++ {
+		idx := (l.next - 1 - i + len(l.queries)) % len(l.queries)
+		queries = append(queries, l.queries[idx])
+	}
+	return queries
+}
+
+// Patterns returns up to limit statements by the total time spent in them, slowest first
+func (l *Log) Patterns(limit int) []Pattern {
+	l.lk.Lock()
+	patterns := make([]Pattern, 0, len(l.patterns))
+	for _, p := range l.patterns {
+		patterns = append(patterns, *p)
+	}
+	l.lk.Unlock()
+
+	slices.SortFunc(patterns, func(a, b Pattern) int {
+		switch {
+		case a.TotalDurationMS > b.TotalDurationMS:
+			return -1
+		case a.TotalDurationMS < b.TotalDurationMS:
+			return 1
+		}
+		return 0
+	})
+
+	if len(patterns) > limit {
+		patterns = patterns[:limit]
+	}
+	return patterns
+}
+
+// explain returns the database's query plan for a statement, one line per plan step
+func (l *Log) explain(ctx context.Context, p Pattern) ([]string, error) {
+	prefix := "EXPLAIN "
+	if l.db.Dialector.Name() == "sqlite" {
+		prefix = "EXPLAIN QUERY PLAN "
+	}
+
+	// Run through database/sql directly, since the statement already has the driver's placeholders
+	sqlDB, err := l.db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlDB.QueryContext(ctx, prefix+p.SQL, p.lastVars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	// Both SQLite and Postgres put the plan step's description in the last column
+	var plan []string
+	for rows.Next() {
+		dest := make([]any, len(cols))
+		for i := range dest {
+			dest[i] = new(sql.NullString)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		plan = append(plan, dest[len(dest)-1].(*sql.NullString).String)
+	}
+
+	return plan, rows.Err()
+}
+
+type SlowQueriesResponse struct {
+	ThresholdMS float64   `json:"threshold_ms"`
+	Queries     []Query   `json:"queries"`
+	Patterns    []Pattern `json:"patterns"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// HandleGetSlowQueries handles the GET /admin/slow-queries endpoint, listing recent slow queries
+// and the statements the most time was spent in
+// Query params:
+// limit - max number of queries and patterns to return (default 100, max 1000)
+// explain - include the query plan of each pattern
+func (l *Log) HandleGetSlowQueries(c echo.Context) error {
+	limit := 100
+	if param := c.QueryParam("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, SlowQueriesResponse{Error: fmt.Sprintf("invalid limit: %s", err)})
+		}
+		if n > 0 {
+			limit = min(n, 1000)
+		}
+	}
+
+	resp := SlowQueriesResponse{
+		ThresholdMS: float64(l.Threshold.Microseconds()) / 1000,
+		Queries:     l.Queries(limit),
+		Patterns:    l.Patterns(limit),
+	}
+
+	if c.QueryParam("explain") == "true" && l.db != nil {
+		for i := range resp.Patterns {
+			plan, err := l.explain(c.Request().Context(), resp.Patterns[i])
+			if err != nil {
+				resp.Patterns[i].Plan = []string{fmt.Sprintf("failed to explain: %s", err)}
+				continue
+			}
+			resp.Patterns[i].Plan = plan
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"net/http"
+
+	"github.com/ericvolp12/atproto.tools/pkg/version"
+	"github.com/labstack/echo/v4"
+)
+
+// Features names the optional API capabilities this version of the stream supports
+var Features = []string{
+	"subscribe",
+	"records_cursor",
+	"records_fields",
+	"records_max_bytes",
+	"records_etag",
+	"repo_activity",
+	"accounts",
+	"syncs",
+	"lints",
+	"backfill_status",
+	"records_search",
+	"rkey_types",
+	"consistency",
+	"repo_scores",
+	"threads",
+	"quarantine",
+	"pds_scoreboard",
+	"did_methods",
+	"dumps",
+	"usage",
+	"actives",
+	"churn",
+	"computed_fields",
+	"provenance",
+	"blocklist",
+	"deadletter",
+	"langs",
+	"gaps",
+	"records_diff",
+	"at_uri",
+}
+
+type AboutResponse struct {
+	Build    version.Info `json:"build"`
+	Features []string     `json:"features"`
+
+	// Relays are the firehose URLs stored from, the first is the primary and the rest are fallbacks
+	Relays []string `json:"relays"`
+	// Upstreams are other firehose URLs consumed for comparison, but not stored
+	Upstreams []string `json:"upstreams"`
+	Sinks     []string `json:"sinks"`
+	// DIDMethods are the DID methods identities can be resolved for
+	DIDMethods []string `json:"did_methods"`
+
+	// RetentionSeconds is how long events and records are kept in the database (0 keeps them forever)
+	RetentionSeconds int64 `json:"retention_seconds"`
+	// Collections lists the collections stored, empty when every collection is stored
+	Collections []string `json:"collections"`
+	// SampleRate is the fraction of repos whose records are stored
+	SampleRate float64 `json:"sample_rate"`
+
+	MaxFieldBytes  int  `json:"max_field_bytes"`
+	MaxRecordBytes int  `json:"max_record_bytes"`
+	Backfill       bool `json:"backfill"`
+	Search         bool `json:"search"`
+	BotScoring     bool `json:"bot_scoring"`
+
+	Liveness  AboutLiveness  `json:"liveness"`
+	Subscribe AboutSubscribe `json:"subscribe"`
+}
+
+type AboutLiveness struct {
+	Mode          string  `json:"mode"`
+	WindowSeconds float64 `json:"window_seconds"`
+	MinProgress   int64   `json:"min_progress"`
+	MaxFailures   int     `json:"max_failures"`
+}
+
+type AboutSubscribe struct {
+	BufferSize int    `json:"buffer_size"`
+	DropPolicy string `json:"drop_policy"`
+	MaxDrops   int64  `json:"max_drops"`
+}
+
+// HandleGetAbout handles the GET /about endpoint, describing what this instance stores
+// so users of a shared looking glass know what data to expect
+func (s *Stream) HandleGetAbout(c echo.Context) error {
+	resp := AboutResponse{
+		Build:            version.Get(),
+		Features:         Features,
+		Relays:           []string{},
+		Upstreams:        []string{},
+		Sinks:            []string{},
+		DIDMethods:       s.didMethods.Methods(),
+		RetentionSeconds: int64(s.recordTTL().Seconds()),
+		Collections:      []string{},
+		SampleRate:       1,
+		MaxFieldBytes:    s.MaxFieldBytes,
+		MaxRecordBytes:   s.MaxRecordBytes,
+		Backfill:         s.BackfillWorkers > 0,
+		Search:           s.searchEnabled,
+		BotScoring:       s.BotScoring,
+		Liveness: AboutLiveness{
+			Mode:          s.LivenessMode,
+			WindowSeconds: s.LivenessWindow.Seconds(),
+			MinProgress:   s.LivenessMinProgress,
+			MaxFailures:   s.LivenessMaxFailures,
+		},
+		Subscribe: AboutSubscribe{
+			BufferSize: s.SubscribeBufferSize,
+			DropPolicy: s.SubscribeDropPolicy,
+			MaxDrops:   s.SubscribeMaxDrops,
+		},
+	}
+
+	for _, u := range s.primary.relay.urls {
+		resp.Relays = append(resp.Relays, u.String())
+	}
+
+	for _, up := range s.upstreams {
+		resp.Upstreams = append(resp.Upstreams, up.relay.url(0).String())
+	}
+
+	for _, sink := range s.sinks {
+		resp.Sinks = append(resp.Sinks, sink.Name())
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
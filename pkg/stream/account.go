@@ -0,0 +1,255 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/araddon/dateparse"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm/clause"
+)
+
+// Account statuses stored alongside the #account event's own status values
+// (deactivated, takendown, suspended, deleted)
+const (
+	AccountActive        = "active"
+	AccountStatusUnknown = "unknown"
+)
+
+func (s *Stream) RepoAccount(acct *FirehoseAccount) error {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "RepoAccount")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("repo", acct.Did),
+		attribute.Int64("seq", acct.Seq),
+	)
+
+	s.SetSeq(acct.Seq)
+
+	// Record metadata about the event
+	e := &Event{
+		FirehoseSeq: acct.Seq,
+		Repo:        acct.Did,
+		EventType:   "account",
+	}
+
+	t, err := dateparse.ParseAny(acct.Time)
+	if err != nil {
+		s.logger.Error("failed to parse time", "err", err)
+		e.Error = fmt.Sprintf("failed to parse time: %v", err)
+		return nil
+	}
+
+	defer s.writeEvent(ctx, e)
+
+	e.Time = t.UnixNano()
+	s.SetEventTime(t)
+
+	status := AccountStatusUnknown
+	switch {
+	case acct.Active:
+		status = AccountActive
+	case acct.Status != nil:
+		status = *acct.Status
+	}
+
+	if err := s.writer.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&AccountStatus{
+		FirehoseSeq: acct.Seq,
+		DID:         acct.Did,
+		Active:      acct.Active,
+		Status:      status,
+		Time:        e.Time,
+	}).Error; err != nil {
+		s.logger.Error("failed to create account status", "err", err)
+		e.Error = fmt.Sprintf("failed to create account status: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Stream) RepoSync(evt *FirehoseSync) error {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "RepoSync")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("repo", evt.Did),
+		attribute.Int64("seq", evt.Seq),
+	)
+
+	s.SetSeq(evt.Seq)
+
+	// Record metadata about the event
+	e := &Event{
+		FirehoseSeq: evt.Seq,
+		Repo:        evt.Did,
+		EventType:   "sync",
+	}
+
+	t, err := dateparse.ParseAny(evt.Time)
+	if err != nil {
+		s.logger.Error("failed to parse time", "err", err)
+		e.Error = fmt.Sprintf("failed to parse time: %v", err)
+		return nil
+	}
+
+	defer s.writeEvent(ctx, e)
+
+	e.Time = t.UnixNano()
+	s.SetEventTime(t)
+
+	if err := s.writer.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&SyncEvent{
+		FirehoseSeq: evt.Seq,
+		DID:         evt.Did,
+		Rev:         evt.Rev,
+		BlocksSize:  len(evt.Blocks),
+		Time:        e.Time,
+	}).Error; err != nil {
+		s.logger.Error("failed to create sync event", "err", err)
+		e.Error = fmt.Sprintf("failed to create sync event: %v", err)
+	}
+
+	return nil
+}
+
+type JSONAccountStatus struct {
+	FirehoseSeq int64  `json:"seq"`
+	DID         string `json:"did"`
+	Active      bool   `json:"active"`
+	Status      string `json:"status"`
+	Time        int64  `json:"time"`
+}
+
+type AccountsResponse struct {
+	Accounts []JSONAccountStatus `json:"accounts"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// HandleGetAccounts handles the GET /accounts endpoint, returning account status transitions
+func (s *Stream) HandleGetAccounts(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	// status - Account status, e.g. active, deactivated, takendown (optional)
+	// limit - Number of transitions to return (default=100)
+	resp := AccountsResponse{}
+
+	q := s.reader.Model(&AccountStatus{})
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("d_id = ?", did.String())
+	}
+
+	if statusParam := c.QueryParam("status"); statusParam != "" {
+		q = q.Where("status = ?", statusParam)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var statuses []AccountStatus
+	if err := q.Order("firehose_seq DESC").Limit(limit).Find(&statuses).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Accounts = make([]JSONAccountStatus, len(statuses))
+	for i, st := range statuses {
+		resp.Accounts[i] = JSONAccountStatus{
+			FirehoseSeq: st.FirehoseSeq,
+			DID:         st.DID,
+			Active:      st.Active,
+			Status:      st.Status,
+			Time:        st.Time,
+		}
+	}
+
+	setRowsReturned(c, len(resp.Accounts))
+	return c.JSON(http.StatusOK, resp)
+}
+
+type JSONSyncEvent struct {
+	FirehoseSeq int64  `json:"seq"`
+	DID         string `json:"did"`
+	Rev         string `json:"rev"`
+	BlocksSize  int    `json:"blocks_size"`
+	Time        int64  `json:"time"`
+}
+
+type SyncsResponse struct {
+	Syncs []JSONSyncEvent `json:"syncs"`
+	Error string          `json:"error,omitempty"`
+}
+
+// HandleGetSyncs handles the GET /syncs endpoint, returning #sync events
+func (s *Stream) HandleGetSyncs(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	// limit - Number of sync events to return (default=100)
+	resp := SyncsResponse{}
+
+	q := s.reader.Model(&SyncEvent{})
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("d_id = ?", did.String())
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var syncs []SyncEvent
+	if err := q.Order("firehose_seq DESC").Limit(limit).Find(&syncs).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Syncs = make([]JSONSyncEvent, len(syncs))
+	for i, sy := range syncs {
+		resp.Syncs[i] = JSONSyncEvent{
+			FirehoseSeq: sy.FirehoseSeq,
+			DID:         sy.DID,
+			Rev:         sy.Rev,
+			BlocksSize:  sy.BlocksSize,
+			Time:        sy.Time,
+		}
+	}
+
+	setRowsReturned(c, len(resp.Syncs))
+	return c.JSON(http.StatusOK, resp)
+}
+
+// parseLimit parses a limit query parameter, defaulting to 100 and capping at 1000
+func parseLimit(param string) (int, error) {
+	if param == "" {
+		return 100, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 {
+		return 100, nil
+	}
+	return min(limit, 1000), nil
+}
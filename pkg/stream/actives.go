@@ -0,0 +1,276 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/hll"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Kinds of activity counted in the hourly actives sketches
+const (
+	// ActiveCommitting counts the distinct repos that committed
+	ActiveCommitting = "committing"
+	// ActiveCreated counts the distinct repos created, seen as commits with no previous revision
+	ActiveCreated = "created"
+)
+
+// activesFlushInterval is how often the current hours' sketches are merged into the database
+const activesFlushInterval = time.Minute
+
+type activeKey struct {
+	hour time.Time
+	kind string
+}
+
+// activesTracker counts distinct active repos per hour with HyperLogLog sketches
+type activesTracker struct {
+	retention time.Duration
+
+	lk sync.Mutex
+	// pending holds the repos seen since the last flush
+	pending map[activeKey]hll.Sketch
+
+	// flushLk serializes flushes, since each reads and rewrites the stored sketches
+	flushLk sync.Mutex
+}
+
+// EnableActives counts the distinct repos committing, and created, each hour, keeping the hourly
+// sketches for retention
+func (s *Stream) EnableActives(retention time.Duration) {
+	s.actives = &activesTracker{
+		retention: retention,
+		pending:   make(map[activeKey]hll.Sketch),
+	}
+}
+
+// observeActive counts a repo's commit towards the hour it was ingested in
+func (s *Stream) observeActive(did string, created bool) {
+	a := s.actives
+	if a == nil {
+		return
+	}
+
+	hour := s.Clock.Now().UTC().Truncate(time.Hour)
+
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	a.sketch(activeKey{hour: hour, kind: ActiveCommitting}).Add(did)
+	if created {
+		a.sketch(activeKey{hour: hour, kind: ActiveCreated}).Add(did)
+	}
+}
+
+// sketch returns the pending sketch for an hour and kind. lk must be held.
+func (a *activesTracker) sketch(key activeKey) hll.Sketch {
+	sk, ok := a.pending[key]
+	if !ok {
+		sk = hll.New()
+		a.pending[key] = sk
+	}
+	return sk
+}
+
+// flushActives merges the sketches accumulated since the last flush into the stored ones
+func (s *Stream) flushActives(ctx context.Context) error {
+	a := s.actives
+	if a == nil {
+		return nil
+	}
+
+	a.flushLk.Lock()
+	defer a.flushLk.Unlock()
+
+	a.lk.Lock()
+	pending := a.pending
+	a.pending = make(map[activeKey]hll.Sketch)
+	a.lk.Unlock()
+
+	for key, sk := range pending {
+		err := s.writer.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var stored ActiveSketch
+			err := tx.Where("hour = ? AND kind = ?", key.hour, key.kind).First(&stored).Error
+			switch {
+			case err == nil:
+				prev, err := hll.FromBytes(stored.Registers)
+				if err != nil {
+					return err
+				}
+				prev.Merge(sk)
+				stored.Registers = prev.Bytes()
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				stored = ActiveSketch{Hour: key.hour, Kind: key.kind, Registers: sk.Bytes()}
+			default:
+				return err
+			}
+			return tx.Save(&stored).Error
+		})
+		if err != nil {
+			// Put the sketch back so it's retried on the next flush
+			a.lk.Lock()
+			a.sketch(key).Merge(sk)
+			a.lk.Unlock()
+			return fmt.Errorf("failed to save %s sketch for %s: %w", key.kind, key.hour.Format(time.RFC3339), err)
+		}
+	}
+
+	return nil
+}
+
+// RunActives periodically flushes the actives sketches, pruning those past retention, and flushes
+// once more on shutdown
+func (s *Stream) RunActives(ctx context.Context) error {
+	if s.actives == nil {
+		return nil
+	}
+
+	logger := s.logger.With("source", "actives")
+
+	ticker := s.Clock.NewTicker(activesFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.flushActives(flushCtx); err != nil {
+				logger.Error("failed to flush actives on shutdown", "err", err)
+			}
+			return nil
+		case <-ticker.C():
+			if err := s.flushActives(ctx); err != nil {
+				logger.Error("failed to flush actives", "err", err)
+			}
+			s.retentionLk.RLock()
+			retention := s.actives.retention
+			s.retentionLk.RUnlock()
+			if retention > 0 {
+				cutoff := s.Clock.Now().Add(-retention)
+				if err := s.writer.WithContext(ctx).Where("hour < ?", cutoff).Delete(&ActiveSketch{}).Error; err != nil {
+					logger.Error("failed to prune actives", "err", err)
+				}
+			}
+		}
+	}
+}
+
+type ActivesBucket struct {
+	Start time.Time `json:"start"`
+	// Estimated distinct repos that committed, and that were created, in the bucket
+	Committing uint64 `json:"committing"`
+	Created    uint64 `json:"created"`
+}
+
+type ActivesResponse struct {
+	IntervalSeconds int64 `json:"interval_seconds"`
+	// Estimated distinct repos across the whole window
+	Committing uint64          `json:"committing"`
+	Created    uint64          `json:"created"`
+	Buckets    []ActivesBucket `json:"buckets"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// HandleGetActives handles the GET /stats/actives endpoint, estimating the distinct repos that
+// committed, and that were created, in fixed-width time buckets
+func (s *Stream) HandleGetActives(c echo.Context) error {
+	// Parse the query parameters
+	// interval - Bucket width as a Go duration, a whole number of hours (default=1h)
+	// window - How far back to report as a Go duration (default=48h)
+	resp := ActivesResponse{}
+
+	if s.actives == nil {
+		resp.Error = "actives tracking is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	interval := time.Hour
+	if param := c.QueryParam("interval"); param != "" {
+		var err error
+		interval, err = time.ParseDuration(param)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid interval: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+	}
+	if interval < time.Hour || interval%time.Hour != 0 {
+		resp.Error = "interval must be a whole number of hours"
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	window := 48 * time.Hour
+	if param := c.QueryParam("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil || window <= 0 {
+			resp.Error = "invalid window, expected a positive Go duration"
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+	}
+
+	if window/interval > maxActivityBuckets {
+		resp.Error = fmt.Sprintf("interval too small, a window of %s would produce more than %d buckets", window, maxActivityBuckets)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	resp.IntervalSeconds = int64(interval.Seconds())
+
+	ctx := c.Request().Context()
+	if err := s.flushActives(ctx); err != nil {
+		s.logger.Error("failed to flush actives", "err", err)
+	}
+
+	// Buckets are aligned to the interval so series stay stable between polls
+	now := s.Clock.Now().UTC()
+	start := now.Add(-window).Truncate(interval)
+	numBuckets := int(now.Sub(start)/interval) + 1
+
+	var stored []ActiveSketch
+	if err := s.reader.WithContext(ctx).Where("hour >= ?", start).Find(&stored).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	// Merge the hourly sketches into each bucket's, and the window's
+	buckets := make([]map[string]hll.Sketch, numBuckets)
+	totals := map[string]hll.Sketch{ActiveCommitting: hll.New(), ActiveCreated: hll.New()}
+	for _, row := range stored {
+		sk, err := hll.FromBytes(row.Registers)
+		if err != nil {
+			continue
+		}
+		i := int(row.Hour.Sub(start) / interval)
+		if i < 0 || i >= numBuckets {
+			continue
+		}
+		if buckets[i] == nil {
+			buckets[i] = map[string]hll.Sketch{ActiveCommitting: hll.New(), ActiveCreated: hll.New()}
+		}
+		if _, ok := buckets[i][row.Kind]; !ok {
+			continue
+		}
+		buckets[i][row.Kind].Merge(sk)
+		totals[row.Kind].Merge(sk)
+	}
+
+	resp.Committing = totals[ActiveCommitting].Estimate()
+	resp.Created = totals[ActiveCreated].Estimate()
+	resp.Buckets = make([]ActivesBucket, numBuckets)
+	for i := range resp.Buckets {
+		resp.Buckets[i].Start = start.Add(time.Duration(i) * interval)
+		if buckets[i] != nil {
+			resp.Buckets[i].Committing = buckets[i][ActiveCommitting].Estimate()
+			resp.Buckets[i].Created = buckets[i][ActiveCreated].Estimate()
+		}
+	}
+
+	setRowsReturned(c, len(resp.Buckets))
+	return c.JSON(http.StatusOK, resp)
+}
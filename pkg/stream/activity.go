@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// maxActivityBuckets caps the number of buckets a single activity request can produce
+const maxActivityBuckets = 1000
+
+type ActivityBucket struct {
+	Start   time.Time `json:"start"`
+	Creates int64     `json:"creates"`
+	Updates int64     `json:"updates"`
+	Deletes int64     `json:"deletes"`
+}
+
+type ActivityResponse struct {
+	DID             string           `json:"did"`
+	IntervalSeconds int64            `json:"interval_seconds"`
+	Buckets         []ActivityBucket `json:"buckets"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// HandleGetRepoActivity handles the GET /repos/:did/activity endpoint, returning counts of
+// a repo's records by action in fixed-width time buckets covering the retention window
+func (s *Stream) HandleGetRepoActivity(c echo.Context) error {
+	// Parse the query parameters
+	// interval - Bucket width as a Go duration (default=1h)
+	intervalParam := c.QueryParam("interval")
+
+	resp := ActivityResponse{}
+
+	did, err := syntax.ParseDID(c.Param("did"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid DID: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	resp.DID = did.String()
+
+	interval := time.Hour
+	if intervalParam != "" {
+		interval, err = time.ParseDuration(intervalParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid interval: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+	}
+
+	if interval < time.Minute {
+		resp.Error = "interval must be at least 1m"
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	ttl := s.recordTTL()
+	if ttl/interval > maxActivityBuckets {
+		resp.Error = fmt.Sprintf("interval too small, the retention window of %s would produce more than %d buckets", ttl, maxActivityBuckets)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	resp.IntervalSeconds = int64(interval.Seconds())
+
+	// Buckets are aligned to the interval so sparklines stay stable between polls
+	now := s.Clock.Now().UTC()
+	start := now.Add(-ttl).Truncate(interval)
+	numBuckets := int(now.Sub(start)/interval) + 1
+
+	resp.Buckets = make([]ActivityBucket, numBuckets)
+	for i := range resp.Buckets {
+		resp.Buckets[i].Start = start.Add(time.Duration(i) * interval)
+	}
+
+	var rows []struct {
+		CreatedAt time.Time
+		Action    string
+	}
+	if err := s.reader.Model(&Record{}).
+		Select("created_at, action").
+		Where("repo = ? AND created_at >= ?", did.String(), start).
+		Scan(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	for _, row := range rows {
+		i := int(row.CreatedAt.Sub(start) / interval)
+		if i < 0 || i >= numBuckets {
+			continue
+		}
+		switch row.Action {
+		case "create":
+			resp.Buckets[i].Creates++
+		case "update":
+			resp.Buckets[i].Updates++
+		case "delete":
+			resp.Buckets[i].Deletes++
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
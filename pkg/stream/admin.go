@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// authorizeAdmin checks a request bears the admin token, returning the status and error to
+// respond with if it doesn't
+func (s *Stream) authorizeAdmin(c echo.Context) (int, string) {
+	if s.AdminToken == "" {
+		return http.StatusNotImplemented, "admin endpoints are not enabled on this instance"
+	}
+	token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		return http.StatusUnauthorized, "invalid admin token"
+	}
+	return 0, ""
+}
+
+// adminActor names who made an admin request for the audit log, from the X-Admin-Actor header
+func adminActor(c echo.Context) string {
+	if actor := strings.TrimSpace(c.Request().Header.Get("X-Admin-Actor")); actor != "" {
+		return actor
+	}
+	return c.RealIP()
+}
+
+// RequireAdmin is middleware rejecting requests that don't bear the admin token, for admin
+// endpoints served by other packages
+func (s *Stream) RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if status, msg := s.authorizeAdmin(c); status != 0 {
+			return c.JSON(status, map[string]string{"error": msg})
+		}
+		return next(c)
+	}
+}
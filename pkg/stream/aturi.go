@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/labstack/echo/v4"
+)
+
+// Where an AT-URI lookup's record came from
+const (
+	AtURISourceLocal = "local"
+	AtURISourceCache = "cache"
+	AtURISourcePDS   = "pds"
+)
+
+// liveRecordTimeout bounds fetching a record from its PDS while a request waits
+const liveRecordTimeout = 10 * time.Second
+
+// liveRecordCache holds records fetched from PDSes by AT-URI, so repeated lookups of a record
+// that isn't stored don't each go to its PDS
+type liveRecordCache struct {
+	records *expirable.LRU[string, *pdsfetch.Record]
+}
+
+// newLiveRecordCache returns a cache of size records, or nil if size is 0, as the LRU treats a
+// size of 0 as unbounded
+func newLiveRecordCache(size int, ttl time.Duration) *liveRecordCache {
+	if size <= 0 {
+		return nil
+	}
+	return &liveRecordCache{records: expirable.NewLRU[string, *pdsfetch.Record](size, nil, ttl)}
+}
+
+// SetLiveRecordCache sets how many records fetched from PDSes are cached for /at lookups, and
+// for how long, 0 disables the cache. It must be called before the stream is started.
+func (s *Stream) SetLiveRecordCache(size int, ttl time.Duration) {
+	s.liveRecords = newLiveRecordCache(size, ttl)
+}
+
+func (lc *liveRecordCache) get(uri string) (*pdsfetch.Record, bool) {
+	if lc == nil {
+		return nil, false
+	}
+	return lc.records.Get(uri)
+}
+
+func (lc *liveRecordCache) add(uri string, rec *pdsfetch.Record) {
+	if lc != nil {
+		lc.records.Add(uri, rec)
+	}
+}
+
+type AtURIResponse struct {
+	URI string `json:"uri"`
+	// Source is where the record came from: local, cache, or pds
+	Source string `json:"source,omitempty"`
+	// CID is the record's CID, only known for records fetched from the PDS
+	CID   string          `json:"cid,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// Record is the stored record with its metadata, only set for local records
+	Record *JSONRecord `json:"record,omitempty"`
+	// Deleted is set when the latest stored version of the record is a delete
+	Deleted bool   `json:"deleted,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HandleGetAtURI handles the GET /at/* endpoint, returning the record an at:// URI points at. The
+// latest stored version is returned if there is one, otherwise the record is fetched from its
+// repo's PDS with com.atproto.repo.getRecord and cached. Records stored truncated are fetched
+// from the PDS in full, unless the repo or its PDS is blocked, and only from public https PDS
+// hosts. The URI's authority may be a handle, which is resolved to a DID and verified to point
+// back at it.
+func (s *Stream) HandleGetAtURI(c echo.Context) error {
+	resp := AtURIResponse{}
+
+	raw, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid AT-URI: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	if !strings.HasPrefix(raw, "at://") {
+		raw = "at://" + strings.TrimPrefix(raw, "at:/")
+	}
+
+	uri, err := syntax.ParseATURI(raw)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid AT-URI: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	collection, rkey := uri.Collection(), uri.RecordKey()
+	if collection == "" || rkey == "" {
+		resp.Error = "AT-URI must point at a record, with a collection and record key"
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	ctx := c.Request().Context()
+
+	// Records are stored by DID, so handles are resolved before looking in storage
+	var id *identity.Identity
+	did, err := uri.Authority().AsDID()
+	if err != nil {
+		handle, err := uri.Authority().AsHandle()
+		if err == nil {
+			id, err = s.identityDir.LookupHandle(ctx, handle)
+		}
+		if err != nil {
+			resp.URI = uri.String()
+			if errors.Is(err, identity.ErrHandleNotFound) || errors.Is(err, identity.ErrHandleMismatch) {
+				atURILookups.WithLabelValues("not_found").Inc()
+				resp.Error = fmt.Sprintf("handle not found: %s", uri.Authority())
+				return c.JSON(http.StatusNotFound, resp)
+			}
+			atURILookups.WithLabelValues("error").Inc()
+			resp.Error = fmt.Sprintf("failed to resolve handle: %s", err)
+			return c.JSON(http.StatusBadGateway, resp)
+		}
+		did = id.DID
+	}
+	resp.URI = fmt.Sprintf("at://%s/%s/%s", did, collection, rkey)
+
+	var stored []Record
+	if err := s.reader.WithContext(ctx).
+		Where("repo = ? AND collection = ? AND r_key = ?", did.String(), collection.String(), rkey.String()).
+		Order("id DESC").
+		Limit(1).
+		Find(&stored).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	if len(stored) > 0 && stored[0].Truncated == "" {
+		rec := dbRecordIDToJSONRecord(stored[0], nil)
+		resp.Source = AtURISourceLocal
+		resp.Record = &rec
+		atURILookups.WithLabelValues(AtURISourceLocal).Inc()
+		if stored[0].Action == "delete" {
+			resp.Deleted = true
+			resp.Error = "record deleted"
+			return c.JSON(http.StatusNotFound, resp)
+		}
+		resp.Value = stored[0].Raw
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	if id == nil {
+		id, err = s.identityDir.LookupDID(ctx, did)
+		if err != nil {
+			atURILookups.WithLabelValues("error").Inc()
+			resp.Error = fmt.Sprintf("failed to resolve DID: %s", err)
+			return c.JSON(http.StatusBadGateway, resp)
+		}
+	}
+	pds := id.PDSEndpoint()
+	if pds == "" {
+		atURILookups.WithLabelValues("error").Inc()
+		resp.Error = "DID has no PDS"
+		return c.JSON(http.StatusBadGateway, resp)
+	}
+	if kind := s.blocklist.blockedBy(did.String(), pds); kind != "" {
+		atURILookups.WithLabelValues("blocked").Inc()
+		resp.Error = fmt.Sprintf("records from this %s are blocked", kind)
+		return c.JSON(http.StatusForbidden, resp)
+	}
+	if err := pdsfetch.CheckPublicEndpoint(pds); err != nil {
+		atURILookups.WithLabelValues("error").Inc()
+		resp.Error = err.Error()
+		return c.JSON(http.StatusBadGateway, resp)
+	}
+
+	if live, ok := s.liveRecords.get(resp.URI); ok {
+		atURILookups.WithLabelValues(AtURISourceCache).Inc()
+		resp.Source = AtURISourceCache
+		resp.CID = live.CID
+		resp.Value = live.Value
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, liveRecordTimeout)
+	defer cancel()
+	live, err := s.livePDS.GetRecord(fetchCtx, pds, did, collection, rkey)
+	if err != nil {
+		if errors.Is(err, pdsfetch.ErrNotFound) {
+			atURILookups.WithLabelValues("not_found").Inc()
+			resp.Error = "record not found"
+			return c.JSON(http.StatusNotFound, resp)
+		}
+		atURILookups.WithLabelValues("error").Inc()
+		resp.Error = fmt.Sprintf("failed to fetch record from PDS: %s", err)
+		return c.JSON(http.StatusBadGateway, resp)
+	}
+
+	s.liveRecords.add(resp.URI, live)
+	atURILookups.WithLabelValues(AtURISourcePDS).Inc()
+	resp.Source = AtURISourcePDS
+	resp.CID = live.CID
+	resp.Value = live.Value
+	return c.JSON(http.StatusOK, resp)
+}
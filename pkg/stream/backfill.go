@@ -0,0 +1,418 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backfill job states
+const (
+	BackfillQueued     = "queued"
+	BackfillInProgress = "in_progress"
+	BackfillComplete   = "complete"
+	BackfillFailed     = "failed"
+)
+
+// BackfillAction is the action stored on records ingested from a repo checkout rather than the firehose
+const BackfillAction = "backfill"
+
+// backfillSweepInterval is how often queued jobs that didn't fit in the in-memory queue are picked up
+const backfillSweepInterval = time.Minute
+
+type backfillRequest struct {
+	DID string
+	PDS string
+}
+
+// enqueueBackfill records a backfill job for a repo the first time it's seen
+// and hands it to the workers if there's room in the queue
+func (s *Stream) enqueueBackfill(ctx context.Context, did, pds string) {
+	if s.BackfillWorkers < 1 || pds == "" {
+		return
+	}
+
+	tx := s.writer.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&BackfillJob{
+		DID:   did,
+		PDS:   pds,
+		State: BackfillQueued,
+	})
+	if tx.Error != nil {
+		s.logger.Error("failed to create backfill job", "did", did, "err", tx.Error)
+		return
+	}
+
+	// The repo has been seen before
+	if tx.RowsAffected == 0 {
+		return
+	}
+
+	select {
+	case s.backfillQueue <- backfillRequest{DID: did, PDS: pds}:
+	default:
+		// The sweeper will pick it up from the DB once the queue drains
+	}
+}
+
+// requeueBackfill queues a repo for backfill whether or not it's been backfilled before, and
+// reports whether it was queued. Repos already being backfilled are left alone.
+func (s *Stream) requeueBackfill(ctx context.Context, did, pds string) bool {
+	if s.BackfillWorkers < 1 || pds == "" {
+		return false
+	}
+
+	tx := s.writer.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&BackfillJob{
+		DID:   did,
+		PDS:   pds,
+		State: BackfillQueued,
+	})
+	if tx.Error != nil {
+		s.logger.Error("failed to create backfill job", "did", did, "err", tx.Error)
+		return false
+	}
+
+	if tx.RowsAffected == 0 {
+		tx = s.writer.WithContext(ctx).Model(&BackfillJob{}).
+			Where("d_id = ? AND state <> ?", did, BackfillInProgress).
+			Updates(map[string]any{"state": BackfillQueued, "pds": pds, "error": ""})
+		if tx.Error != nil {
+			s.logger.Error("failed to requeue backfill job", "did", did, "err", tx.Error)
+			return false
+		}
+		if tx.RowsAffected == 0 {
+			return false
+		}
+	}
+
+	select {
+	case s.backfillQueue <- backfillRequest{DID: did, PDS: pds}:
+	default:
+	}
+	return true
+}
+
+// RunBackfill runs BackfillWorkers workers that fetch full repos for DIDs seen on the firehose
+// and ingest their records, until ctx is cancelled
+func (s *Stream) RunBackfill(ctx context.Context) error {
+	logger := s.logger.With("source", "backfill")
+	logger.Info("starting backfill workers", "workers", s.BackfillWorkers)
+
+	// Jobs interrupted by a restart are picked back up by the sweeper
+	if err := s.writer.Model(&BackfillJob{}).
+		Where("state = ?", BackfillInProgress).
+		Update("state", BackfillQueued).Error; err != nil {
+		return fmt.Errorf("failed to requeue interrupted backfill jobs: %w", err)
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < s.BackfillWorkers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-s.backfillQueue:
+					s.backfillRepo(ctx, req)
+				}
+			}
+		}()
+	}
+
+	ticker := s.Clock.NewTicker(backfillSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for i := 0; i < s.BackfillWorkers; i++ {
+				<-done
+			}
+			return nil
+		case <-ticker.C():
+			if len(s.backfillQueue) > 0 {
+				continue
+			}
+
+			var jobs []BackfillJob
+			if err := s.reader.Where("state = ?", BackfillQueued).
+				Order("created_at ASC").
+				Limit(cap(s.backfillQueue)).
+				Find(&jobs).Error; err != nil {
+				logger.Error("failed to load queued backfill jobs", "err", err)
+				continue
+			}
+
+			for _, job := range jobs {
+				select {
+				case s.backfillQueue <- backfillRequest{DID: job.DID, PDS: job.PDS}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// backfillRepo claims a queued job and ingests every record in the repo
+func (s *Stream) backfillRepo(ctx context.Context, req backfillRequest) {
+	ctx, span := tracer.Start(ctx, "backfillRepo")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("repo", req.DID),
+		attribute.String("pds", req.PDS),
+	)
+
+	logger := s.logger.With("source", "backfill", "did", req.DID, "pds", req.PDS)
+
+	// Claim the job so a sweep can't hand it to a second worker
+	now := s.Clock.Now()
+	tx := s.writer.Model(&BackfillJob{}).
+		Where("d_id = ? AND state = ?", req.DID, BackfillQueued).
+		Updates(map[string]any{"state": BackfillInProgress, "started_at": now})
+	if tx.Error != nil {
+		logger.Error("failed to claim backfill job", "err", tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		return
+	}
+
+	numRecords, err := s.ingestRepo(ctx, req)
+
+	updates := map[string]any{
+		"state":        BackfillComplete,
+		"records":      numRecords,
+		"completed_at": s.Clock.Now(),
+		"error":        "",
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down, leave the job to be resumed on the next start
+			updates = map[string]any{"state": BackfillQueued}
+		} else {
+			logger.Warn("backfill failed", "err", err)
+			updates["state"] = BackfillFailed
+			updates["error"] = err.Error()
+		}
+	} else {
+		logger.Info("backfill complete", "records", numRecords, "duration", s.Clock.Since(now))
+	}
+
+	backfillJobs.WithLabelValues(updates["state"].(string)).Inc()
+
+	if err := s.writer.Model(&BackfillJob{}).Where("d_id = ?", req.DID).Updates(updates).Error; err != nil {
+		logger.Error("failed to update backfill job", "err", err)
+	}
+}
+
+// ingestRepo fetches a repo from its PDS and writes each of its records that differs from the
+// version stored for its path to the sinks. Stored records missing from the repo are deleted.
+func (s *Stream) ingestRepo(ctx context.Context, req backfillRequest) (int, error) {
+	did, err := syntax.ParseDID(req.DID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DID: %w", err)
+	}
+
+	if kind := s.blocklist.blockedBy(req.DID, req.PDS); kind != "" {
+		s.logger.Info("skipping backfill of blocked repo", "did", req.DID, "pds", req.PDS, "block", kind)
+		return 0, nil
+	}
+
+	// Taken before the fetch, so records created while it's in flight aren't taken for deleted
+	stored, err := s.storedVersions(ctx, req.DID)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := s.pds.ReadRepo(ctx, req.PDS, did)
+	if err != nil {
+		if errors.Is(err, pdsfetch.ErrNotFound) {
+			return 0, fmt.Errorf("repo not found on PDS")
+		}
+		return 0, fmt.Errorf("failed to fetch repo: %w", err)
+	}
+
+	numRecords := 0
+	err = r.ForEach(ctx, "", func(path string, nodeCid cid.Cid) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Anything still in the repo is kept, even if it can't be read this time
+		prev, wasStored := stored[path]
+		delete(stored, path)
+
+		collection, rkey, ok := strings.Cut(path, "/")
+		if !ok || !s.recordFilter.Load().allows(req.DID, collection) {
+			return nil
+		}
+
+		_, rec, err := r.GetRecordBytes(ctx, path)
+		if err != nil || rec == nil {
+			return nil
+		}
+
+		asCbor, err := data.UnmarshalCBOR(*rec)
+		if err != nil {
+			return nil
+		}
+
+		recJSON, rawSize, truncated, err := s.truncateRecord(asCbor)
+		if err != nil {
+			return nil
+		}
+
+		numRecords++
+		if wasStored && prev.Action != "delete" && prev.Truncated == truncated && bytes.Equal(prev.Raw, recJSON) {
+			return nil
+		}
+
+		dbRecord := &Record{
+			Repo:       req.DID,
+			Collection: collection,
+			RKey:       rkey,
+			Action:     BackfillAction,
+			Raw:        recJSON,
+			RawSize:    rawSize,
+			Truncated:  truncated,
+		}
+		dbRecord.ReplyRoot, dbRecord.ReplyParent = recordReplyRefs(collection, asCbor)
+		dbRecord.Langs = recordLangs(asCbor)
+		dbRecord.setProvenance(pdsHost(req.PDS), "", nil, VerificationNone)
+		dbRecord.CID = nodeCid.String()
+
+		if err := s.writeRecord(ctx, ChangeSourceBackfill, dbRecord); err != nil {
+			return fmt.Errorf("failed to write record %q: %w", path, err)
+		}
+
+		recordsBackfilled.Inc()
+		return nil
+	})
+	if err != nil {
+		return numRecords, err
+	}
+
+	for path, prev := range stored {
+		if prev.Action == "delete" || !s.recordFilter.Load().allows(req.DID, prev.Collection) {
+			continue
+		}
+
+		dbRecord := &Record{
+			Repo:       req.DID,
+			Collection: prev.Collection,
+			RKey:       prev.RKey,
+			Action:     "delete",
+		}
+		dbRecord.setProvenance(pdsHost(req.PDS), "", nil, VerificationNone)
+
+		if err := s.writeRecord(ctx, ChangeSourceBackfill, dbRecord); err != nil {
+			return numRecords, fmt.Errorf("failed to delete record %q: %w", path, err)
+		}
+	}
+
+	return numRecords, nil
+}
+
+// storedVersions returns the latest version stored of each of a repo's records, by path
+func (s *Stream) storedVersions(ctx context.Context, did string) (map[string]Record, error) {
+	var records []Record
+	err := s.writer.WithContext(ctx).
+		Select("id", "collection", "r_key", "action", "raw", "truncated").
+		Where("id IN (?)", s.writer.Model(&Record{}).Select("MAX(id)").Where("repo = ?", did).Group("collection, r_key")).
+		Find(&records).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored records: %w", err)
+	}
+
+	versions := make(map[string]Record, len(records))
+	for _, rec := range records {
+		versions[rec.Collection+"/"+rec.RKey] = rec
+	}
+	return versions, nil
+}
+
+type JSONBackfillJob struct {
+	DID         string     `json:"did"`
+	PDS         string     `json:"pds"`
+	State       string     `json:"state"`
+	Records     int        `json:"records"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type BackfillStatusResponse struct {
+	Enabled bool             `json:"enabled"`
+	States  map[string]int64 `json:"states,omitempty"`
+	Job     *JSONBackfillJob `json:"job,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// HandleGetBackfillStatus handles the GET /backfill/status endpoint, returning counts of
+// backfill jobs by state, or a single repo's job if a DID is given
+func (s *Stream) HandleGetBackfillStatus(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	resp := BackfillStatusResponse{Enabled: s.BackfillWorkers > 0}
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+
+		var job BackfillJob
+		if err := s.reader.Where("d_id = ?", did.String()).First(&job).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				resp.Error = "no backfill job for repo"
+				return c.JSON(http.StatusNotFound, resp)
+			}
+			resp.Error = err.Error()
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
+
+		resp.Job = &JSONBackfillJob{
+			DID:         job.DID,
+			PDS:         job.PDS,
+			State:       job.State,
+			Records:     job.Records,
+			Error:       job.Error,
+			CreatedAt:   job.CreatedAt,
+			StartedAt:   job.StartedAt,
+			CompletedAt: job.CompletedAt,
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	var rows []struct {
+		State string
+		Count int64
+	}
+	if err := s.reader.Model(&BackfillJob{}).Select("state, COUNT(*) AS count").Group("state").Scan(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.States = map[string]int64{}
+	for _, row := range rows {
+		resp.States[row.State] = row.Count
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,338 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of ingest blocks
+const (
+	BlockKindDID = "did"
+	BlockKindPDS = "pds"
+)
+
+// blocklist is the in-memory copy of the ingest blocks, consulted for every record
+type blocklist struct {
+	dids     map[string]bool
+	pdsHosts map[string]bool
+	lk       sync.RWMutex
+}
+
+// EnableBlocklist loads the ingest blocks, dropping records from blocked DIDs and PDS hosts at
+// ingest. Blocks are managed at /admin/blocks by requests bearing the AdminToken.
+func (s *Stream) EnableBlocklist(ctx context.Context) error {
+	var blocks []IngestBlock
+	if err := s.writer.WithContext(ctx).Find(&blocks).Error; err != nil {
+		return fmt.Errorf("failed to load ingest blocks: %w", err)
+	}
+
+	b := &blocklist{
+		dids:     make(map[string]bool),
+		pdsHosts: make(map[string]bool),
+	}
+	for _, block := range blocks {
+		b.set(block.Kind, block.Value, true)
+	}
+
+	s.blocklist = b
+	s.logger.Info("loaded ingest blocks", "blocks", len(blocks))
+	return nil
+}
+
+func (b *blocklist) set(kind, value string, blocked bool) {
+	if b == nil {
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	m := b.dids
+	if kind == BlockKindPDS {
+		m = b.pdsHosts
+	}
+	if blocked {
+		m[value] = true
+	} else {
+		delete(m, value)
+	}
+}
+
+// blockedBy returns the kind of block dropping records from a repo hosted on pds (a URL, may be
+// empty if unknown), or an empty string if its records are kept
+func (b *blocklist) blockedBy(did, pds string) string {
+	if b == nil {
+		return ""
+	}
+
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	if b.dids[did] {
+		return BlockKindDID
+	}
+	if pds != "" && b.pdsHosts[strings.ToLower(pdsHost(pds))] {
+		return BlockKindPDS
+	}
+	return ""
+}
+
+// normalizeBlock validates a block's value, reducing PDS URLs to their host
+func normalizeBlock(kind, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case BlockKindDID:
+		did, err := syntax.ParseDID(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid DID: %w", err)
+		}
+		return did.String(), nil
+	case BlockKindPDS:
+		host := strings.ToLower(pdsHost(value))
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return "", fmt.Errorf("invalid PDS host %q", value)
+		}
+		return host, nil
+	default:
+		return "", fmt.Errorf("invalid kind %q, expected %s or %s", kind, BlockKindDID, BlockKindPDS)
+	}
+}
+
+type JSONIngestBlock struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+type BlocksResponse struct {
+	Blocks []JSONIngestBlock `json:"blocks"`
+	Error  string            `json:"error,omitempty"`
+}
+
+type BlockResponse struct {
+	Block *JSONIngestBlock `json:"block,omitempty"`
+	Error string           `json:"error,omitempty"`
+}
+
+type BlockRequest struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func dbBlockToJSON(b IngestBlock) JSONIngestBlock {
+	return JSONIngestBlock{
+		ID:        b.ID,
+		CreatedAt: b.CreatedAt,
+		Kind:      b.Kind,
+		Value:     b.Value,
+		Reason:    b.Reason,
+		CreatedBy: b.CreatedBy,
+	}
+}
+
+// HandleGetBlocks handles the GET /admin/blocks endpoint, listing every ingest block
+func (s *Stream) HandleGetBlocks(c echo.Context) error {
+	// Query params:
+	// kind - Only return blocks of this kind: did or pds (optional)
+	resp := BlocksResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	q := s.reader.WithContext(c.Request().Context()).Order("id DESC")
+	if kind := c.QueryParam("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+
+	var blocks []IngestBlock
+	if err := q.Find(&blocks).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Blocks = make([]JSONIngestBlock, len(blocks))
+	for i, b := range blocks {
+		resp.Blocks[i] = dbBlockToJSON(b)
+	}
+
+	setRowsReturned(c, len(resp.Blocks))
+	return c.JSON(http.StatusOK, resp)
+}
+
+// HandleAddBlock handles the POST /admin/blocks endpoint, blocking a DID or PDS host
+func (s *Stream) HandleAddBlock(c echo.Context) error {
+	resp := BlockResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	var req BlockRequest
+	if err := c.Bind(&req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	value, err := normalizeBlock(req.Kind, req.Value)
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	block := IngestBlock{Kind: req.Kind, Value: value, Reason: req.Reason, CreatedBy: adminActor(c)}
+	err = s.writer.WithContext(c.Request().Context()).Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&block)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errBlockExists
+		}
+		return tx.Create(&IngestBlockAudit{
+			Action: "add",
+			Kind:   block.Kind,
+			Value:  block.Value,
+			Reason: block.Reason,
+			Actor:  block.CreatedBy,
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, errBlockExists) {
+			resp.Error = err.Error()
+			return c.JSON(http.StatusConflict, resp)
+		}
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	s.blocklist.set(block.Kind, block.Value, true)
+	s.logger.Info("ingest block added", "kind", block.Kind, "value", block.Value, "reason", block.Reason, "actor", block.CreatedBy)
+
+	jsonBlock := dbBlockToJSON(block)
+	resp.Block = &jsonBlock
+	return c.JSON(http.StatusCreated, resp)
+}
+
+var errBlockExists = errors.New("already blocked")
+
+// HandleDeleteBlock handles the DELETE /admin/blocks/:id endpoint, lifting a block
+func (s *Stream) HandleDeleteBlock(c echo.Context) error {
+	resp := BlockResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid id: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var block IngestBlock
+	err = s.writer.WithContext(c.Request().Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&block, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&block).Error; err != nil {
+			return err
+		}
+		return tx.Create(&IngestBlockAudit{
+			Action: "remove",
+			Kind:   block.Kind,
+			Value:  block.Value,
+			Reason: block.Reason,
+			Actor:  adminActor(c),
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			resp.Error = "block not found"
+			return c.JSON(http.StatusNotFound, resp)
+		}
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	s.blocklist.set(block.Kind, block.Value, false)
+	s.logger.Info("ingest block removed", "kind", block.Kind, "value", block.Value, "actor", adminActor(c))
+
+	jsonBlock := dbBlockToJSON(block)
+	resp.Block = &jsonBlock
+	return c.JSON(http.StatusOK, resp)
+}
+
+type JSONIngestBlockAudit struct {
+	CreatedAt time.Time `json:"created_at"`
+	Action    string    `json:"action"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	Actor     string    `json:"actor"`
+}
+
+type BlockAuditResponse struct {
+	Entries []JSONIngestBlockAudit `json:"entries"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// HandleGetBlockAudit handles the GET /admin/blocks/audit endpoint, listing changes to the
+// ingest blocks, newest first
+func (s *Stream) HandleGetBlockAudit(c echo.Context) error {
+	// Query params:
+	// value - Only return changes to blocks of this DID or PDS host (optional)
+	// limit - Number of entries to return (default=100)
+	resp := BlockAuditResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	q := s.reader.WithContext(c.Request().Context()).Order("id DESC").Limit(limit)
+	if value := c.QueryParam("value"); value != "" {
+		q = q.Where("value = ?", value)
+	}
+
+	var entries []IngestBlockAudit
+	if err := q.Find(&entries).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Entries = make([]JSONIngestBlockAudit, len(entries))
+	for i, e := range entries {
+		resp.Entries[i] = JSONIngestBlockAudit{
+			CreatedAt: e.CreatedAt,
+			Action:    e.Action,
+			Kind:      e.Kind,
+			Value:     e.Value,
+			Reason:    e.Reason,
+			Actor:     e.Actor,
+		}
+	}
+
+	setRowsReturned(c, len(resp.Entries))
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,248 @@
+package stream
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// botScoreCollection is the collection whose creates are scored
+	botScoreCollection = "app.bsky.feed.post"
+	// botScoreMinPosts is how many posts a repo needs in the retention window to be scored
+	botScoreMinPosts = 5
+	// botScoreMaxPosts caps how many of a repo's most recent posts are scored
+	botScoreMaxPosts = 5000
+	// botScoreCandidates is how many of the most active repos the ranked list scores
+	botScoreCandidates = 200
+)
+
+// Weights of each heuristic in the combined score
+const (
+	botScoreRegularityWeight = 0.4
+	botScoreDuplicateWeight  = 0.4
+	botScoreBurstinessWeight = 0.2
+)
+
+// BotScore scores how automated a repo's posting looks, each heuristic is between 0 (human-like) and 1 (bot-like)
+type BotScore struct {
+	DID   string `json:"did"`
+	Posts int    `json:"posts"`
+
+	// Regularity is high when posts arrive at near-constant intervals
+	Regularity float64 `json:"regularity"`
+	// DuplicateRatio is the fraction of posts whose text was already posted by the repo
+	DuplicateRatio float64 `json:"duplicate_ratio"`
+	// Burstiness is high when posts arrive in dense bursts separated by long silences
+	Burstiness float64 `json:"burstiness"`
+
+	Score float64 `json:"score"`
+}
+
+type BotScoreResponse struct {
+	*BotScore
+	Error string `json:"error,omitempty"`
+}
+
+type BotScoresResponse struct {
+	Scores []BotScore `json:"scores"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// scoreRepo scores a repo's posts within the retention window, returning nil if it has too few to judge
+func (s *Stream) scoreRepo(did string) (*BotScore, error) {
+	var rows []struct {
+		CreatedAt time.Time
+		Raw       []byte
+	}
+	if err := s.reader.Model(&Record{}).
+		Select("created_at, raw").
+		Where("repo = ? AND collection = ? AND action = ?", did, botScoreCollection, "create").
+		Order("id DESC").
+		Limit(botScoreMaxPosts).
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load posts: %w", err)
+	}
+
+	if len(rows) < botScoreMinPosts {
+		return nil, nil
+	}
+
+	times := make([]time.Time, len(rows))
+	texts := make([]string, len(rows))
+	for i, row := range rows {
+		times[i] = row.CreatedAt
+
+		var post struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(row.Raw, &post); err == nil {
+			texts[i] = strings.ToLower(strings.TrimSpace(post.Text))
+		}
+	}
+
+	score := &BotScore{
+		DID:            did,
+		Posts:          len(rows),
+		DuplicateRatio: duplicateRatio(texts),
+	}
+	score.Regularity, score.Burstiness = gapScores(times)
+	score.Score = botScoreRegularityWeight*score.Regularity +
+		botScoreDuplicateWeight*score.DuplicateRatio +
+		botScoreBurstinessWeight*score.Burstiness
+
+	return score, nil
+}
+
+// duplicateRatio returns the fraction of non-empty texts that repeat an earlier one
+func duplicateRatio(texts []string) float64 {
+	seen := make(map[string]struct{}, len(texts))
+	total, dupes := 0, 0
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		total++
+		if _, ok := seen[text]; ok {
+			dupes++
+			continue
+		}
+		seen[text] = struct{}{}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(dupes) / float64(total)
+}
+
+// gapScores derives regularity and burstiness from the gaps between post times, using the
+// coefficient of variation of the gaps and the Goh-Barabási burstiness parameter
+func gapScores(times []time.Time) (regularity, burstiness float64) {
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+
+	gaps := make([]float64, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]).Seconds())
+	}
+
+	mean := 0.0
+	for _, g := range gaps {
+		mean += g
+	}
+	mean /= float64(len(gaps))
+
+	variance := 0.0
+	for _, g := range gaps {
+		variance += (g - mean) * (g - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(gaps)))
+
+	// Everything posted at the same instant is as regular and bursty as it gets
+	if mean == 0 {
+		return 1, 1
+	}
+
+	cv := stddev / mean
+	regularity = math.Max(0, 1-cv)
+
+	// B ranges from -1 (perfectly periodic) to 1 (maximally bursty)
+	b := (stddev - mean) / (stddev + mean)
+	burstiness = (b + 1) / 2
+
+	return regularity, burstiness
+}
+
+// HandleGetRepoScore handles the GET /repos/:did/score endpoint, scoring how automated
+// a repo's posting looks within the retention window
+func (s *Stream) HandleGetRepoScore(c echo.Context) error {
+	resp := BotScoreResponse{}
+
+	if !s.BotScoring {
+		resp.Error = "bot scoring is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	did, err := syntax.ParseDID(c.Param("did"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid DID: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	score, err := s.scoreRepo(did.String())
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	if score == nil {
+		resp.Error = fmt.Sprintf("repo has fewer than %d posts in the retention window", botScoreMinPosts)
+		return c.JSON(http.StatusNotFound, resp)
+	}
+
+	resp.BotScore = score
+	return c.JSON(http.StatusOK, resp)
+}
+
+// HandleGetRepoScores handles the GET /repos/scores endpoint, ranking the most active
+// repos in the retention window by how automated their posting looks
+func (s *Stream) HandleGetRepoScores(c echo.Context) error {
+	// Parse the query parameters
+	// limit - Number of scores to return (default=100)
+	resp := BotScoresResponse{}
+
+	if !s.BotScoring {
+		resp.Error = "bot scoring is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	// Only the most active repos are scored, scoring every repo would scan the whole window
+	var candidates []string
+	if err := s.reader.Model(&Record{}).
+		Select("repo").
+		Where("collection = ? AND action = ?", botScoreCollection, "create").
+		Group("repo").
+		Having("COUNT(*) >= ?", botScoreMinPosts).
+		Order("COUNT(*) DESC").
+		Limit(botScoreCandidates).
+		Scan(&candidates).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Scores = []BotScore{}
+	for _, did := range candidates {
+		score, err := s.scoreRepo(did)
+		if err != nil {
+			resp.Error = err.Error()
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
+		if score != nil {
+			resp.Scores = append(resp.Scores, *score)
+		}
+	}
+
+	slices.SortFunc(resp.Scores, func(a, b BotScore) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+
+	if len(resp.Scores) > limit {
+		resp.Scores = resp.Scores[:limit]
+	}
+
+	setRowsReturned(c, len(resp.Scores))
+	return c.JSON(http.StatusOK, resp)
+}
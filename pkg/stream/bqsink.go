@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/ericvolp12/atproto.tools/pkg/bq"
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+)
+
+// BQSink writes records, and optionally events and identities, to BigQuery
+type BQSink struct {
+	bq    *bq.BQ
+	clock clock.Clock
+}
+
+func NewBQSink(b *bq.BQ, clk clock.Clock) *BQSink {
+	return &BQSink{bq: b, clock: clk}
+}
+
+func (b *BQSink) Name() string { return "bigquery" }
+
+// UseBQStorageWrite writes BigQuery rows through the Storage Write API, keeping its write offsets
+// in the stream's database alongside the cursor they line up with
+func (s *Stream) UseBQStorageWrite(ctx context.Context, b *bq.BQ) error {
+	return b.UseStorageWrite(ctx, s.writer)
+}
+
+func (b *BQSink) WriteRecord(ctx context.Context, rec *Record) error {
+	bqRecord := &bq.Record{
+		CreatedAt:   b.clock.Now(),
+		FirehoseSeq: rec.FirehoseSeq,
+		Repo:        rec.Repo,
+		Collection:  rec.Collection,
+		RKey:        rec.RKey,
+		Action:      rec.Action,
+	}
+
+	if rec.Raw != nil {
+		bqRecord.Raw = bigquery.NullJSON{Valid: true, JSONVal: string(rec.Raw)}
+	}
+
+	if rec.Truncated != "" {
+		bqRecord.Error = truncationError(rec.Truncated, rec.RawSize)
+	}
+
+	return b.bq.InsertRecord(ctx, bqRecord)
+}
+
+func (b *BQSink) WriteEvent(ctx context.Context, evt *Event) error {
+	if !b.bq.ExportsEvents() {
+		return nil
+	}
+
+	bqEvent := &bq.Event{
+		CreatedAt:   b.clock.Now(),
+		FirehoseSeq: evt.FirehoseSeq,
+		Repo:        evt.Repo,
+		EventType:   evt.EventType,
+		Time:        time.Unix(0, evt.Time),
+		Creates:     int64(evt.Creates),
+		Updates:     int64(evt.Updates),
+		Deletes:     int64(evt.Deletes),
+		Error:       evt.Error,
+	}
+
+	if evt.Since != nil {
+		bqEvent.Since = bigquery.NullString{Valid: true, StringVal: *evt.Since}
+	}
+
+	if evt.Collections != "" {
+		if err := json.Unmarshal([]byte(evt.Collections), &bqEvent.Collections); err != nil {
+			return fmt.Errorf("failed to parse event collections: %w", err)
+		}
+	}
+
+	return b.bq.InsertEvent(ctx, bqEvent)
+}
+
+func (b *BQSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	return b.bq.InsertIdentity(ctx, &bq.Identity{
+		CreatedAt: b.clock.Now(),
+		DID:       id.DID,
+		Handle:    id.Handle,
+		PDS:       id.PDS,
+		Status:    id.Status,
+	})
+}
+
+func (b *BQSink) Flush(ctx context.Context) error {
+	return b.bq.Flush(ctx)
+}
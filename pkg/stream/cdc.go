@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kinds of change data capture events
+const (
+	ChangeRecordInserted  = "record_inserted"
+	ChangeEventInserted   = "event_inserted"
+	ChangeIdentityUpdated = "identity_updated"
+	ChangeRowsExpired     = "rows_expired"
+)
+
+// Where an inserted record came from
+const (
+	ChangeSourceFirehose  = "firehose"
+	ChangeSourceBackfill  = "backfill"
+	ChangeSourceReprocess = "reprocess"
+)
+
+// Change is a change data capture event describing a write to the looking glass database. Only
+// the field matching its Kind is set.
+type Change struct {
+	Kind string
+	Time time.Time
+	// Source is where an inserted record came from, one of the ChangeSource* values
+	Source string
+
+	Record   *Record
+	Event    *Event
+	Identity *Identity
+	Expiry   *Expiry
+}
+
+// Expiry describes rows deleted from a table for passing out of retention
+type Expiry struct {
+	Table  string
+	Before time.Time // Rows created before this were deleted
+	Rows   int64
+}
+
+// ChangeConsumer receives changes published on the stream's bus. Consumers are called in the
+// order they were added, on the goroutine making the change, so slow ones hold up ingestion.
+type ChangeConsumer interface {
+	// Name identifies the consumer in logs and metrics
+	Name() string
+	HandleChange(ctx context.Context, c *Change) error
+}
+
+// changeBus fans changes out to every consumer, decoupling what's ingested from where it goes
+type changeBus struct {
+	consumers []ChangeConsumer
+	lk        sync.RWMutex
+}
+
+// consumerError is a change a consumer failed to handle
+type consumerError struct {
+	consumer string
+	err      error
+}
+
+func (b *changeBus) add(c ChangeConsumer) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.consumers = append(b.consumers, c)
+}
+
+// publish delivers a change to every consumer, returning the failures
+func (b *changeBus) publish(ctx context.Context, c *Change) []consumerError {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+
+	changesPublished.WithLabelValues(c.Kind).Inc()
+
+	var failed []consumerError
+	for _, consumer := range b.consumers {
+		if err := consumer.HandleChange(ctx, c); err != nil {
+			changeConsumerErrors.WithLabelValues(consumer.Name(), c.Kind).Inc()
+			failed = append(failed, consumerError{consumer: consumer.Name(), err: err})
+		}
+	}
+	return failed
+}
+
+// AddChangeConsumer subscribes a consumer to every change the stream makes to its database, for
+// outputs that need more than the Sink interface offers, like expiries. Consumers must be added
+// before the stream is started.
+func (s *Stream) AddChangeConsumer(c ChangeConsumer) {
+	s.logger.Info("adding change consumer", "consumer", c.Name())
+	s.changes.add(c)
+}
+
+// expireRows deletes a table's rows created before a time, publishing the expiry, and returns how
+// many were deleted. Failures are logged and count as nothing deleted.
+func (s *Stream) expireRows(ctx context.Context, table string, before time.Time) int64 {
+	tx := s.writer.WithContext(ctx).Exec(fmt.Sprintf("DELETE FROM %s WHERE created_at < ?", table), before)
+	if tx.Error != nil {
+		s.logger.Error("failed to delete expired rows", "table", table, "err", tx.Error)
+		return 0
+	}
+
+	expiry := &Expiry{Table: table, Before: before, Rows: tx.RowsAffected}
+	for _, f := range s.publishChange(ctx, &Change{Kind: ChangeRowsExpired, Expiry: expiry}) {
+		s.logger.Error("failed to publish expiry", "consumer", f.consumer, "table", table, "err", f.err)
+	}
+	return tx.RowsAffected
+}
+
+func (s *Stream) publishChange(ctx context.Context, c *Change) []consumerError {
+	c.Time = s.Clock.Now()
+	return s.changes.publish(ctx, c)
+}
+
+// sinkConsumer adapts a Sink to the change bus, dead-lettering records it fails to write
+type sinkConsumer struct {
+	sink Sink
+	s    *Stream
+}
+
+func (sc *sinkConsumer) Name() string { return sc.sink.Name() }
+
+func (sc *sinkConsumer) HandleChange(ctx context.Context, c *Change) error {
+	if _, ok := sc.sink.(replaySafeSink); !ok && sc.s.replayed(c) {
+		return nil
+	}
+
+	switch c.Kind {
+	case ChangeRecordInserted:
+		if err := sc.sink.WriteRecord(ctx, c.Record); err != nil {
+			sinkWriteErrors.WithLabelValues(sc.sink.Name(), "record").Inc()
+			sc.s.deadLetter(ctx, sc.sink.Name(), c.Record, err)
+			return err
+		}
+	case ChangeEventInserted:
+		if err := sc.sink.WriteEvent(ctx, c.Event); err != nil {
+			sinkWriteErrors.WithLabelValues(sc.sink.Name(), "event").Inc()
+			return err
+		}
+	case ChangeIdentityUpdated:
+		if err := sc.sink.WriteIdentity(ctx, c.Identity); err != nil {
+			sinkWriteErrors.WithLabelValues(sc.sink.Name(), "identity").Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// eventCacheConsumer keeps the recent event cache current
+type eventCacheConsumer struct {
+	cache *eventCache
+}
+
+func (ec *eventCacheConsumer) Name() string { return "event_cache" }
+
+func (ec *eventCacheConsumer) HandleChange(ctx context.Context, c *Change) error {
+	if c.Kind == ChangeEventInserted {
+		ec.cache.add(c.Event)
+	}
+	return nil
+}
+
+// subscribeConsumer rebroadcasts the ops of live commits to /subscribe clients. Backfilled and
+// reprocessed records aren't rebroadcast, as they'd arrive long after the commits they came from,
+// and neither are records re-read by the replay window, which clients may already have seen.
+type subscribeConsumer struct {
+	s *Stream
+}
+
+func (sc *subscribeConsumer) Name() string { return "subscribe" }
+
+func (sc *subscribeConsumer) HandleChange(ctx context.Context, c *Change) error {
+	if c.Kind != ChangeRecordInserted || c.Source != ChangeSourceFirehose || sc.s.replayed(c) {
+		return nil
+	}
+	rec := c.Record
+	sc.s.emitCommitOp(rec.FirehoseSeq, rec.Repo, rec.Rev, rec.Action, rec.Collection, rec.RKey, rec.CID, rec.Langs, rec.Raw)
+	return nil
+}
@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// observeChurn checks whether a deleted record was created within the churn window, and if so
+// records how long it lived on both the delete and the create it undid
+func (s *Stream) observeChurn(ctx context.Context, del *Record) error {
+	if s.ChurnWindow <= 0 {
+		return nil
+	}
+
+	// A create still waiting in the database batch has to be written before it can be found
+	if s.dbBatch != nil {
+		if err := s.dbBatch.flushIfBuffered(ctx, del.Repo, del.Collection, del.RKey); err != nil {
+			return fmt.Errorf("failed to flush database batch: %w", err)
+		}
+	}
+
+	// Backfilled creates were ingested long after they were made, so only firehose creates count
+	var creates []Record
+	err := s.writer.WithContext(ctx).
+		Where("repo = ? AND collection = ? AND r_key = ? AND action = ? AND firehose_seq > 0", del.Repo, del.Collection, del.RKey, "create").
+		Order("id DESC").
+		Limit(1).
+		Find(&creates).Error
+	if err != nil {
+		return fmt.Errorf("failed to find created record: %w", err)
+	}
+	if len(creates) == 0 {
+		return nil
+	}
+
+	lifetime := s.Clock.Since(creates[0].CreatedAt)
+	if lifetime > s.ChurnWindow {
+		return nil
+	}
+
+	seconds := int64(lifetime.Seconds())
+	del.ChurnSeconds = &seconds
+	recordsChurned.WithLabelValues(del.Collection).Inc()
+
+	err = s.writer.WithContext(ctx).Model(&Record{}).
+		Where("id = ?", creates[0].ID).
+		Update("churn_seconds", seconds).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark created record as churned: %w", err)
+	}
+	return nil
+}
+
+type ChurnStats struct {
+	Collection string `json:"collection"`
+	// Creates is the number of records created, and Churned how many of them were deleted within the churn window
+	Creates    int64   `json:"creates"`
+	Churned    int64   `json:"churned"`
+	Rate       float64 `json:"rate"`
+	AvgSeconds float64 `json:"avg_seconds"`
+}
+
+type ChurnResponse struct {
+	Window string       `json:"window"`
+	Churn  []ChurnStats `json:"churn"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// HandleGetChurnStats handles the GET /stats/churn endpoint, reporting per collection how many
+// created records were deleted again within the churn window, highest churn rate first.
+// Records created less than a window before until may still be deleted, so recent rates run low.
+func (s *Stream) HandleGetChurnStats(c echo.Context) error {
+	// Parse the query parameters
+	// collection - Collection NSID (optional)
+	// since - Only count records created at or after this RFC3339 timestamp or unix time (default 24h ago)
+	// until - Only count records created before this RFC3339 timestamp or unix time (optional)
+	collectionParam := c.QueryParam("collection")
+	sinceParam := c.QueryParam("since")
+	untilParam := c.QueryParam("until")
+
+	resp := ChurnResponse{Window: s.ChurnWindow.String()}
+
+	if s.ChurnWindow <= 0 {
+		resp.Error = "churn detection is not enabled"
+		return c.JSON(http.StatusNotFound, resp)
+	}
+
+	since := s.Clock.Now().Add(-24 * time.Hour)
+	if sinceParam != "" {
+		t, err := parseTimeParam(sinceParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid since: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		since = t
+	}
+
+	q := s.reader.Model(&Record{}).
+		Select("collection, COUNT(*) AS creates, COUNT(churn_seconds) AS churned, COALESCE(AVG(churn_seconds), 0) AS avg_seconds").
+		Where("action = ? AND firehose_seq > 0 AND created_at >= ?", "create", since)
+
+	if untilParam != "" {
+		until, err := parseTimeParam(untilParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid until: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("created_at < ?", until)
+	}
+
+	if collectionParam != "" {
+		collection, err := syntax.ParseNSID(collectionParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid collection: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("collection = ?", collection.String())
+	}
+
+	resp.Churn = []ChurnStats{}
+	if err := q.Group("collection").Scan(&resp.Churn).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	for i := range resp.Churn {
+		if st := &resp.Churn[i]; st.Creates > 0 {
+			st.Rate = float64(st.Churned) / float64(st.Creates)
+		}
+	}
+	slices.SortFunc(resp.Churn, func(a, b ChurnStats) int {
+		return cmp.Compare(b.Rate, a.Rate)
+	})
+
+	setRowsReturned(c, len(resp.Churn))
+	return c.JSON(http.StatusOK, resp)
+}
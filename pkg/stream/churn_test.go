@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+)
+
+func TestChurnOfBufferedCreate(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+	ctx := context.Background()
+
+	s := &Stream{
+		writer:      db,
+		Clock:       clock.NewFake(time.Now().Add(time.Minute)),
+		ChurnWindow: time.Hour,
+	}
+	s.dbBatch = &dbBatchSink{dbSink: &dbSink{db: db, name: "db"}, size: 10, logger: slog.Default()}
+
+	// The create is still buffered when its delete arrives
+	create := &Record{FirehoseSeq: 1, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "create"}
+	if err := s.dbBatch.WriteRecord(ctx, create); err != nil {
+		t.Fatalf("WriteRecord: %v", err)
+	}
+
+	del := &Record{FirehoseSeq: 2, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "delete"}
+	if err := s.observeChurn(ctx, del); err != nil {
+		t.Fatalf("observeChurn: %v", err)
+	}
+
+	if del.ChurnSeconds == nil {
+		t.Fatal("delete of a buffered create wasn't marked as churn")
+	}
+	var stored Record
+	if err := db.Where("firehose_seq = ?", 1).First(&stored).Error; err != nil {
+		t.Fatalf("buffered create wasn't written: %v", err)
+	}
+	if stored.ChurnSeconds == nil || *stored.ChurnSeconds != *del.ChurnSeconds {
+		t.Errorf("create churn_seconds = %v, want %d", stored.ChurnSeconds, *del.ChurnSeconds)
+	}
+}
+
+func TestChurnChangesRecordsETag(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+	ctx := context.Background()
+
+	s := &Stream{
+		writer:      db,
+		Clock:       clock.NewFake(time.Now().Add(time.Minute)),
+		ChurnWindow: time.Hour,
+	}
+
+	create := &Record{FirehoseSeq: 1, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "create"}
+	if err := db.Create(create).Error; err != nil {
+		t.Fatalf("failed to store create: %v", err)
+	}
+
+	// A client polls for the repo's creates, which marking the create as churned changes
+	params := url.Values{"did": {"did:plc:a"}, "action": {"create"}}
+	page := func() []Record {
+		t.Helper()
+		var records []Record
+		if err := db.Where("repo = ? AND action = ?", "did:plc:a", "create").Order("id DESC").Find(&records).Error; err != nil {
+			t.Fatalf("failed to get page: %v", err)
+		}
+		return records
+	}
+	before := pageETag(params, page())
+
+	del := &Record{FirehoseSeq: 2, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "delete"}
+	if err := s.observeChurn(ctx, del); err != nil {
+		t.Fatalf("observeChurn: %v", err)
+	}
+
+	if after := pageETag(params, page()); before == after {
+		t.Errorf("ETag %s didn't change when the create was marked as churned", after)
+	}
+}
@@ -0,0 +1,119 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingConn counts the bytes read from and written to a connection, which for a compressed
+// websocket are the compressed bytes on the wire
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+	metric  prometheus.Counter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	if c.metric != nil {
+		c.metric.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	if c.metric != nil {
+		c.metric.Add(float64(n))
+	}
+	return n, err
+}
+
+// wireConnKey is the context key of the wireConnSlot a dial reports its connection in
+type wireConnKey struct{}
+
+type wireConnSlot struct {
+	metric prometheus.Counter
+	conn   *countingConn
+}
+
+// NewDialer returns a firehose dialer that counts the bytes it reads off the wire, and offers
+// permessage-deflate compression to the relay if compression is set
+func NewDialer(compression bool) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		EnableCompression: compression,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 30 * time.Second}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if slot, ok := ctx.Value(wireConnKey{}).(*wireConnSlot); ok {
+				slot.conn = &countingConn{Conn: conn, metric: slot.metric}
+				return slot.conn, nil
+			}
+			return conn, nil
+		},
+	}
+}
+
+// compressionNegotiated reports whether a websocket handshake's headers agreed on permessage-deflate
+func compressionNegotiated(h http.Header) bool {
+	return strings.Contains(h.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+}
+
+// compressionStats tracks how many bytes a compressed websocket saved, by comparing the size of
+// the messages sent or received over it with the bytes that crossed the wire
+type compressionStats struct {
+	conn  *countingConn
+	wire  func(*countingConn) int64
+	saved prometheus.Counter
+
+	lk       sync.Mutex
+	payload  int64
+	reported int64
+}
+
+// addPayload records a message's uncompressed size and reports any new savings
+func (cs *compressionStats) addPayload(n int64) {
+	cs.lk.Lock()
+	defer cs.lk.Unlock()
+
+	cs.payload += n
+	// Savings are reported cumulatively since wire bytes are buffered and don't line up with messages
+	if saved := cs.payload - cs.wire(cs.conn); saved > cs.reported {
+		cs.saved.Add(float64(saved - cs.reported))
+		cs.reported = saved
+	}
+}
+
+// hijackCounter wraps a response writer so the connection a websocket upgrade hijacks counts
+// the bytes written to it
+type hijackCounter struct {
+	http.ResponseWriter
+	metric prometheus.Counter
+	conn   *countingConn
+}
+
+func (h *hijackCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.conn = &countingConn{Conn: conn, metric: h.metric}
+	return h.conn, brw, nil
+}
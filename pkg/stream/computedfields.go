@@ -0,0 +1,176 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+)
+
+// Limits on what a computed field extracts from a single record
+const (
+	maxComputedValues      = 32
+	maxComputedValueLength = 256
+)
+
+// computedFieldParamPrefix prefixes the /records query params filtering on computed fields
+const computedFieldParamPrefix = "kv."
+
+var computedFieldName = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+// ComputedField is an operator-defined value extracted from records at ingest
+type ComputedField struct {
+	Name string `json:"-"`
+	// Collection limits the field to records of one collection, empty for every collection
+	Collection string `json:"collection,omitempty"`
+	// Path is a dotted path into the record, where each segment is an object key, an array index,
+	// or * for every element of an array (e.g. "langs.*" or "embed.external.uri")
+	Path string `json:"path"`
+
+	segments []string
+}
+
+// LoadComputedFields reads computed fields from a JSON config file, an object keyed by field name
+func LoadComputedFields(configPath string) ([]ComputedField, error) {
+	raw, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read computed fields config: %w", err)
+	}
+
+	var byName map[string]ComputedField
+	if err := json.Unmarshal(raw, &byName); err != nil {
+		return nil, fmt.Errorf("failed to parse computed fields config: %w", err)
+	}
+
+	fields := make([]ComputedField, 0, len(byName))
+	for name, f := range byName {
+		if !computedFieldName.MatchString(name) {
+			return nil, fmt.Errorf("computed field name %q must be 1-64 lowercase letters, digits, or underscores", name)
+		}
+		if f.Collection != "" {
+			if _, err := syntax.ParseNSID(f.Collection); err != nil {
+				return nil, fmt.Errorf("computed field %q has an invalid collection: %w", name, err)
+			}
+		}
+		if f.Path == "" {
+			return nil, fmt.Errorf("computed field %q must set a path", name)
+		}
+		f.Name = name
+		f.segments = strings.Split(f.Path, ".")
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// EnableComputedFields extracts the given fields from each record ingested from now on, making
+// them filterable with kv.<name> query params on /records
+func (s *Stream) EnableComputedFields(fields []ComputedField) {
+	s.computedFields = make(map[string]ComputedField, len(fields))
+	for _, f := range fields {
+		s.computedFields[f.Name] = f
+	}
+}
+
+// computeFields extracts the configured computed fields from a decoded record
+func (s *Stream) computeFields(collection string, rec map[string]any) []RecordField {
+	var fields []RecordField
+	for _, f := range s.computedFields {
+		if f.Collection != "" && f.Collection != collection {
+			continue
+		}
+		for _, v := range extractPath(rec, f.segments) {
+			if len(fields) >= maxComputedValues {
+				return fields
+			}
+			fields = append(fields, RecordField{Name: f.Name, Value: v})
+		}
+	}
+	return fields
+}
+
+// extractPath returns the scalar values at a path into a record, formatted as strings
+func extractPath(v any, segments []string) []string {
+	if len(segments) == 0 {
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case bool:
+			s = strconv.FormatBool(v)
+		case data.CIDLink:
+			s = v.String()
+		default:
+			return nil
+		}
+		if len(s) > maxComputedValueLength {
+			s = s[:maxComputedValueLength]
+		}
+		return []string{s}
+	}
+
+	seg, rest := segments[0], segments[1:]
+	switch v := v.(type) {
+	case map[string]any:
+		return extractPath(v[seg], rest)
+	case []any:
+		if seg == "*" {
+			var values []string
+			for _, elem := range v {
+				values = append(values, extractPath(elem, rest)...)
+			}
+			return values
+		}
+		i, err := strconv.Atoi(seg)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil
+		}
+		return extractPath(v[i], rest)
+	}
+	return nil
+}
+
+// saveComputedFields stores the computed field values of a written record
+func (s *Stream) saveComputedFields(ctx context.Context, rec *Record, fields []RecordField) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	for i := range fields {
+		fields[i].FirehoseSeq = rec.FirehoseSeq
+		fields[i].Repo = rec.Repo
+		fields[i].Collection = rec.Collection
+		fields[i].RKey = rec.RKey
+	}
+
+	return s.writer.WithContext(ctx).Create(&fields).Error
+}
+
+// filterComputedFields narrows a records query to those matching every kv.<name>=<value> param
+func (s *Stream) filterComputedFields(q *gorm.DB, params map[string][]string) (*gorm.DB, error) {
+	for param, values := range params {
+		name, ok := strings.CutPrefix(param, computedFieldParamPrefix)
+		if !ok {
+			continue
+		}
+		if _, ok := s.computedFields[name]; !ok {
+			return nil, fmt.Errorf("unknown computed field %q", name)
+		}
+		for _, value := range values {
+			q = q.Where(`EXISTS (SELECT 1 FROM record_fields
+				WHERE record_fields.firehose_seq = records.firehose_seq AND record_fields.repo = records.repo
+				AND record_fields.collection = records.collection AND record_fields.r_key = records.r_key
+				AND record_fields.name = ? AND record_fields.value = ?)`, name, value)
+		}
+	}
+	return q, nil
+}
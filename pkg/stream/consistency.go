@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/labstack/echo/v4"
+)
+
+// maxRecentMissing is how many of the most recent unmatched commits /consistency reports
+const maxRecentMissing = 100
+
+type commitKey struct {
+	repo string
+	rev  string
+}
+
+type pendingCommit struct {
+	host   string
+	seenAt time.Time
+}
+
+type MissingCommit struct {
+	Repo      string    `json:"repo"`
+	Rev       string    `json:"rev"`
+	SeenOn    string    `json:"seen_on"`
+	MissingOn string    `json:"missing_on"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
+// consistencyChecker pairs up (repo, rev) commits seen on two upstreams, reporting any
+// seen on one but not the other within the window
+type consistencyChecker struct {
+	hosts  [2]string
+	window time.Duration
+	clock  clock.Clock
+
+	pending map[commitKey]pendingCommit
+	matched int64
+	missing map[string]int64 // Host the commit was missing from -> count
+	recent  []MissingCommit
+	lk      sync.Mutex
+}
+
+func newConsistencyChecker(a, b string, window time.Duration, clk clock.Clock) *consistencyChecker {
+	return &consistencyChecker{
+		hosts:   [2]string{a, b},
+		window:  window,
+		clock:   clk,
+		pending: make(map[commitKey]pendingCommit),
+		missing: map[string]int64{a: 0, b: 0},
+	}
+}
+
+// observe records a commit seen on host, matching it against the other host if it already saw it.
+// It's a no-op on a nil checker so callers needn't check whether comparison is enabled.
+func (cc *consistencyChecker) observe(host, repo, rev string) {
+	if cc == nil {
+		return
+	}
+
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+
+	key := commitKey{repo: repo, rev: rev}
+	if p, ok := cc.pending[key]; ok {
+		if p.host != host {
+			delete(cc.pending, key)
+			cc.matched++
+			consistencyMatched.Inc()
+		}
+		return
+	}
+
+	cc.pending[key] = pendingCommit{host: host, seenAt: cc.clock.Now()}
+}
+
+func (cc *consistencyChecker) other(host string) string {
+	if host == cc.hosts[0] {
+		return cc.hosts[1]
+	}
+	return cc.hosts[0]
+}
+
+// sweep reports commits that went unmatched for longer than the window as missing from the other host
+func (cc *consistencyChecker) sweep() {
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+
+	cutoff := cc.clock.Now().Add(-cc.window)
+	for key, p := range cc.pending {
+		if p.seenAt.After(cutoff) {
+			continue
+		}
+		delete(cc.pending, key)
+
+		missingOn := cc.other(p.host)
+		cc.missing[missingOn]++
+		consistencyMissing.WithLabelValues(missingOn).Inc()
+
+		cc.recent = append(cc.recent, MissingCommit{
+			Repo:      key.repo,
+			Rev:       key.rev,
+			SeenOn:    p.host,
+			MissingOn: missingOn,
+			SeenAt:    p.seenAt,
+		})
+	}
+
+	if len(cc.recent) > maxRecentMissing {
+		cc.recent = cc.recent[len(cc.recent)-maxRecentMissing:]
+	}
+
+	pending := map[string]float64{cc.hosts[0]: 0, cc.hosts[1]: 0}
+	for _, p := range cc.pending {
+		pending[p.host]++
+	}
+	for host, n := range pending {
+		consistencyPending.WithLabelValues(host).Set(n)
+	}
+}
+
+// EnableConsistency compares the primary relay's commits with those of the upstream with the
+// given host, reporting commits seen on one but not the other within window. The upstream must
+// already have been added and this must be called before the stream is started.
+func (s *Stream) EnableConsistency(host string, window time.Duration) error {
+	up := s.upstream(host)
+	if up == nil || up == s.primary {
+		return fmt.Errorf("no upstream with host %q to compare against", host)
+	}
+
+	cc := newConsistencyChecker(s.primary.host, up.host, window, s.Clock)
+	s.primary.consistency = cc
+	up.consistency = cc
+	s.consistency = cc
+	return nil
+}
+
+// RunConsistencyChecker sweeps unmatched commits every tenth of the comparison window
+// until ctx is cancelled, it returns immediately if comparison isn't enabled
+func (s *Stream) RunConsistencyChecker(ctx context.Context) error {
+	if s.consistency == nil {
+		return nil
+	}
+
+	ticker := s.Clock.NewTicker(s.consistency.window / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			s.consistency.sweep()
+		}
+	}
+}
+
+type ConsistencyResponse struct {
+	Enabled       bool             `json:"enabled"`
+	Hosts         []string         `json:"hosts,omitempty"`
+	WindowSeconds float64          `json:"window_seconds,omitempty"`
+	Pending       int              `json:"pending"`
+	Matched       int64            `json:"matched"`
+	Missing       map[string]int64 `json:"missing,omitempty"`
+	RecentMissing []MissingCommit  `json:"recent_missing,omitempty"`
+}
+
+// HandleGetConsistency handles the GET /consistency endpoint, reporting how well the
+// primary relay and the compared upstream agree on the commits they emit
+func (s *Stream) HandleGetConsistency(c echo.Context) error {
+	cc := s.consistency
+	if cc == nil {
+		return c.JSON(http.StatusOK, ConsistencyResponse{})
+	}
+
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+
+	resp := ConsistencyResponse{
+		Enabled:       true,
+		Hosts:         cc.hosts[:],
+		WindowSeconds: cc.window.Seconds(),
+		Pending:       len(cc.pending),
+		Matched:       cc.matched,
+		Missing:       make(map[string]int64, len(cc.missing)),
+		RecentMissing: make([]MissingCommit, len(cc.recent)),
+	}
+
+	for host, n := range cc.missing {
+		resp.Missing[host] = n
+	}
+
+	// Newest first
+	for i, m := range cc.recent {
+		resp.RecentMissing[len(cc.recent)-1-i] = m
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
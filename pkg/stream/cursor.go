@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CursorResponse struct {
+	Seq        int64      `json:"seq"`
+	Time       *time.Time `json:"time,omitempty"`
+	LagSeconds *float64   `json:"lag_seconds,omitempty"`
+	Relay      string     `json:"relay"`
+	Host       string     `json:"host"`
+
+	// Upstreams are the other firehoses consumed for comparison with the primary relay
+	Upstreams []CursorResponse `json:"upstreams,omitempty"`
+}
+
+// cursorStatus reports how far the consumer has read into each upstream's firehose
+func (s *Stream) cursorStatus() CursorResponse {
+	resp := s.primary.cursorStatus(s.Clock.Since)
+	for _, up := range s.upstreams {
+		resp.Upstreams = append(resp.Upstreams, up.cursorStatus(s.Clock.Since))
+	}
+	return resp
+}
+
+func (up *upstream) cursorStatus(since func(time.Time) time.Duration) CursorResponse {
+	resp := CursorResponse{
+		Seq:   up.getSeq(),
+		Relay: up.relay.url(0).String(),
+		Host:  up.host,
+	}
+
+	if t := up.getEventTime(); !t.IsZero() {
+		lag := since(t).Seconds()
+		resp.Time = &t
+		resp.LagSeconds = &lag
+	}
+
+	return resp
+}
+
+// HandleGetCursor handles the GET /cursor endpoint, reporting the consumer's current
+// firehose cursor, the time of the last processed event, and how far behind real time it is
+func (s *Stream) HandleGetCursor(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.cursorStatus())
+}
+
+// RunCursorPublisher POSTs the consumer's cursor status as JSON to publishURL every interval
+// so downstream systems can track how fresh the looking glass's data is
+func (s *Stream) RunCursorPublisher(ctx context.Context, publishURL string, interval time.Duration) error {
+	ticker := s.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	logger := s.logger.With("source", "cursor_publisher", "url", publishURL)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			if err := s.publishCursor(ctx, client, publishURL); err != nil {
+				cursorPublishes.WithLabelValues("failed").Inc()
+				logger.Warn("failed to publish cursor", "err", err)
+				continue
+			}
+			cursorPublishes.WithLabelValues("ok").Inc()
+		}
+	}
+}
+
+func (s *Stream) publishCursor(ctx context.Context, client *http.Client, publishURL string) error {
+	body, err := json.Marshal(s.cursorStatus())
+	if err != nil {
+		return fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, publishURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "atp-looking-glass/0.0.1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
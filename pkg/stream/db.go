@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"fmt"
+
+	"github.com/ericvolp12/atproto.tools/pkg/slowlog"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Supported database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// DBMaxOpenConns caps the Postgres connection pool shared by the stream's reader and writer
+const DBMaxOpenConns = 50
+
+// openDBs opens the writer and reader handles for the given driver.
+// SQLite gets a single-connection writer and a separate reader so reads don't queue behind writes,
+// while Postgres shares one pooled handle between both since it supports concurrent writers.
+func openDBs(driver, dsn string, gormLogger logger.Interface) (writer *gorm.DB, reader *gorm.DB, err error) {
+	switch driver {
+	case DriverSQLite:
+		writer, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{
+			Logger: gormLogger,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open sqlite db: %w", err)
+		}
+
+		sqlDB, err := writer.DB()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get sql db: %w", err)
+		}
+
+		sqlDB.SetMaxOpenConns(1)
+
+		// Set pragmas for performance
+		writer.Exec("PRAGMA journal_mode=WAL;")
+		writer.Exec("PRAGMA synchronous=normal;")
+
+		reader, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{
+			Logger: gormLogger,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open sqlite db: %w", err)
+		}
+
+		reader.Exec("PRAGMA journal_mode=WAL;")
+		reader.Exec("PRAGMA synchronous=normal;")
+
+		return writer, reader, nil
+	case DriverPostgres:
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+			Logger: gormLogger,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open postgres db: %w", err)
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get sql db: %w", err)
+		}
+
+		sqlDB.SetMaxOpenConns(DBMaxOpenConns)
+		sqlDB.SetMaxIdleConns(DBMaxOpenConns / 2)
+
+		return db, db, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported db driver %q", driver)
+	}
+}
+
+// UseSlowQueryLog records the stream's reads slower than the log's threshold
+func (s *Stream) UseSlowQueryLog(l *slowlog.Log) error {
+	return s.reader.Use(l)
+}
+
+// migrateSchema creates or updates every table the stream uses
+func migrateSchema(db *gorm.DB) error {
+	err := db.AutoMigrate(&Event{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate events: %w", err)
+	}
+
+	// Backfilled records share seq 0, so the unique index now includes the repo
+	if db.Migrator().HasIndex(&Record{}, "idx_records_seq_path") {
+		if err := db.Migrator().DropIndex(&Record{}, "idx_records_seq_path"); err != nil {
+			return fmt.Errorf("failed to drop old records index: %w", err)
+		}
+	}
+
+	// Records used to be inserted without a unique index, so restarts and relay redeliveries
+	// left duplicates that would stop it being created. The first copy of each is kept.
+	if db.Migrator().HasTable(&Record{}) && !db.Migrator().HasIndex(&Record{}, "idx_records_seq_repo_path") {
+		err := db.Exec("DELETE FROM records WHERE id NOT IN (SELECT MIN(id) FROM records GROUP BY firehose_seq, repo, collection, r_key)").Error
+		if err != nil {
+			return fmt.Errorf("failed to remove duplicate records: %w", err)
+		}
+	}
+
+	err = db.AutoMigrate(&Record{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate records: %w", err)
+	}
+
+	// Cursors saved before upstreams had their own belong to the primary relay, which is looked
+	// up by an empty host. The column is added with that default rather than left to AutoMigrate,
+	// which would add it as NULL (and SQLite can't add a unique column at all).
+	if db.Migrator().HasTable(&Cursor{}) && !db.Migrator().HasColumn(&Cursor{}, "host") {
+		err := db.Exec("ALTER TABLE ? ADD COLUMN ? text NOT NULL DEFAULT ''", clause.Table{Name: "cursors"}, clause.Column{Name: "host"}).Error
+		if err != nil {
+			return fmt.Errorf("failed to add cursor host: %w", err)
+		}
+	}
+
+	err = db.AutoMigrate(&Cursor{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate cursor: %w", err)
+	}
+
+	// Databases migrated while the column was added as NULL
+	if err := db.Exec("UPDATE cursors SET host = '' WHERE host IS NULL").Error; err != nil {
+		return fmt.Errorf("failed to migrate cursor hosts: %w", err)
+	}
+
+	err = db.AutoMigrate(Identity{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate identity: %w", err)
+	}
+
+	err = db.AutoMigrate(&AccountStatus{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate account status: %w", err)
+	}
+
+	err = db.AutoMigrate(&SyncEvent{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate sync event: %w", err)
+	}
+
+	err = db.AutoMigrate(&RecordLint{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate record lint: %w", err)
+	}
+
+	err = db.AutoMigrate(&RecordField{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate record field: %w", err)
+	}
+
+	err = db.AutoMigrate(&BackfillJob{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate backfill job: %w", err)
+	}
+
+	err = db.AutoMigrate(&QuarantinedRecord{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate quarantined record: %w", err)
+	}
+
+	err = db.AutoMigrate(&Dump{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate dump: %w", err)
+	}
+
+	err = db.AutoMigrate(&DumpSalt{}, &DumpPseudonym{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate dump de-identification: %w", err)
+	}
+
+	err = db.AutoMigrate(&APIKeyUsage{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate api key usage: %w", err)
+	}
+
+	err = db.AutoMigrate(&ActiveSketch{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate active sketches: %w", err)
+	}
+
+	err = db.AutoMigrate(&IngestBlock{}, &IngestBlockAudit{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate ingest blocks: %w", err)
+	}
+
+	err = db.AutoMigrate(&DeadLetter{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate dead letters: %w", err)
+	}
+
+	err = db.AutoMigrate(&Gap{})
+	if err != nil {
+		return fmt.Errorf("failed to migrate gaps: %w", err)
+	}
+
+	return nil
+}
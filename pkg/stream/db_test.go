@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB opens an empty SQLite database for migration tests
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "lg.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	return db
+}
+
+// legacyCursor is Cursor as stored before upstreams had their own
+type legacyCursor struct {
+	gorm.Model
+	LastSeq int64
+}
+
+func (legacyCursor) TableName() string { return "cursors" }
+
+func TestMigrateLegacyCursor(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&legacyCursor{}); err != nil {
+		t.Fatalf("failed to create legacy cursors: %v", err)
+	}
+	if err := db.Create(&legacyCursor{LastSeq: 12345}).Error; err != nil {
+		t.Fatalf("failed to save legacy cursor: %v", err)
+	}
+
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+
+	s := &Stream{writer: db}
+	c, err := s.loadCursor("")
+	if err != nil {
+		t.Fatalf("loadCursor: %v", err)
+	}
+	if c.LastSeq != 12345 {
+		t.Errorf("primary cursor LastSeq = %d after migration, want 12345", c.LastSeq)
+	}
+
+	var count int64
+	db.Model(&Cursor{}).Count(&count)
+	if count != 1 {
+		t.Errorf("got %d cursors, want the migrated one only", count)
+	}
+}
+
+// legacyRecord is Record as stored before records had a unique index
+type legacyRecord struct {
+	gorm.Model
+	FirehoseSeq int64 `gorm:"index"`
+	Repo        string
+	Collection  string
+	RKey        string
+	Action      string
+	Raw         []byte
+}
+
+func (legacyRecord) TableName() string { return "records" }
+
+func TestMigrateDuplicateRecords(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&legacyRecord{}); err != nil {
+		t.Fatalf("failed to create legacy records: %v", err)
+	}
+
+	// A replay after an unclean restart stored the first record twice
+	records := []*legacyRecord{
+		{FirehoseSeq: 1, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "create"},
+		{FirehoseSeq: 2, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "2", Action: "create"},
+		{FirehoseSeq: 1, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "create"},
+	}
+	if err := db.Create(records).Error; err != nil {
+		t.Fatalf("failed to seed records: %v", err)
+	}
+
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+
+	var ids []uint
+	if err := db.Model(&Record{}).Order("id").Pluck("id", &ids).Error; err != nil {
+		t.Fatalf("failed to list records: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != records[0].ID || ids[1] != records[1].ID {
+		t.Errorf("records after migration = %v, want the first copy of each: [%d %d]", ids, records[0].ID, records[1].ID)
+	}
+	if !db.Migrator().HasIndex(&Record{}, "idx_records_seq_repo_path") {
+		t.Error("unique records index wasn't created")
+	}
+}
+
+func TestMigrateRecordsIndexSwap(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&legacyRecord{}); err != nil {
+		t.Fatalf("failed to create legacy records: %v", err)
+	}
+	// The unique index records had before backfills shared seq 0
+	if err := db.Exec("CREATE UNIQUE INDEX idx_records_seq_path ON records (firehose_seq, collection, r_key)").Error; err != nil {
+		t.Fatalf("failed to create old records index: %v", err)
+	}
+	seeded := &legacyRecord{Repo: "did:plc:a", Collection: "app.bsky.actor.profile", RKey: "self", Action: BackfillAction}
+	if err := db.Create(seeded).Error; err != nil {
+		t.Fatalf("failed to seed record: %v", err)
+	}
+
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+
+	if db.Migrator().HasIndex(&Record{}, "idx_records_seq_path") {
+		t.Error("old records index wasn't dropped")
+	}
+
+	// A second repo's backfilled profile now has a row of its own
+	other := &Record{Repo: "did:plc:b", Collection: "app.bsky.actor.profile", RKey: "self", Action: BackfillAction}
+	if err := db.Create(other).Error; err != nil {
+		t.Errorf("failed to store a second repo's backfilled record: %v", err)
+	}
+
+	dup := &Record{Repo: "did:plc:a", Collection: "app.bsky.actor.profile", RKey: "self", Action: BackfillAction}
+	if err := db.Create(dup).Error; err == nil {
+		t.Error("stored a duplicate of the seeded record, want a unique index violation")
+	}
+}
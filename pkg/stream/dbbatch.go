@@ -0,0 +1,185 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dbBatchSink buffers the events and records bound for the database, writing each batch in a
+// single transaction instead of one statement per op
+type dbBatchSink struct {
+	*dbSink
+	size       int
+	logger     *slog.Logger
+	deadLetter func(ctx context.Context, sink string, rec *Record, err error)
+
+	events  []*Event
+	records []*Record
+	lk      sync.Mutex
+
+	// flushLk keeps batches from being written out of order
+	flushLk sync.Mutex
+}
+
+// WriteRecord buffers a record, writing the batch once it's full. Failed rows are dead-lettered
+// when the batch is written, so errors aren't returned for the record that happened to fill it.
+func (b *dbBatchSink) WriteRecord(ctx context.Context, rec *Record) error {
+	b.lk.Lock()
+	b.records = append(b.records, rec)
+	events, records := b.takeIfFull()
+	b.lk.Unlock()
+
+	b.writeFullBatch(ctx, events, records)
+	return nil
+}
+
+func (b *dbBatchSink) WriteEvent(ctx context.Context, evt *Event) error {
+	b.lk.Lock()
+	b.events = append(b.events, evt)
+	events, records := b.takeIfFull()
+	b.lk.Unlock()
+
+	b.writeFullBatch(ctx, events, records)
+	return nil
+}
+
+// takeIfFull empties the buffer if it holds a full batch, and must be called with lk held
+func (b *dbBatchSink) takeIfFull() ([]*Event, []*Record) {
+	if len(b.events)+len(b.records) < b.size {
+		return nil, nil
+	}
+	return b.take()
+}
+
+// take empties the buffer, and must be called with lk held
+func (b *dbBatchSink) take() ([]*Event, []*Record) {
+	events, records := b.events, b.records
+	b.events, b.records = nil, nil
+	return events, records
+}
+
+func (b *dbBatchSink) writeFullBatch(ctx context.Context, events []*Event, records []*Record) {
+	if len(events) == 0 && len(records) == 0 {
+		return
+	}
+	if err := b.writeBatch(ctx, events, records); err != nil {
+		b.logger.Error("failed to write batch", "sink", b.name, "err", err)
+	}
+}
+
+// Flush writes whatever is buffered, however small the batch
+func (b *dbBatchSink) Flush(ctx context.Context) error {
+	b.lk.Lock()
+	events, records := b.take()
+	b.lk.Unlock()
+
+	if len(events) == 0 && len(records) == 0 {
+		return nil
+	}
+	return b.writeBatch(ctx, events, records)
+}
+
+// flushIfBuffered writes the buffered batch if it holds a record at the path, so reads of the
+// path's records see it
+func (b *dbBatchSink) flushIfBuffered(ctx context.Context, repo, collection, rkey string) error {
+	b.lk.Lock()
+	buffered := slices.ContainsFunc(b.records, func(rec *Record) bool {
+		return rec.Repo == repo && rec.Collection == collection && rec.RKey == rkey
+	})
+	b.lk.Unlock()
+
+	if !buffered {
+		return nil
+	}
+	return b.Flush(ctx)
+}
+
+// writeBatch writes a batch in one transaction. If the transaction fails, the batch is retried a
+// row at a time so one bad row doesn't take the rest down with it, and records that still fail
+// are dead-lettered.
+func (b *dbBatchSink) writeBatch(ctx context.Context, events []*Event, records []*Record) error {
+	b.flushLk.Lock()
+	defer b.flushLk.Unlock()
+
+	start := time.Now()
+	err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(events) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(events, 500).Error; err != nil {
+				return err
+			}
+		}
+		var firehose, backfilled []*Record
+		for _, rec := range records {
+			if rec.FirehoseSeq == 0 {
+				backfilled = append(backfilled, rec)
+			} else {
+				firehose = append(firehose, rec)
+			}
+		}
+		if len(firehose) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(firehose, 500).Error; err != nil {
+				return err
+			}
+		}
+		for _, rec := range backfilled {
+			if err := writeBackfilled(tx, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	dbBatchDuration.Observe(time.Since(start).Seconds())
+	dbBatchRows.Observe(float64(len(events) + len(records)))
+	if err == nil {
+		return nil
+	}
+
+	dbBatchFallbacks.Inc()
+	b.logger.Warn("batch write failed, writing rows one at a time", "sink", b.name, "events", len(events), "records", len(records), "err", err)
+
+	var errs []error
+	for _, evt := range events {
+		if err := b.dbSink.WriteEvent(ctx, evt); err != nil {
+			sinkWriteErrors.WithLabelValues(b.name, "event").Inc()
+			errs = append(errs, err)
+		}
+	}
+	for _, rec := range records {
+		if err := b.dbSink.WriteRecord(ctx, rec); err != nil {
+			sinkWriteErrors.WithLabelValues(b.name, "record").Inc()
+			b.deadLetter(ctx, b.name, rec, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunDBBatches flushes the database sink's batch every DBBatchInterval until ctx is cancelled, so
+// writes aren't held back for long when the firehose is quiet. The final batch is written when the
+// stream flushes its sinks at shutdown.
+func (s *Stream) RunDBBatches(ctx context.Context) error {
+	if s.dbBatch == nil {
+		return nil
+	}
+
+	ticker := s.Clock.NewTicker(s.DBBatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			if err := s.dbBatch.Flush(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error("failed to flush db batch", "err", err)
+			}
+		}
+	}
+}
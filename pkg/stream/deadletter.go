@@ -0,0 +1,282 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	slogGorm "github.com/orandin/slog-gorm"
+)
+
+// deadLetterSpill appends dead letters that can't be stored in the database to an NDJSON file
+type deadLetterSpill struct {
+	path string
+	lk   sync.Mutex
+}
+
+// EnableDeadLetterSpill appends dead letters to an NDJSON file at path when they can't be stored
+// in the dead letter table, as when the database itself is failing. ReplayDeadLetters imports the
+// file back into the table.
+func (s *Stream) EnableDeadLetterSpill(path string) {
+	s.deadLetterSpill = &deadLetterSpill{path: path}
+}
+
+func (sp *deadLetterSpill) append(dl *DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	f, err := os.OpenFile(sp.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// deadLetter keeps a record a sink failed to write so it can be replayed later, spilling it to
+// disk if the database won't take it either. Failures are logged, since the write error has
+// already been recorded on the event.
+func (s *Stream) deadLetter(ctx context.Context, sink string, rec *Record, writeErr error) {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		s.logger.Error("failed to encode dead letter", "sink", sink, "repo", rec.Repo, "err", err)
+		deadLetters.WithLabelValues(sink, "lost").Inc()
+		return
+	}
+
+	dl := &DeadLetter{
+		CreatedAt:   s.Clock.Now(),
+		Sink:        sink,
+		FirehoseSeq: rec.FirehoseSeq,
+		Repo:        rec.Repo,
+		Path:        rec.Collection + "/" + rec.RKey,
+		Action:      rec.Action,
+		Error:       writeErr.Error(),
+		Record:      raw,
+	}
+
+	err = s.writer.WithContext(ctx).Create(dl).Error
+	if err == nil {
+		deadLetters.WithLabelValues(sink, "table").Inc()
+		return
+	}
+
+	if s.deadLetterSpill == nil {
+		s.logger.Error("failed to store dead letter", "sink", sink, "repo", rec.Repo, "path", dl.Path, "err", err)
+		deadLetters.WithLabelValues(sink, "lost").Inc()
+		return
+	}
+
+	dl.ID = 0
+	if spillErr := s.deadLetterSpill.append(dl); spillErr != nil {
+		s.logger.Error("failed to spill dead letter", "sink", sink, "repo", rec.Repo, "path", dl.Path, "err", errors.Join(err, spillErr))
+		deadLetters.WithLabelValues(sink, "lost").Inc()
+		return
+	}
+	deadLetters.WithLabelValues(sink, "spill").Inc()
+}
+
+// DeadLetterReplay reports what ReplayDeadLetters did
+type DeadLetterReplay struct {
+	Imported int // Dead letters imported from the spill file
+	Replayed int
+	Failed   int
+}
+
+// ReplayDeadLetters imports any dead letters spilled to spillPath into the dead letter table, then
+// retries writing every pending dead letter of the db sink to the database. Dead letters of other
+// sinks are left for inspection at /deadletter, as those sinks retry their own writes.
+func ReplayDeadLetters(ctx context.Context, logger *slog.Logger, driver, dsn, spillPath string, batchSize int) (DeadLetterReplay, error) {
+	var res DeadLetterReplay
+
+	db, _, err := openDBs(driver, dsn, slogGorm.New())
+	if err != nil {
+		return res, err
+	}
+	if err := db.AutoMigrate(&DeadLetter{}); err != nil {
+		return res, fmt.Errorf("failed to migrate dead letters: %w", err)
+	}
+
+	if spillPath != "" {
+		res.Imported, err = importDeadLetterSpill(ctx, db, spillPath)
+		if err != nil {
+			return res, fmt.Errorf("failed to import spilled dead letters: %w", err)
+		}
+		logger.Info("imported spilled dead letters", "path", spillPath, "dead_letters", res.Imported)
+	}
+
+	sink := &dbSink{db: db, name: "db"}
+	var batch []DeadLetter
+	err = db.WithContext(ctx).
+		Where("sink = ? AND replayed_at IS NULL", sink.Name()).
+		FindInBatches(&batch, batchSize, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				dl := &batch[i]
+
+				var rec Record
+				replayErr := json.Unmarshal(dl.Record, &rec)
+				if replayErr == nil {
+					replayErr = sink.WriteRecord(ctx, &rec)
+				}
+
+				if replayErr != nil {
+					dl.ReplayError = replayErr.Error()
+					res.Failed++
+					deadLettersReplayed.WithLabelValues("failed").Inc()
+				} else {
+					now := time.Now()
+					dl.ReplayedAt = &now
+					dl.ReplayError = ""
+					res.Replayed++
+					deadLettersReplayed.WithLabelValues("ok").Inc()
+				}
+
+				if err := db.WithContext(ctx).Model(dl).Select("replayed_at", "replay_error").Updates(dl).Error; err != nil {
+					return fmt.Errorf("failed to update dead letter %d: %w", dl.ID, err)
+				}
+			}
+			logger.Info("replayed batch", "replayed", res.Replayed, "failed", res.Failed)
+			return nil
+		}).Error
+	return res, err
+}
+
+// importDeadLetterSpill moves the dead letters in a spill file into the table, removing the file
+// once they're all stored
+func importDeadLetterSpill(ctx context.Context, db *gorm.DB, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	imported := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			return imported, fmt.Errorf("failed to parse line %d: %w", imported+1, err)
+		}
+		dl.ID = 0
+		if err := db.WithContext(ctx).Create(&dl).Error; err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+
+	return imported, os.Remove(path)
+}
+
+type JSONDeadLetter struct {
+	ID          uint            `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Sink        string          `json:"sink"`
+	FirehoseSeq int64           `json:"seq"`
+	Repo        string          `json:"repo"`
+	Path        string          `json:"path"`
+	Action      string          `json:"action"`
+	Error       string          `json:"error"`
+	Record      json.RawMessage `json:"record,omitempty"`
+	ReplayedAt  *time.Time      `json:"replayed_at,omitempty"`
+	ReplayError string          `json:"replay_error,omitempty"`
+}
+
+type DeadLetterResponse struct {
+	DeadLetters []JSONDeadLetter `json:"dead_letters"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// HandleGetDeadLetters handles the GET /deadletter endpoint, listing records sinks failed to write
+func (s *Stream) HandleGetDeadLetters(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	// sink - Sink that failed the write (optional)
+	// pending - Only return dead letters that haven't been replayed (optional)
+	// raw - Include the record as it would have been written (optional)
+	// limit - Number of dead letters to return (default=100)
+	resp := DeadLetterResponse{}
+
+	q := s.reader.WithContext(c.Request().Context()).Model(&DeadLetter{})
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("repo = ?", did.String())
+	}
+
+	if sink := c.QueryParam("sink"); sink != "" {
+		q = q.Where("sink = ?", sink)
+	}
+
+	if c.QueryParam("pending") == "true" {
+		q = q.Where("replayed_at IS NULL")
+	}
+
+	includeRaw := c.QueryParam("raw") == "true"
+	if !includeRaw {
+		q = q.Omit("record")
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var rows []DeadLetter
+	if err := q.Order("id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.DeadLetters = make([]JSONDeadLetter, len(rows))
+	for i, row := range rows {
+		resp.DeadLetters[i] = JSONDeadLetter{
+			ID:          row.ID,
+			CreatedAt:   row.CreatedAt,
+			Sink:        row.Sink,
+			FirehoseSeq: row.FirehoseSeq,
+			Repo:        row.Repo,
+			Path:        row.Path,
+			Action:      row.Action,
+			Error:       row.Error,
+			ReplayedAt:  row.ReplayedAt,
+			ReplayError: row.ReplayError,
+		}
+		if includeRaw {
+			resp.DeadLetters[i].Record = row.Record
+		}
+	}
+
+	setRowsReturned(c, len(resp.DeadLetters))
+	return c.JSON(http.StatusOK, resp)
+}
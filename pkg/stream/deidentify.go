@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// pseudonymPrefix marks DIDs replaced in de-identified dumps, so they can't be mistaken for real DIDs
+const pseudonymPrefix = "anon:"
+
+// deidentifyStrippedFields are record fields removed from de-identified dumps because they
+// commonly hold handles, names, or contact details, or are CIDs of strong refs and blobs that
+// link straight back to the public records and repos they came from
+var deidentifyStrippedFields = map[string]bool{
+	"handle":      true,
+	"email":       true,
+	"displayName": true,
+	"description": true,
+	"cid":         true,
+	"$link":       true,
+}
+
+// deidentifyTimeResolution is what ingest times in de-identified dumps are truncated to, so they
+// can't be matched against the firehose
+const deidentifyTimeResolution = time.Hour
+
+// mentionPattern matches @handle mentions in free text
+var mentionPattern = regexp.MustCompile(`@[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)+`)
+
+// deidentifier replaces DIDs with pseudonyms salted per rotation period, and strips handles
+// and identifying fields from the records of a dump
+type deidentifier struct {
+	period string
+	salt   []byte
+	// pseudonyms maps each DID seen to its pseudonym, kept in the local database only
+	pseudonyms map[string]string
+}
+
+// dumpSaltPeriod returns the salt rotation period a dump day falls in
+func dumpSaltPeriod(day time.Time, rotation time.Duration) string {
+	if rotation <= 0 {
+		return day.Format(dumpDayFormat)
+	}
+	return day.Truncate(rotation).Format(dumpDayFormat)
+}
+
+// newDeidentifier returns a deidentifier using the salt of the rotation period a day falls in,
+// generating the salt if it's the period's first dump
+func (s *Stream) newDeidentifier(ctx context.Context, day time.Time) (*deidentifier, error) {
+	period := dumpSaltPeriod(day, s.DumpSaltRotation)
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	ds := DumpSalt{Period: period}
+	if err := s.writer.WithContext(ctx).Where(&ds).Attrs(DumpSalt{Salt: salt}).FirstOrCreate(&ds).Error; err != nil {
+		return nil, fmt.Errorf("failed to load dump salt: %w", err)
+	}
+
+	return &deidentifier{period: period, salt: ds.Salt, pseudonyms: make(map[string]string)}, nil
+}
+
+func (d *deidentifier) pseudonym(did string) string {
+	if p, ok := d.pseudonyms[did]; ok {
+		return p
+	}
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte(did))
+	p := pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:32]
+	d.pseudonyms[did] = p
+	return p
+}
+
+// rkey replaces a record key with a pseudonym, since TIDs are unique enough to find the record
+func (d *deidentifier) rkey(rkey string) string {
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte("rkey:" + rkey))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// value de-identifies a decoded JSON value
+func (d *deidentifier) value(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if deidentifyStrippedFields[k] {
+				delete(v, k)
+				continue
+			}
+			v[k] = d.value(field)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = d.value(item)
+		}
+		return v
+	case string:
+		return d.text(v)
+	default:
+		return v
+	}
+}
+
+// text replaces DIDs, AT-URIs, and the record keys in them with pseudonyms, and mentions with a
+// placeholder
+func (d *deidentifier) text(s string) string {
+	if strings.HasPrefix(s, "did:") && !strings.ContainsAny(s, " \n") {
+		return d.pseudonym(s)
+	}
+	if rest, ok := strings.CutPrefix(s, "at://"); ok {
+		authority, path, hasPath := strings.Cut(rest, "/")
+		if strings.HasPrefix(authority, "did:") {
+			authority = d.pseudonym(authority)
+		} else {
+			authority = pseudonymPrefix + "handle"
+		}
+		if !hasPath {
+			return "at://" + authority
+		}
+		if collection, rkey, ok := strings.Cut(path, "/"); ok {
+			path = collection + "/" + d.rkey(rkey)
+		}
+		return "at://" + authority + "/" + path
+	}
+	return mentionPattern.ReplaceAllString(s, "@redacted")
+}
+
+// record de-identifies a record in place. Its firehose seq is dropped and its ingest time
+// coarsened, since either would find the commit it came from. Records whose payload can't be
+// parsed are written without it rather than risk leaking it.
+func (d *deidentifier) record(rec *Record) {
+	rec.Repo = d.pseudonym(rec.Repo)
+	rec.RKey = d.rkey(rec.RKey)
+	rec.FirehoseSeq = 0
+	rec.CreatedAt = rec.CreatedAt.Truncate(deidentifyTimeResolution)
+
+	if len(rec.Raw) == 0 {
+		return
+	}
+
+	var payload any
+	if err := json.Unmarshal(rec.Raw, &payload); err != nil {
+		rec.Raw = nil
+		return
+	}
+
+	raw, err := json.Marshal(d.value(payload))
+	if err != nil {
+		rec.Raw = nil
+		return
+	}
+	rec.Raw = raw
+}
+
+// saveDeidentifyMapping stores the pseudonyms handed out in the local database, so the
+// publisher can map them back to DIDs. The mapping is never included in a dump.
+func (s *Stream) saveDeidentifyMapping(ctx context.Context, d *deidentifier) error {
+	rows := make([]DumpPseudonym, 0, len(d.pseudonyms))
+	for did, p := range d.pseudonyms {
+		rows = append(rows, DumpPseudonym{Pseudonym: p, DID: did, Period: d.period})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return s.writer.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		CreateInBatches(rows, 1000).Error
+}
@@ -0,0 +1,118 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Statuses of a stored identity
+const (
+	IdentityStatusResolved          = "resolved"
+	IdentityStatusUnsupportedMethod = "unsupported_method"
+)
+
+// ErrUnsupportedDIDMethod is returned when no resolver is registered for a DID's method
+var ErrUnsupportedDIDMethod = errors.New("unsupported DID method")
+
+// DIDResolver resolves the identities of DIDs of a single method
+type DIDResolver interface {
+	// LookupDID resolves a DID, reporting whether the identity was served from a cache
+	LookupDID(ctx context.Context, did syntax.DID) (id *identity.Identity, fromCache bool, err error)
+	// Purge drops any cached identity for a DID so the next lookup resolves it again
+	Purge(ctx context.Context, did syntax.DID)
+}
+
+// didMethods routes identity lookups to the resolver registered for each DID's method
+type didMethods struct {
+	resolvers map[string]DIDResolver
+}
+
+func newDIDMethods() *didMethods {
+	return &didMethods{resolvers: make(map[string]DIDResolver)}
+}
+
+// Methods returns the registered DID methods, sorted
+func (m *didMethods) Methods() []string {
+	methods := make([]string, 0, len(m.resolvers))
+	for method := range m.resolvers {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+func (m *didMethods) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, bool, error) {
+	r, ok := m.resolvers[did.Method()]
+	if !ok {
+		return nil, false, fmt.Errorf("%w: %s", ErrUnsupportedDIDMethod, did.Method())
+	}
+	return r.LookupDID(ctx, did)
+}
+
+func (m *didMethods) Purge(ctx context.Context, did syntax.DID) {
+	if r, ok := m.resolvers[did.Method()]; ok {
+		r.Purge(ctx, did)
+	}
+}
+
+// directoryResolver resolves DIDs through an indigo identity directory, which handles did:plc and did:web
+type directoryResolver struct {
+	dir *identity.CacheDirectory
+}
+
+func (d *directoryResolver) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, bool, error) {
+	return d.dir.LookupDIDWithCacheState(ctx, did)
+}
+
+func (d *directoryResolver) Purge(ctx context.Context, did syntax.DID) {
+	d.dir.Purge(ctx, did.AtIdentifier())
+}
+
+// RegisterDIDMethod sets the resolver used for DIDs of a method, replacing any existing one.
+// Methods must be registered before the stream is started.
+func (s *Stream) RegisterDIDMethod(method string, r DIDResolver) {
+	s.logger.Info("registering DID method", "method", method)
+	s.didMethods.resolvers[method] = r
+}
+
+// resolveIdentity looks up a DID with its method's resolver, dropping any cached identity first
+// if refresh is set, and writes identities that weren't cached to the sinks. DIDs of methods
+// without a resolver are written with the unsupported method status instead.
+// It returns the identity, if one was resolved, and whether it was freshly resolved.
+func (s *Stream) resolveIdentity(ctx context.Context, did syntax.DID, refresh bool) (*identity.Identity, bool) {
+	if refresh {
+		s.didMethods.Purge(ctx, did)
+	}
+
+	id, fromCache, err := s.didMethods.LookupDID(ctx, did)
+	if err != nil {
+		if errors.Is(err, ErrUnsupportedDIDMethod) {
+			unsupportedDIDMethodLookups.Inc()
+			s.writeIdentity(ctx, &Identity{
+				DID:    did.String(),
+				Status: IdentityStatusUnsupportedMethod,
+			})
+			return nil, false
+		}
+		s.logger.Error("failed to lookup DID", "err", err)
+		return nil, false
+	}
+
+	if fromCache {
+		return id, false
+	}
+
+	s.writeIdentity(ctx, &Identity{
+		DID:    id.DID.String(),
+		Handle: id.Handle.String(),
+		PDS:    id.PDSEndpoint(),
+		Status: IdentityStatusResolved,
+	})
+
+	return id, true
+}
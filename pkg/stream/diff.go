@@ -0,0 +1,240 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// PatchOp is a JSON Patch (RFC 6902) operation
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// diffJSON appends the operations turning a into b to ops, recursing into objects and arrays.
+// Arrays are compared by index, so an insertion shows up as replacements and an add at the end.
+func diffJSON(path string, a, b any, ops []PatchOp) []PatchOp {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			childPath := path + "/" + escapePointer(k)
+			aChild, inA := av[k]
+			bChild, inB := bv[k]
+			switch {
+			case !inB:
+				ops = append(ops, PatchOp{Op: "remove", Path: childPath})
+			case !inA:
+				ops = append(ops, patchValue("add", childPath, bChild))
+			default:
+				ops = diffJSON(childPath, aChild, bChild, ops)
+			}
+		}
+		return ops
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+
+		for i := 0; i < min(len(av), len(bv)); i++ {
+			ops = diffJSON(path+"/"+strconv.Itoa(i), av[i], bv[i], ops)
+		}
+		for i := len(av); i < len(bv); i++ {
+			ops = append(ops, patchValue("add", path+"/"+strconv.Itoa(i), bv[i]))
+		}
+		// Remove from the end so earlier indexes stay valid as the patch is applied
+		for i := len(av) - 1; i >= len(bv); i-- {
+			ops = append(ops, PatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, patchValue("replace", path, b))
+	}
+	return ops
+}
+
+func patchValue(op, path string, v any) PatchOp {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		raw = []byte("null")
+	}
+	return PatchOp{Op: op, Path: path, Value: raw}
+}
+
+// escapePointer escapes a key for use in a JSON Pointer
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+type RecordVersion struct {
+	ID         uint       `json:"id"`
+	IngestedAt time.Time  `json:"ingested_at"`
+	Record     JSONRecord `json:"record"`
+	// Deleted is set when this version deletes the record
+	Deleted bool `json:"deleted,omitempty"`
+	// Diff patches the previous version into this one, and is empty if nothing changed. It's
+	// null for the first version and for deletes.
+	Diff []PatchOp `json:"diff"`
+}
+
+type RecordDiffResponse struct {
+	URI      string          `json:"uri"`
+	Versions []RecordVersion `json:"versions"`
+	// Cursor fetches the next page of versions, set when this page is full
+	Cursor string `json:"cursor,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HandleGetRecordDiff handles the GET /records/diff endpoint, returning every stored version of
+// a record, oldest first, with a JSON Patch from each version to the next
+func (s *Stream) HandleGetRecordDiff(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID
+	// collection - Collection NSID
+	// rkey - Record Key
+	// limit - Number of versions to return (default=100)
+	// cursor - Continuation token from a previous response to fetch the next page (optional)
+	resp := RecordDiffResponse{}
+
+	did, err := syntax.ParseDID(c.QueryParam("did"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid DID: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	collection, err := syntax.ParseNSID(c.QueryParam("collection"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid collection: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	rkey, err := syntax.ParseRecordKey(c.QueryParam("rkey"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid record key: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var cursor uint
+	if cursorParam := c.QueryParam("cursor"); cursorParam != "" {
+		if cursor, err = decodeCursor(cursorParam); err != nil {
+			resp.Error = fmt.Sprintf("invalid cursor: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+	}
+
+	resp.URI = fmt.Sprintf("at://%s/%s/%s", did, collection, rkey)
+
+	versions := func() *gorm.DB {
+		return s.reader.WithContext(c.Request().Context()).
+			Where("repo = ? AND collection = ? AND r_key = ?", did.String(), collection.String(), rkey.String())
+	}
+
+	var records []Record
+	if err := versions().Where("id > ?", cursor).Order("id ASC").Limit(limit).Find(&records).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	if len(records) == 0 {
+		if cursor != 0 {
+			resp.Versions = []RecordVersion{}
+			return c.JSON(http.StatusOK, resp)
+		}
+		resp.Error = "record not found"
+		return c.JSON(http.StatusNotFound, resp)
+	}
+
+	// A later page's first version is diffed against the last version of the page before it
+	var prev any
+	first := true
+	if cursor != 0 {
+		var before []Record
+		if err := versions().Where("id <= ?", cursor).Order("id DESC").Limit(1).Find(&before).Error; err != nil {
+			resp.Error = err.Error()
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
+		if len(before) > 0 {
+			first = false
+			if before[0].Action != "delete" && before[0].Raw != nil {
+				if err := json.Unmarshal(before[0].Raw, &prev); err != nil {
+					prev = nil
+				}
+			}
+		}
+	}
+
+	resp.Versions = make([]RecordVersion, len(records))
+	for i, r := range records {
+		version := RecordVersion{
+			ID:         r.ID,
+			IngestedAt: r.CreatedAt,
+			Record:     dbRecordIDToJSONRecord(r, nil),
+		}
+
+		var cur any
+		if r.Raw != nil {
+			if err := json.Unmarshal(r.Raw, &cur); err != nil {
+				cur = nil
+			}
+		}
+
+		switch {
+		case r.Action == "delete":
+			version.Deleted = true
+		case first:
+			// Nothing came before it to diff against
+		case prev == nil:
+			version.Diff = []PatchOp{patchValue("add", "", cur)}
+		default:
+			version.Diff = diffJSON("", prev, cur, []PatchOp{})
+		}
+
+		first = false
+		resp.Versions[i] = version
+		if r.Action == "delete" {
+			prev = nil
+		} else {
+			prev = cur
+		}
+	}
+
+	if len(records) == limit {
+		resp.Cursor = encodeCursor(records[len(records)-1].ID)
+	}
+
+	setRowsReturned(c, len(resp.Versions))
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Directory serves identities as an indigo identity.Directory, so indigo-based services running
+// alongside the stream can share its identity resolution. DIDs are resolved with the stream's
+// DID method resolvers and their caches, which ingest keeps warm. Handles are looked up in the
+// identity store, so handles of repos the stream hasn't seen aren't found.
+type Directory struct {
+	s *Stream
+}
+
+var _ identity.Directory = (*Directory)(nil)
+
+// Directory returns an identity.Directory backed by the stream
+func (s *Stream) Directory() *Directory {
+	return &Directory{s: s}
+}
+
+func (d *Directory) LookupDID(ctx context.Context, did syntax.DID) (*identity.Identity, error) {
+	id, _, err := d.s.didMethods.LookupDID(ctx, did)
+	return id, err
+}
+
+func (d *Directory) LookupHandle(ctx context.Context, h syntax.Handle) (*identity.Identity, error) {
+	h = h.Normalize()
+
+	dids, err := d.storedDIDs(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	// A handle can be stored against several DIDs if it moved, the one it resolves back to wins
+	for _, raw := range dids {
+		did, err := syntax.ParseDID(raw)
+		if err != nil {
+			continue
+		}
+		id, err := d.LookupDID(ctx, did)
+		if err != nil {
+			if errors.Is(err, identity.ErrDIDNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if id.Handle.Normalize() == h {
+			return id, nil
+		}
+	}
+	return nil, identity.ErrHandleNotFound
+}
+
+func (d *Directory) Lookup(ctx context.Context, a syntax.AtIdentifier) (*identity.Identity, error) {
+	if handle, err := a.AsHandle(); err == nil {
+		return d.LookupHandle(ctx, handle)
+	}
+	if did, err := a.AsDID(); err == nil {
+		return d.LookupDID(ctx, did)
+	}
+	return nil, fmt.Errorf("at-identifier neither a handle nor a DID")
+}
+
+// Purge drops the cached identity of a DID, or of every DID a handle is stored against
+func (d *Directory) Purge(ctx context.Context, a syntax.AtIdentifier) error {
+	if did, err := a.AsDID(); err == nil {
+		d.s.didMethods.Purge(ctx, did)
+		return nil
+	}
+
+	handle, err := a.AsHandle()
+	if err != nil {
+		return fmt.Errorf("at-identifier neither a handle nor a DID")
+	}
+	dids, err := d.storedDIDs(ctx, handle.Normalize())
+	if err != nil {
+		return err
+	}
+	for _, raw := range dids {
+		if did, err := syntax.ParseDID(raw); err == nil {
+			d.s.didMethods.Purge(ctx, did)
+		}
+	}
+	return nil
+}
+
+// storedDIDs returns the DIDs a handle is stored against, most recently updated first
+func (d *Directory) storedDIDs(ctx context.Context, h syntax.Handle) ([]string, error) {
+	var dids []string
+	err := d.s.reader.WithContext(ctx).Model(&Identity{}).
+		Where("handle = ? AND status = ?", h.String(), IdentityStatusResolved).
+		Order("updated_at DESC").
+		Limit(10).
+		Pluck("d_id", &dids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up handle: %w", err)
+	}
+	return dids, nil
+}
@@ -0,0 +1,421 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/parq"
+	"github.com/labstack/echo/v4"
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+// Formats a daily dump can be published in
+const (
+	DumpFormatParquet = "parquet"
+	DumpFormatJSONL   = "jsonl"
+)
+
+// dumpDayFormat is how a dump's UTC day is written in its keys and manifest
+const dumpDayFormat = "2006-01-02"
+
+// dumpGracePeriod is how long after a day ends its dump waits, so records still being written land in it
+const dumpGracePeriod = 15 * time.Minute
+
+// dumpLookback is how many days back unpublished dumps are caught up when records are kept forever
+const dumpLookback = 7
+
+// dumpBatchSize is how many records are read from the database at a time while writing a dump
+const dumpBatchSize = 10_000
+
+// DumpRecord is a row of a JSONL dump
+type DumpRecord struct {
+	// Seq is left out of de-identified dumps
+	Seq        int64           `json:"seq,omitempty"`
+	Repo       string          `json:"repo"`
+	Collection string          `json:"collection"`
+	RKey       string          `json:"rkey"`
+	Action     string          `json:"action"`
+	IngestedAt time.Time       `json:"ingested_at"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	// Truncated is set when the stored record was cut down to fit the size limits
+	Truncated string `json:"truncated,omitempty"`
+}
+
+// DumpFile is a file of a published dump
+type DumpFile struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// DumpManifest describes a published dump, and is uploaded alongside its files
+type DumpManifest struct {
+	Day         string    `json:"day"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Collections the dump is filtered to, empty when it has every collection
+	Collections []string   `json:"collections,omitempty"`
+	Records     int64      `json:"records"`
+	Files       []DumpFile `json:"files"`
+	URL         string     `json:"url"`
+	// Deidentified is set when DIDs and record keys were replaced with pseudonyms, handles and CIDs
+	// stripped, seqs dropped, and ingest times truncated to the hour. Pseudonyms are stable within
+	// SaltPeriod, the start of the salt rotation period the day falls in.
+	Deidentified bool   `json:"deidentified,omitempty"`
+	SaltPeriod   string `json:"salt_period,omitempty"`
+}
+
+// dumpWriter writes dump rows in one of the dump formats
+type dumpWriter interface {
+	Write(recs []Record) error
+	Close() error
+}
+
+type parquetDumpWriter struct {
+	w *parquet.GenericWriter[parq.Record]
+}
+
+func (p *parquetDumpWriter) Write(recs []Record) error {
+	rows := make([]parq.Record, len(recs))
+	for i, rec := range recs {
+		rows[i] = parq.Record{
+			CreatedAt:   rec.CreatedAt,
+			FirehoseSeq: rec.FirehoseSeq,
+			Repo:        rec.Repo,
+			Collection:  rec.Collection,
+			RKey:        rec.RKey,
+			Action:      rec.Action,
+			Raw:         string(rec.Raw),
+		}
+		if rec.Truncated != "" {
+			rows[i].Error = truncationError(rec.Truncated, rec.RawSize)
+		}
+	}
+	_, err := p.w.Write(rows)
+	return err
+}
+
+func (p *parquetDumpWriter) Close() error {
+	return p.w.Close()
+}
+
+type jsonlDumpWriter struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func newJSONLDumpWriter(w io.Writer) *jsonlDumpWriter {
+	gz := gzip.NewWriter(w)
+	return &jsonlDumpWriter{gz: gz, enc: json.NewEncoder(gz)}
+}
+
+func (j *jsonlDumpWriter) Write(recs []Record) error {
+	for _, rec := range recs {
+		row := DumpRecord{
+			Seq:        rec.FirehoseSeq,
+			Repo:       rec.Repo,
+			Collection: rec.Collection,
+			RKey:       rec.RKey,
+			Action:     rec.Action,
+			IngestedAt: rec.CreatedAt,
+			Truncated:  rec.Truncated,
+		}
+		if len(rec.Raw) > 0 {
+			row.Record = rec.Raw
+		}
+		if err := j.enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonlDumpWriter) Close() error {
+	return j.gz.Close()
+}
+
+// dumpFileName returns the name of a dump's file in a format
+func dumpFileName(format string) string {
+	if format == DumpFormatJSONL {
+		return "records.jsonl.gz"
+	}
+	return "records.parquet"
+}
+
+// pendingDumpDays returns the UTC days that have ended, are entirely inside the retention
+// window, and haven't been published yet, oldest first
+func (s *Stream) pendingDumpDays(ctx context.Context) ([]time.Time, error) {
+	now := s.Clock.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+
+	start := today.AddDate(0, 0, -dumpLookback)
+	if ttl := s.recordTTL(); ttl > 0 {
+		// Days that started before the retention window have already lost records
+		start = now.Add(-ttl).Truncate(24 * time.Hour)
+		if start.Before(now.Add(-ttl)) {
+			start = start.AddDate(0, 0, 1)
+		}
+	}
+
+	var published []string
+	if err := s.reader.WithContext(ctx).Model(&Dump{}).Where("day >= ?", start.Format(dumpDayFormat)).Pluck("day", &published).Error; err != nil {
+		return nil, fmt.Errorf("failed to list published dumps: %w", err)
+	}
+	done := make(map[string]bool, len(published))
+	for _, day := range published {
+		done[day] = true
+	}
+
+	var days []time.Time
+	for day := start; !day.AddDate(0, 0, 1).Add(dumpGracePeriod).After(now); day = day.AddDate(0, 0, 1) {
+		if !done[day.Format(dumpDayFormat)] {
+			days = append(days, day)
+		}
+	}
+
+	return days, nil
+}
+
+// writeDumpFile writes the day's records to a temporary file in a format, de-identifying them
+// first if deid is set, returning the file rewound to its start, and how many records it holds
+func (s *Stream) writeDumpFile(ctx context.Context, day time.Time, format string, deid *deidentifier) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "dump-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create dump file: %w", err)
+	}
+
+	var w dumpWriter
+	switch format {
+	case DumpFormatParquet:
+		w = &parquetDumpWriter{w: parquet.NewGenericWriter[parq.Record](f, parquet.Compression(&parquet.Zstd), parq.BloomFilters)}
+	case DumpFormatJSONL:
+		w = newJSONLDumpWriter(f)
+	default:
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, fmt.Errorf("unsupported dump format %q", format)
+	}
+
+	fail := func(err error) (*os.File, int64, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	q := s.reader.WithContext(ctx).
+		Where("created_at >= ? AND created_at < ?", day, day.AddDate(0, 0, 1))
+	if len(s.DumpCollections) > 0 {
+		q = q.Where("collection IN ?", s.DumpCollections)
+	}
+
+	var n int64
+	var batch []Record
+	err = q.FindInBatches(&batch, dumpBatchSize, func(tx *gorm.DB, _ int) error {
+		n += int64(len(batch))
+		if deid != nil {
+			for i := range batch {
+				deid.record(&batch[i])
+			}
+		}
+		return w.Write(batch)
+	}).Error
+	if err != nil {
+		return fail(fmt.Errorf("failed to write dump records: %w", err))
+	}
+
+	if err := w.Close(); err != nil {
+		return fail(fmt.Errorf("failed to finish dump file: %w", err))
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(fmt.Errorf("failed to rewind dump file: %w", err))
+	}
+
+	return f, n, nil
+}
+
+// uploadDumpFile checksums a written dump file and uploads it
+func (s *Stream) uploadDumpFile(ctx context.Context, f *os.File, key, format string) (*DumpFile, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum dump file: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind dump file: %w", err)
+	}
+
+	if err := s.DumpStore.Put(ctx, key, f, size); err != nil {
+		return nil, err
+	}
+
+	return &DumpFile{
+		Name:   key,
+		Format: format,
+		URL:    s.DumpStore.URL(key),
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// publishDump writes, uploads, and records the dump of a UTC day. The manifest is uploaded
+// after every file, so a dump with a manifest is always complete.
+func (s *Stream) publishDump(ctx context.Context, day time.Time) (*DumpManifest, error) {
+	dayStr := day.Format(dumpDayFormat)
+	manifest := &DumpManifest{
+		Day:         dayStr,
+		Collections: s.DumpCollections,
+		Files:       []DumpFile{},
+	}
+
+	var deid *deidentifier
+	if s.DumpDeidentify {
+		var err error
+		deid, err = s.newDeidentifier(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Deidentified = true
+		manifest.SaltPeriod = deid.period
+	}
+
+	for _, format := range s.DumpFormats {
+		f, n, err := s.writeDumpFile(ctx, day, format, deid)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := s.uploadDumpFile(ctx, f, dayStr+"/"+dumpFileName(format), format)
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Records = n
+		manifest.Files = append(manifest.Files, *file)
+	}
+
+	if deid != nil {
+		if err := s.saveDeidentifyMapping(ctx, deid); err != nil {
+			return nil, fmt.Errorf("failed to save pseudonym mapping: %w", err)
+		}
+	}
+
+	manifest.GeneratedAt = s.Clock.Now().UTC()
+	manifestKey := dayStr + "/manifest.json"
+	manifest.URL = s.DumpStore.URL(manifestKey)
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dump manifest: %w", err)
+	}
+
+	if err := s.DumpStore.Put(ctx, manifestKey, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		return nil, err
+	}
+
+	if err := s.writer.WithContext(ctx).Save(&Dump{
+		Day:      dayStr,
+		Records:  manifest.Records,
+		Manifest: raw,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to record published dump: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// RunDumps publishes a dump of each UTC day's records every DumpInterval, once the day has
+// ended, catching up on any days in the retention window that weren't published yet
+func (s *Stream) RunDumps(ctx context.Context) error {
+	if s.DumpStore == nil || s.DumpInterval <= 0 {
+		return nil
+	}
+
+	logger := s.logger.With("source", "dumps")
+
+	ticker := s.Clock.NewTicker(s.DumpInterval)
+	defer ticker.Stop()
+
+	for {
+		days, err := s.pendingDumpDays(ctx)
+		if err != nil {
+			logger.Error("failed to find days to dump", "err", err)
+		}
+
+		for _, day := range days {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			start := s.Clock.Now()
+			manifest, err := s.publishDump(ctx, day)
+			if err != nil {
+				dumpsPublished.WithLabelValues("failed").Inc()
+				logger.Error("failed to publish dump", "day", day.Format(dumpDayFormat), "err", err)
+				continue
+			}
+			dumpsPublished.WithLabelValues("ok").Inc()
+			logger.Info("published dump", "day", manifest.Day, "records", manifest.Records, "took", s.Clock.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+type DumpsResponse struct {
+	Dumps []DumpManifest `json:"dumps"`
+	Error string         `json:"error,omitempty"`
+}
+
+// HandleGetDumps handles the GET /dumps endpoint, listing the published daily dumps newest first
+func (s *Stream) HandleGetDumps(c echo.Context) error {
+	// Parse the query parameters
+	// limit - Number of dumps to return (default=100)
+	resp := DumpsResponse{}
+
+	if s.DumpStore == nil {
+		resp.Error = "dataset dumps are not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var dumps []Dump
+	if err := s.reader.Order("day DESC").Limit(limit).Find(&dumps).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Dumps = make([]DumpManifest, 0, len(dumps))
+	for _, d := range dumps {
+		var manifest DumpManifest
+		if err := json.Unmarshal(d.Manifest, &manifest); err != nil {
+			resp.Error = fmt.Sprintf("failed to parse manifest of dump %s: %s", d.Day, err)
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
+		resp.Dumps = append(resp.Dumps, manifest)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+)
+
+// pageETag builds a weak ETag from a query's parameters and the page of records it returned, so
+// it changes whenever the page would: a matching row is written, a row on the page is updated in
+// place (like a create marked as churned), or one is deleted. It only needs the page query, which
+// walks the ID index, rather than aggregates over every matching row.
+func pageETag(params url.Values, records []Record) string {
+	h := fnv.New64a()
+	h.Write([]byte(params.Encode()))
+
+	var newest uint
+	var buf [8]byte
+	for _, r := range records {
+		newest = max(newest, r.ID)
+		binary.BigEndian.PutUint64(buf[:], uint64(r.ID))
+		h.Write(buf[:])
+		binary.BigEndian.PutUint64(buf[:], uint64(r.UpdatedAt.UnixNano()))
+		h.Write(buf[:])
+	}
+
+	return fmt.Sprintf("W/\"%d-%x\"", newest, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header matches the given ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
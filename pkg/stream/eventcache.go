@@ -0,0 +1,63 @@
+package stream
+
+import "sync"
+
+// eventCache is a ring buffer of the most recently written events, indexed by seq,
+// so exact-seq lookups for fresh events don't have to hit the database
+type eventCache struct {
+	events []Event
+	next   int
+	bySeq  map[int64]int // seq -> index into events
+	lk     sync.RWMutex
+}
+
+func newEventCache(size int) *eventCache {
+	return &eventCache{
+		events: make([]Event, size),
+		bySeq:  make(map[int64]int, size),
+	}
+}
+
+// add caches an event, evicting the oldest cached event if the cache is full
+func (ec *eventCache) add(e *Event) {
+	ec.lk.Lock()
+	defer ec.lk.Unlock()
+
+	if len(ec.events) == 0 {
+		return
+	}
+
+	// Replayed events replace their cached copy in place
+	if i, ok := ec.bySeq[e.FirehoseSeq]; ok {
+		ec.events[i] = *e
+		return
+	}
+
+	if old := ec.events[ec.next]; old.EventType != "" && ec.bySeq[old.FirehoseSeq] == ec.next {
+		delete(ec.bySeq, old.FirehoseSeq)
+	}
+
+	ec.events[ec.next] = *e
+	ec.bySeq[e.FirehoseSeq] = ec.next
+	ec.next = (ec.next + 1) % len(ec.events)
+}
+
+// get returns the cached event with the given seq, if any
+func (ec *eventCache) get(seq int64) (Event, bool) {
+	ec.lk.RLock()
+	defer ec.lk.RUnlock()
+
+	i, ok := ec.bySeq[seq]
+	if !ok {
+		eventCacheLookups.WithLabelValues("miss").Inc()
+		return Event{}, false
+	}
+	eventCacheLookups.WithLabelValues("hit").Inc()
+	return ec.events[i], true
+}
+
+// SetEventCacheSize sets how many recent events are kept in memory for exact-seq lookups,
+// 0 disables the cache. It must be called before the stream is started.
+func (s *Stream) SetEventCacheSize(size int) {
+	s.events = newEventCache(size)
+}
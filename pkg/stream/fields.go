@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// recordFields selects which optional fields of a JSONRecord are returned
+type recordFields struct {
+	Handle bool
+	PDS    bool
+	Raw    bool
+
+	// Provenance is opted into with include=provenance rather than selected with fields=
+	Provenance bool
+}
+
+// parseRecordFields parses the fields= query parameter, a comma-separated list of the optional
+// record fields to return (handle, pds, raw), along with include=. All fields are returned if
+// fields= is absent.
+func parseRecordFields(params url.Values) (recordFields, error) {
+	if !params.Has("fields") {
+		fields := recordFields{Handle: true, PDS: true, Raw: true}
+		return fields, fields.parseIncludes(params)
+	}
+
+	fields := recordFields{}
+	for _, field := range strings.Split(params.Get("fields"), ",") {
+		switch strings.TrimSpace(field) {
+		case "":
+		case "handle":
+			fields.Handle = true
+		case "pds":
+			fields.PDS = true
+		case "raw":
+			fields.Raw = true
+		default:
+			return fields, fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	return fields, fields.parseIncludes(params)
+}
+
+// parseIncludes parses the include= query parameter, a comma-separated list of the optional
+// blocks to add to each record (provenance). None are added if the parameter is absent.
+func (f *recordFields) parseIncludes(params url.Values) error {
+	for _, include := range strings.Split(params.Get("include"), ",") {
+		switch strings.TrimSpace(include) {
+		case "":
+		case "provenance":
+			f.Provenance = true
+		default:
+			return fmt.Errorf("unknown include %q", include)
+		}
+	}
+	return nil
+}
+
+// needsIdentities reports whether the selected fields require looking up repo identities
+func (f recordFields) needsIdentities() bool {
+	return f.Handle || f.PDS
+}
+
+// apply clears the fields of a record that weren't selected
+func (f recordFields) apply(rec *JSONRecord) {
+	if !f.Handle {
+		rec.Handle = ""
+	}
+	if !f.PDS {
+		rec.PDS = ""
+	}
+	if !f.Raw {
+		rec.Raw = nil
+		rec.Truncated = ""
+		rec.RawSize = 0
+	}
+}
+
+// capRawBytes drops raw payloads from records once the running total of raw bytes
+// would exceed maxBytes, marking each dropped record as truncated.
+// Records are kept in the order given, so earlier records keep their payloads.
+// It returns the number of raw bytes kept and the number of payloads dropped.
+func capRawBytes(records []Record, jsonRecords []JSONRecord, maxBytes int) (int, int) {
+	total, dropped := 0, 0
+	for i, r := range records {
+		rec := &jsonRecords[i]
+		if rec.Raw == nil {
+			continue
+		}
+
+		size := len(r.Raw)
+		if maxBytes > 0 && total+size > maxBytes {
+			rec.Raw = nil
+			rec.Truncated = TruncatedResponse
+			rec.RawSize = size
+			if r.Truncated != "" {
+				rec.RawSize = r.RawSize
+			}
+			dropped++
+			continue
+		}
+
+		total += size
+	}
+
+	return total, dropped
+}
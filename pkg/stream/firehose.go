@@ -0,0 +1,228 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/gorilla/websocket"
+)
+
+// FirehoseAccount is a #account frame, announcing a change to an account's hosting status.
+// The pinned indigo predates it, so it's decoded with our own generated CBOR code.
+type FirehoseAccount struct {
+	Active bool    `json:"active" cborgen:"active"`
+	Did    string  `json:"did" cborgen:"did"`
+	Seq    int64   `json:"seq" cborgen:"seq"`
+	Status *string `json:"status,omitempty" cborgen:"status,omitempty"`
+	Time   string  `json:"time" cborgen:"time"`
+}
+
+// FirehoseSync is a #sync frame, asserting a repo's current state without a diff
+type FirehoseSync struct {
+	Blocks []byte `json:"blocks,omitempty" cborgen:"blocks,omitempty"`
+	Did    string `json:"did" cborgen:"did"`
+	Rev    string `json:"rev" cborgen:"rev"`
+	Seq    int64  `json:"seq" cborgen:"seq"`
+	Time   string `json:"time" cborgen:"time"`
+}
+
+// firehoseCallbacks are the handlers for an upstream's frames, adding the frame types indigo's
+// callbacks don't cover
+type firehoseCallbacks struct {
+	*events.RepoStreamCallbacks
+	RepoAccount func(evt *FirehoseAccount) error
+	RepoSync    func(evt *FirehoseSync) error
+}
+
+// firehosePingInterval is how often the relay is pinged to keep the connection alive
+const firehosePingInterval = 30 * time.Second
+
+// readFirehose reads an upstream's frames until the connection fails or ctx is cancelled. It
+// stands in for indigo's events.HandleRepoStream, which drops the frame types it doesn't know.
+// Frames indigo can decode are handed to the scheduler. #account and #sync frames are decoded
+// here and handled on the read loop, as the scheduler only carries indigo's event types.
+func (s *Stream) readFirehose(ctx context.Context, up *upstream, con *websocket.Conn, sched events.Scheduler, rsc *firehoseCallbacks) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer sched.Shutdown()
+
+	logger := s.logger.With("host", up.host)
+
+	go func() {
+		t := s.Clock.NewTicker(firehosePingInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C():
+				if err := con.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
+					logger.Warn("failed to ping relay", "err", err)
+				}
+			case <-ctx.Done():
+				con.Close()
+				return
+			}
+		}
+	}()
+
+	con.SetPingHandler(func(message string) error {
+		err := con.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(time.Minute))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil
+		}
+		return err
+	})
+
+	con.SetPongHandler(func(string) error {
+		if err := con.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+			logger.Error("failed to set read deadline", "err", err)
+		}
+		return nil
+	})
+
+	// seen holds the unknown message types already logged for this connection
+	seen := map[string]bool{}
+	lastSeq := int64(-1)
+	for ctx.Err() == nil {
+		mt, rawReader, err := con.NextReader()
+		if err != nil {
+			return err
+		}
+		if mt != websocket.BinaryMessage {
+			return fmt.Errorf("expected binary message from subscription endpoint")
+		}
+
+		r := &countingReader{r: rawReader}
+		var header events.EventHeader
+		if err := header.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading header: %w", err)
+		}
+
+		if err := s.handleFrame(ctx, up, &header, r, sched, rsc, &lastSeq); err != nil {
+			return err
+		}
+
+		// Drain what the decoder left, so skipped frames are counted at their full size
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return fmt.Errorf("reading frame: %w", err)
+		}
+		s.countFrame(up, &header, r.n, seen)
+	}
+	return ctx.Err()
+}
+
+// handleFrame decodes a frame's body and dispatches it. Message types we can't decode are skipped.
+func (s *Stream) handleFrame(ctx context.Context, up *upstream, header *events.EventHeader, r io.Reader, sched events.Scheduler, rsc *firehoseCallbacks, lastSeq *int64) error {
+	if header.Op == events.EvtKindErrorFrame {
+		var frame events.ErrorFrame
+		if err := frame.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading error frame: %w", err)
+		}
+		return sched.AddWork(ctx, "", &events.XRPCStreamEvent{Error: &frame})
+	}
+	if header.Op != events.EvtKindMessage {
+		return fmt.Errorf("unrecognized event stream type: %d", header.Op)
+	}
+
+	var (
+		repo string
+		seq  int64
+		xev  *events.XRPCStreamEvent
+	)
+	switch header.MsgType {
+	case "#commit":
+		var evt atproto.SyncSubscribeRepos_Commit
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading commit event: %w", err)
+		}
+		repo, seq, xev = evt.Repo, evt.Seq, &events.XRPCStreamEvent{RepoCommit: &evt}
+	case "#handle":
+		var evt atproto.SyncSubscribeRepos_Handle
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading handle event: %w", err)
+		}
+		repo, seq, xev = evt.Did, evt.Seq, &events.XRPCStreamEvent{RepoHandle: &evt}
+	case "#identity":
+		var evt atproto.SyncSubscribeRepos_Identity
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading identity event: %w", err)
+		}
+		repo, seq, xev = evt.Did, evt.Seq, &events.XRPCStreamEvent{RepoIdentity: &evt}
+	case "#info":
+		var evt atproto.SyncSubscribeRepos_Info
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading info event: %w", err)
+		}
+		xev = &events.XRPCStreamEvent{RepoInfo: &evt}
+	case "#migrate":
+		var evt atproto.SyncSubscribeRepos_Migrate
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading migrate event: %w", err)
+		}
+		repo, seq, xev = evt.Did, evt.Seq, &events.XRPCStreamEvent{RepoMigrate: &evt}
+	case "#tombstone":
+		var evt atproto.SyncSubscribeRepos_Tombstone
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading tombstone event: %w", err)
+		}
+		repo, seq, xev = evt.Did, evt.Seq, &events.XRPCStreamEvent{RepoTombstone: &evt}
+	case "#labebatch", "#labels":
+		var evt atproto.LabelSubscribeLabels_Labels
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading labels event: %w", err)
+		}
+		seq, xev = evt.Seq, &events.XRPCStreamEvent{LabelLabels: &evt}
+	case "#account":
+		var evt FirehoseAccount
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading account event: %w", err)
+		}
+		s.observeFrameSeq(ctx, up, evt.Seq, lastSeq)
+		if rsc.RepoAccount != nil {
+			if err := rsc.RepoAccount(&evt); err != nil {
+				s.logger.Error("failed to handle account event", "host", up.host, "seq", evt.Seq, "err", err)
+			}
+		}
+		return nil
+	case "#sync":
+		var evt FirehoseSync
+		if err := evt.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("reading sync event: %w", err)
+		}
+		s.observeFrameSeq(ctx, up, evt.Seq, lastSeq)
+		if rsc.RepoSync != nil {
+			if err := rsc.RepoSync(&evt); err != nil {
+				s.logger.Error("failed to handle sync event", "host", up.host, "seq", evt.Seq, "err", err)
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	s.observeFrameSeq(ctx, up, seq, lastSeq)
+	return sched.AddWork(ctx, repo, xev)
+}
+
+// observeFrameSeq checks a frame's seq is in order and, for the primary relay, looks for gaps.
+// Frames without a seq are ignored.
+func (s *Stream) observeFrameSeq(ctx context.Context, up *upstream, seq int64, lastSeq *int64) {
+	if seq == 0 {
+		return
+	}
+	if seq < *lastSeq {
+		s.logger.Error("got events out of order from stream", "host", up.host, "seq", seq, "prev", *lastSeq)
+	}
+	*lastSeq = seq
+
+	if up == s.primary {
+		s.observeSeq(ctx, seq)
+	}
+}
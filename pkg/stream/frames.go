@@ -0,0 +1,124 @@
+package stream
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/labstack/echo/v4"
+)
+
+// frameCounter tracks how many of each firehose frame type we've received
+type frameCounter struct {
+	counts map[string]int64
+	lk     sync.RWMutex
+}
+
+func newFrameCounter() *frameCounter {
+	return &frameCounter{
+		counts: make(map[string]int64),
+	}
+}
+
+func (fc *frameCounter) inc(frameType string) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	fc.counts[frameType]++
+}
+
+func (fc *frameCounter) snapshot() map[string]int64 {
+	fc.lk.RLock()
+	defer fc.lk.RUnlock()
+	counts := make(map[string]int64, len(fc.counts))
+	for k, v := range fc.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+// knownFrameTypes maps the message types in frame headers to the names frames are counted under
+var knownFrameTypes = map[string]string{
+	"#commit":    "commit",
+	"#handle":    "handle",
+	"#identity":  "identity",
+	"#info":      "info",
+	"#migrate":   "migrate",
+	"#tombstone": "tombstone",
+	"#account":   "account",
+	"#sync":      "sync",
+	"#labebatch": "labels",
+	"#labels":    "labels",
+}
+
+// frameType returns the name a frame is counted under from its header, or "unknown" for
+// message types we don't recognize
+func frameType(header *events.EventHeader) string {
+	switch header.Op {
+	case events.EvtKindErrorFrame:
+		return "error"
+	case events.EvtKindMessage:
+		if ft, ok := knownFrameTypes[header.MsgType]; ok {
+			return ft
+		}
+	}
+	return "unknown"
+}
+
+// countFrame counts a frame read from an upstream, with size its length before compression.
+// Unknown message types are logged once per connection, seen tracking the ones already logged.
+func (s *Stream) countFrame(up *upstream, header *events.EventHeader, size int64, seen map[string]bool) {
+	ft := frameType(header)
+	up.frames.inc(ft)
+	framesReceived.WithLabelValues(up.host, ft).Inc()
+
+	if cs := up.compression.Load(); cs != nil {
+		cs.addPayload(size)
+	}
+
+	if ft == "unknown" && !seen[header.MsgType] {
+		seen[header.MsgType] = true
+		s.logger.Warn("received unknown frame type from firehose, the upstream protocol may have changed",
+			"host", up.host, "op", header.Op, "type", header.MsgType)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type FrameStatsResponse struct {
+	Host   string           `json:"host"`
+	Frames map[string]int64 `json:"frames"`
+	Total  int64            `json:"total"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// HandleGetFrameStats handles the GET /stats/frames endpoint
+func (s *Stream) HandleGetFrameStats(c echo.Context) error {
+	// Query params:
+	// host - Upstream host to report on, defaults to the primary relay (optional)
+	up := s.upstream(c.QueryParam("host"))
+	if up == nil {
+		return c.JSON(http.StatusNotFound, FrameStatsResponse{Error: "unknown upstream host"})
+	}
+
+	resp := FrameStatsResponse{
+		Host:   up.host,
+		Frames: up.frames.snapshot(),
+	}
+
+	for _, n := range resp.Frames {
+		resp.Total += n
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// gapTracker follows the primary relay's sequence numbers in the order they're read, before the
+// scheduler hands them to workers out of order
+type gapTracker struct {
+	lastSeq int64
+	// fill is the latest gap whose repos are being checked for missed commits, nil if there's none
+	fill *gapFill
+	lk   sync.Mutex
+}
+
+// gapFill tracks the repos checked after a gap, each only on its first commit after it
+type gapFill struct {
+	gapID   uint
+	endSeq  int64
+	until   time.Time
+	checked map[string]bool
+}
+
+// seed sets where the tracker starts from if it hasn't seen an event yet, so a cursor that's
+// fallen out of the relay's replay window shows up as a gap
+func (gt *gapTracker) seed(seq int64) {
+	gt.lk.Lock()
+	defer gt.lk.Unlock()
+	if gt.lastSeq == 0 {
+		gt.lastSeq = seq
+	}
+}
+
+// observeSeq records a gap if seq skips at least GapMinSize past the last seq seen. Events
+// replayed after a reconnect, with seqs at or below it, are ignored.
+func (s *Stream) observeSeq(ctx context.Context, seq int64) {
+	s.gaps.lk.Lock()
+	last := s.gaps.lastSeq
+	if seq > last {
+		s.gaps.lastSeq = seq
+	}
+	s.gaps.lk.Unlock()
+
+	if last == 0 || seq-last-1 < max(s.GapMinSize, 1) {
+		return
+	}
+	s.recordGap(ctx, last+1, seq-1)
+}
+
+func (s *Stream) recordGap(ctx context.Context, start, end int64) {
+	gap := &Gap{
+		Host:     s.primary.host,
+		StartSeq: start,
+		EndSeq:   end,
+		Missing:  end - start + 1,
+	}
+
+	firehoseGaps.Inc()
+	firehoseGapEvents.Add(float64(gap.Missing))
+	s.logger.Warn("gap in firehose sequence", "start_seq", start, "end_seq", end, "missing", gap.Missing)
+
+	if err := s.writer.WithContext(ctx).Create(gap).Error; err != nil {
+		s.logger.Error("failed to record gap", "start_seq", start, "end_seq", end, "err", err)
+		return
+	}
+
+	if s.GapFill {
+		s.gaps.lk.Lock()
+		s.gaps.fill = &gapFill{
+			gapID:   gap.ID,
+			endSeq:  end,
+			until:   s.Clock.Now().Add(s.GapFillWindow),
+			checked: map[string]bool{},
+		}
+		s.gaps.lk.Unlock()
+	}
+}
+
+// checkGapFill queues a repo committing within GapFillWindow of a gap for backfill if the commit
+// shows it missed one: its previous revision isn't the last one stored for it. Repos that don't
+// commit within the window can't be told apart from those that weren't in the gap.
+func (s *Stream) checkGapFill(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit, pds string) {
+	if evt.Since == nil || pds == "" {
+		return
+	}
+
+	s.gaps.lk.Lock()
+	fill := s.gaps.fill
+	if fill == nil || evt.Seq <= fill.endSeq || s.Clock.Now().After(fill.until) || fill.checked[evt.Repo] {
+		s.gaps.lk.Unlock()
+		return
+	}
+	fill.checked[evt.Repo] = true
+	s.gaps.lk.Unlock()
+
+	var prev []Event
+	err := s.reader.WithContext(ctx).Select("rev").
+		Where("repo = ? AND event_type = ? AND firehose_seq < ?", evt.Repo, "commit", evt.Seq).
+		Order("firehose_seq DESC").
+		Limit(1).
+		Find(&prev).Error
+	if err != nil {
+		s.logger.Error("failed to load previous commit for gap fill", "repo", evt.Repo, "err", err)
+		return
+	}
+
+	// Repos without a stored commit, or whose last one was stored before revisions were, can't be checked
+	if len(prev) == 0 || prev[0].Rev == "" || prev[0].Rev == *evt.Since {
+		return
+	}
+	if s.blocklist.blockedBy(evt.Repo, pds) != "" {
+		return
+	}
+
+	if !s.requeueBackfill(ctx, evt.Repo, pds) {
+		return
+	}
+	gapFillRepos.Inc()
+	s.logger.Info("queued backfill of repo that missed commits in a gap", "repo", evt.Repo, "gap", fill.gapID, "stored_rev", prev[0].Rev, "since", *evt.Since)
+
+	if err := s.writer.WithContext(ctx).Model(&Gap{}).Where("id = ?", fill.gapID).
+		Update("repos_refilled", gorm.Expr("repos_refilled + 1")).Error; err != nil {
+		s.logger.Error("failed to count gap refill", "gap", fill.gapID, "err", err)
+	}
+}
+
+type JSONGap struct {
+	ID            uint      `json:"id"`
+	DetectedAt    time.Time `json:"detected_at"`
+	Host          string    `json:"host"`
+	StartSeq      int64     `json:"start_seq"`
+	EndSeq        int64     `json:"end_seq"`
+	Missing       int64     `json:"missing"`
+	ReposRefilled int       `json:"repos_refilled"`
+}
+
+type GapsResponse struct {
+	Gaps []JSONGap `json:"gaps"`
+	// MissingTotal is the number of events missed across every recorded gap
+	MissingTotal int64  `json:"missing_total"`
+	Error        string `json:"error,omitempty"`
+}
+
+// HandleGetGaps handles the GET /gaps endpoint, listing the runs of firehose events the archive is
+// missing, newest first
+func (s *Stream) HandleGetGaps(c echo.Context) error {
+	// Query params:
+	// since - Only return gaps detected at or after this RFC3339 time (optional)
+	// limit - Number of gaps to return (default=100)
+	resp := GapsResponse{}
+
+	q := s.reader.WithContext(c.Request().Context()).Model(&Gap{})
+
+	if sinceParam := c.QueryParam("since"); sinceParam != "" {
+		since, err := time.Parse(time.RFC3339, sinceParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid since: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("created_at >= ?", since)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	if err := s.reader.WithContext(c.Request().Context()).Model(&Gap{}).
+		Select("COALESCE(SUM(missing), 0)").Scan(&resp.MissingTotal).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	var gaps []Gap
+	if err := q.Order("id DESC").Limit(limit).Find(&gaps).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Gaps = make([]JSONGap, len(gaps))
+	for i, gap := range gaps {
+		resp.Gaps[i] = JSONGap{
+			ID:            gap.ID,
+			DetectedAt:    gap.CreatedAt,
+			Host:          gap.Host,
+			StartSeq:      gap.StartSeq,
+			EndSeq:        gap.EndSeq,
+			Missing:       gap.Missing,
+			ReposRefilled: gap.ReposRefilled,
+		}
+	}
+
+	setRowsReturned(c, len(resp.Gaps))
+	return c.JSON(http.StatusOK, resp)
+}
@@ -3,39 +3,62 @@ package stream
 import (
 	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
 )
 
 type JSONRecord struct {
 	FirehoseSeq int64                  `json:"seq"`
 	Repo        string                 `json:"repo"`
-	Handle      string                 `json:"handle"`
-	PDS         string                 `json:"pds"`
+	Handle      string                 `json:"handle,omitempty"`
+	PDS         string                 `json:"pds,omitempty"`
 	Collection  string                 `json:"collection"`
 	RKey        string                 `json:"rkey"`
+	RKeyType    string                 `json:"rkey_type,omitempty"`
 	Action      string                 `json:"action"`
 	Raw         map[string]interface{} `json:"raw,omitempty"`
+	Truncated   string                 `json:"truncated,omitempty"`
+	RawSize     int                    `json:"raw_size,omitempty"`
+	// ChurnSeconds is how long the record lived, if it was deleted within the churn window
+	ChurnSeconds *int64 `json:"churn_seconds,omitempty"`
+	// Langs are the primary subtags of the languages the record declares
+	Langs []string `json:"langs,omitempty"`
+	// Provenance is only included with include=provenance
+	Provenance *JSONProvenance `json:"provenance,omitempty"`
 }
 
 type RecordsResponse struct {
-	Records []JSONRecord `json:"records"`
-	Error   string       `json:"error,omitempty"`
+	Records    []JSONRecord `json:"records"`
+	RawBytes   int          `json:"raw_bytes"`
+	RawDropped int          `json:"raw_dropped,omitempty"`
+	Cursor     string       `json:"cursor,omitempty"`
+	Error      string       `json:"error,omitempty"`
 }
 
 type RecordsQuery struct {
 	DID        *syntax.DID
 	Collection *syntax.NSID
 	Rkey       *syntax.RecordKey
+	RkeyType   string
+	Churned    *bool
+	Langs      []string
 	Seq        *int64
+	Since      *time.Time
+	Until      *time.Time
+	Cursor     *uint
 	Limit      int
+	MaxBytes   int
+	Fields     recordFields
 }
 
 func dbRecordIDToJSONRecord(r Record, id *Identity) JSONRecord {
@@ -44,7 +67,19 @@ func dbRecordIDToJSONRecord(r Record, id *Identity) JSONRecord {
 		Repo:        r.Repo,
 		Collection:  r.Collection,
 		RKey:        r.RKey,
+		RKeyType:    r.RKeyType,
 		Action:      r.Action,
+		Truncated:   r.Truncated,
+
+		ChurnSeconds: r.ChurnSeconds,
+	}
+
+	if r.Langs != "" {
+		rec.Langs = strings.Split(r.Langs, ",")
+	}
+
+	if r.Truncated != "" {
+		rec.RawSize = r.RawSize
 	}
 
 	if r.Raw != nil {
@@ -69,21 +104,60 @@ func dbRecordIDToJSONRecord(r Record, id *Identity) JSONRecord {
 	return rec
 }
 
+// identitiesForRecords loads the identities of the repos of the given records, keyed by DID
+func (s *Stream) identitiesForRecords(records []Record) (map[string]*Identity, error) {
+	var identities []Identity
+
+	var dids []string
+	for _, r := range records {
+		dids = append(dids, r.Repo)
+	}
+
+	if err := s.reader.Where("d_id IN ?", dids).Find(&identities).Error; err != nil {
+		return nil, err
+	}
+
+	// Convert the identities to a map
+	identityMap := make(map[string]*Identity)
+	for i := range identities {
+		id := identities[i]
+		identityMap[id.DID] = &id
+	}
+
+	return identityMap, nil
+}
+
 // HandleGetRecords handles the GET /records endpoint
 func (s *Stream) HandleGetRecords(c echo.Context) error {
 	// Parse the query parameters
 	// did - Repo DID (optional)
 	// collection - Collection NSID (optional)
 	// rkey - Record Key (optional)
+	// rkey_type - Record key format: tid, literal, or custom (optional)
+	// churned - true for only records deleted within the churn window and their creates, false to exclude them (optional)
+	// langs - Comma-separated or repeated language tags, only return records declaring any of them (optional)
 	// seq - Firehose sequence number (optional)
 	// limit - Number of records to return (default=100)
+	// max_bytes - Maximum total raw payload bytes to return, later records have their raw payloads dropped (optional)
+	// fields - Comma-separated optional fields to return: handle, pds, raw (default=all)
+	// include - Comma-separated optional blocks to add to each record: provenance (optional)
+	// since - Only return records ingested at or after this RFC3339 timestamp or unix time (optional)
+	// until - Only return records ingested before this RFC3339 timestamp or unix time (optional)
+	// cursor - Continuation token from a previous response to fetch the next page (optional)
+	// kv.<name> - Only return records whose computed field <name> has this value, repeatable (optional)
 
 	// Validate the query parameters
 	didParam := c.QueryParam("did")
 	collectionParam := c.QueryParam("collection")
 	rkeyParam := c.QueryParam("rkey")
+	rkeyTypeParam := c.QueryParam("rkey_type")
+	churnedParam := c.QueryParam("churned")
 	seqParam := c.QueryParam("seq")
 	limitParam := c.QueryParam("limit")
+	maxBytesParam := c.QueryParam("max_bytes")
+	sinceParam := c.QueryParam("since")
+	untilParam := c.QueryParam("until")
+	cursorParam := c.QueryParam("cursor")
 
 	resp := RecordsResponse{}
 
@@ -116,6 +190,30 @@ func (s *Stream) HandleGetRecords(c echo.Context) error {
 		query.Rkey = &rkey
 	}
 
+	if rkeyTypeParam != "" {
+		if !slices.Contains(rkeyTypes, rkeyTypeParam) {
+			resp.Error = fmt.Sprintf("invalid rkey_type: %q", rkeyTypeParam)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.RkeyType = rkeyTypeParam
+	}
+
+	if churnedParam != "" {
+		churned, err := strconv.ParseBool(churnedParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid churned: %q", churnedParam)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.Churned = &churned
+	}
+
+	langs, err := parseLangs(c.QueryParams()["langs"])
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid langs: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	query.Langs = langs
+
 	if seqParam != "" {
 		seq, err := strconv.ParseInt(seqParam, 10, 64)
 		if err != nil {
@@ -155,6 +253,49 @@ func (s *Stream) HandleGetRecords(c echo.Context) error {
 		query.Limit = 1000
 	}
 
+	if maxBytesParam != "" {
+		maxBytes, err := strconv.Atoi(maxBytesParam)
+		if err != nil || maxBytes < 0 {
+			resp.Error = fmt.Sprintf("invalid max_bytes: %q", maxBytesParam)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.MaxBytes = maxBytes
+	}
+
+	fields, err := parseRecordFields(c.QueryParams())
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid fields: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	query.Fields = fields
+
+	if sinceParam != "" {
+		since, err := parseTimeParam(sinceParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid since: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.Since = &since
+	}
+
+	if untilParam != "" {
+		until, err := parseTimeParam(untilParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid until: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.Until = &until
+	}
+
+	if cursorParam != "" {
+		cursor, err := decodeCursor(cursorParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid cursor: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		query.Cursor = &cursor
+	}
+
 	// Query the database
 	var records []Record
 	q := s.reader
@@ -167,9 +308,36 @@ func (s *Stream) HandleGetRecords(c echo.Context) error {
 	if query.Rkey != nil {
 		q = q.Where("r_key = ?", query.Rkey.String())
 	}
+	if query.RkeyType != "" {
+		q = q.Where("r_key_type = ?", query.RkeyType)
+	}
+	if query.Churned != nil {
+		if *query.Churned {
+			q = q.Where("churn_seconds IS NOT NULL")
+		} else {
+			q = q.Where("churn_seconds IS NULL")
+		}
+	}
+	q = filterLangs(q, query.Langs)
 	if query.Seq != nil {
 		q = q.Where("firehose_seq = ?", *query.Seq)
 	}
+	if query.Since != nil {
+		q = q.Where("created_at >= ?", *query.Since)
+	}
+	if query.Until != nil {
+		q = q.Where("created_at < ?", *query.Until)
+	}
+	if query.Cursor != nil {
+		q = q.Where("id < ?", *query.Cursor)
+	}
+	q, err = s.filterComputedFields(q, c.QueryParams())
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	q = q.Session(&gorm.Session{})
+
 	q = q.Order("id DESC").Limit(query.Limit).Find(&records)
 
 	if q.Error != nil {
@@ -177,46 +345,63 @@ func (s *Stream) HandleGetRecords(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, resp)
 	}
 
-	// Query the database for identities
-	var identities []Identity
-
-	var dids []string
-	for _, r := range records {
-		dids = append(dids, r.Repo)
+	// Let polling clients skip the rest of the work and the response body if the page is unchanged
+	etag := pageETag(c.QueryParams(), records)
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
 
-	q = s.reader.Where("d_id IN ?", dids).Find(&identities)
-	if q.Error != nil {
-		resp.Error = q.Error.Error()
-		return c.JSON(http.StatusInternalServerError, resp)
-	}
-
-	// Convert the identities to a map
-	identityMap := make(map[string]*Identity)
-	for i := range identities {
-		id := identities[i]
-		identityMap[id.DID] = &id
+	// Query the database for identities
+	identityMap := map[string]*Identity{}
+	if query.Fields.needsIdentities() {
+		identityMap, err = s.identitiesForRecords(records)
+		if err != nil {
+			resp.Error = err.Error()
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
 	}
 
 	// Convert the records to JSON
 	resp.Records = make([]JSONRecord, len(records))
 	for i, r := range records {
 		resp.Records[i] = dbRecordIDToJSONRecord(r, identityMap[r.Repo])
+		query.Fields.apply(&resp.Records[i])
+		if query.Fields.Provenance {
+			resp.Records[i].Provenance = recordProvenance(r)
+		}
+	}
+
+	// Newest records keep their raw payloads when capping the response size
+	resp.RawBytes, resp.RawDropped = capRawBytes(records, resp.Records, query.MaxBytes)
+
+	// Pages are keyed on row ID, so rows written while paging never shift a page
+	if len(records) == query.Limit {
+		resp.Cursor = encodeCursor(records[len(records)-1].ID)
 	}
 
 	// Do a final sort by firehose sequence number
 	slices.SortFunc(resp.Records, recordSeqSortFunc)
 
+	setRowsReturned(c, len(resp.Records))
 	return c.JSON(http.StatusOK, resp)
 }
 
 type JSONEvent struct {
-	FirehoseSeq int64   `json:"seq"`
-	Repo        string  `json:"repo"`
-	EventType   string  `json:"event_type"`
-	Error       string  `json:"error,omitempty"`
-	Time        int64   `json:"time"`
-	Since       *string `json:"since"`
+	FirehoseSeq int64           `json:"seq"`
+	Repo        string          `json:"repo"`
+	EventType   string          `json:"event_type"`
+	Error       string          `json:"error,omitempty"`
+	Time        int64           `json:"time"`
+	Since       *string         `json:"since"`
+	Ops         *JSONOpsSummary `json:"ops,omitempty"`
+}
+
+type JSONOpsSummary struct {
+	Creates     int      `json:"creates"`
+	Updates     int      `json:"updates"`
+	Deletes     int      `json:"deletes"`
+	Collections []string `json:"collections"`
 }
 
 type EventsResponse struct {
@@ -232,7 +417,7 @@ type EventsQuery struct {
 }
 
 func dbEventToJSONEvent(e Event) JSONEvent {
-	return JSONEvent{
+	evt := JSONEvent{
 		FirehoseSeq: e.FirehoseSeq,
 		Repo:        e.Repo,
 		EventType:   e.EventType,
@@ -240,6 +425,20 @@ func dbEventToJSONEvent(e Event) JSONEvent {
 		Time:        e.Time,
 		Since:       e.Since,
 	}
+
+	if e.EventType == "commit" && e.Collections != "" {
+		ops := &JSONOpsSummary{
+			Creates: e.Creates,
+			Updates: e.Updates,
+			Deletes: e.Deletes,
+		}
+		if err := json.Unmarshal([]byte(e.Collections), &ops.Collections); err != nil {
+			ops.Collections = []string{}
+		}
+		evt.Ops = ops
+	}
+
+	return evt
 }
 
 // HandleGetEvents handles the GET /events endpoint
@@ -301,6 +500,18 @@ func (s *Stream) HandleGetEvents(c echo.Context) error {
 		query.Limit = 1000
 	}
 
+	// Exact-seq lookups for recent events are served from memory
+	if query.Seq != nil {
+		if e, ok := s.events.get(*query.Seq); ok {
+			resp.Events = []JSONEvent{}
+			if (query.DID == nil || e.Repo == query.DID.String()) && (query.EventType == nil || e.EventType == *query.EventType) {
+				resp.Events = append(resp.Events, dbEventToJSONEvent(e))
+			}
+			setRowsReturned(c, len(resp.Events))
+			return c.JSON(http.StatusOK, resp)
+		}
+	}
+
 	// Query the database
 	var events []Event
 	q := s.reader
@@ -325,6 +536,70 @@ func (s *Stream) HandleGetEvents(c echo.Context) error {
 	for i, e := range events {
 		resp.Events[i] = dbEventToJSONEvent(e)
 	}
+	setRowsReturned(c, len(resp.Events))
+	return c.JSON(http.StatusOK, resp)
+}
+
+type EventRecordsResponse struct {
+	Event   *JSONEvent   `json:"event,omitempty"`
+	Records []JSONRecord `json:"records"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// HandleGetEventRecords handles the GET /events/:seq/records endpoint,
+// returning an event along with all the records persisted from it
+func (s *Stream) HandleGetEventRecords(c echo.Context) error {
+	// Query params:
+	// include - Comma-separated optional blocks to add to each record: provenance (optional)
+	resp := EventRecordsResponse{}
+
+	seq, err := strconv.ParseInt(c.Param("seq"), 10, 64)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid sequence number: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var includes recordFields
+	if err := includes.parseIncludes(c.QueryParams()); err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	event, ok := s.events.get(seq)
+	if !ok {
+		if err := s.reader.Where("firehose_seq = ?", seq).First(&event).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				resp.Error = "event not found"
+				return c.JSON(http.StatusNotFound, resp)
+			}
+			resp.Error = err.Error()
+			return c.JSON(http.StatusInternalServerError, resp)
+		}
+	}
+
+	var records []Record
+	if err := s.reader.Where("firehose_seq = ?", seq).Order("id ASC").Find(&records).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	identityMap, err := s.identitiesForRecords(records)
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	jsonEvent := dbEventToJSONEvent(event)
+	resp.Event = &jsonEvent
+	resp.Records = make([]JSONRecord, len(records))
+	for i, r := range records {
+		resp.Records[i] = dbRecordIDToJSONRecord(r, identityMap[r.Repo])
+		if includes.Provenance {
+			resp.Records[i].Provenance = recordProvenance(r)
+		}
+	}
+
+	setRowsReturned(c, len(resp.Records))
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -332,6 +607,7 @@ type JSONIdentity struct {
 	DID       string    `json:"did"`
 	Handle    string    `json:"handle"`
 	PDS       string    `json:"pds"`
+	Status    string    `json:"status,omitempty"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
@@ -352,6 +628,7 @@ func dbIdentityToJSONIdentity(i Identity) JSONIdentity {
 		DID:       i.DID,
 		Handle:    i.Handle,
 		PDS:       i.PDS,
+		Status:    i.Status,
 		UpdatedAt: i.UpdatedAt,
 	}
 }
@@ -438,6 +715,7 @@ func (s *Stream) HandleGetIdentities(c echo.Context) error {
 	for i, id := range identities {
 		resp.Identities[i] = dbIdentityToJSONIdentity(id)
 	}
+	setRowsReturned(c, len(resp.Identities))
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+// Identity export formats
+const (
+	IdentityExportCSV     = "csv"
+	IdentityExportParquet = "parquet"
+)
+
+// identityExportBatchSize is how many identities are read from the database at a time while exporting
+const identityExportBatchSize = 10_000
+
+// ExportedIdentity is a row of the identity export
+type ExportedIdentity struct {
+	DID       string    `parquet:"did"`
+	Handle    string    `parquet:"handle"`
+	PDS       string    `parquet:"pds"`
+	UpdatedAt time.Time `parquet:"updated_at,timestamp(microsecond)"`
+}
+
+// identityWriter writes export rows in one of the export formats
+type identityWriter interface {
+	Write(rows []ExportedIdentity) error
+	Close() error
+}
+
+type csvIdentityWriter struct {
+	w *csv.Writer
+}
+
+func newCSVIdentityWriter(w io.Writer) (*csvIdentityWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"did", "handle", "pds", "updated_at"}); err != nil {
+		return nil, err
+	}
+	return &csvIdentityWriter{w: cw}, nil
+}
+
+func (c *csvIdentityWriter) Write(rows []ExportedIdentity) error {
+	for _, row := range rows {
+		if err := c.w.Write([]string{row.DID, row.Handle, row.PDS, row.UpdatedAt.UTC().Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvIdentityWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type parquetIdentityWriter struct {
+	w *parquet.GenericWriter[ExportedIdentity]
+}
+
+func (p *parquetIdentityWriter) Write(rows []ExportedIdentity) error {
+	_, err := p.w.Write(rows)
+	return err
+}
+
+func (p *parquetIdentityWriter) Close() error {
+	return p.w.Close()
+}
+
+// RunIdentityExport writes the full identity table to path every interval, in the given format,
+// so other services can bulk-load current handle mappings. Each export replaces the last one
+// atomically, so readers never see a partial file.
+func (s *Stream) RunIdentityExport(ctx context.Context, path, format string, interval time.Duration) error {
+	logger := s.logger.With("source", "identity_export", "path", path, "format", format)
+
+	ticker := s.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		start := s.Clock.Now()
+		n, err := s.exportIdentities(ctx, path, format)
+		if err != nil {
+			identityExports.WithLabelValues("failed").Inc()
+			logger.Error("failed to export identities", "err", err)
+		} else {
+			identityExports.WithLabelValues("ok").Inc()
+			logger.Info("exported identities", "identities", n, "took", s.Clock.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+func (s *Stream) exportIdentities(ctx context.Context, path, format string) (int, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	var w identityWriter
+	switch format {
+	case IdentityExportCSV:
+		w, err = newCSVIdentityWriter(f)
+		if err != nil {
+			return 0, fmt.Errorf("failed to write csv header: %w", err)
+		}
+	case IdentityExportParquet:
+		w = &parquetIdentityWriter{w: parquet.NewGenericWriter[ExportedIdentity](f)}
+	default:
+		return 0, fmt.Errorf("unsupported identity export format %q", format)
+	}
+
+	n := 0
+	var batch []Identity
+	err = s.reader.WithContext(ctx).FindInBatches(&batch, identityExportBatchSize, func(tx *gorm.DB, _ int) error {
+		rows := make([]ExportedIdentity, len(batch))
+		for i, id := range batch {
+			rows[i] = ExportedIdentity{
+				DID:       id.DID,
+				Handle:    id.Handle,
+				PDS:       id.PDS,
+				UpdatedAt: id.UpdatedAt,
+			}
+		}
+		n += len(rows)
+		return w.Write(rows)
+	}).Error
+	if err != nil {
+		return n, fmt.Errorf("failed to export identities: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return n, fmt.Errorf("failed to finish export file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return n, fmt.Errorf("failed to close export file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return n, fmt.Errorf("failed to move export file into place: %w", err)
+	}
+
+	return n, nil
+}
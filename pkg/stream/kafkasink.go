@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/ericvolp12/atproto.tools/pkg/kafka"
+)
+
+// KafkaSink publishes records, and optionally events and identities, to Kafka topics
+type KafkaSink struct {
+	kafka *kafka.Kafka
+	clock clock.Clock
+}
+
+func NewKafkaSink(k *kafka.Kafka, clk clock.Clock) *KafkaSink {
+	return &KafkaSink{kafka: k, clock: clk}
+}
+
+func (k *KafkaSink) Name() string { return "kafka" }
+
+func (k *KafkaSink) WriteRecord(ctx context.Context, rec *Record) error {
+	msg := &kafka.Record{
+		CreatedAt:   k.clock.Now(),
+		FirehoseSeq: rec.FirehoseSeq,
+		Repo:        rec.Repo,
+		Collection:  rec.Collection,
+		RKey:        rec.RKey,
+		Action:      rec.Action,
+	}
+
+	if rec.Raw != nil {
+		raw := string(rec.Raw)
+		msg.Raw = &raw
+	}
+
+	if rec.Truncated != "" {
+		msg.Error = truncationError(rec.Truncated, rec.RawSize)
+	}
+
+	return k.kafka.PublishRecord(ctx, msg)
+}
+
+func (k *KafkaSink) WriteEvent(ctx context.Context, evt *Event) error {
+	if !k.kafka.PublishesEvents() {
+		return nil
+	}
+
+	msg := &kafka.Event{
+		CreatedAt:   k.clock.Now(),
+		FirehoseSeq: evt.FirehoseSeq,
+		Repo:        evt.Repo,
+		EventType:   evt.EventType,
+		Time:        time.Unix(0, evt.Time),
+		Since:       evt.Since,
+		Creates:     int64(evt.Creates),
+		Updates:     int64(evt.Updates),
+		Deletes:     int64(evt.Deletes),
+		Collections: []string{},
+		Error:       evt.Error,
+	}
+
+	if evt.Collections != "" {
+		if err := json.Unmarshal([]byte(evt.Collections), &msg.Collections); err != nil {
+			return fmt.Errorf("failed to parse event collections: %w", err)
+		}
+	}
+
+	return k.kafka.PublishEvent(ctx, msg)
+}
+
+func (k *KafkaSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	return k.kafka.PublishIdentity(ctx, &kafka.Identity{
+		CreatedAt: k.clock.Now(),
+		DID:       id.DID,
+		Handle:    id.Handle,
+		PDS:       id.PDS,
+		Status:    id.Status,
+	})
+}
+
+func (k *KafkaSink) Flush(ctx context.Context) error {
+	return k.kafka.Flush(ctx)
+}
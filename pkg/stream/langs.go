@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// langTagRegex loosely matches a BCP-47 language tag, enough to reject garbage
+var langTagRegex = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// primaryLang reduces a language tag to its lowercased primary subtag, so en-US and en match
+func primaryLang(tag string) string {
+	primary, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(primary)
+}
+
+// recordLangs extracts the languages a record declares in its langs array, reduced to primary
+// subtags and joined with commas, or an empty string if it declares none
+func recordLangs(rec map[string]any) string {
+	raw, ok := rec["langs"].([]any)
+	if !ok {
+		return ""
+	}
+
+	var langs []string
+	for _, v := range raw {
+		tag, ok := v.(string)
+		if !ok || !langTagRegex.MatchString(tag) {
+			continue
+		}
+		if lang := primaryLang(tag); !slices.Contains(langs, lang) {
+			langs = append(langs, lang)
+		}
+	}
+	return strings.Join(langs, ",")
+}
+
+// parseLangs parses language filters given as repeated or comma-separated params
+func parseLangs(params []string) ([]string, error) {
+	var langs []string
+	for _, param := range params {
+		for _, tag := range strings.Split(param, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			if !langTagRegex.MatchString(tag) {
+				return nil, fmt.Errorf("invalid language tag %q", tag)
+			}
+			if lang := primaryLang(tag); !slices.Contains(langs, lang) {
+				langs = append(langs, lang)
+			}
+		}
+	}
+	return langs, nil
+}
+
+// langsMatch reports whether a record's languages include any of those wanted
+func langsMatch(recLangs string, wanted []string) bool {
+	for _, lang := range strings.Split(recLangs, ",") {
+		if lang != "" && slices.Contains(wanted, lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterLangs limits a records query to records declaring any of langs
+func filterLangs(q *gorm.DB, langs []string) *gorm.DB {
+	if len(langs) == 0 {
+		return q
+	}
+
+	clauses := make([]string, len(langs))
+	args := make([]any, len(langs))
+	for i, lang := range langs {
+		clauses[i] = "(',' || langs || ',') LIKE ?"
+		args[i] = "%," + lang + ",%"
+	}
+	return q.Where(strings.Join(clauses, " OR "), args...)
+}
@@ -0,0 +1,320 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+// Lint rules flagged on ingested records
+const (
+	LintFacetOutOfBounds = "facet_out_of_bounds"
+	LintFacetSplitsRune  = "facet_splits_rune"
+	LintEmbedInvalidCID  = "embed_invalid_cid"
+	LintAltTextTooLong   = "alt_text_too_long"
+)
+
+// maxAltTextLength is the alt text length, in characters, beyond which we flag an image
+const maxAltTextLength = 2000
+
+// lintResult is a single malformation found in a record
+type lintResult struct {
+	Rule   string
+	Detail string
+}
+
+// lintRecord checks a decoded record for common malformations. Only posts are linted.
+func lintRecord(collection string, rec map[string]any) []lintResult {
+	if collection != "app.bsky.feed.post" {
+		return nil
+	}
+
+	var results []lintResult
+
+	text, _ := rec["text"].(string)
+	facets, _ := rec["facets"].([]any)
+	for i, f := range facets {
+		facet, ok := f.(map[string]any)
+		if !ok {
+			continue
+		}
+		index, ok := facet["index"].(map[string]any)
+		if !ok {
+			continue
+		}
+		start, _ := index["byteStart"].(int64)
+		end, _ := index["byteEnd"].(int64)
+
+		if start < 0 || end < start || end > int64(len(text)) {
+			results = append(results, lintResult{
+				Rule:   LintFacetOutOfBounds,
+				Detail: fmt.Sprintf("facet %d spans bytes [%d, %d) of %d byte text", i, start, end, len(text)),
+			})
+			continue
+		}
+
+		if !runeBoundary(text, int(start)) || !runeBoundary(text, int(end)) {
+			results = append(results, lintResult{
+				Rule:   LintFacetSplitsRune,
+				Detail: fmt.Sprintf("facet %d spans bytes [%d, %d) which split a UTF-8 character", i, start, end),
+			})
+		}
+	}
+
+	if embed, ok := rec["embed"].(map[string]any); ok {
+		results = append(results, lintEmbed(embed)...)
+	}
+
+	return results
+}
+
+// runeBoundary reports whether i is at the start of a character (or the end) of s
+func runeBoundary(s string, i int) bool {
+	return i == len(s) || utf8.RuneStart(s[i])
+}
+
+func lintEmbed(embed map[string]any) []lintResult {
+	var results []lintResult
+
+	switch embed["$type"] {
+	case "app.bsky.embed.images":
+		images, _ := embed["images"].([]any)
+		for i, img := range images {
+			image, ok := img.(map[string]any)
+			if !ok {
+				continue
+			}
+			if !validBlobRef(image["image"]) {
+				results = append(results, lintResult{Rule: LintEmbedInvalidCID, Detail: fmt.Sprintf("image %d has an invalid blob ref", i)})
+			}
+			if alt, ok := image["alt"].(string); ok && utf8.RuneCountInString(alt) > maxAltTextLength {
+				results = append(results, lintResult{Rule: LintAltTextTooLong, Detail: fmt.Sprintf("image %d alt text is %d characters", i, utf8.RuneCountInString(alt))})
+			}
+		}
+	case "app.bsky.embed.external":
+		external, _ := embed["external"].(map[string]any)
+		if thumb, ok := external["thumb"]; ok && !validBlobRef(thumb) {
+			results = append(results, lintResult{Rule: LintEmbedInvalidCID, Detail: "external thumb has an invalid blob ref"})
+		}
+	case "app.bsky.embed.record":
+		ref, _ := embed["record"].(map[string]any)
+		if !validStrongRefCID(ref) {
+			results = append(results, lintResult{Rule: LintEmbedInvalidCID, Detail: "embedded record has an invalid cid"})
+		}
+	case "app.bsky.embed.recordWithMedia":
+		if record, ok := embed["record"].(map[string]any); ok {
+			results = append(results, lintEmbed(record)...)
+		}
+		if media, ok := embed["media"].(map[string]any); ok {
+			results = append(results, lintEmbed(media)...)
+		}
+	}
+
+	return results
+}
+
+// validBlobRef reports whether a blob (or legacy blob) references a usable CID
+func validBlobRef(v any) bool {
+	switch blob := v.(type) {
+	case data.Blob:
+		return cid.Cid(blob.Ref).Defined()
+	case *data.Blob:
+		return blob != nil && cid.Cid(blob.Ref).Defined()
+	case map[string]any:
+		// Legacy blobs carry the CID as a string
+		raw, ok := blob["cid"].(string)
+		if !ok {
+			return false
+		}
+		_, err := cid.Decode(raw)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// validStrongRefCID reports whether a strong ref's cid field parses
+func validStrongRefCID(ref map[string]any) bool {
+	raw, ok := ref["cid"].(string)
+	if !ok {
+		return false
+	}
+	_, err := cid.Decode(raw)
+	return err == nil
+}
+
+// recordClient returns the client that wrote a record, for the clients that self-report
+// with a "via" field
+func recordClient(rec map[string]any) string {
+	via, _ := rec["via"].(string)
+	if len(via) > 100 {
+		via = via[:100]
+	}
+	return via
+}
+
+// saveLints stores the lint results for a record
+func (s *Stream) saveLints(ctx context.Context, rec *Record, client string, lints []lintResult) error {
+	if len(lints) == 0 {
+		return nil
+	}
+
+	rows := make([]RecordLint, len(lints))
+	for i, l := range lints {
+		recordsLinted.WithLabelValues(l.Rule).Inc()
+		rows[i] = RecordLint{
+			FirehoseSeq: rec.FirehoseSeq,
+			Repo:        rec.Repo,
+			Collection:  rec.Collection,
+			RKey:        rec.RKey,
+			Client:      client,
+			Rule:        l.Rule,
+			Detail:      l.Detail,
+		}
+	}
+
+	return s.writer.WithContext(ctx).Create(&rows).Error
+}
+
+type LintStats struct {
+	Rule   string `json:"rule"`
+	Group  string `json:"group"`
+	Count  int64  `json:"count"`
+	Sample string `json:"sample"`
+}
+
+type LintStatsResponse struct {
+	GroupBy string      `json:"group_by"`
+	Stats   []LintStats `json:"stats"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// HandleGetLintStats handles the GET /stats/lint endpoint, aggregating lint results
+// per rule and per client or PDS
+func (s *Stream) HandleGetLintStats(c echo.Context) error {
+	// Parse the query parameters
+	// group_by - pds or client (default=pds)
+	// rule - Lint rule (optional)
+	resp := LintStatsResponse{GroupBy: c.QueryParam("group_by")}
+	if resp.GroupBy == "" {
+		resp.GroupBy = "pds"
+	}
+
+	q := s.reader.Table("record_lints")
+
+	switch resp.GroupBy {
+	case "pds":
+		q = q.Select("record_lints.rule, identities.pds AS grp, COUNT(*) AS count, MAX(record_lints.detail) AS sample").
+			Joins("LEFT JOIN identities ON identities.d_id = record_lints.repo")
+	case "client":
+		q = q.Select("record_lints.rule, record_lints.client AS grp, COUNT(*) AS count, MAX(record_lints.detail) AS sample")
+	default:
+		resp.Error = "group_by must be pds or client"
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	if rule := c.QueryParam("rule"); rule != "" {
+		q = q.Where("record_lints.rule = ?", rule)
+	}
+
+	var rows []struct {
+		Rule   string
+		Grp    *string
+		Count  int64
+		Sample string
+	}
+	if err := q.Group("record_lints.rule, grp").Order("count DESC").Limit(1000).Scan(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Stats = make([]LintStats, len(rows))
+	for i, row := range rows {
+		group := ""
+		if row.Grp != nil {
+			group = *row.Grp
+			if resp.GroupBy == "pds" {
+				if u, err := url.Parse(group); err == nil {
+					group = u.Host
+				}
+			}
+		}
+		resp.Stats[i] = LintStats{Rule: row.Rule, Group: group, Count: row.Count, Sample: row.Sample}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type JSONRecordLint struct {
+	FirehoseSeq int64  `json:"seq"`
+	Repo        string `json:"repo"`
+	Collection  string `json:"collection"`
+	RKey        string `json:"rkey"`
+	Client      string `json:"client,omitempty"`
+	Rule        string `json:"rule"`
+	Detail      string `json:"detail"`
+}
+
+type LintsResponse struct {
+	Lints []JSONRecordLint `json:"lints"`
+	Error string           `json:"error,omitempty"`
+}
+
+// HandleGetLints handles the GET /lints endpoint, listing individual lint results
+func (s *Stream) HandleGetLints(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	// rule - Lint rule (optional)
+	// limit - Number of lint results to return (default=100)
+	resp := LintsResponse{}
+
+	q := s.reader.Model(&RecordLint{})
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("repo = ?", did.String())
+	}
+
+	if rule := c.QueryParam("rule"); rule != "" {
+		q = q.Where("rule = ?", rule)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var lints []RecordLint
+	if err := q.Order("id DESC").Limit(limit).Find(&lints).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Lints = make([]JSONRecordLint, len(lints))
+	for i, l := range lints {
+		resp.Lints[i] = JSONRecordLint{
+			FirehoseSeq: l.FirehoseSeq,
+			Repo:        l.Repo,
+			Collection:  l.Collection,
+			RKey:        l.RKey,
+			Client:      l.Client,
+			Rule:        l.Rule,
+			Detail:      l.Detail,
+		}
+	}
+
+	setRowsReturned(c, len(resp.Lints))
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+)
+
+// Liveness modes, controlling what the liveness checker does when the firehose goes quiet
+const (
+	// LivenessRestart reconnects, rotates relays, and finally exits when the firehose goes quiet
+	LivenessRestart = "restart"
+	// LivenessWarn only logs and counts quiet windows, for low-traffic relays that legitimately go quiet
+	LivenessWarn = "warn"
+)
+
+// RunLivenessChecker supervises the relay connection, checking every LivenessWindow that the
+// firehose cursor advanced by at least LivenessMinProgress. In LivenessRestart mode it escalates
+// on each quiet window: first by forcing a reconnect, then by rotating to the fallback relay
+// (if configured), and finally by returning an error once LivenessMaxFailures consecutive
+// windows have passed without enough progress.
+func (s *Stream) RunLivenessChecker(ctx context.Context) error {
+	window := s.LivenessWindow
+	ticker := s.Clock.NewTicker(window)
+	defer ticker.Stop()
+	lastSeq := s.GetSeq()
+	failures := 0
+
+	logger := s.logger.With("source", "liveness_checker", "mode", s.LivenessMode)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			seq := s.GetSeq()
+			progress := seq - lastSeq
+			lastSeq = seq
+
+			if progress >= s.LivenessMinProgress {
+				if failures > 0 {
+					logger.Info("stream recovered", "last_seq", seq, "failures", failures)
+				}
+				logger.Debug("stream made progress, resetting liveness timer", "last_seq", seq, "progress", progress)
+				failures = 0
+				continue
+			}
+
+			failures++
+
+			if s.LivenessMode == LivenessWarn {
+				livenessEscalations.WithLabelValues("warn").Inc()
+				logger.Warn("not enough progress within liveness window", "last_seq", seq, "progress", progress, "window", window, "failures", failures)
+				continue
+			}
+
+			switch {
+			case failures > s.LivenessMaxFailures:
+				livenessEscalations.WithLabelValues("exit").Inc()
+				logger.Error("not enough progress within liveness window, giving up", "last_seq", seq, "progress", progress, "window", window, "failures", failures)
+				return fmt.Errorf("not enough progress in last %d liveness windows of %s", failures, window)
+			case failures > 1 && s.RotateRelay():
+				livenessEscalations.WithLabelValues("rotate_relay").Inc()
+				logger.Warn("not enough progress within liveness window, rotating relay", "last_seq", seq, "progress", progress, "window", window, "failures", failures)
+			default:
+				livenessEscalations.WithLabelValues("reconnect").Inc()
+				logger.Warn("not enough progress within liveness window, reconnecting", "last_seq", seq, "progress", progress, "window", window, "failures", failures)
+				s.Reconnect()
+			}
+		}
+	}
+}
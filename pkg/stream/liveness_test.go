@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+)
+
+// logSignal is a log destination signalling each line containing match
+type logSignal struct {
+	match []byte
+	c     chan struct{}
+}
+
+func (l *logSignal) Write(p []byte) (int, error) {
+	if bytes.Contains(p, l.match) {
+		l.c <- struct{}{}
+	}
+	return len(p), nil
+}
+
+func TestLivenessChecker(t *testing.T) {
+	recovered := &logSignal{match: []byte("stream recovered"), c: make(chan struct{}, 1)}
+	u, _ := url.Parse("wss://relay.example.com/xrpc/com.atproto.sync.subscribeRepos")
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := &Stream{
+		logger:              slog.New(slog.NewTextHandler(recovered, nil)),
+		primary:             newUpstream(u),
+		Clock:               fake,
+		LivenessWindow:      time.Minute,
+		LivenessMinProgress: 10,
+		LivenessMaxFailures: 2,
+		LivenessMode:        LivenessRestart,
+	}
+
+	// Reconnects cancel the relay connection
+	reconnects := make(chan struct{}, 1)
+	s.primary.relay.cancel = func() { reconnects <- struct{}{} }
+
+	done := make(chan error, 1)
+	go func() { done <- s.RunLivenessChecker(context.Background()) }()
+	fake.BlockUntil(1)
+
+	quietWindow := func() {
+		t.Helper()
+		fake.Advance(time.Minute)
+		select {
+		case <-reconnects:
+		case err := <-done:
+			t.Fatalf("liveness checker gave up early: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("quiet window didn't force a reconnect")
+		}
+	}
+
+	quietWindow()
+	quietWindow()
+
+	// Enough progress resets the failures, so it takes two more quiet windows to give up
+	s.primary.setSeq(100)
+	fake.Advance(time.Minute)
+	select {
+	case <-recovered.c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress didn't reset the liveness checker")
+	}
+	quietWindow()
+	quietWindow()
+
+	fake.Advance(time.Minute)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("liveness checker returned nil after too many quiet windows")
+		}
+	case <-reconnects:
+		t.Fatal("liveness checker reconnected instead of giving up")
+	case <-time.After(5 * time.Second):
+		t.Fatal("liveness checker didn't give up")
+	}
+}
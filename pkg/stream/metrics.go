@@ -1,39 +1,335 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/ericvolp12/atproto.tools/pkg/metrics"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var reqSz = promauto.NewHistogramVec(prometheus.HistogramOpts{
+var promFactory = metrics.NewFactory(metrics.LookingGlass, "stream")
+
+var reqSz = promFactory.NewHistogramVec(prometheus.HistogramOpts{
 	Name:    "http_request_size_bytes",
 	Help:    "A histogram of request sizes for requests.",
 	Buckets: prometheus.ExponentialBuckets(100, 10, 8),
 }, []string{"code", "method", "path"})
 
-var reqDur = promauto.NewHistogramVec(prometheus.HistogramOpts{
+var reqDur = promFactory.NewHistogramVec(prometheus.HistogramOpts{
 	Name:    "http_request_duration_seconds",
 	Help:    "A histogram of latencies for requests.",
 	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 20),
 }, []string{"code", "method", "path"})
 
-var reqCnt = promauto.NewCounterVec(prometheus.CounterOpts{
+var reqCnt = promFactory.NewCounterVec(prometheus.CounterOpts{
 	Name: "http_requests_total",
 	Help: "A counter for requests to the wrapped handler.",
 }, []string{"code", "method", "path"})
 
-var resSz = promauto.NewHistogramVec(prometheus.HistogramOpts{
+var resSz = promFactory.NewHistogramVec(prometheus.HistogramOpts{
 	Name:    "http_response_size_bytes",
 	Help:    "A histogram of response sizes for requests.",
 	Buckets: prometheus.ExponentialBuckets(100, 10, 8),
 }, []string{"code", "method", "path"})
 
+var framesReceived = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_frames_received_total",
+	Help: "The number of firehose frames received by upstream host and frame type, including unknown frames.",
+}, []string{"host", "type"})
+
+var upstreamSeq = promFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upstream_seq",
+	Help: "The last firehose sequence number seen from each upstream host.",
+}, []string{"host"})
+
+var upstreamEventTime = promFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upstream_event_time_seconds",
+	Help: "The unix time of the latest firehose event seen from each upstream host, so time() minus it is the consumer's lag.",
+}, []string{"host"})
+
+var recordsTruncated = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "records_truncated_total",
+	Help: "The number of records truncated for exceeding size limits, by truncation kind.",
+}, []string{"kind"})
+
+var recordIngestLatency = promFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "record_ingest_latency_seconds",
+	Help:    "Time between a record's commit time and it being persisted, with trace ID exemplars.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+}, []string{"action"})
+
+// observeIngestLatency records a record's ingest latency, attaching the
+// trace ID as an exemplar when the span in ctx is sampled
+func observeIngestLatency(ctx context.Context, action string, latency time.Duration) {
+	obs := recordIngestLatency.WithLabelValues(action)
+
+	sc := trace.SpanContextFromContext(ctx)
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && sc.IsSampled() {
+		eo.ObserveWithExemplar(latency.Seconds(), prometheus.Labels{"trace_id": sc.TraceID().String()})
+		return
+	}
+
+	obs.Observe(latency.Seconds())
+}
+
+var subscribersConnected = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "subscribers_connected",
+	Help: "The number of clients connected to the /subscribe endpoint.",
+})
+
+var subscriberEventsSent = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscriber_events_sent_total",
+	Help: "The number of events queued for /subscribe clients.",
+})
+
+var subscriberEventsReplayed = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscriber_events_replayed_total",
+	Help: "The number of stored events replayed to /subscribe clients that passed a cursor.",
+})
+
+var subscribersDropped = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscribers_dropped_total",
+	Help: "The number of /subscribe clients disconnected for falling behind.",
+})
+
+var subscriberEventsDropped = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "subscriber_events_dropped_total",
+	Help: "The number of events dropped for /subscribe clients that fell behind, by drop policy.",
+}, []string{"policy"})
+
+var eventCacheLookups = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "event_cache_lookups_total",
+	Help: "The number of exact-seq event lookups served from memory (hit) or the database (miss).",
+}, []string{"result"})
+
+var consistencyMatched = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "consistency_matched_total",
+	Help: "The number of commits seen on both compared upstreams.",
+})
+
+var consistencyMissing = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "consistency_missing_total",
+	Help: "The number of commits seen on one compared upstream but not on this host within the window.",
+}, []string{"host"})
+
+var consistencyPending = promFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "consistency_pending",
+	Help: "The number of commits seen on this host still waiting to be seen on the other compared upstream.",
+}, []string{"host"})
+
+var storageRowsMigrated = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "storage_rows_migrated_total",
+	Help: "The number of rows copied by migrate-storage, by table.",
+}, []string{"table"})
+
+var identityExports = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "identity_exports_total",
+	Help: "The number of identity table exports, by result.",
+}, []string{"result"})
+
+var unsupportedDIDMethodLookups = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "unsupported_did_method_lookups_total",
+	Help: "The number of identity lookups for DIDs of a method with no registered resolver.",
+})
+
+var dumpsPublished = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "dumps_published_total",
+	Help: "The number of daily dataset dumps published, by result.",
+}, []string{"result"})
+
+var apiKeyRejectedRequests = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "api_key_rejected_requests_total",
+	Help: "The number of requests rejected for a missing or invalid API key, or an exhausted daily quota",
+}, []string{"reason"})
+
+var firehoseWireBytes = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_wire_bytes_total",
+	Help: "The number of bytes read from each upstream's firehose connection, after any compression",
+}, []string{"host"})
+
+var firehoseCompressed = promFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "firehose_compression_negotiated",
+	Help: "Whether the current connection to each upstream negotiated permessage-deflate compression",
+}, []string{"host"})
+
+var firehoseCompressionSaved = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "firehose_compression_saved_bytes_total",
+	Help: "The approximate number of firehose bytes compression saved, from the re-encoded size of each frame",
+}, []string{"host"})
+
+var subscribeWireBytes = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscribe_wire_bytes_total",
+	Help: "The number of bytes written to /subscribe clients, after any compression",
+})
+
+var subscribeCompressionSaved = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscribe_compression_saved_bytes_total",
+	Help: "The number of bytes compression saved on /subscribe connections",
+})
+
+var subscribeZstdSaved = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "subscribe_zstd_saved_bytes_total",
+	Help: "The number of bytes zstd compression saved on each compressed /subscribe event, counted once per event",
+})
+
+var recordsChurned = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "records_churned_total",
+	Help: "The number of records deleted within the churn window of being created",
+}, []string{"collection"})
+
+var recordsFiltered = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "records_filtered_total",
+	Help: "The number of records not stored because of the collection and DID filters",
+})
+
+var recordsBlocked = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "records_blocked_total",
+	Help: "The number of records dropped at ingest because their DID or PDS host is blocked",
+}, []string{"kind"})
+
+var deadLetters = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "records_dead_lettered_total",
+	Help: "The number of records sinks failed to write, by sink and where the dead letter went (table, spill, or lost)",
+}, []string{"sink", "destination"})
+
+var deadLettersReplayed = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "dead_letters_replayed_total",
+	Help: "The number of dead letters replayed, by result",
+}, []string{"result"})
+
+var dbBatchRows = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "db_batch_rows",
+	Help:    "The number of events and records written per database batch",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+})
+
+var dbBatchDuration = promFactory.NewHistogram(prometheus.HistogramOpts{
+	Name:    "db_batch_duration_seconds",
+	Help:    "The time taken to write a database batch",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 20),
+})
+
+var dbBatchFallbacks = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "db_batch_fallbacks_total",
+	Help: "The number of database batches that failed and were retried a row at a time",
+})
+
+var changesPublished = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "cdc_changes_published_total",
+	Help: "The number of changes published on the change bus, by kind",
+}, []string{"kind"})
+
+var changeConsumerErrors = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "cdc_consumer_errors_total",
+	Help: "The number of changes a change bus consumer failed to handle, by consumer and kind",
+}, []string{"consumer", "kind"})
+
+var backpressureStalls = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "backpressure_stalls_total",
+	Help: "The number of times reading from an upstream was paused because too many events were in flight",
+}, []string{"host"})
+
+var backpressureWait = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "backpressure_wait_seconds_total",
+	Help: "The time reading from an upstream spent paused for backpressure",
+}, []string{"host"})
+
+var configReloads = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "config_reloads_total",
+	Help: "The number of times the stream's settings were reloaded, by result",
+}, []string{"result"})
+
+var firehoseGaps = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "firehose_gaps_total",
+	Help: "The number of gaps detected in the primary relay's sequence numbers",
+})
+
+var firehoseGapEvents = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "firehose_gap_events_total",
+	Help: "The number of events missed in gaps in the primary relay's sequence numbers",
+})
+
+var gapFillRepos = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "gap_fill_repos_total",
+	Help: "The number of repos queued for backfill because they missed commits in a gap",
+})
+
+var atURILookups = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "at_uri_lookups_total",
+	Help: "The number of AT-URI lookups by where the record came from: local, cache, pds, not_found, blocked, or error",
+}, []string{"result"})
+
+var recordsEvicted = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "records_evicted_total",
+	Help: "The number of records evicted from repos holding more than the per-repo record cap",
+})
+
+var reposOverQuota = promFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "repos_over_quota",
+	Help: "The number of repos found over the per-repo record cap in the last sweep",
+})
+
+var sinkWriteErrors = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "sink_write_errors_total",
+	Help: "The number of failed writes to a sink, by sink and kind of write.",
+}, []string{"sink", "kind"})
+
+var relayConnections = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_connections_total",
+	Help: "The number of relay connection attempts, by upstream host and result.",
+}, []string{"host", "result"})
+
+var relayReconnects = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "relay_reconnects_total",
+	Help: "The number of times the stream reconnected to an upstream after its connection ended or failed",
+}, []string{"host"})
+
+var relayReconnectBackoff = promFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "relay_reconnect_backoff_seconds",
+	Help: "How long the stream last waited before reconnecting to an upstream",
+}, []string{"host"})
+
+var livenessEscalations = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "liveness_escalations_total",
+	Help: "The number of liveness escalation steps taken, by action.",
+}, []string{"action"})
+
+var cursorPublishes = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "cursor_publishes_total",
+	Help: "The number of attempts to publish the consumer's cursor, by result.",
+}, []string{"result"})
+
+var recordsLinted = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "record_lints_total",
+	Help: "The number of malformations found in ingested records, by lint rule.",
+}, []string{"rule"})
+
+var recordsQuarantined = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "records_quarantined_total",
+	Help: "The number of record payloads quarantined after failing to decode, by the stage that failed.",
+}, []string{"stage"})
+
+var quarantineReprocessed = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "quarantine_reprocessed_total",
+	Help: "The number of quarantined payloads reprocessed, by result.",
+}, []string{"result"})
+
+var backfillJobs = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_jobs_total",
+	Help: "The number of repo backfill jobs finished, by resulting state.",
+}, []string{"state"})
+
+var recordsBackfilled = promFactory.NewCounter(prometheus.CounterOpts{
+	Name: "records_backfilled_total",
+	Help: "The number of records ingested from repo backfills.",
+})
+
 // MetricsMiddleware defines handler function for metrics middleware
 func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -0,0 +1,208 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	slogGorm "github.com/orandin/slog-gorm"
+)
+
+// TableCopy reports how many rows of a table were copied by MigrateStorage
+type TableCopy struct {
+	Table       string
+	Source      int64 // Rows in the source table
+	Copied      int64 // Rows read from the source and written (or already present) in the destination
+	Missing     int64 // Copied rows whose primary key wasn't found in the destination afterwards
+	Destination int64 // Rows in the destination table after the copy
+}
+
+// Verified reports whether every source row made it to the destination. Each copied row's
+// primary key is looked up in the destination, rather than comparing row counts, since rows the
+// stream dual-writes during the copy would make up for any that were dropped.
+func (tc TableCopy) Verified() bool {
+	return tc.Missing == 0
+}
+
+// serialTables are the tables with auto-increment IDs whose Postgres sequences must be moved
+// past the copied IDs, or new rows would collide with them
+var serialTables = []string{"records", "cursors", "record_lints", "record_fields", "quarantined_records", "ingest_blocks", "ingest_block_audits", "dead_letters", "gaps"}
+
+// MigrateStorage copies an existing SQLite looking glass database into Postgres in batches,
+// logging progress as it goes. Rows already in the destination are skipped, so it's safe to
+// re-run, including while the stream is dual-writing to Postgres during a cutover.
+func MigrateStorage(ctx context.Context, logger *slog.Logger, sqlitePath, postgresDSN string, batchSize int) ([]TableCopy, error) {
+	gormLogger := slogGorm.New()
+
+	_, src, err := openDBs(DriverSQLite, sqlitePath, gormLogger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source: %w", err)
+	}
+
+	dst, _, err := openDBs(DriverPostgres, postgresDSN, gormLogger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination: %w", err)
+	}
+
+	logger.Info("migrating destination schema")
+	if err := migrateSchema(dst); err != nil {
+		return nil, err
+	}
+
+	// Parents before children, so a partial copy is still internally consistent
+	copies := []struct {
+		table string
+		copy  func(context.Context, *slog.Logger, *gorm.DB, *gorm.DB, string, int) (TableCopy, error)
+	}{
+		{"cursors", copyTable[Cursor]},
+		{"identities", copyTable[Identity]},
+		{"backfill_jobs", copyTable[BackfillJob]},
+		{"events", copyTable[Event]},
+		{"records", copyTable[Record]},
+		{"record_lints", copyTable[RecordLint]},
+		{"record_fields", copyTable[RecordField]},
+		{"account_statuses", copyTable[AccountStatus]},
+		{"sync_events", copyTable[SyncEvent]},
+		{"quarantined_records", copyTable[QuarantinedRecord]},
+		{"dumps", copyTable[Dump]},
+		{"dump_salts", copyTable[DumpSalt]},
+		{"dump_pseudonyms", copyTable[DumpPseudonym]},
+		{"api_key_usages", copyTable[APIKeyUsage]},
+		{"active_sketches", copyTable[ActiveSketch]},
+		{"ingest_blocks", copyTable[IngestBlock]},
+		{"ingest_block_audits", copyTable[IngestBlockAudit]},
+		{"dead_letters", copyTable[DeadLetter]},
+		{"gaps", copyTable[Gap]},
+	}
+
+	var results []TableCopy
+	for _, c := range copies {
+		tc, err := c.copy(ctx, logger, src, dst, c.table, batchSize)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, tc)
+	}
+
+	for _, table := range serialTables {
+		sql := fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)", table, table)
+		if err := dst.WithContext(ctx).Exec(sql).Error; err != nil {
+			return results, fmt.Errorf("failed to reset %s id sequence: %w", table, err)
+		}
+	}
+
+	return results, nil
+}
+
+// copyTable copies every row of T from src to dst in primary key order, batchSize rows at a time.
+// Tables are paged on their whole primary key, since some have composite keys FindInBatches can't
+// page on.
+func copyTable[T any](ctx context.Context, logger *slog.Logger, src, dst *gorm.DB, table string, batchSize int) (TableCopy, error) {
+	tc := TableCopy{Table: table}
+	logger = logger.With("table", table)
+
+	stmt := &gorm.Statement{DB: src}
+	if err := stmt.Parse(new(T)); err != nil {
+		return tc, fmt.Errorf("failed to parse %s schema: %w", table, err)
+	}
+	pk := stmt.Schema.PrimaryFields
+	if len(pk) == 0 {
+		return tc, fmt.Errorf("%s has no primary key to page on", table)
+	}
+	cols := make([]string, len(pk))
+	for i, f := range pk {
+		cols[i] = f.DBName
+	}
+	keyCols := "(" + strings.Join(cols, ", ") + ")"
+	keyArgs := "(" + strings.Repeat("?, ", len(cols)-1) + "?)"
+
+	if err := src.WithContext(ctx).Unscoped().Model(new(T)).Count(&tc.Source).Error; err != nil {
+		return tc, fmt.Errorf("failed to count source %s: %w", table, err)
+	}
+
+	logger.Info("copying table", "rows", tc.Source)
+	start := time.Now()
+
+	var after []any
+	for {
+		q := src.WithContext(ctx).Unscoped().Order(strings.Join(cols, ", ")).Limit(batchSize)
+		if after != nil {
+			q = q.Where(keyCols+" > "+keyArgs, after...)
+		}
+		var batch []T
+		if err := q.Find(&batch).Error; err != nil {
+			return tc, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		keys := make([][]any, len(batch))
+		for i := range batch {
+			rv := reflect.ValueOf(&batch[i]).Elem()
+			keys[i] = make([]any, len(pk))
+			for j, f := range pk {
+				keys[i][j], _ = f.ValueOf(ctx, rv)
+			}
+		}
+		after = keys[len(keys)-1]
+
+		// Keep each insert and lookup well under Postgres' bind parameter limit
+		if err := dst.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(batch, 1000).Error; err != nil {
+			return tc, fmt.Errorf("failed to write %s batch: %w", table, err)
+		}
+		for i := 0; i < len(keys); i += 1000 {
+			chunk := keys[i:min(i+1000, len(keys))]
+			var found int64
+			if err := dst.WithContext(ctx).Unscoped().Model(new(T)).Where(keyCols+" IN ?", chunk).Count(&found).Error; err != nil {
+				return tc, fmt.Errorf("failed to verify %s batch: %w", table, err)
+			}
+			tc.Missing += int64(len(chunk)) - found
+		}
+
+		tc.Copied += int64(len(batch))
+		storageRowsMigrated.WithLabelValues(table).Add(float64(len(batch)))
+
+		elapsed := time.Since(start)
+		logger.Info("copied batch",
+			"copied", tc.Copied,
+			"total", tc.Source,
+			"rows_per_second", float64(tc.Copied)/elapsed.Seconds(),
+		)
+
+		if len(batch) < batchSize {
+			break
+		}
+	}
+
+	if err := dst.WithContext(ctx).Unscoped().Model(new(T)).Count(&tc.Destination).Error; err != nil {
+		return tc, fmt.Errorf("failed to count destination %s: %w", table, err)
+	}
+
+	logger.Info("table copied", "source", tc.Source, "copied", tc.Copied, "missing", tc.Missing, "destination", tc.Destination, "verified", tc.Verified(), "took", time.Since(start))
+
+	return tc, nil
+}
+
+// AddDualWrite adds a sink that also writes events, records, and identities to a second
+// database, so a new backend can be kept current while MigrateStorage copies the old one.
+// It must be added after the primary database sink, as records keep the IDs that sink assigned.
+func (s *Stream) AddDualWrite(driver, dsn string) error {
+	db, _, err := openDBs(driver, dsn, slogGorm.New())
+	if err != nil {
+		return fmt.Errorf("failed to open dual-write db: %w", err)
+	}
+
+	if err := migrateSchema(db); err != nil {
+		return err
+	}
+
+	s.AddSink(&dbSink{db: db, name: "db_dual_write"})
+	return nil
+}
@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestCopyTableCompositeKey(t *testing.T) {
+	src, dst := openTestDB(t), openTestDB(t)
+	for _, db := range []*gorm.DB{src, dst} {
+		if err := migrateSchema(db); err != nil {
+			t.Fatalf("migrateSchema: %v", err)
+		}
+	}
+
+	// More rows than a batch, keyed on (key_name, day) and (hour, kind)
+	var usages []APIKeyUsage
+	var sketches []ActiveSketch
+	hour := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		usages = append(usages, APIKeyUsage{KeyName: fmt.Sprintf("key-%d", i%3), Day: fmt.Sprintf("2026-10-%02d", i+1), Requests: int64(i)})
+		sketches = append(sketches, ActiveSketch{Hour: hour.Add(time.Duration(i/2) * time.Hour), Kind: []string{"committing", "created"}[i%2]})
+	}
+	if err := src.Create(&usages).Error; err != nil {
+		t.Fatalf("failed to store usages: %v", err)
+	}
+	if err := src.Create(&sketches).Error; err != nil {
+		t.Fatalf("failed to store sketches: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, tc := range []func() (TableCopy, error){
+		func() (TableCopy, error) {
+			return copyTable[APIKeyUsage](ctx, slog.Default(), src, dst, "api_key_usages", 5)
+		},
+		func() (TableCopy, error) {
+			return copyTable[ActiveSketch](ctx, slog.Default(), src, dst, "active_sketches", 5)
+		},
+	} {
+		res, err := tc()
+		if err != nil {
+			t.Fatalf("copyTable: %v", err)
+		}
+		if res.Copied != 12 || res.Destination != 12 || !res.Verified() {
+			t.Errorf("%s copy = %d copied, %d in destination, %d missing, want 12 copied and in destination, none missing",
+				res.Table, res.Copied, res.Destination, res.Missing)
+		}
+	}
+}
@@ -12,12 +12,33 @@ type Record struct {
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt
 
-	FirehoseSeq int64  `gorm:"index"`
-	Repo        string `gorm:"index:idx_path;index:idx_records_repo_id,priority:1"`
-	Collection  string `gorm:"index:idx_path"`
-	RKey        string `gorm:"index:idx_path"`
+	FirehoseSeq int64  `gorm:"index;uniqueIndex:idx_records_seq_repo_path,priority:1"` // 0 for backfilled records
+	Repo        string `gorm:"index:idx_path;index:idx_records_repo_id,priority:1;uniqueIndex:idx_records_seq_repo_path,priority:2"`
+	Collection  string `gorm:"index:idx_path;uniqueIndex:idx_records_seq_repo_path,priority:3"`
+	RKey        string `gorm:"index:idx_path;uniqueIndex:idx_records_seq_repo_path,priority:4"`
+	RKeyType    string `gorm:"index"` // tid, literal, or custom
 	Action      string
 	Raw         []byte // Raw JSON data
+	RawSize     int    // Size of the raw JSON before any record-level truncation
+	Truncated   string // Truncation marker, empty if the record was stored in full
+
+	ReplyRoot   string `gorm:"index"` // AT-URI of the thread root, for posts that are replies
+	ReplyParent string `gorm:"index"` // AT-URI of the post replied to
+	Langs       string // Primary subtags of the languages the record declares, comma-separated
+
+	RecordCreatedAt *time.Time // createdAt embedded in the record, if present
+	CreatedAtSkew   *int64     // Seconds between RecordCreatedAt and ingest, negative if createdAt is in the future
+
+	ChurnSeconds *int64 `gorm:"index"` // Seconds a record deleted within the churn window lived, set on its create and delete
+
+	SourceHost   string     // Relay or PDS host the record was received from
+	CommitCID    string     `gorm:"column:commit_cid"` // CID of the commit carrying the record, empty for backfills
+	EventTime    *time.Time // Time of the commit according to the upstream
+	Verification string     // How the record's content was checked, one of the Verification* values
+
+	// Not stored, only passed on to sinks
+	CID string `gorm:"-"` // CID of the record's content, empty for deletes
+	Rev string `gorm:"-"` // Revision of the commit carrying the record, empty for backfills
 }
 
 type Event struct {
@@ -31,10 +52,18 @@ type Event struct {
 	Error       string
 	Time        int64
 	Since       *string
+	Rev         string // Revision of the repo after a commit
+
+	// Summary of the ops in a commit event
+	Creates     int
+	Updates     int
+	Deletes     int
+	Collections string // JSON array of the collections touched by the commit
 }
 
 type Cursor struct {
 	gorm.Model
+	Host    string `gorm:"uniqueIndex"` // Upstream host, empty for the primary relay
 	LastSeq int64
 }
 
@@ -46,4 +75,193 @@ type Identity struct {
 	DID    string `gorm:"primarykey"`
 	Handle string `gorm:"index"`
 	PDS    string `gorm:"index"`
+	// Status is whether the DID resolved, or was of a method with no registered resolver
+	Status string `gorm:"index"`
+}
+
+// AccountStatus is an account status transition from a #account event
+type AccountStatus struct {
+	CreatedAt time.Time `gorm:"index"`
+
+	FirehoseSeq int64  `gorm:"primarykey"`
+	DID         string `gorm:"index"`
+	Active      bool
+	Status      string `gorm:"index"`
+	Time        int64
+}
+
+// SyncEvent is a #sync event, announcing a repo's current state without a diff
+type SyncEvent struct {
+	CreatedAt time.Time `gorm:"index"`
+
+	FirehoseSeq int64  `gorm:"primarykey"`
+	DID         string `gorm:"index"`
+	Rev         string
+	BlocksSize  int
+	Time        int64
+}
+
+// RecordField is a computed field's value extracted from a record, which may have several values
+// for one field
+type RecordField struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	FirehoseSeq int64  `gorm:"index:idx_record_fields_record,priority:1"`
+	Repo        string `gorm:"index:idx_record_fields_record,priority:2"`
+	Collection  string `gorm:"index:idx_record_fields_record,priority:3"`
+	RKey        string `gorm:"index:idx_record_fields_record,priority:4"`
+	Name        string `gorm:"index:idx_record_fields_name_value,priority:1"`
+	Value       string `gorm:"index:idx_record_fields_name_value,priority:2"`
+}
+
+// RecordLint is a malformation found in an ingested record
+type RecordLint struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	FirehoseSeq int64  `gorm:"index"`
+	Repo        string `gorm:"index"`
+	Collection  string
+	RKey        string
+	Client      string `gorm:"index"` // Self-reported client from the record's "via" field, if any
+	Rule        string `gorm:"index"`
+	Detail      string
+}
+
+// BackfillJob tracks the backfill of a repo's full history
+type BackfillJob struct {
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+
+	DID         string `gorm:"primarykey"`
+	PDS         string
+	State       string `gorm:"index"`
+	Records     int
+	Error       string
+	StartedAt   *time.Time
+	CompletedAt *time.Time
+}
+
+// QuarantinedRecord holds the raw bytes of a record, or of a whole commit's blocks, that failed to
+// decode so the payload isn't lost and can be reprocessed once the decoder is fixed
+type QuarantinedRecord struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	FirehoseSeq int64  `gorm:"index"`
+	Repo        string `gorm:"index"`
+	Rev         string
+	Path        string // Empty for commits whose blocks couldn't be read
+	Action      string
+	CID         string
+	Stage       string `gorm:"index"` // car, cbor, json, or uri
+	Error       string
+	Raw         []byte // The record's CBOR, or the commit's CAR blocks for the car stage
+	RawSize     int
+	Ops         []byte // JSON-encoded commit ops for the car stage
+
+	ReprocessedAt  *time.Time
+	ReprocessError string
+}
+
+// Dump is a published daily dataset dump
+type Dump struct {
+	CreatedAt time.Time
+
+	Day      string `gorm:"primarykey"` // UTC day the dump covers, YYYY-MM-DD
+	Records  int64
+	Manifest []byte // JSON-encoded DumpManifest
+}
+
+// APIKeyUsage is the requests, rows, and bytes served to an API key on a UTC day
+type APIKeyUsage struct {
+	UpdatedAt time.Time `json:"updated_at"`
+
+	KeyName      string `gorm:"primarykey" json:"key"`
+	Day          string `gorm:"primarykey;index" json:"day"` // YYYY-MM-DD
+	Requests     int64  `json:"requests"`
+	RowsReturned int64  `json:"rows_returned"`
+	BytesServed  int64  `json:"bytes_served"`
+}
+
+// ActiveSketch is a HyperLogLog sketch of the distinct repos active in an hour, by kind of activity
+type ActiveSketch struct {
+	UpdatedAt time.Time
+
+	Hour      time.Time `gorm:"primarykey"`
+	Kind      string    `gorm:"primarykey"` // committing or created
+	Registers []byte
+}
+
+// DumpSalt is the secret salt de-identified dumps use for a rotation period
+type DumpSalt struct {
+	CreatedAt time.Time
+
+	Period string `gorm:"primarykey"` // Start of the rotation period, YYYY-MM-DD
+	Salt   []byte
+}
+
+// DumpPseudonym maps a pseudonym in a de-identified dump back to its DID, and is never published
+type DumpPseudonym struct {
+	Pseudonym string `gorm:"primarykey"`
+	DID       string `gorm:"index"`
+	Period    string
+}
+
+// IngestBlock is a DID or PDS host whose records are dropped at ingest
+type IngestBlock struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Kind      string `gorm:"uniqueIndex:idx_ingest_blocks_kind_value,priority:1"` // did or pds
+	Value     string `gorm:"uniqueIndex:idx_ingest_blocks_kind_value,priority:2"` // A DID or PDS hostname
+	Reason    string
+	CreatedBy string
+}
+
+// IngestBlockAudit records a change to the ingest blocks and who made it
+type IngestBlockAudit struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Action string // add or remove
+	Kind   string
+	Value  string `gorm:"index"`
+	Reason string
+	Actor  string
+}
+
+// DeadLetter is a record a sink failed to write, kept so the write can be replayed once whatever
+// broke it is fixed
+type DeadLetter struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Sink        string `gorm:"index"`
+	FirehoseSeq int64
+	Repo        string `gorm:"index"`
+	Path        string
+	Action      string
+	Error       string
+	Record      []byte // JSON-encoded Record as it was passed to the sink
+
+	ReplayedAt  *time.Time
+	ReplayError string
+}
+
+// Gap is a run of firehose sequence numbers skipped by the primary relay, whose events were never
+// received, as when reconnecting from a cursor past the relay's replay window
+type Gap struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Host     string
+	StartSeq int64 // First missing seq
+	EndSeq   int64 // Last missing seq
+	Missing  int64
+
+	// ReposRefilled counts the repos queued for backfill because their commits after the gap
+	// showed they'd missed one
+	ReposRefilled int
 }
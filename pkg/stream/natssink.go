@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/ericvolp12/atproto.tools/pkg/nats"
+)
+
+// Placeholders the NATS subject templates can use
+var (
+	NATSRecordPlaceholders   = []string{"collection", "action", "repo"}
+	NATSIdentityPlaceholders = []string{"did"}
+)
+
+// NATSSink publishes records and identities to NATS JetStream as the same JSON events /subscribe
+// sends, on subjects rendered from templates such as atproto.records.{collection}
+type NATSSink struct {
+	nats              *nats.NATS
+	recordsSubject    nats.Subject
+	identitiesSubject *nats.Subject
+	clock             clock.Clock
+}
+
+// NewNATSSink creates a sink publishing records to recordsSubject, and identities to
+// identitiesSubject unless it's nil
+func NewNATSSink(n *nats.NATS, recordsSubject nats.Subject, identitiesSubject *nats.Subject, clk clock.Clock) *NATSSink {
+	return &NATSSink{nats: n, recordsSubject: recordsSubject, identitiesSubject: identitiesSubject, clock: clk}
+}
+
+func (n *NATSSink) Name() string { return "nats" }
+
+func (n *NATSSink) WriteRecord(ctx context.Context, rec *Record) error {
+	evt := &JetstreamEvent{
+		DID:    rec.Repo,
+		TimeUS: n.clock.Now().UnixMicro(),
+		Seq:    rec.FirehoseSeq,
+		Kind:   "commit",
+		Commit: &JetstreamCommit{
+			Operation:  rec.Action,
+			Collection: rec.Collection,
+			RKey:       rec.RKey,
+			Record:     json.RawMessage(rec.Raw),
+		},
+	}
+
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	subject := n.recordsSubject.Render(map[string]string{
+		"collection": rec.Collection,
+		"action":     rec.Action,
+		"repo":       rec.Repo,
+	})
+
+	// Backfilled records share seq 0, so they aren't deduplicated
+	msgID := ""
+	if rec.FirehoseSeq > 0 {
+		msgID = fmt.Sprintf("%d/%s/%s/%s", rec.FirehoseSeq, rec.Repo, rec.Collection, rec.RKey)
+	}
+
+	return n.nats.Publish(ctx, subject, msgID, data)
+}
+
+// Events are only published as the records and identities they carry
+func (n *NATSSink) WriteEvent(ctx context.Context, evt *Event) error {
+	return nil
+}
+
+func (n *NATSSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	if n.identitiesSubject == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(&JetstreamEvent{
+		DID:    id.DID,
+		TimeUS: n.clock.Now().UnixMicro(),
+		Kind:   "identity",
+		Identity: &JetstreamIdentity{
+			DID:    id.DID,
+			Handle: id.Handle,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %w", err)
+	}
+
+	return n.nats.Publish(ctx, n.identitiesSubject.Render(map[string]string{"did": id.DID}), "", data)
+}
+
+func (n *NATSSink) Flush(ctx context.Context) error {
+	return n.nats.Flush(ctx)
+}
@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// encodeCursor builds an opaque continuation token from the last row ID of a page
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+// decodeCursor parses a continuation token produced by encodeCursor
+func decodeCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("malformed cursor")
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed cursor")
+	}
+	return uint(id), nil
+}
+
+// parseTimeParam parses an RFC3339 timestamp or unix seconds from a query parameter
+func parseTimeParam(param string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, param); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC3339 timestamp or unix seconds")
+	}
+	return time.Unix(secs, 0), nil
+}
@@ -0,0 +1,59 @@
+package stream
+
+import (
+	"context"
+
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/ericvolp12/atproto.tools/pkg/parq"
+)
+
+// ParqSink writes records to local Parquet files
+type ParqSink struct {
+	parq  *parq.Parq
+	clock clock.Clock
+}
+
+func NewParqSink(p *parq.Parq, clk clock.Clock) *ParqSink {
+	return &ParqSink{parq: p, clock: clk}
+}
+
+func (p *ParqSink) Name() string { return "parquet" }
+
+func (p *ParqSink) WriteRecord(ctx context.Context, rec *Record) error {
+	parqRecord := &parq.RecordV2{
+		CreatedAt:   p.clock.Now(),
+		EventTime:   rec.EventTime,
+		FirehoseSeq: rec.FirehoseSeq,
+		Repo:        rec.Repo,
+		Collection:  rec.Collection,
+		RKey:        rec.RKey,
+		Action:      rec.Action,
+		CID:         rec.CID,
+		Rev:         rec.Rev,
+		Raw:         string(rec.Raw),
+	}
+
+	// Only v2 files have the parsed fields, so v1 writers skip parsing
+	if p.parq.Schema == parq.SchemaV2 {
+		parqRecord.Fields = parq.ParseFields(rec.Raw)
+	}
+
+	if rec.Truncated != "" {
+		parqRecord.Error = truncationError(rec.Truncated, rec.RawSize)
+	}
+
+	return p.parq.InsertRecord(ctx, parqRecord)
+}
+
+// Only records are written to Parquet
+func (p *ParqSink) WriteEvent(ctx context.Context, evt *Event) error {
+	return nil
+}
+
+func (p *ParqSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	return nil
+}
+
+func (p *ParqSink) Flush(ctx context.Context) error {
+	return p.parq.Flush(ctx)
+}
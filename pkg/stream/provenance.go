@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	// VerificationCID means the record's bytes hash to the CID its commit listed for them. The
+	// commit's signature isn't checked, so this vouches for the relay having passed the record on
+	// intact, not for the repo having signed it.
+	VerificationCID = "cid"
+	// VerificationNone means nothing about the record's content was checked, as for deletes,
+	// which carry no content, and backfilled records
+	VerificationNone = "none"
+)
+
+// JSONProvenance describes where a record came from and how far it can be trusted
+type JSONProvenance struct {
+	// SourceHost is the relay or, for backfilled records, the PDS the record was received from
+	SourceHost string `json:"source_host,omitempty"`
+	// ReceivedAt is when the record was ingested
+	ReceivedAt time.Time `json:"received_at"`
+	// EventTime is when the upstream says the commit carrying the record happened
+	EventTime *time.Time `json:"event_time,omitempty"`
+	Seq       int64      `json:"seq"`
+	// CommitCID is the CID of the commit carrying the record, empty for backfilled records
+	CommitCID    string `json:"commit_cid,omitempty"`
+	Verification string `json:"verification"`
+}
+
+// setProvenance records where a record was received from and how it was checked
+func (r *Record) setProvenance(sourceHost, commitCID string, eventTime *time.Time, verification string) {
+	r.SourceHost = sourceHost
+	r.CommitCID = commitCID
+	r.EventTime = eventTime
+	r.Verification = verification
+}
+
+func recordProvenance(r Record) *JSONProvenance {
+	p := &JSONProvenance{
+		SourceHost:   r.SourceHost,
+		ReceivedAt:   r.CreatedAt,
+		EventTime:    r.EventTime,
+		Seq:          r.FirehoseSeq,
+		CommitCID:    r.CommitCID,
+		Verification: r.Verification,
+	}
+	// Records stored before provenance was tracked have none of it
+	if p.Verification == "" {
+		p.Verification = VerificationNone
+	}
+	return p
+}
+
+// pdsHost returns the host of a PDS endpoint, or the endpoint itself if it isn't a URL
+func pdsHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	return u.Host
+}
@@ -0,0 +1,373 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Stages of ingestion a quarantined payload failed at
+const (
+	QuarantineStageCAR  = "car"
+	QuarantineStageCBOR = "cbor"
+	QuarantineStageJSON = "json"
+	QuarantineStageURI  = "uri"
+)
+
+// decodeError is a record that couldn't be decoded, and whose payload should be quarantined
+type decodeError struct {
+	stage string
+	err   error
+}
+
+func (e *decodeError) Error() string { return e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// decodedRecord is a created or updated record ready to be written, with the lints found in it
+type decodedRecord struct {
+	record *Record
+	lints  []lintResult
+	client string
+	// fields are the record's computed field values
+	fields []RecordField
+}
+
+// decodeRecord turns a record's CBOR into the row stored for it, returning a *decodeError
+// naming the stage that failed if it can't be decoded
+func (s *Stream) decodeRecord(seq int64, repoDID, action, path string, raw []byte) (*decodedRecord, error) {
+	asCbor, err := data.UnmarshalCBOR(raw)
+	if err != nil {
+		return nil, &decodeError{stage: QuarantineStageCBOR, err: fmt.Errorf("failed to unmarshal record from CBOR: %w", err)}
+	}
+
+	// Lint before truncation rewrites the record
+	collection, _, _ := strings.Cut(path, "/")
+	lints := lintRecord(collection, asCbor)
+	client := recordClient(asCbor)
+
+	recJSON, rawSize, truncated, err := s.truncateRecord(asCbor)
+	if err != nil {
+		return nil, &decodeError{stage: QuarantineStageJSON, err: fmt.Errorf("failed to marshal record to JSON: %w", err)}
+	}
+
+	recURI, err := syntax.ParseATURI(fmt.Sprintf("at://%s/%s", repoDID, path))
+	if err != nil {
+		return nil, &decodeError{stage: QuarantineStageURI, err: fmt.Errorf("failed to parse record uri: %w", err)}
+	}
+
+	rec := &Record{
+		FirehoseSeq: seq,
+		Repo:        recURI.Authority().String(),
+		Collection:  recURI.Collection().String(),
+		RKey:        recURI.RecordKey().String(),
+		Action:      action,
+		Raw:         recJSON,
+		RawSize:     rawSize,
+		Truncated:   truncated,
+	}
+
+	rec.ReplyRoot, rec.ReplyParent = recordReplyRefs(rec.Collection, asCbor)
+	rec.Langs = recordLangs(asCbor)
+
+	if createdAt := recordCreatedAt(asCbor); createdAt != nil {
+		skew := int64(s.Clock.Since(*createdAt).Seconds())
+		rec.RecordCreatedAt = createdAt
+		rec.CreatedAtSkew = &skew
+	}
+
+	fields := s.computeFields(collection, asCbor)
+
+	return &decodedRecord{record: rec, lints: lints, client: client, fields: fields}, nil
+}
+
+// quarantine stores a payload that failed to decode, logging rather than returning failures
+// since the event it came from has already been recorded with the error
+func (s *Stream) quarantine(ctx context.Context, q *QuarantinedRecord) {
+	recordsQuarantined.WithLabelValues(q.Stage).Inc()
+	q.RawSize = len(q.Raw)
+	if err := s.writer.WithContext(ctx).Create(q).Error; err != nil {
+		s.logger.Error("failed to quarantine payload", "repo", q.Repo, "seq", q.FirehoseSeq, "path", q.Path, "err", err)
+	}
+}
+
+// reprocessQuarantined retries ingesting a quarantined payload, returning how many records were written.
+// Records in a reprocessed commit that still fail to decode are quarantined on their own.
+func (s *Stream) reprocessQuarantined(ctx context.Context, q *QuarantinedRecord) (int, error) {
+	if q.Stage != QuarantineStageCAR {
+		dec, err := s.decodeRecord(q.FirehoseSeq, q.Repo, q.Action, q.Path, q.Raw)
+		if err != nil {
+			return 0, err
+		}
+		// Records are only decoded once their CID has been checked
+		dec.record.setProvenance(s.primary.host, "", nil, VerificationCID)
+		dec.record.CID = q.CID
+		dec.record.Rev = q.Rev
+		if err := s.writeRecord(ctx, ChangeSourceReprocess, dec.record); err != nil {
+			return 0, fmt.Errorf("failed to write record: %w", err)
+		}
+		if err := s.saveLints(ctx, dec.record, dec.client, dec.lints); err != nil {
+			s.logger.Error("failed to save record lints", "err", err)
+		}
+		if err := s.saveComputedFields(ctx, dec.record, dec.fields); err != nil {
+			s.logger.Error("failed to save computed fields", "err", err)
+		}
+		return 1, nil
+	}
+
+	var ops []*atproto.SyncSubscribeRepos_RepoOp
+	if err := json.Unmarshal(q.Ops, &ops); err != nil {
+		return 0, fmt.Errorf("failed to parse quarantined ops: %w", err)
+	}
+
+	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(q.Raw))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event repo: %w", err)
+	}
+
+	written := 0
+	for _, op := range ops {
+		var rec *Record
+		switch op.Action {
+		case "create", "update":
+			c, raw, err := r.GetRecordBytes(ctx, op.Path)
+			if err != nil || raw == nil {
+				return written, fmt.Errorf("failed to get record bytes (path: %q): %v", op.Path, err)
+			}
+
+			dec, err := s.decodeRecord(q.FirehoseSeq, q.Repo, op.Action, op.Path, *raw)
+			if err != nil {
+				var de *decodeError
+				if errors.As(err, &de) {
+					s.quarantine(ctx, &QuarantinedRecord{
+						FirehoseSeq: q.FirehoseSeq,
+						Repo:        q.Repo,
+						Rev:         q.Rev,
+						Path:        op.Path,
+						Action:      op.Action,
+						CID:         c.String(),
+						Stage:       de.stage,
+						Error:       de.err.Error(),
+						Raw:         *raw,
+					})
+					continue
+				}
+				return written, err
+			}
+
+			if err := s.saveLints(ctx, dec.record, dec.client, dec.lints); err != nil {
+				s.logger.Error("failed to save record lints", "err", err)
+			}
+			if err := s.saveComputedFields(ctx, dec.record, dec.fields); err != nil {
+				s.logger.Error("failed to save computed fields", "err", err)
+			}
+			rec = dec.record
+
+			verification := VerificationNone
+			if op.Cid != nil && cid.Cid(*op.Cid) == c {
+				verification = VerificationCID
+			}
+			rec.setProvenance(s.primary.host, "", nil, verification)
+			rec.CID = c.String()
+		case "delete":
+			collection, rkey, _ := strings.Cut(op.Path, "/")
+			rec = &Record{
+				FirehoseSeq: q.FirehoseSeq,
+				Repo:        q.Repo,
+				Collection:  collection,
+				RKey:        rkey,
+				Action:      op.Action,
+			}
+			rec.setProvenance(s.primary.host, "", nil, VerificationNone)
+		default:
+			continue
+		}
+
+		rec.Rev = q.Rev
+		if err := s.writeRecord(ctx, ChangeSourceReprocess, rec); err != nil {
+			return written, fmt.Errorf("failed to write record (path: %q): %w", op.Path, err)
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+type JSONQuarantinedRecord struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FirehoseSeq    int64      `json:"seq"`
+	Repo           string     `json:"repo"`
+	Rev            string     `json:"rev,omitempty"`
+	Path           string     `json:"path,omitempty"`
+	Action         string     `json:"action,omitempty"`
+	CID            string     `json:"cid,omitempty"`
+	Stage          string     `json:"stage"`
+	Error          string     `json:"error"`
+	RawSize        int        `json:"raw_size"`
+	Raw            []byte     `json:"raw,omitempty"` // Base64 encoded
+	ReprocessedAt  *time.Time `json:"reprocessed_at,omitempty"`
+	ReprocessError string     `json:"reprocess_error,omitempty"`
+}
+
+func dbQuarantinedToJSON(q QuarantinedRecord, includeRaw bool) JSONQuarantinedRecord {
+	rec := JSONQuarantinedRecord{
+		ID:             q.ID,
+		CreatedAt:      q.CreatedAt,
+		FirehoseSeq:    q.FirehoseSeq,
+		Repo:           q.Repo,
+		Rev:            q.Rev,
+		Path:           q.Path,
+		Action:         q.Action,
+		CID:            q.CID,
+		Stage:          q.Stage,
+		Error:          q.Error,
+		RawSize:        q.RawSize,
+		ReprocessedAt:  q.ReprocessedAt,
+		ReprocessError: q.ReprocessError,
+	}
+	if includeRaw {
+		rec.Raw = q.Raw
+	}
+	return rec
+}
+
+type QuarantineResponse struct {
+	Quarantined []JSONQuarantinedRecord `json:"quarantined"`
+	Error       string                  `json:"error,omitempty"`
+}
+
+// HandleGetQuarantine handles the GET /quarantine endpoint, listing payloads that failed to decode
+func (s *Stream) HandleGetQuarantine(c echo.Context) error {
+	// Parse the query parameters
+	// did - Repo DID (optional)
+	// stage - Stage the payload failed at: car, cbor, json, or uri (optional)
+	// pending - Only return payloads that haven't been reprocessed (optional)
+	// raw - Include the base64 encoded payload (optional)
+	// limit - Number of payloads to return (default=100)
+	resp := QuarantineResponse{}
+
+	q := s.reader.Model(&QuarantinedRecord{})
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("repo = ?", did.String())
+	}
+
+	if stage := c.QueryParam("stage"); stage != "" {
+		q = q.Where("stage = ?", stage)
+	}
+
+	if c.QueryParam("pending") == "true" {
+		q = q.Where("reprocessed_at IS NULL")
+	}
+
+	includeRaw := c.QueryParam("raw") == "true"
+	if !includeRaw {
+		q = q.Omit("raw", "ops")
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var rows []QuarantinedRecord
+	if err := q.Order("id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Quarantined = make([]JSONQuarantinedRecord, len(rows))
+	for i, row := range rows {
+		resp.Quarantined[i] = dbQuarantinedToJSON(row, includeRaw)
+	}
+
+	setRowsReturned(c, len(resp.Quarantined))
+	return c.JSON(http.StatusOK, resp)
+}
+
+type ReprocessResponse struct {
+	Quarantined *JSONQuarantinedRecord `json:"quarantined,omitempty"`
+	Records     int                    `json:"records"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// HandleReprocessQuarantined handles the POST /quarantine/:id/reprocess endpoint, retrying
+// ingestion of a quarantined payload with the current decoder
+func (s *Stream) HandleReprocessQuarantined(c echo.Context) error {
+	ctx := c.Request().Context()
+	resp := ReprocessResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid id: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var q QuarantinedRecord
+	if err := s.writer.WithContext(ctx).First(&q, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			resp.Error = "quarantined payload not found"
+			return c.JSON(http.StatusNotFound, resp)
+		}
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	if q.ReprocessedAt != nil {
+		resp.Error = "payload has already been reprocessed"
+		return c.JSON(http.StatusConflict, resp)
+	}
+
+	written, reprocessErr := s.reprocessQuarantined(ctx, &q)
+	resp.Records = written
+	s.logger.Info("quarantined payload reprocessed", "id", q.ID, "records", written, "err", reprocessErr, "actor", adminActor(c))
+
+	if reprocessErr != nil {
+		q.ReprocessError = reprocessErr.Error()
+		quarantineReprocessed.WithLabelValues("failed").Inc()
+	} else {
+		now := s.Clock.Now()
+		q.ReprocessedAt = &now
+		q.ReprocessError = ""
+		quarantineReprocessed.WithLabelValues("ok").Inc()
+	}
+
+	if err := s.writer.WithContext(ctx).Model(&q).Select("reprocessed_at", "reprocess_error").Updates(&q).Error; err != nil {
+		resp.Error = fmt.Sprintf("failed to update quarantined payload: %s", err)
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	jsonQ := dbQuarantinedToJSON(q, false)
+	resp.Quarantined = &jsonQ
+
+	if reprocessErr != nil {
+		resp.Error = reprocessErr.Error()
+		return c.JSON(http.StatusUnprocessableEntity, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
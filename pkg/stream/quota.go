@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// repoQuotaInterval is how often repos over the record cap are trimmed
+const repoQuotaInterval = 5 * time.Minute
+
+// RunRepoQuota trims every repo holding more than RepoRecordCap records back down to the cap,
+// evicting its oldest records first, until ctx is cancelled. Repos may overshoot the cap between
+// sweeps, but one hyperactive account can't fill the retention window on its own.
+func (s *Stream) RunRepoQuota(ctx context.Context) error {
+	if s.RepoRecordCap <= 0 {
+		return nil
+	}
+
+	logger := s.logger.With("source", "repo_quota")
+
+	ticker := s.Clock.NewTicker(repoQuotaInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			if err := s.enforceRepoQuota(ctx, logger); err != nil && ctx.Err() == nil {
+				logger.Error("failed to enforce repo record cap", "err", err)
+			}
+		}
+	}
+}
+
+func (s *Stream) enforceRepoQuota(ctx context.Context, logger *slog.Logger) error {
+	var over []struct {
+		Repo  string
+		Count int64
+	}
+	err := s.writer.WithContext(ctx).Model(&Record{}).
+		Select("repo, COUNT(*) AS count").
+		Group("repo").
+		Having("COUNT(*) > ?", s.RepoRecordCap).
+		Scan(&over).Error
+	if err != nil {
+		return fmt.Errorf("failed to find repos over the cap: %w", err)
+	}
+	reposOverQuota.Set(float64(len(over)))
+
+	for _, r := range over {
+		evicted, err := s.evictOldestRecords(ctx, r.Repo)
+		if err != nil {
+			return fmt.Errorf("failed to evict records of %s: %w", r.Repo, err)
+		}
+		recordsEvicted.Add(float64(evicted))
+		logger.Info("evicted records of repo over the cap", "repo", r.Repo, "records", r.Count, "evicted", evicted)
+	}
+
+	return nil
+}
+
+// evictOldestRecords deletes a repo's records older than its RepoRecordCap newest, along with
+// their lints and computed fields
+func (s *Stream) evictOldestRecords(ctx context.Context, repo string) (int64, error) {
+	// The newest record past the cap marks where eviction starts
+	var boundary Record
+	err := s.writer.WithContext(ctx).
+		Select("id", "created_at").
+		Where("repo = ?", repo).
+		Order("id DESC").
+		Offset(s.RepoRecordCap).
+		Limit(1).
+		Take(&boundary).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var evicted int64
+	err = s.writer.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec("DELETE FROM records WHERE repo = ? AND id <= ?", repo, boundary.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		evicted = res.RowsAffected
+
+		// Lints and fields aren't keyed by record ID, so they're trimmed by age instead
+		if err := tx.Exec("DELETE FROM record_lints WHERE repo = ? AND created_at <= ?", repo, boundary.CreatedAt).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM record_fields WHERE repo = ? AND created_at <= ?", repo, boundary.CreatedAt).Error
+	})
+	return evicted, err
+}
@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// recordFilter decides which records are stored. An empty filter allows everything.
+type recordFilter struct {
+	includeCollections []string
+	excludeCollections []string
+	// includeDIDs is nil to allow every repo
+	includeDIDs map[string]bool
+}
+
+// EnableRecordFilter limits the records the stream stores and passes to sinks to those in
+// includeCollections (if any are given) but not in excludeCollections, from repos in includeDIDs
+// (if any are given). Collections may be NSIDs or prefixes ending in .*, like app.bsky.feed.*.
+// Commit events are still stored so the stream's cursor and event history stay complete.
+func (s *Stream) EnableRecordFilter(includeCollections, excludeCollections, includeDIDs []string) error {
+	f, err := newRecordFilter(includeCollections, excludeCollections, includeDIDs)
+	if err != nil {
+		return err
+	}
+	s.recordFilter.Store(f)
+	return nil
+}
+
+// newRecordFilter builds a filter, or returns nil if it wouldn't filter anything
+func newRecordFilter(includeCollections, excludeCollections, includeDIDs []string) (*recordFilter, error) {
+	if len(includeCollections) == 0 && len(excludeCollections) == 0 && len(includeDIDs) == 0 {
+		return nil, nil
+	}
+	f := &recordFilter{}
+
+	for _, pattern := range includeCollections {
+		if err := validateCollectionPattern(pattern); err != nil {
+			return nil, err
+		}
+		f.includeCollections = append(f.includeCollections, pattern)
+	}
+	for _, pattern := range excludeCollections {
+		if err := validateCollectionPattern(pattern); err != nil {
+			return nil, err
+		}
+		f.excludeCollections = append(f.excludeCollections, pattern)
+	}
+
+	if len(includeDIDs) > 0 {
+		f.includeDIDs = make(map[string]bool, len(includeDIDs))
+		for _, raw := range includeDIDs {
+			did, err := syntax.ParseDID(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DID %q: %w", raw, err)
+			}
+			f.includeDIDs[did.String()] = true
+		}
+	}
+
+	return f, nil
+}
+
+func validateCollectionPattern(pattern string) error {
+	if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		// A prefix is the start of an NSID, which needs at least one more segment to be valid
+		if _, err := syntax.ParseNSID(prefix + ".x"); err != nil {
+			return fmt.Errorf("invalid collection pattern %q: %w", pattern, err)
+		}
+		return nil
+	}
+	if _, err := syntax.ParseNSID(pattern); err != nil {
+		return fmt.Errorf("invalid collection %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func matchCollection(patterns []string, collection string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(collection, prefix) {
+				return true
+			}
+		} else if collection == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsRepo reports whether records from a repo may be stored
+func (f *recordFilter) allowsRepo(did string) bool {
+	return f == nil || f.includeDIDs == nil || f.includeDIDs[did]
+}
+
+// allows reports whether a record may be stored, counting the ones that aren't
+func (f *recordFilter) allows(did, collection string) bool {
+	if f == nil {
+		return true
+	}
+	ok := f.allowsRepo(did) &&
+		(len(f.includeCollections) == 0 || matchCollection(f.includeCollections, collection)) &&
+		!matchCollection(f.excludeCollections, collection)
+	if !ok {
+		recordsFiltered.Inc()
+	}
+	return ok
+}
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+)
+
+// relayReconnectMinBackoff is the first wait before reconnecting to a relay, doubling with each
+// consecutive failure up to the stream's ReconnectMaxBackoff
+const relayReconnectMinBackoff = time.Second
+
+// relayStableConnection is how long a connection must last for the backoff to reset, so a relay
+// that accepts connections and immediately drops them is still backed off from
+const relayStableConnection = 30 * time.Second
+
+// reconnectBackoff returns a jittered wait before the nth consecutive reconnect attempt, between
+// half and all of the exponential backoff so upstreams don't reconnect in lockstep
+func reconnectBackoff(attempt int, max time.Duration) time.Duration {
+	backoff := relayReconnectMinBackoff
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, max)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// relayConn tracks the relays the stream can consume from and the active connection
+type relayConn struct {
+	urls    []*url.URL
+	current int
+	cancel  context.CancelFunc
+	lk      sync.Mutex
+}
+
+// url returns the relay to connect to next, with the subscription's cursor set to seq
+func (r *relayConn) url(seq int64) *url.URL {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	u := *r.urls[r.current]
+	if seq != 0 {
+		q := u.Query()
+		q.Set("cursor", fmt.Sprintf("%d", seq))
+		u.RawQuery = q.Encode()
+	}
+	return &u
+}
+
+// rotate switches to the next configured relay, returning false if there's only one
+func (r *relayConn) rotate() bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if len(r.urls) < 2 {
+		return false
+	}
+	r.current = (r.current + 1) % len(r.urls)
+	return true
+}
+
+// setCancel records the cancel func of the active connection
+func (r *relayConn) setCancel(cancel context.CancelFunc) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.cancel = cancel
+}
+
+// drop cancels the active connection, if any, so the stream reconnects
+func (r *relayConn) drop() {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// AddFallbackRelay adds a relay to rotate to when the current one stops making progress.
+// It must be called before the stream is started.
+func (s *Stream) AddFallbackRelay(socketURL string) error {
+	u, err := url.Parse(socketURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse fallback socket url: %w", err)
+	}
+	s.primary.relay.urls = append(s.primary.relay.urls, u)
+	return nil
+}
+
+// Reconnect drops the current relay connection so the stream reconnects from the last seen cursor
+func (s *Stream) Reconnect() {
+	s.primary.relay.drop()
+}
+
+// RotateRelay switches to the next configured relay and reconnects to it,
+// returning false (without reconnecting) if no fallback relay is configured
+func (s *Stream) RotateRelay() bool {
+	if !s.primary.relay.rotate() {
+		return false
+	}
+	s.primary.relay.drop()
+	return true
+}
+
+// callbacks are the handlers for the primary relay's events
+func (s *Stream) callbacks() *firehoseCallbacks {
+	return &firehoseCallbacks{
+		RepoStreamCallbacks: &events.RepoStreamCallbacks{
+			RepoCommit:    s.RepoCommit,
+			RepoHandle:    s.RepoHandle,
+			RepoIdentity:  s.RepoIdentity,
+			RepoInfo:      s.RepoInfo,
+			RepoMigrate:   s.RepoMigrate,
+			RepoTombstone: s.RepoTombstone,
+			LabelLabels:   s.LabelLabels,
+			LabelInfo:     s.LabelInfo,
+			Error:         s.Error,
+		},
+		RepoAccount: s.RepoAccount,
+		RepoSync:    s.RepoSync,
+	}
+}
+
+// consume connects to an upstream's current relay and processes events until the connection ends,
+// reconnecting from the upstream's latest cursor until ctx is cancelled. Failed or short-lived
+// connections are retried with jittered exponential backoff, reset once a connection holds.
+func (s *Stream) consume(ctx context.Context, up *upstream, rsc *firehoseCallbacks) {
+	logger := s.logger.With("host", up.host)
+
+	attempt := 0
+	for ctx.Err() == nil {
+		start := s.Clock.Now()
+		err := s.consumeOnce(ctx, up, rsc)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			logger.Error("relay connection failed", "err", err)
+			relayConnections.WithLabelValues(up.host, "failed").Inc()
+		}
+		if err == nil && s.Clock.Since(start) >= relayStableConnection {
+			attempt = 0
+		}
+
+		// A connection that held is redialed right away, anything else waits
+		attempt++
+		var backoff time.Duration
+		if attempt > 1 || err != nil {
+			backoff = reconnectBackoff(attempt, s.ReconnectMaxBackoff)
+		}
+		relayReconnects.WithLabelValues(up.host).Inc()
+		relayReconnectBackoff.WithLabelValues(up.host).Set(backoff.Seconds())
+		logger.Info("reconnecting to relay", "seq", up.getSeq(), "attempt", attempt, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+		case <-s.Clock.After(backoff):
+		}
+	}
+}
+
+func (s *Stream) consumeOnce(ctx context.Context, up *upstream, rsc *firehoseCallbacks) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	up.relay.setCancel(cancel)
+
+	socketURL := up.relay.url(up.getSeq())
+
+	s.logger.Info("connecting to relay", "url", socketURL.String(), "host", up.host)
+
+	slot := &wireConnSlot{metric: firehoseWireBytes.WithLabelValues(up.host)}
+	dialCtx := context.WithValue(connCtx, wireConnKey{}, slot)
+
+	con, resp, err := s.Dialer.DialContext(dialCtx, socketURL.String(), http.Header{
+		"User-Agent": []string{"atp-looking-glass/0.0.1"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	defer con.Close()
+
+	relayConnections.WithLabelValues(up.host, "connected").Inc()
+
+	// Track compression savings when the dialer counted the connection and the relay agreed to compress
+	up.compression.Store(nil)
+	if resp != nil && compressionNegotiated(resp.Header) {
+		firehoseCompressed.WithLabelValues(up.host).Set(1)
+		if slot.conn != nil {
+			up.compression.Store(&compressionStats{
+				conn:  slot.conn,
+				wire:  func(c *countingConn) int64 { return c.read.Load() },
+				saved: firehoseCompressionSaved.WithLabelValues(up.host),
+			})
+		}
+	} else {
+		firehoseCompressed.WithLabelValues(up.host).Set(0)
+	}
+
+	scheduler := s.newScheduler(up.host, con.RemoteAddr().String(), rsc.EventHandler)
+
+	if up == s.primary {
+		s.gaps.seed(up.getSeq())
+		s.scheduler = scheduler
+	}
+
+	if err := s.readFirehose(connCtx, up, con, scheduler, rsc); err != nil {
+		s.logger.Error("repo stream failed", "err", err, "host", up.host)
+	}
+
+	return nil
+}
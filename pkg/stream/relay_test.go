@@ -0,0 +1,34 @@
+package stream
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRelayConnURLCursor(t *testing.T) {
+	primary, _ := url.Parse("wss://relay.example.com/xrpc/com.atproto.sync.subscribeRepos")
+	fallback, _ := url.Parse("wss://fallback.example.com/xrpc/com.atproto.sync.subscribeRepos?compress=true")
+	r := &relayConn{urls: []*url.URL{primary, fallback}}
+
+	if got := r.url(0).Query(); got.Has("cursor") {
+		t.Errorf("url(0) set a cursor: %v", got)
+	}
+
+	// Reconnects resume from the in-memory cursor
+	if got := r.url(42).Query().Get("cursor"); got != "42" {
+		t.Errorf("url(42) cursor = %q, want 42", got)
+	}
+
+	if !r.rotate() {
+		t.Fatal("rotate() = false with a fallback configured")
+	}
+	q := r.url(43).Query()
+	if q.Get("cursor") != "43" || q.Get("compress") != "true" {
+		t.Errorf("fallback url query = %v, want cursor=43 and the relay's own params", q)
+	}
+
+	// The configured URLs aren't modified
+	if primary.RawQuery != "" {
+		t.Errorf("primary url was modified: %s", primary)
+	}
+}
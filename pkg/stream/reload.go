@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReloadSettings are the settings that can be changed while the stream runs, without dropping
+// its relay connections
+type ReloadSettings struct {
+	// IncludeCollections, ExcludeCollections, and IncludeDIDs make up the record filter, see
+	// EnableRecordFilter
+	IncludeCollections []string
+	ExcludeCollections []string
+	IncludeDIDs        []string
+
+	// TTL is how long events and records are kept (0 to keep them forever)
+	TTL time.Duration
+	// QuarantineRetention replaces Stream.QuarantineRetention
+	QuarantineRetention time.Duration
+	// ActivesRetention is how long actives sketches are kept, ignored unless actives are enabled
+	ActivesRetention time.Duration
+}
+
+var errReloadDisabled = errors.New("reload is not enabled on this instance")
+
+// EnableReload lets the stream's settings be reloaded by Reload and at POST /admin/reload, with
+// load reading their current values, typically from a config file
+func (s *Stream) EnableReload(load func() (ReloadSettings, error)) {
+	s.reload = load
+}
+
+// Reload reads the settings and applies them. Nothing is changed if any setting is invalid.
+func (s *Stream) Reload() error {
+	if s.reload == nil {
+		return errReloadDisabled
+	}
+
+	rs, err := s.reload()
+	if err == nil {
+		err = s.applySettings(rs)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("failed").Inc()
+		return err
+	}
+	configReloads.WithLabelValues("ok").Inc()
+	return nil
+}
+
+func (s *Stream) applySettings(rs ReloadSettings) error {
+	if rs.TTL < 0 || rs.QuarantineRetention < 0 || rs.ActivesRetention < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	filter, err := newRecordFilter(rs.IncludeCollections, rs.ExcludeCollections, rs.IncludeDIDs)
+	if err != nil {
+		return err
+	}
+
+	s.recordFilter.Store(filter)
+
+	s.retentionLk.Lock()
+	s.ttl = rs.TTL
+	s.QuarantineRetention = rs.QuarantineRetention
+	if s.actives != nil {
+		s.actives.retention = rs.ActivesRetention
+	}
+	s.retentionLk.Unlock()
+
+	s.logger.Info("settings reloaded",
+		"include_collections", rs.IncludeCollections,
+		"exclude_collections", rs.ExcludeCollections,
+		"include_dids", len(rs.IncludeDIDs),
+		"ttl", rs.TTL,
+		"quarantine_retention", rs.QuarantineRetention,
+		"actives_retention", rs.ActivesRetention,
+	)
+	return nil
+}
+
+// recordTTL is how long events and records are currently kept
+func (s *Stream) recordTTL() time.Duration {
+	s.retentionLk.RLock()
+	defer s.retentionLk.RUnlock()
+	return s.ttl
+}
+
+type ReloadResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// HandleReload handles the POST /admin/reload endpoint, reloading the stream's settings
+func (s *Stream) HandleReload(c echo.Context) error {
+	resp := ReloadResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	if err := s.Reload(); err != nil {
+		resp.Error = err.Error()
+		if errors.Is(err, errReloadDisabled) {
+			return c.JSON(http.StatusNotImplemented, resp)
+		}
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	s.logger.Info("reload requested", "actor", adminActor(c))
+	return c.JSON(http.StatusOK, resp)
+}
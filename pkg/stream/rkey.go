@@ -0,0 +1,131 @@
+package stream
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// Record key formats, as described by the lexicon key types
+const (
+	RKeyTID     = "tid"
+	RKeyLiteral = "literal"
+	RKeyCustom  = "custom"
+)
+
+var rkeyTypes = []string{RKeyTID, RKeyLiteral, RKeyCustom}
+
+// literalRKeys are the fixed record keys used by literal:* lexicon keys
+var literalRKeys = []string{"self"}
+
+// classifyRKey returns the format of a record key
+func classifyRKey(rkey string) string {
+	if _, err := syntax.ParseTID(rkey); err == nil {
+		return RKeyTID
+	}
+	if slices.Contains(literalRKeys, rkey) {
+		return RKeyLiteral
+	}
+	return RKeyCustom
+}
+
+type RKeyStats struct {
+	Collection string `json:"collection"`
+	TID        int64  `json:"tid"`
+	Literal    int64  `json:"literal"`
+	Custom     int64  `json:"custom"`
+	// Unclassified counts records stored before rkey formats were recorded
+	Unclassified int64 `json:"unclassified,omitempty"`
+	// Collisions counts rkeys created more than once in the same repo and collection
+	Collisions int64 `json:"collisions"`
+}
+
+type RKeyStatsResponse struct {
+	Stats []RKeyStats `json:"stats"`
+	Error string      `json:"error,omitempty"`
+}
+
+// HandleGetRKeyStats handles the GET /stats/rkeys endpoint, breaking down the record key
+// formats used by each collection so adoption of TID-based keys can be measured
+func (s *Stream) HandleGetRKeyStats(c echo.Context) error {
+	// Parse the query parameters
+	// collection - Collection NSID (optional)
+	resp := RKeyStatsResponse{}
+
+	q := s.reader.Model(&Record{}).Where("action <> ?", "delete")
+	collisions := s.reader.Model(&Record{}).
+		Select("collection").
+		Where("action = ?", "create").
+		Group("repo, collection, r_key").
+		Having("COUNT(*) > 1")
+
+	if collectionParam := c.QueryParam("collection"); collectionParam != "" {
+		collection, err := syntax.ParseNSID(collectionParam)
+		if err != nil {
+			resp.Error = "invalid collection: " + err.Error()
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("collection = ?", collection.String())
+		collisions = collisions.Where("collection = ?", collection.String())
+	}
+
+	var rows []struct {
+		Collection string
+		RKeyType   string
+		Count      int64
+	}
+	if err := q.Select("collection, r_key_type, COUNT(*) AS count").Group("collection, r_key_type").Scan(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	var collisionRows []struct {
+		Collection string
+		Count      int64
+	}
+	if err := s.reader.Table("(?) AS c", collisions).Select("collection, COUNT(*) AS count").Group("collection").Scan(&collisionRows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	byCollection := map[string]*RKeyStats{}
+	stats := func(collection string) *RKeyStats {
+		if st, ok := byCollection[collection]; ok {
+			return st
+		}
+		st := &RKeyStats{Collection: collection}
+		byCollection[collection] = st
+		return st
+	}
+
+	for _, row := range rows {
+		st := stats(row.Collection)
+		switch row.RKeyType {
+		case RKeyTID:
+			st.TID += row.Count
+		case RKeyLiteral:
+			st.Literal += row.Count
+		case RKeyCustom:
+			st.Custom += row.Count
+		default:
+			st.Unclassified += row.Count
+		}
+	}
+
+	for _, row := range collisionRows {
+		stats(row.Collection).Collisions = row.Count
+	}
+
+	resp.Stats = []RKeyStats{}
+	for _, st := range byCollection {
+		resp.Stats = append(resp.Stats, *st)
+	}
+	slices.SortFunc(resp.Stats, func(a, b RKeyStats) int {
+		return cmp.Compare(b.TID+b.Literal+b.Custom, a.TID+a.Literal+a.Custom)
+	})
+
+	return c.JSON(http.StatusOK, resp)
+}
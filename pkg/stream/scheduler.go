@@ -0,0 +1,107 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/autoscaling"
+	"github.com/bluesky-social/indigo/events/schedulers/parallel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schedulers firehose events can be processed with
+const (
+	// SchedulerParallel processes events with a fixed pool of workers
+	SchedulerParallel = "parallel"
+	// SchedulerAutoscale grows and shrinks its workers with the event rate, up to SchedulerWorkers
+	SchedulerAutoscale = "autoscale"
+)
+
+// ValidateScheduler checks the scheduler settings, returning an error naming the first bad one
+func (s *Stream) ValidateScheduler() error {
+	if s.SchedulerMode != SchedulerParallel && s.SchedulerMode != SchedulerAutoscale {
+		return fmt.Errorf("invalid scheduler %q, expected %s or %s", s.SchedulerMode, SchedulerParallel, SchedulerAutoscale)
+	}
+	if s.SchedulerWorkers < 1 {
+		return fmt.Errorf("scheduler workers must be at least 1")
+	}
+	if s.SchedulerQueueDepth < 1 {
+		return fmt.Errorf("scheduler queue depth must be at least 1")
+	}
+	if s.BackpressureLimit < 0 {
+		return fmt.Errorf("backpressure limit must not be negative")
+	}
+	return nil
+}
+
+// newScheduler creates the scheduler an upstream's events are processed with
+func (s *Stream) newScheduler(host, ident string, do func(context.Context, *events.XRPCStreamEvent) error) events.Scheduler {
+	var bp *backpressureScheduler
+	if s.BackpressureLimit > 0 {
+		bp = &backpressureScheduler{
+			slots:   make(chan struct{}, s.BackpressureLimit),
+			stalls:  backpressureStalls.WithLabelValues(host),
+			waiting: backpressureWait.WithLabelValues(host),
+		}
+		next := do
+		do = func(ctx context.Context, xev *events.XRPCStreamEvent) error {
+			defer bp.release()
+			return next(ctx, xev)
+		}
+	}
+
+	var sched events.Scheduler
+	switch s.SchedulerMode {
+	case SchedulerAutoscale:
+		settings := autoscaling.DefaultAutoscaleSettings()
+		settings.MaxConcurrency = s.SchedulerWorkers
+		settings.MaximumBufferedItemsPerRepo = s.SchedulerQueueDepth
+		sched = autoscaling.NewScheduler(settings, ident, do)
+	default:
+		sched = parallel.NewScheduler(s.SchedulerWorkers, s.SchedulerQueueDepth, ident, do)
+	}
+
+	if bp == nil {
+		return sched
+	}
+	bp.Scheduler = sched
+	return bp
+}
+
+// backpressureScheduler caps the events queued or being processed. Events for a repo that's
+// already being worked on are otherwise buffered without limit, so when writes fall behind this
+// blocks the websocket read loop instead, leaving the relay to buffer for us.
+type backpressureScheduler struct {
+	events.Scheduler
+
+	slots   chan struct{}
+	stalls  prometheus.Counter
+	waiting prometheus.Counter
+}
+
+func (b *backpressureScheduler) AddWork(ctx context.Context, repo string, val *events.XRPCStreamEvent) error {
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		b.stalls.Inc()
+		start := time.Now()
+		select {
+		case b.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.waiting.Add(time.Since(start).Seconds())
+	}
+
+	if err := b.Scheduler.AddWork(ctx, repo, val); err != nil {
+		b.release()
+		return err
+	}
+	return nil
+}
+
+func (b *backpressureScheduler) release() {
+	<-b.slots
+}
@@ -0,0 +1,243 @@
+package stream
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scoreboardMinCommits is how many commits a PDS needs in the retention window to be ranked
+const scoreboardMinCommits = 100
+
+// scoreboardFutureSkew is how far in the future a record's createdAt can be before it counts against its PDS
+const scoreboardFutureSkew = 5 * time.Minute
+
+// Weights of each failure rate in the conformance score
+const (
+	scoreboardCIDMismatchWeight = 0.3
+	scoreboardDecodeWeight      = 0.25
+	scoreboardInvalidWeight     = 0.2
+	scoreboardSkewWeight        = 0.15
+	scoreboardTooBigWeight      = 0.1
+)
+
+// PDSConformance is a PDS's protocol conformance signals over the retention window
+type PDSConformance struct {
+	PDS     string `json:"pds"`
+	Repos   int64  `json:"repos"`
+	Commits int64  `json:"commits"`
+	Records int64  `json:"records"`
+
+	// CIDMismatches counts commits whose op CIDs didn't match the blocks they shipped
+	CIDMismatches int64 `json:"cid_mismatches"`
+	// TooBig counts commits too big to include their blocks
+	TooBig int64 `json:"too_big"`
+	// DecodeFailures counts records and commits that couldn't be decoded and were quarantined
+	DecodeFailures int64 `json:"decode_failures"`
+	// InvalidRecords counts lint results, malformations in records that otherwise decoded
+	InvalidRecords int64 `json:"invalid_records"`
+	// FutureSkew counts records whose createdAt was in the future when ingested
+	FutureSkew int64 `json:"future_skew"`
+
+	// Score is between 0 (every commit or record failed a check) and 100 (none did)
+	Score float64 `json:"score"`
+}
+
+// Scoreboard ranks PDSs by conformance score, best first
+type Scoreboard struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	PDSs        []PDSConformance `json:"pdss"`
+}
+
+// failureRate returns n as a fraction of total, capped at 1
+func failureRate(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return min(1, float64(n)/float64(total))
+}
+
+func (pc *PDSConformance) score() {
+	failure := scoreboardCIDMismatchWeight*failureRate(pc.CIDMismatches, pc.Commits) +
+		scoreboardTooBigWeight*failureRate(pc.TooBig, pc.Commits) +
+		scoreboardDecodeWeight*failureRate(pc.DecodeFailures, pc.Commits) +
+		scoreboardInvalidWeight*failureRate(pc.InvalidRecords, pc.Records) +
+		scoreboardSkewWeight*failureRate(pc.FutureSkew, pc.Records)
+	pc.Score = 100 * (1 - failure)
+}
+
+// buildScoreboard aggregates the per-PDS signals stored in the retention window
+func (s *Stream) buildScoreboard(ctx context.Context) (*Scoreboard, error) {
+	db := s.reader.WithContext(ctx)
+	byPDS := make(map[string]*PDSConformance)
+	get := func(pds *string) *PDSConformance {
+		host := ""
+		if pds != nil {
+			if u, err := url.Parse(*pds); err == nil {
+				host = u.Host
+			}
+		}
+		pc, ok := byPDS[host]
+		if !ok {
+			pc = &PDSConformance{PDS: host}
+			byPDS[host] = pc
+		}
+		return pc
+	}
+
+	var events []struct {
+		PDS           *string
+		Repos         int64
+		Commits       int64
+		CIDMismatches int64
+		TooBig        int64
+	}
+	if err := db.Table("events").
+		Select("identities.pds, COUNT(DISTINCT events.repo) AS repos, COUNT(*) AS commits, "+
+			"SUM(CASE WHEN events.error LIKE ? THEN 1 ELSE 0 END) AS cid_mismatches, "+
+			"SUM(CASE WHEN events.error = ? THEN 1 ELSE 0 END) AS too_big", "%cid mismatch%", "commit too big").
+		Joins("LEFT JOIN identities ON identities.d_id = events.repo").
+		Where("events.event_type = ?", "commit").
+		Group("identities.pds").
+		Scan(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to aggregate events: %w", err)
+	}
+	for _, row := range events {
+		pc := get(row.PDS)
+		pc.Repos += row.Repos
+		pc.Commits += row.Commits
+		pc.CIDMismatches += row.CIDMismatches
+		pc.TooBig += row.TooBig
+	}
+
+	var records []struct {
+		PDS        *string
+		Records    int64
+		FutureSkew int64
+	}
+	if err := db.Table("records").
+		Select("identities.pds, COUNT(*) AS records, SUM(CASE WHEN records.created_at_skew < ? THEN 1 ELSE 0 END) AS future_skew",
+			-int64(scoreboardFutureSkew.Seconds())).
+		Joins("LEFT JOIN identities ON identities.d_id = records.repo").
+		Where("records.action IN ?", []string{"create", "update"}).
+		Group("identities.pds").
+		Scan(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to aggregate records: %w", err)
+	}
+	for _, row := range records {
+		pc := get(row.PDS)
+		pc.Records += row.Records
+		pc.FutureSkew += row.FutureSkew
+	}
+
+	var counts []struct {
+		PDS   *string
+		Count int64
+	}
+	if err := db.Table("record_lints").
+		Select("identities.pds, COUNT(*) AS count").
+		Joins("LEFT JOIN identities ON identities.d_id = record_lints.repo").
+		Group("identities.pds").
+		Scan(&counts).Error; err != nil {
+		return nil, fmt.Errorf("failed to aggregate lints: %w", err)
+	}
+	for _, row := range counts {
+		get(row.PDS).InvalidRecords += row.Count
+	}
+
+	// Quarantined payloads outlive the retention window, so only count the ones inside it
+	counts = nil
+	quarantined := db.Table("quarantined_records").
+		Select("identities.pds, COUNT(*) AS count").
+		Joins("LEFT JOIN identities ON identities.d_id = quarantined_records.repo")
+	if ttl := s.recordTTL(); ttl > 0 {
+		quarantined = quarantined.Where("quarantined_records.created_at >= ?", s.Clock.Now().Add(-ttl))
+	}
+	if err := quarantined.
+		Group("identities.pds").
+		Scan(&counts).Error; err != nil {
+		return nil, fmt.Errorf("failed to aggregate quarantined records: %w", err)
+	}
+	for _, row := range counts {
+		get(row.PDS).DecodeFailures += row.Count
+	}
+
+	sb := &Scoreboard{GeneratedAt: s.Clock.Now(), PDSs: []PDSConformance{}}
+	for _, pc := range byPDS {
+		// Repos with unknown identities can't be attributed to a PDS
+		if pc.PDS == "" || pc.Commits < scoreboardMinCommits {
+			continue
+		}
+		pc.score()
+		sb.PDSs = append(sb.PDSs, *pc)
+	}
+
+	slices.SortFunc(sb.PDSs, func(a, b PDSConformance) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Commits, a.Commits)
+	})
+
+	return sb, nil
+}
+
+// RunScoreboard rebuilds the PDS conformance scoreboard every ScoreboardInterval
+func (s *Stream) RunScoreboard(ctx context.Context) error {
+	if s.ScoreboardInterval <= 0 {
+		return nil
+	}
+
+	logger := s.logger.With("source", "scoreboard")
+
+	ticker := s.Clock.NewTicker(s.ScoreboardInterval)
+	defer ticker.Stop()
+
+	for {
+		start := s.Clock.Now()
+		sb, err := s.buildScoreboard(ctx)
+		if err != nil {
+			logger.Error("failed to build PDS scoreboard", "err", err)
+		} else {
+			s.scoreboard.Store(sb)
+			logger.Info("built PDS scoreboard", "pdss", len(sb.PDSs), "took", s.Clock.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+type ScoreboardResponse struct {
+	*Scoreboard
+	Error string `json:"error,omitempty"`
+}
+
+// HandleGetScoreboard handles the GET /pds/scoreboard endpoint, ranking PDSs by how well
+// their commits and records conform to the protocol
+func (s *Stream) HandleGetScoreboard(c echo.Context) error {
+	resp := ScoreboardResponse{}
+
+	if s.ScoreboardInterval <= 0 {
+		resp.Error = "the PDS scoreboard is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	sb := s.scoreboard.Load()
+	if sb == nil {
+		resp.Error = "the PDS scoreboard hasn't been built yet"
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+
+	resp.Scoreboard = sb
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// EnableSearch creates the full-text index over record payloads, if it doesn't already exist,
+// and turns on the /records/search endpoint. SQLite uses an FTS5 table kept in sync with
+// triggers (the binary must be built with the sqlite_fts5 tag) and Postgres uses a GIN index.
+func (s *Stream) EnableSearch(ctx context.Context) error {
+	db := s.writer.WithContext(ctx)
+
+	switch s.dbDriver {
+	case DriverSQLite:
+		exists := db.Migrator().HasTable("records_fts")
+
+		stmts := []string{
+			`CREATE VIRTUAL TABLE IF NOT EXISTS records_fts USING fts5(raw)`,
+			`CREATE TRIGGER IF NOT EXISTS records_fts_insert AFTER INSERT ON records BEGIN
+				INSERT INTO records_fts(rowid, raw) VALUES (new.id, CAST(new.raw AS TEXT));
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS records_fts_delete AFTER DELETE ON records BEGIN
+				DELETE FROM records_fts WHERE rowid = old.id;
+			END`,
+		}
+		for _, stmt := range stmts {
+			if err := db.Exec(stmt).Error; err != nil {
+				return fmt.Errorf("failed to create search index: %w", err)
+			}
+		}
+
+		// Index the records written before search was enabled
+		if !exists {
+			s.logger.Info("indexing existing records for search")
+			if err := db.Exec(`INSERT INTO records_fts(rowid, raw) SELECT id, CAST(raw AS TEXT) FROM records WHERE raw IS NOT NULL`).Error; err != nil {
+				return fmt.Errorf("failed to index existing records: %w", err)
+			}
+		}
+	case DriverPostgres:
+		if err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_records_raw_fts ON records USING GIN (to_tsvector('simple', convert_from(raw, 'UTF8')))`).Error; err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	default:
+		return fmt.Errorf("search is not supported with the %q driver", s.dbDriver)
+	}
+
+	s.searchEnabled = true
+	return nil
+}
+
+// HandleSearchRecords handles the GET /records/search endpoint, a full-text search over
+// the raw JSON of stored records
+func (s *Stream) HandleSearchRecords(c echo.Context) error {
+	// Parse the query parameters
+	// q - Text to search for (required)
+	// did - Repo DID (optional)
+	// collection - Collection NSID (optional)
+	// limit - Number of records to return (default=100)
+	// include - Comma-separated optional blocks to add to each record: provenance (optional)
+	resp := RecordsResponse{}
+
+	if !s.searchEnabled {
+		resp.Error = "search is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	text := strings.TrimSpace(c.QueryParam("q"))
+	if text == "" {
+		resp.Error = "q is required"
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	q := s.reader.Model(&Record{})
+
+	switch s.dbDriver {
+	case DriverSQLite:
+		// Search for the text as a phrase so user input can't inject FTS5 query syntax
+		phrase := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+		q = q.Joins("JOIN records_fts ON records_fts.rowid = records.id").
+			Where("records_fts MATCH ?", phrase)
+	case DriverPostgres:
+		q = q.Where("to_tsvector('simple', convert_from(raw, 'UTF8')) @@ phraseto_tsquery('simple', ?)", text)
+	}
+
+	if didParam := c.QueryParam("did"); didParam != "" {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid DID: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("records.repo = ?", did.String())
+	}
+
+	if collectionParam := c.QueryParam("collection"); collectionParam != "" {
+		collection, err := syntax.ParseNSID(collectionParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid collection: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("records.collection = ?", collection.String())
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var includes recordFields
+	if err := includes.parseIncludes(c.QueryParams()); err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	var records []Record
+	if err := q.Order("records.id DESC").Limit(limit).Find(&records).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	identityMap, err := s.identitiesForRecords(records)
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	resp.Records = make([]JSONRecord, len(records))
+	for i, r := range records {
+		resp.Records[i] = dbRecordIDToJSONRecord(r, identityMap[r.Repo])
+		if includes.Provenance {
+			resp.Records[i].Provenance = recordProvenance(r)
+		}
+		resp.RawBytes += len(r.Raw)
+	}
+
+	slices.SortFunc(resp.Records, recordSeqSortFunc)
+
+	setRowsReturned(c, len(resp.Records))
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,150 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Sink is a destination for the events, records, and identities ingested from the firehose
+type Sink interface {
+	// Name identifies the sink in logs and metrics
+	Name() string
+	WriteRecord(ctx context.Context, rec *Record) error
+	WriteEvent(ctx context.Context, evt *Event) error
+	WriteIdentity(ctx context.Context, id *Identity) error
+	// Flush writes out anything the sink has buffered
+	Flush(ctx context.Context) error
+}
+
+// AddSink registers a sink to receive everything ingested from the firehose, as a consumer of
+// the stream's change bus. Sinks must be added before the stream is started.
+func (s *Stream) AddSink(sink Sink) {
+	s.logger.Info("adding sink", "sink", sink.Name())
+	s.sinks = append(s.sinks, sink)
+	s.changes.add(&sinkConsumer{sink: sink, s: s})
+}
+
+// DBSink returns a sink that writes to the stream's own database, backing the query API.
+// If DBBatchSize is above 1, writes are buffered and flushed in transactions of that many rows.
+func (s *Stream) DBSink() Sink {
+	sink := &dbSink{db: s.writer, name: "db"}
+	if s.DBBatchSize <= 1 {
+		return sink
+	}
+
+	s.dbBatch = &dbBatchSink{
+		dbSink:     sink,
+		size:       s.DBBatchSize,
+		logger:     s.logger,
+		deadLetter: s.deadLetter,
+	}
+	return s.dbBatch
+}
+
+// writeRecord publishes a record from source, one of the ChangeSource* values, returning the
+// errors of any consumers that failed to take it
+func (s *Stream) writeRecord(ctx context.Context, source string, rec *Record) error {
+	if rec.RKeyType == "" {
+		rec.RKeyType = classifyRKey(rec.RKey)
+	}
+
+	var errs []error
+	for _, f := range s.publishChange(ctx, &Change{Kind: ChangeRecordInserted, Source: source, Record: rec}) {
+		errs = append(errs, fmt.Errorf("%s: %w", f.consumer, f.err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Stream) writeEvent(ctx context.Context, evt *Event) {
+	for _, f := range s.publishChange(ctx, &Change{Kind: ChangeEventInserted, Event: evt}) {
+		s.logger.Error("failed to write event", "consumer", f.consumer, "seq", evt.FirehoseSeq, "err", f.err)
+	}
+}
+
+func (s *Stream) writeIdentity(ctx context.Context, id *Identity) {
+	for _, f := range s.publishChange(ctx, &Change{Kind: ChangeIdentityUpdated, Identity: id}) {
+		s.logger.Error("failed to write identity", "consumer", f.consumer, "did", id.DID, "err", f.err)
+	}
+}
+
+// flushSinks flushes every sink, logging any that fail and returning their errors
+func (s *Stream) flushSinks(ctx context.Context) error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := sink.Flush(ctx); err != nil {
+			s.logger.Error("failed to flush sink", "sink", sink.Name(), "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replaySafeSink is implemented by sinks that write idempotently, which are the only ones sent
+// the events the replay window re-reads
+type replaySafeSink interface {
+	replaySafe()
+}
+
+// replayed reports whether a change re-delivers an event or record from before the stored
+// cursor the replay window rewound from
+func (s *Stream) replayed(c *Change) bool {
+	through := s.replayedThrough.Load()
+	switch {
+	case through == 0:
+		return false
+	case c.Kind == ChangeRecordInserted:
+		return c.Source == ChangeSourceFirehose && c.Record.FirehoseSeq > 0 && c.Record.FirehoseSeq <= through
+	case c.Kind == ChangeEventInserted:
+		return c.Event.FirehoseSeq <= through
+	}
+	return false
+}
+
+// dbSink writes to the SQL database the stream's API queries
+type dbSink struct {
+	db   *gorm.DB
+	name string
+}
+
+func (d *dbSink) Name() string { return d.name }
+
+func (d *dbSink) replaySafe() {}
+
+// Events and records are created idempotently so replays don't fail on duplicates
+func (d *dbSink) WriteRecord(ctx context.Context, rec *Record) error {
+	if rec.FirehoseSeq == 0 {
+		return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return writeBackfilled(tx, rec)
+		})
+	}
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(rec).Error
+}
+
+// writeBackfilled stores a record from a repo checkout in place of the one an earlier backfill
+// stored for its path. It's inserted as a new row rather than updated so it has the highest ID,
+// and so reads as the path's latest version.
+func writeBackfilled(tx *gorm.DB, rec *Record) error {
+	err := tx.Unscoped().
+		Where("firehose_seq = 0 AND repo = ? AND collection = ? AND r_key = ?", rec.Repo, rec.Collection, rec.RKey).
+		Delete(&Record{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(rec).Error
+}
+
+func (d *dbSink) WriteEvent(ctx context.Context, evt *Event) error {
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(evt).Error
+}
+
+func (d *dbSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	return d.db.WithContext(ctx).Save(id).Error
+}
+
+func (d *dbSink) Flush(ctx context.Context) error {
+	return nil
+}
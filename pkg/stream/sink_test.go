@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+// countingSink counts the records written to it
+type countingSink struct {
+	records int
+}
+
+func (cs *countingSink) Name() string                                       { return "counting" }
+func (cs *countingSink) WriteRecord(ctx context.Context, rec *Record) error { cs.records++; return nil }
+func (cs *countingSink) WriteEvent(ctx context.Context, evt *Event) error   { return nil }
+func (cs *countingSink) WriteIdentity(ctx context.Context, id *Identity) error {
+	return nil
+}
+func (cs *countingSink) Flush(ctx context.Context) error { return nil }
+
+// replaySafeCountingSink is a countingSink that claims to write idempotently
+type replaySafeCountingSink struct {
+	countingSink
+}
+
+func (replaySafeCountingSink) replaySafe() {}
+
+func TestReplayWindowSinks(t *testing.T) {
+	s := &Stream{}
+	s.replayedThrough.Store(100)
+
+	plain := &countingSink{}
+	safe := &replaySafeCountingSink{}
+	consumers := []*sinkConsumer{{sink: plain, s: s}, {sink: safe, s: s}}
+
+	for _, seq := range []int64{99, 100, 101} {
+		c := &Change{Kind: ChangeRecordInserted, Source: ChangeSourceFirehose, Record: &Record{FirehoseSeq: seq}}
+		for _, sc := range consumers {
+			if err := sc.HandleChange(context.Background(), c); err != nil {
+				t.Fatalf("HandleChange: %v", err)
+			}
+		}
+	}
+
+	if plain.records != 1 {
+		t.Errorf("sink that isn't replay safe got %d records, want only the one past the stored cursor", plain.records)
+	}
+	if safe.records != 3 {
+		t.Errorf("replay safe sink got %d records, want 3", safe.records)
+	}
+}
+
+func TestBackfilledRecordReplaced(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+	ctx := context.Background()
+
+	plain := &dbSink{db: db, name: "db"}
+	sinks := map[string]Sink{
+		"db":    plain,
+		"batch": &dbBatchSink{dbSink: plain, size: 10, logger: slog.Default()},
+	}
+	for name, sink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			repo := "did:plc:" + name
+			write := func(rec *Record) {
+				t.Helper()
+				rec.Repo, rec.Collection, rec.RKey = repo, "app.bsky.actor.profile", "self"
+				if err := sink.WriteRecord(ctx, rec); err != nil {
+					t.Fatalf("WriteRecord: %v", err)
+				}
+				if err := sink.Flush(ctx); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+
+			write(&Record{Action: BackfillAction, Raw: []byte(`{"displayName":"a"}`)})
+			write(&Record{FirehoseSeq: 5, Action: "update", Raw: []byte(`{"displayName":"b"}`)})
+			// A refill after a gap that hid a later update
+			write(&Record{Action: BackfillAction, Raw: []byte(`{"displayName":"c"}`)})
+
+			var versions []Record
+			if err := db.Where("repo = ?", repo).Order("id ASC").Find(&versions).Error; err != nil {
+				t.Fatalf("failed to load records: %v", err)
+			}
+			if len(versions) != 2 {
+				t.Fatalf("got %d versions, want the firehose update and one backfilled copy", len(versions))
+			}
+			if latest := versions[1]; latest.FirehoseSeq != 0 || string(latest.Raw) != `{"displayName":"c"}` {
+				t.Errorf("latest version is seq %d %s, want the refilled copy", latest.FirehoseSeq, latest.Raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// recordCreatedAt returns the createdAt embedded in a record, if it has a parseable one
+func recordCreatedAt(rec map[string]any) *time.Time {
+	raw, ok := rec["createdAt"].(string)
+	if !ok {
+		return nil
+	}
+	t, err := dateparse.ParseAny(raw)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// Skew buckets, in order, with the upper bound (exclusive) in seconds of each
+var skewBuckets = []struct {
+	Name  string
+	Upper int64
+}{
+	{"future", 0},
+	{"under_1m", 60},
+	{"under_1h", 60 * 60},
+	{"under_1d", 24 * 60 * 60},
+	{"under_7d", 7 * 24 * 60 * 60},
+	{"under_30d", 30 * 24 * 60 * 60},
+}
+
+const skewBucketOver30d = "over_30d"
+
+// skewBucketSQL builds a CASE expression assigning each record to a skew bucket
+func skewBucketSQL() string {
+	expr := "CASE"
+	for _, b := range skewBuckets {
+		expr += fmt.Sprintf(" WHEN records.created_at_skew < %d THEN '%s'", b.Upper, b.Name)
+	}
+	return expr + fmt.Sprintf(" ELSE '%s' END", skewBucketOver30d)
+}
+
+type SkewStats struct {
+	Collection string           `json:"collection"`
+	PDS        string           `json:"pds"`
+	Count      int64            `json:"count"`
+	AvgSeconds float64          `json:"avg_seconds"`
+	Buckets    map[string]int64 `json:"buckets"`
+}
+
+type SkewResponse struct {
+	Skew  []SkewStats `json:"skew"`
+	Error string      `json:"error,omitempty"`
+}
+
+// HandleGetSkewStats handles the GET /stats/skew endpoint, reporting how far records'
+// embedded createdAt lags (or leads) the time we ingested them, per collection and PDS
+func (s *Stream) HandleGetSkewStats(c echo.Context) error {
+	// Parse the query parameters
+	// collection - Collection NSID (optional)
+	// pds - PDS endpoint (optional)
+	collectionParam := c.QueryParam("collection")
+	pdsParam := c.QueryParam("pds")
+
+	resp := SkewResponse{}
+
+	q := s.reader.Table("records").
+		Select("records.collection, identities.pds, " + skewBucketSQL() + " AS bucket, COUNT(*) AS count, SUM(records.created_at_skew) AS total").
+		Joins("LEFT JOIN identities ON identities.d_id = records.repo").
+		Where("records.created_at_skew IS NOT NULL")
+
+	if collectionParam != "" {
+		collection, err := syntax.ParseNSID(collectionParam)
+		if err != nil {
+			resp.Error = fmt.Sprintf("invalid collection: %s", err)
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("records.collection = ?", collection.String())
+	}
+
+	if pdsParam != "" {
+		q = q.Where("identities.pds = ?", pdsParam)
+	}
+
+	var rows []struct {
+		Collection string
+		PDS        *string
+		Bucket     string
+		Count      int64
+		Total      int64
+	}
+	if err := q.Group("records.collection, identities.pds, bucket").Scan(&rows).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	// Fold the bucket rows into one entry per collection and PDS
+	stats := make(map[[2]string]*SkewStats)
+	totals := make(map[[2]string]int64)
+	resp.Skew = []SkewStats{}
+	for _, row := range rows {
+		pds := ""
+		if row.PDS != nil {
+			if u, err := url.Parse(*row.PDS); err == nil {
+				pds = u.Host
+			}
+		}
+		key := [2]string{row.Collection, pds}
+		st, ok := stats[key]
+		if !ok {
+			st = &SkewStats{Collection: row.Collection, PDS: pds, Buckets: map[string]int64{}}
+			stats[key] = st
+		}
+		st.Count += row.Count
+		st.Buckets[row.Bucket] += row.Count
+		totals[key] += row.Total
+	}
+
+	for key, st := range stats {
+		if st.Count > 0 {
+			st.AvgSeconds = float64(totals[key]) / float64(st.Count)
+		}
+		resp.Skew = append(resp.Skew, *st)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -10,99 +10,235 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/araddon/dateparse"
 	"github.com/bluesky-social/indigo/api/atproto"
-	"github.com/bluesky-social/indigo/atproto/data"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/events"
-	"github.com/bluesky-social/indigo/events/schedulers/parallel"
 	"github.com/bluesky-social/indigo/repo"
-	"github.com/ericvolp12/atproto.tools/pkg/bq"
+	"github.com/ericvolp12/atproto.tools/pkg/clock"
+	"github.com/ericvolp12/atproto.tools/pkg/lifecycle"
+	"github.com/ericvolp12/atproto.tools/pkg/network"
+	"github.com/ericvolp12/atproto.tools/pkg/objstore"
+	"github.com/ericvolp12/atproto.tools/pkg/pdsfetch"
 	"github.com/gorilla/websocket"
 	"github.com/ipfs/go-cid"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/time/rate"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
 	slogGorm "github.com/orandin/slog-gorm"
 )
 
 type Stream struct {
-	logger    *slog.Logger
-	socketURL *url.URL
+	logger *slog.Logger
 
-	scheduler events.Scheduler
+	// primary is the relay whose events are stored, upstreams are only tracked for comparison
+	primary   *upstream
+	upstreams []*upstream
 
-	lastSeq int64
-	seqLk   sync.RWMutex
+	consistency *consistencyChecker
 
-	streamClosed chan struct{}
+	scheduler events.Scheduler
 
-	writer *gorm.DB
-	reader *gorm.DB
-	ttl    time.Duration
+	streamClosed chan struct{}
 
-	dir *identity.CacheDirectory
+	writer   *gorm.DB
+	reader   *gorm.DB
+	dbDriver string
+
+	// retentionLk guards ttl, QuarantineRetention, and the actives retention, which can be reloaded
+	retentionLk sync.RWMutex
+	ttl         time.Duration
+
+	searchEnabled bool
+
+	// computedFields are extracted from records at ingest, keyed by name
+	computedFields map[string]ComputedField
+	// recordFilter limits which records are stored, holding nil to store them all
+	recordFilter atomic.Pointer[recordFilter]
+
+	// replayedThrough is the stored cursor the replay window rewound from. Events up to it were
+	// already delivered before the restart, so they're only rewritten by idempotent sinks.
+	replayedThrough atomic.Int64
+	// blocklist drops records from blocked DIDs and PDS hosts, nil unless enabled
+	blocklist *blocklist
+	// reload reads the settings applied by Reload, nil unless enabled
+	reload func() (ReloadSettings, error)
+	// deadLetterSpill takes dead letters the database can't, nil unless enabled
+	deadLetterSpill *deadLetterSpill
+	// gaps follows the primary relay's seqs to find the events it skipped
+	gaps gapTracker
+	// dbBatch buffers database writes, nil unless DBBatchSize is above 1
+	dbBatch *dbBatchSink
+
+	didMethods *didMethods
+
+	// usage accounts requests to API keys, nil unless usage tracking is enabled
+	usage *usageTracker
+	// actives counts distinct active repos per hour, nil unless enabled
+	actives *activesTracker
+
+	sinks []Sink
+	// changes carries every write to the sinks and other consumers
+	changes changeBus
+
+	subscribers *subscribers
+	events      *eventCache
+	liveRecords *liveRecordCache
+	scoreboard  atomic.Pointer[Scoreboard]
+
+	// subscribeZstdDict is the dictionary zstd compressed /subscribe messages use, if any
+	subscribeZstdDict []byte
+
+	pds           *pdsfetch.Client
+	backfillQueue chan backfillRequest
+
+	// livePDS fetches records for /at lookups, only from public PDS hosts
+	livePDS *pdsfetch.Client
+	// identityDir is the cached indigo directory the did:plc and did:web resolvers share, also
+	// used to resolve and verify handles
+	identityDir *identity.CacheDirectory
+
+	// Clock drives the cursor save, retention, and liveness routines
+	Clock clock.Clock
+	// Dialer connects to the firehose
+	Dialer WebsocketDialer
+
+	// CursorOverride, if set, is used as the starting cursor instead of the stored one
+	CursorOverride *int64
+	// StartFrom, if set, resumes from the first stored event at or after this time
+	StartFrom time.Time
+	// ReplayWindow rewinds the stored cursor by this much event time at startup. Only the
+	// database sink is sent the events before the stored cursor again, see replayedThrough.
+	ReplayWindow time.Duration
+	// MaxFieldBytes caps the size of any single string or bytes field in a record (0 for no limit)
+	MaxFieldBytes int
+	// MaxRecordBytes caps the size of a record's raw JSON, dropping everything but its $type if exceeded (0 for no limit)
+	MaxRecordBytes int
+	// SubscribeBufferSize is how many events are buffered for each /subscribe client
+	SubscribeBufferSize int
+	// SubscribeDropPolicy is what to do when a /subscribe client's buffer is full, one of the Subscribe* policies
+	SubscribeDropPolicy string
+	// SubscribeCompression offers permessage-deflate compression to /subscribe clients
+	SubscribeCompression bool
+	// SubscribeCompressionLevel is the flate level compressed /subscribe messages are written at
+	SubscribeCompressionLevel int
+	// SubscribeMaxDrops is how many events a /subscribe client may miss before being disconnected (0 for no limit)
+	SubscribeMaxDrops int64
+	// SchedulerMode is how firehose events are scheduled, one of the Scheduler* modes
+	SchedulerMode string
+	// SchedulerWorkers is how many events are processed at once, or the most the autoscaling
+	// scheduler scales up to
+	SchedulerWorkers int
+	// SchedulerQueueDepth is the scheduler's per-repo queue depth. The indigo schedulers take it
+	// but don't yet enforce it, so BackpressureLimit is what actually bounds buffering.
+	SchedulerQueueDepth int
+	// BackpressureLimit caps the events queued or being processed per upstream, blocking the
+	// websocket read loop while it's reached (0 for no limit)
+	BackpressureLimit int
+	// DBBatchSize is how many events and records the db sink writes per transaction (1 or less to
+	// write each as it arrives)
+	DBBatchSize int
+	// DBBatchInterval is the longest a partial batch waits before being written
+	DBBatchInterval time.Duration
+	// RepoRecordCap is how many records each repo may keep, with the oldest evicted past it (0 for no limit)
+	RepoRecordCap int
+	// ChurnWindow is how soon after being created a deleted record counts as churn (0 disables churn detection)
+	ChurnWindow time.Duration
+	// BotScoring enables the repo automation scoring endpoints
+	BotScoring bool
+	// QuarantineRetention is how long payloads that failed to decode are kept, independent of the
+	// retention window so they outlive the events they came from (0 to keep them forever). Once
+	// the stream is started it's only changed by Reload.
+	QuarantineRetention time.Duration
+	// ScoreboardInterval is how often the PDS conformance scoreboard is rebuilt (0 to disable it)
+	ScoreboardInterval time.Duration
+	// DumpStore is where daily dataset dumps are published (nil to disable them)
+	DumpStore objstore.Store
+	// DumpInterval is how often to check for days that are ready to be dumped
+	DumpInterval time.Duration
+	// DumpCollections limits dumps to these collections, empty to dump every collection
+	DumpCollections []string
+	// DumpFormats are the formats each dump is written in, DumpFormatParquet and DumpFormatJSONL
+	DumpFormats []string
+	// DumpDeidentify replaces DIDs in dumps with salted pseudonyms and strips handles and identifying fields
+	DumpDeidentify bool
+	// DumpSaltRotation is how long a de-identification salt is used before a new one is generated
+	DumpSaltRotation time.Duration
+	// BackfillWorkers is the number of workers fetching full repos for new DIDs (0 disables backfill)
+	BackfillWorkers int
+	// LivenessWindow is how often the liveness checker looks for progress
+	LivenessWindow time.Duration
+	// LivenessMinProgress is how far the cursor must advance within each liveness window
+	LivenessMinProgress int64
+	// LivenessMode is LivenessRestart or LivenessWarn
+	LivenessMode string
+	// LivenessMaxFailures is how many consecutive quiet liveness windows are tolerated before giving up
+	LivenessMaxFailures int
+	// ReconnectMaxBackoff caps the wait between attempts to reconnect to a relay
+	ReconnectMaxBackoff time.Duration
+	// GapMinSize is how many consecutive seqs the primary relay must skip to be recorded as a gap
+	GapMinSize int64
+	// GapFill queues repos for backfill when their first commit within GapFillWindow of a gap
+	// shows they missed one in it. It needs BackfillWorkers.
+	GapFill bool
+	// GapFillWindow is how long after a gap repos' commits are checked for missed ones
+	GapFillWindow time.Duration
+	// ShutdownBudget bounds the stream's shutdown phases, see ShutdownPhases
+	ShutdownBudget *lifecycle.Budget
+	// AdminToken authorizes requests to the /admin endpoints, which are disabled while it's empty
+	AdminToken string
+}
 
-	bq *bq.BQ
+// ShutdownPhases are the steps the stream takes to shut down, in order, with their default
+// shares of the shutdown budget. Flushing sinks gets the most as it's where data is lost.
+var ShutdownPhases = []lifecycle.Phase{
+	{Name: "scheduler_drain", Share: 0.3},
+	{Name: "sink_flush", Share: 0.4},
+	{Name: "cursor_save", Share: 0.1},
 }
 
 var tracer = otel.Tracer("stream")
 
+// WebsocketDialer opens websocket connections, satisfied by *websocket.Dialer
+type WebsocketDialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
 func NewStream(
 	logger *slog.Logger,
 	socketURL string,
-	sqlitePath string,
+	profile *network.Profile,
+	dbDriver string,
+	dbDSN string,
 	migrate bool,
 	ttl time.Duration,
-	bq *bq.BQ,
 ) (*Stream, error) {
 	gormLogger := slogGorm.New()
 
-	writer, err := gorm.Open(sqlite.Open(sqlitePath), &gorm.Config{
-		Logger: gormLogger,
-	})
-
-	sqlDB, err := writer.DB()
+	writer, reader, err := openDBs(dbDriver, dbDSN, gormLogger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sql db: %w", err)
+		return nil, err
 	}
 
-	sqlDB.SetMaxOpenConns(1)
-
 	if migrate {
 		logger.Info("running database migrations")
-		err := writer.AutoMigrate(&Event{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to migrate events: %w", err)
-		}
-
-		err = writer.AutoMigrate(&Record{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to migrate records: %w", err)
-		}
-
-		err = writer.AutoMigrate(&Cursor{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to migrate cursor: %w", err)
-		}
-
-		err = writer.AutoMigrate(Identity{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to migrate identity: %w", err)
+		if err := migrateSchema(writer); err != nil {
+			return nil, err
 		}
 		logger.Info("database migrations complete")
 	}
 
 	base := identity.BaseDirectory{
-		PLCURL: identity.DefaultPLCURL,
+		PLCURL: profile.PLCHost,
 		HTTPClient: http.Client{
 			Timeout: time.Second * 15,
 		},
@@ -113,170 +249,282 @@ func NewStream(
 				return d.DialContext(ctx, network, address)
 			},
 		},
-		TryAuthoritativeDNS: true,
-		// primary Bluesky PDS instance only supports HTTP resolution method
-		SkipDNSDomainSuffixes: []string{".bsky.social"},
+		TryAuthoritativeDNS:   true,
+		SkipDNSDomainSuffixes: profile.SkipDNSDomainSuffixes,
 	}
 
 	dir := identity.NewCacheDirectory(&base, 100_000, time.Hour*6, time.Minute*2, time.Hour*6)
 
-	// Set pragmas for performance
-	writer.Exec("PRAGMA journal_mode=WAL;")
-	writer.Exec("PRAGMA synchronous=normal;")
-
-	reader, err := gorm.Open(sqlite.Open(sqlitePath), &gorm.Config{
-		Logger: gormLogger,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to open sqlite db: %w", err)
-	}
-
-	reader.Exec("PRAGMA journal_mode=WAL;")
-	reader.Exec("PRAGMA synchronous=normal;")
+	methods := newDIDMethods()
+	methods.resolvers["plc"] = &directoryResolver{dir: &dir}
+	methods.resolvers["web"] = &directoryResolver{dir: &dir}
 
 	u, err := url.Parse(socketURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse socket url: %w", err)
 	}
 
-	return &Stream{
+	s := &Stream{
 		logger:       logger,
-		socketURL:    u,
+		primary:      newUpstream(u),
 		streamClosed: make(chan struct{}),
 		writer:       writer,
 		reader:       reader,
+		dbDriver:     dbDriver,
 		ttl:          ttl,
-		dir:          &dir,
-		bq:           bq,
-	}, nil
+		didMethods:   methods,
+		subscribers:  newSubscribers(),
+		events:       newEventCache(10_000),
+		liveRecords:  newLiveRecordCache(10_000, 5*time.Minute),
+		pds:          pdsfetch.NewClient("atp-looking-glass/0.0.1"),
+		livePDS:      pdsfetch.NewPublicClient("atp-looking-glass/0.0.1"),
+		identityDir:  &dir,
+		Clock:        clock.Real,
+		Dialer:       websocket.DefaultDialer,
+
+		ShutdownBudget: lifecycle.NewBudget(logger, 30*time.Second, ShutdownPhases...),
+
+		backfillQueue: make(chan backfillRequest, 10_000),
+
+		SubscribeBufferSize:       1000,
+		SubscribeDropPolicy:       SubscribeDisconnect,
+		SubscribeCompressionLevel: 1,
+		LivenessWindow:            15 * time.Second,
+		LivenessMinProgress:       1,
+		LivenessMode:              LivenessRestart,
+		LivenessMaxFailures:       3,
+		ReconnectMaxBackoff:       2 * time.Minute,
+		GapMinSize:                1,
+		GapFillWindow:             10 * time.Minute,
+		SchedulerMode:             SchedulerParallel,
+		SchedulerWorkers:          100,
+		SchedulerQueueDepth:       10,
+	}
+
+	// In-memory consumers go first, so they aren't held up behind the sinks' writes
+	s.changes.add(&eventCacheConsumer{cache: s.events})
+	s.changes.add(&subscribeConsumer{s: s})
+
+	return s, nil
 }
 
 func (s *Stream) Start(ctx context.Context) error {
-	// Load the cursor if it exists
-	var c Cursor
-	if err := s.writer.First(&c).Error; err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			c = Cursor{}
-			err := s.writer.Create(&c).Error
-			if err != nil {
-				return fmt.Errorf("failed to create cursor: %w", err)
-			}
+	// The primary relay's cursor is stored with an empty host, which migrateSchema backfills on
+	// cursors saved before upstreams had their own
+	c, err := s.loadCursor("")
+	if err != nil {
+		return err
+	}
+
+	// Apply any user-specified starting point over the stored cursor
+	if s.CursorOverride != nil {
+		s.logger.Info("overriding stored cursor", "stored_seq", c.LastSeq, "seq", *s.CursorOverride)
+		c.LastSeq = *s.CursorOverride
+	} else if !s.StartFrom.IsZero() {
+		seq, err := s.seqForTime(s.StartFrom)
+		if err != nil {
+			return fmt.Errorf("failed to find cursor for start time: %w", err)
+		}
+		s.logger.Info("overriding stored cursor from start time", "stored_seq", c.LastSeq, "seq", seq, "start_from", s.StartFrom)
+		c.LastSeq = seq
+	} else if s.ReplayWindow > 0 && c.LastSeq > 0 {
+		// The database sink writes events and records idempotently, so replaying a window into
+		// it is safe. Sinks that aren't, like Kafka or BigQuery, skip the replayed events.
+		seq, err := s.seqForReplayWindow(c.LastSeq, s.ReplayWindow)
+		if err != nil {
+			s.logger.Warn("failed to apply replay window, resuming from stored cursor", "err", err, "seq", c.LastSeq)
+		} else {
+			s.logger.Info("rewinding stored cursor by replay window", "stored_seq", c.LastSeq, "seq", seq, "window", s.ReplayWindow)
+			s.replayedThrough.Store(c.LastSeq)
+			c.LastSeq = seq
 		}
 	}
 
-	// Start a routine to save the cursor every 60 seconds
+	// Seed the in-memory cursor so a quiet stream doesn't save over the starting point
+	s.SetSeq(c.LastSeq)
+
+	go s.saveCursor(c, s.primary)
+	cursors := map[*upstream]*Cursor{s.primary: c}
+
+	// Other upstreams always resume from their own stored cursors
+	consumers := sync.WaitGroup{}
+	for _, up := range s.upstreams {
+		uc, err := s.loadCursor(up.host)
+		if err != nil {
+			return err
+		}
+		up.setSeq(uc.LastSeq)
+
+		go s.saveCursor(uc, up)
+		cursors[up] = uc
+
+		consumers.Add(1)
+		go func(up *upstream) {
+			defer consumers.Done()
+			s.consume(ctx, up, up.trackingCallbacks())
+		}(up)
+	}
+
+	// Start a routine to delete old events and records every 5 minutes. It runs even without a
+	// retention window, as one may be set by a reload.
 	go func() {
-		ticker := time.NewTicker(60 * time.Second)
+		ticker := s.Clock.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-s.streamClosed:
-				s.seqLk.RLock()
-				c.LastSeq = s.lastSeq
-				s.seqLk.RUnlock()
-				s.logger.Info("stream closed, saving cursor", "seq", c.LastSeq)
-				if err := s.writer.Save(&c).Error; err != nil {
-					s.logger.Error("failed to save cursor", "err", err)
-				}
-				s.logger.Info("cursor saved")
 				return
-			case <-ticker.C:
-				s.seqLk.RLock()
-				c.LastSeq = s.lastSeq
-				s.seqLk.RUnlock()
-				s.logger.Info("saving cursor", "seq", c.LastSeq)
-				if err := s.writer.Save(&c).Error; err != nil {
-					s.logger.Error("failed to save cursor", "err", err)
+			case <-ticker.C():
+				s.retentionLk.RLock()
+				ttl, quarantineRetention := s.ttl, s.QuarantineRetention
+				s.retentionLk.RUnlock()
+
+				// Quarantined records have their own retention, kept with or without the main one
+				if quarantineRetention > 0 {
+					s.expireRows(ctx, "quarantined_records", s.Clock.Now().Add(-quarantineRetention))
+				}
+
+				if ttl <= 0 {
+					continue
 				}
+
+				s.logger.Info("deleting old events and records")
+				before := s.Clock.Now().Add(-ttl)
+				eventsDeleted := s.expireRows(ctx, "events", before)
+				recordsDeleted := s.expireRows(ctx, "records", before)
+				s.expireRows(ctx, "record_lints", before)
+				s.expireRows(ctx, "record_fields", before)
+
+				s.logger.Info("old events and records deleted", "events_deleted", eventsDeleted, "records", recordsDeleted)
 			}
 		}
 	}()
 
-	// Start a routine to delete old events and records every 5 minutes
-	if s.ttl > 0 {
-		go func() {
-			ticker := time.NewTicker(5 * time.Minute)
-			for {
-				select {
-				case <-s.streamClosed:
-					return
-				case <-ticker.C:
-					s.logger.Info("deleting old events and records")
-					tx := s.writer.Exec("DELETE FROM events WHERE created_at < ?", time.Now().Add(-s.ttl))
-					if tx.Error != nil {
-						s.logger.Error("failed to delete old events", "err", tx.Error)
-					}
-
-					eventsDeleted := tx.RowsAffected
-
-					tx = s.writer.Exec("DELETE FROM records WHERE created_at < ?", time.Now().Add(-s.ttl))
-					if tx.Error != nil {
-						s.logger.Error("failed to delete old records", "err", tx.Error)
-					}
-
-					recordsDeleted := tx.RowsAffected
-
-					s.logger.Info("old events and records deleted", "events_deleted", eventsDeleted, "records", recordsDeleted)
-				}
-			}
-		}()
-	}
+	consumers.Add(1)
+	go func() {
+		defer consumers.Done()
+		s.consume(ctx, s.primary, s.callbacks())
+	}()
 
-	socketURL := s.socketURL
-	if c.LastSeq != 0 {
-		q := socketURL.Query()
-		q.Set("seq", fmt.Sprintf("%d", c.LastSeq))
-		socketURL.RawQuery = q.Encode()
-	}
+	<-ctx.Done()
+	s.shutdown(&consumers, cursors)
 
-	rsc := events.RepoStreamCallbacks{
-		RepoCommit:    s.RepoCommit,
-		RepoHandle:    s.RepoHandle,
-		RepoIdentity:  s.RepoIdentity,
-		RepoInfo:      s.RepoInfo,
-		RepoMigrate:   s.RepoMigrate,
-		RepoTombstone: s.RepoTombstone,
-		LabelLabels:   s.LabelLabels,
-		LabelInfo:     s.LabelInfo,
-		Error:         s.Error,
-	}
+	return nil
+}
+
+// shutdown runs the stream's shutdown phases within its budget: waiting for the schedulers to
+// finish the events they've queued, flushing the sinks, and saving every upstream's cursor
+func (s *Stream) shutdown(consumers *sync.WaitGroup, cursors map[*upstream]*Cursor) {
+	s.ShutdownBudget.Begin()
+
+	drained := make(chan struct{})
+	go func() {
+		consumers.Wait()
+		close(drained)
+	}()
+
+	s.ShutdownBudget.Run("scheduler_drain", func(ctx context.Context) error {
+		select {
+		case <-drained:
+			s.logger.Info("repo stream shut down")
+			return nil
+		case <-ctx.Done():
+			// Events still queued are replayed from the saved cursor on restart
+			return fmt.Errorf("schedulers still processing queued events: %w", ctx.Err())
+		}
+	})
 
-	d := websocket.DefaultDialer
+	close(s.streamClosed)
 
-	s.logger.Info("connecting to relay", "url", socketURL.String())
+	s.ShutdownBudget.Run("sink_flush", s.flushSinks)
 
-	con, _, err := d.Dial(socketURL.String(), http.Header{
-		"User-Agent": []string{"atp-looking-glass/0.0.1"},
+	s.ShutdownBudget.Run("cursor_save", func(ctx context.Context) error {
+		var errs []error
+		for up, c := range cursors {
+			c.LastSeq = up.getSeq()
+			s.logger.Info("saving cursor", "host", up.host, "seq", c.LastSeq)
+			if err := s.writer.WithContext(ctx).Save(c).Error; err != nil {
+				errs = append(errs, fmt.Errorf("failed to save cursor for %q at seq %d: %w", up.host, c.LastSeq, err))
+			}
+		}
+		return errors.Join(errs...)
 	})
+}
 
+// seqForTime returns a cursor that replays from the first stored event at or after t
+func (s *Stream) seqForTime(t time.Time) (int64, error) {
+	var e Event
+	err := s.reader.Where("time >= ?", t.UnixNano()).Order("firehose_seq ASC").First(&e).Error
 	if err != nil {
-		return fmt.Errorf("failed to connect to relay: %w", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, fmt.Errorf("no stored events at or after %s", t.Format(time.RFC3339))
+		}
+		return 0, fmt.Errorf("failed to query events: %w", err)
 	}
 
-	scheduler := parallel.NewScheduler(100, 10, con.RemoteAddr().String(), rsc.EventHandler)
-
-	s.scheduler = scheduler
+	return e.FirehoseSeq - 1, nil
+}
 
-	if err := events.HandleRepoStream(ctx, con, scheduler); err != nil {
-		s.logger.Error("repo stream failed", "err", err)
+// seqForReplayWindow returns a cursor that replays window worth of events before seq
+func (s *Stream) seqForReplayWindow(seq int64, window time.Duration) (int64, error) {
+	var e Event
+	err := s.reader.Where("firehose_seq <= ? AND time > 0", seq).Order("firehose_seq DESC").First(&e).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, fmt.Errorf("no stored events at or before seq %d", seq)
+		}
+		return 0, fmt.Errorf("failed to query events: %w", err)
 	}
 
-	s.logger.Info("repo stream shut down")
+	return s.seqForTime(time.Unix(0, e.Time).Add(-window))
+}
 
-	close(s.streamClosed)
+// loadCursor loads the stored cursor for an upstream host, creating it if it doesn't exist
+func (s *Stream) loadCursor(host string) (*Cursor, error) {
+	c := Cursor{Host: host}
+	if err := s.writer.Where("host = ?", host).FirstOrCreate(&c).Error; err != nil {
+		return nil, fmt.Errorf("failed to load cursor for %q: %w", host, err)
+	}
+	return &c, nil
+}
 
-	return nil
+// saveCursor saves an upstream's cursor every 60 seconds until the stream closes, after which
+// shutdown saves it one last time
+func (s *Stream) saveCursor(c *Cursor, up *upstream) {
+	logger := s.logger.With("host", up.host)
+
+	ticker := s.Clock.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.streamClosed:
+			return
+		case <-ticker.C():
+			c.LastSeq = up.getSeq()
+			logger.Info("saving cursor", "seq", c.LastSeq)
+			if err := s.writer.Save(c).Error; err != nil {
+				logger.Error("failed to save cursor", "err", err)
+			}
+		}
+	}
 }
 
 func (s *Stream) SetSeq(seq int64) {
-	s.seqLk.Lock()
-	defer s.seqLk.Unlock()
-	s.lastSeq = seq
+	s.primary.setSeq(seq)
+}
+
+// SetEventTime records the firehose time of the most recently processed event
+func (s *Stream) SetEventTime(t time.Time) {
+	s.primary.setEventTime(t)
+}
+
+// GetEventTime returns the firehose time of the most recently processed event
+func (s *Stream) GetEventTime() time.Time {
+	return s.primary.getEventTime()
 }
 
 func (s *Stream) GetSeq() int64 {
-	s.seqLk.RLock()
-	defer s.seqLk.RUnlock()
-	return s.lastSeq
+	return s.primary.getSeq()
 }
 
 func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
@@ -292,6 +540,9 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 	)
 
 	s.SetSeq(evt.Seq)
+	s.primary.consistency.observe(s.primary.host, evt.Repo, evt.Rev)
+	// A repo's first commit has no previous revision
+	s.observeActive(evt.Repo, evt.Since == nil)
 
 	// Record metadata about the event
 	e := &Event{
@@ -299,13 +550,12 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 		Repo:        evt.Repo,
 		EventType:   "commit",
 		Since:       evt.Since,
+		Rev:         evt.Rev,
 	}
 
-	defer func() {
-		if err := s.writer.Create(e).Error; err != nil {
-			s.logger.Error("failed to create event", "err", err)
-		}
-	}()
+	summarizeOps(e, evt.Ops)
+
+	defer s.writeEvent(ctx, e)
 
 	if evt.TooBig {
 		s.logger.Warn("commit too big", "repo", evt.Repo, "seq", evt.Seq)
@@ -317,6 +567,18 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 	if err != nil {
 		s.logger.Error("failed to read event repo", "err", err)
 		e.Error = fmt.Sprintf("failed to read event repo: %v", err)
+
+		// The ops are kept with the blocks so the whole commit can be reprocessed
+		ops, _ := json.Marshal(evt.Ops)
+		s.quarantine(ctx, &QuarantinedRecord{
+			FirehoseSeq: evt.Seq,
+			Repo:        evt.Repo,
+			Rev:         evt.Rev,
+			Stage:       QuarantineStageCAR,
+			Error:       err.Error(),
+			Raw:         evt.Blocks,
+			Ops:         ops,
+		})
 		return nil
 	}
 
@@ -328,26 +590,36 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 	}
 
 	e.Time = t.UnixNano()
+	s.SetEventTime(t)
 
+	pds := ""
 	did, err := syntax.ParseDID(evt.Repo)
 	if err != nil {
 		s.logger.Error("failed to parse DID", "err", err)
-	} else {
-		id, fromCache, err := s.dir.LookupDIDWithCacheState(ctx, did)
-		if err != nil {
-			s.logger.Error("failed to lookup DID", "err", err)
-		} else if !fromCache {
-			if err := s.writer.Save(&Identity{
-				DID:    id.DID.String(),
-				Handle: id.Handle.String(),
-				PDS:    id.PDSEndpoint(),
-			}).Error; err != nil {
-				s.logger.Error("failed to save identity", "err", err)
-			}
+	} else if s.recordFilter.Load().allowsRepo(evt.Repo) {
+		id, fresh := s.resolveIdentity(ctx, did, false)
+		if id != nil {
+			pds = id.PDSEndpoint()
 		}
+		if fresh && s.blocklist.blockedBy(evt.Repo, pds) == "" {
+			s.enqueueBackfill(ctx, id.DID.String(), pds)
+		}
+		s.checkGapFill(ctx, evt, pds)
 	}
 
+	// Records from blocked repos are dropped, but the event is still stored and counted
+	blockedBy := s.blocklist.blockedBy(evt.Repo, pds)
+
 	for _, op := range evt.Ops {
+		collection, _, _ := strings.Cut(op.Path, "/")
+		if !s.recordFilter.Load().allows(evt.Repo, collection) {
+			continue
+		}
+		if blockedBy != "" {
+			recordsBlocked.WithLabelValues(blockedBy).Inc()
+			continue
+		}
+
 		switch op.Action {
 		case "create", "update":
 			if op.Cid == nil {
@@ -376,56 +648,45 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 				continue
 			}
 
-			asCbor, err := data.UnmarshalCBOR(*rec)
+			dec, err := s.decodeRecord(evt.Seq, evt.Repo, op.Action, op.Path, *rec)
 			if err != nil {
-				logger.Error("failed to unmarshal record from CBOR", "err", err, "cid", c, "path", op.Path)
-				e.Error += fmt.Sprintf("failed to unmarshal record from CBOR (path: %q): %v", op.Path, err)
+				logger.Error("failed to decode record", "err", err, "cid", c, "path", op.Path)
+				e.Error += fmt.Sprintf("failed to decode record (path: %q): %v", op.Path, err)
+
+				var de *decodeError
+				if errors.As(err, &de) {
+					s.quarantine(ctx, &QuarantinedRecord{
+						FirehoseSeq: evt.Seq,
+						Repo:        evt.Repo,
+						Rev:         evt.Rev,
+						Path:        op.Path,
+						Action:      op.Action,
+						CID:         c.String(),
+						Stage:       de.stage,
+						Error:       de.err.Error(),
+						Raw:         *rec,
+					})
+				}
 				continue
 			}
-
-			recJSON, err := json.Marshal(asCbor)
-			if err != nil {
-				logger.Error("failed to marshal record to JSON", "err", err)
-				e.Error += fmt.Sprintf("failed to marshal record to JSON (path: %q): %v", op.Path, err)
-				continue
+			dbRecord := dec.record
+			dbRecord.setProvenance(s.primary.host, evt.Commit.String(), &t, VerificationCID)
+			dbRecord.CID = c.String()
+			dbRecord.Rev = evt.Rev
+
+			if err := s.writeRecord(ctx, ChangeSourceFirehose, dbRecord); err != nil {
+				logger.Error("failed to write record", "err", err)
+				e.Error += fmt.Sprintf("failed to write record (path: %q): %v", op.Path, err)
+			} else {
+				observeIngestLatency(ctx, op.Action, s.Clock.Since(t))
 			}
 
-			recRawURI := fmt.Sprintf("at://%s/%s", evt.Repo, op.Path)
-			recURI, err := syntax.ParseATURI(recRawURI)
-			if err != nil {
-				logger.Error("failed to parse record uri", "err", err)
-				e.Error += fmt.Sprintf("failed to parse record uri (path: %q): %v", op.Path, err)
-				continue
+			if err := s.saveLints(ctx, dbRecord, dec.client, dec.lints); err != nil {
+				logger.Error("failed to save record lints", "err", err)
 			}
 
-			dbRecord := &Record{
-				FirehoseSeq: evt.Seq,
-				Repo:        recURI.Authority().String(),
-				Collection:  recURI.Collection().String(),
-				RKey:        recURI.RecordKey().String(),
-				Action:      op.Action,
-				Raw:         recJSON,
-			}
-
-			if err := s.writer.Create(dbRecord).Error; err != nil {
-				logger.Error("failed to create db record", "err", err)
-				e.Error += fmt.Sprintf("failed to create db record (path: %q): %v", op.Path, err)
-			}
-
-			if s.bq != nil {
-				bqRecord := &bq.Record{
-					CreatedAt:   time.Now(),
-					FirehoseSeq: evt.Seq,
-					Repo:        recURI.Authority().String(),
-					Collection:  recURI.Collection().String(),
-					RKey:        recURI.RecordKey().String(),
-					Action:      op.Action,
-					Raw:         bigquery.NullJSON{Valid: true, JSONVal: string(recJSON)},
-				}
-
-				if err := s.bq.InsertRecord(ctx, bqRecord); err != nil {
-					logger.Error("failed to insert record into BQ", "err", err)
-				}
+			if err := s.saveComputedFields(ctx, dbRecord, dec.fields); err != nil {
+				logger.Error("failed to save computed fields", "err", err)
 			}
 		case "delete":
 			recRawURI := fmt.Sprintf("at://%s/%s", evt.Repo, op.Path)
@@ -443,25 +704,18 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 				RKey:        recURI.RecordKey().String(),
 				Action:      op.Action,
 			}
+			dbRecord.setProvenance(s.primary.host, evt.Commit.String(), &t, VerificationNone)
+			dbRecord.Rev = evt.Rev
 
-			if err := s.writer.Create(dbRecord).Error; err != nil {
-				logger.Error("failed to create db record", "err", err)
-				e.Error += fmt.Sprintf("failed to create db record (path: %q): %v", op.Path, err)
+			if err := s.observeChurn(ctx, dbRecord); err != nil {
+				logger.Error("failed to check record churn", "err", err)
 			}
 
-			if s.bq != nil {
-				bqRecord := &bq.Record{
-					CreatedAt:   time.Now(),
-					FirehoseSeq: evt.Seq,
-					Repo:        recURI.Authority().String(),
-					Collection:  recURI.Collection().String(),
-					RKey:        recURI.RecordKey().String(),
-					Action:      op.Action,
-				}
-
-				if err := s.bq.InsertRecord(ctx, bqRecord); err != nil {
-					logger.Error("failed to insert record into BQ", "err", err)
-				}
+			if err := s.writeRecord(ctx, ChangeSourceFirehose, dbRecord); err != nil {
+				logger.Error("failed to write record", "err", err)
+				e.Error += fmt.Sprintf("failed to write record (path: %q): %v", op.Path, err)
+			} else {
+				observeIngestLatency(ctx, op.Action, s.Clock.Since(t))
 			}
 		default:
 			logger.Warn("unknown action", "action", op.Action)
@@ -472,6 +726,33 @@ func (s *Stream) RepoCommit(evt *atproto.SyncSubscribeRepos_Commit) error {
 	return nil
 }
 
+// summarizeOps records counts of each action and the collections touched by a commit's ops on its event
+func summarizeOps(e *Event, ops []*atproto.SyncSubscribeRepos_RepoOp) {
+	collections := []string{}
+	for _, op := range ops {
+		switch op.Action {
+		case "create":
+			e.Creates++
+		case "update":
+			e.Updates++
+		case "delete":
+			e.Deletes++
+		}
+
+		collection, _, _ := strings.Cut(op.Path, "/")
+		if !slices.Contains(collections, collection) {
+			collections = append(collections, collection)
+		}
+	}
+
+	slices.Sort(collections)
+	collectionsJSON, err := json.Marshal(collections)
+	if err != nil {
+		return
+	}
+	e.Collections = string(collectionsJSON)
+}
+
 func (s *Stream) RepoHandle(handle *atproto.SyncSubscribeRepos_Handle) error {
 	ctx := context.Background()
 	ctx, span := tracer.Start(ctx, "RepoHandle")
@@ -494,18 +775,8 @@ func (s *Stream) RepoHandle(handle *atproto.SyncSubscribeRepos_Handle) error {
 	if err != nil {
 		s.logger.Error("failed to parse DID", "err", err)
 	} else {
-		s.dir.Purge(ctx, did.AtIdentifier())
-		id, err := s.dir.LookupDID(ctx, did)
-		if err != nil {
-			s.logger.Error("failed to lookup DID", "err", err)
-		} else {
-			if err := s.writer.Save(&Identity{
-				DID:    id.DID.String(),
-				Handle: id.Handle.String(),
-				PDS:    id.PDSEndpoint(),
-			}).Error; err != nil {
-				s.logger.Error("failed to save identity", "err", err)
-			}
+		if id, _ := s.resolveIdentity(ctx, did, true); id != nil {
+			s.emitIdentity(e.FirehoseSeq, id.DID.String(), id.Handle.String())
 		}
 	}
 
@@ -516,13 +787,10 @@ func (s *Stream) RepoHandle(handle *atproto.SyncSubscribeRepos_Handle) error {
 		return nil
 	}
 
-	defer func() {
-		if err := s.writer.Create(e).Error; err != nil {
-			s.logger.Error("failed to create event", "err", err)
-		}
-	}()
+	defer s.writeEvent(ctx, e)
 
 	e.Time = t.UnixNano()
+	s.SetEventTime(t)
 
 	return nil
 
@@ -550,18 +818,8 @@ func (s *Stream) RepoIdentity(id *atproto.SyncSubscribeRepos_Identity) error {
 	if err != nil {
 		s.logger.Error("failed to parse DID", "err", err)
 	} else {
-		s.dir.Purge(ctx, did.AtIdentifier())
-		id, err := s.dir.LookupDID(ctx, did)
-		if err != nil {
-			s.logger.Error("failed to lookup DID", "err", err)
-		} else {
-			if err := s.writer.Save(&Identity{
-				DID:    id.DID.String(),
-				Handle: id.Handle.String(),
-				PDS:    id.PDSEndpoint(),
-			}).Error; err != nil {
-				s.logger.Error("failed to save identity", "err", err)
-			}
+		if id, _ := s.resolveIdentity(ctx, did, true); id != nil {
+			s.emitIdentity(e.FirehoseSeq, id.DID.String(), id.Handle.String())
 		}
 	}
 
@@ -572,13 +830,10 @@ func (s *Stream) RepoIdentity(id *atproto.SyncSubscribeRepos_Identity) error {
 		return nil
 	}
 
-	defer func() {
-		if err := s.writer.Create(e).Error; err != nil {
-			s.logger.Error("failed to create event", "err", err)
-		}
-	}()
+	defer s.writeEvent(ctx, e)
 
 	e.Time = t.UnixNano()
+	s.SetEventTime(t)
 
 	return nil
 }
@@ -616,13 +871,10 @@ func (s *Stream) RepoMigrate(migrate *atproto.SyncSubscribeRepos_Migrate) error
 		return nil
 	}
 
-	defer func() {
-		if err := s.writer.Create(e).Error; err != nil {
-			s.logger.Error("failed to create event", "err", err)
-		}
-	}()
+	defer s.writeEvent(ctx, e)
 
 	e.Time = t.UnixNano()
+	s.SetEventTime(t)
 
 	return nil
 }
@@ -652,13 +904,10 @@ func (s *Stream) RepoTombstone(tomb *atproto.SyncSubscribeRepos_Tombstone) error
 		return nil
 	}
 
-	defer func() {
-		if err := s.writer.Create(e).Error; err != nil {
-			s.logger.Error("failed to create event", "err", err)
-		}
-	}()
+	defer s.writeEvent(ctx, e)
 
 	e.Time = t.UnixNano()
+	s.SetEventTime(t)
 
 	return nil
 }
@@ -0,0 +1,472 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// JetstreamEvent is a simplified, Jetstream-compatible JSON event
+type JetstreamEvent struct {
+	DID      string             `json:"did"`
+	TimeUS   int64              `json:"time_us"`
+	Seq      int64              `json:"seq"`
+	Kind     string             `json:"kind"`
+	Commit   *JetstreamCommit   `json:"commit,omitempty"`
+	Identity *JetstreamIdentity `json:"identity,omitempty"`
+}
+
+type JetstreamCommit struct {
+	Rev        string          `json:"rev"`
+	Operation  string          `json:"operation"`
+	Collection string          `json:"collection"`
+	RKey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	CID        string          `json:"cid,omitempty"`
+}
+
+type JetstreamIdentity struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle"`
+	Seq    int64  `json:"seq"`
+}
+
+// Policies for subscribers whose outbound buffer is full
+const (
+	// SubscribeDisconnect disconnects the subscriber
+	SubscribeDisconnect = "disconnect"
+	// SubscribeDropNewest drops the event that didn't fit
+	SubscribeDropNewest = "drop_newest"
+	// SubscribeDropOldest drops the oldest buffered event to make room
+	SubscribeDropOldest = "drop_oldest"
+)
+
+// subscribeUsageBatchBytes is how many bytes a subscription writes between accounting them to
+// its API key
+const subscribeUsageBatchBytes = 64 << 10
+
+// subscriber is a single /subscribe websocket client and its filters
+type subscriber struct {
+	conn        *websocket.Conn
+	collections []string // Exact NSIDs or prefixes ending in ".*"
+	dids        map[string]struct{}
+	langs       []string // Primary language subtags, commits are only sent if their record declares one
+	outbound    chan outboundMsg
+	closeOnce   sync.Once
+	closed      chan struct{}
+
+	// zstd subscribers are sent binary messages compressed with the shared dictionary
+	zstd bool
+
+	// What to do when outbound is full, and how many events may be dropped before disconnecting (0 for no limit)
+	dropPolicy string
+	maxDrops   int64
+	dropped    atomic.Int64
+}
+
+// outboundMsg is an event queued for a subscriber, with its seq and key so events the subscriber
+// was already replayed can be skipped
+type outboundMsg struct {
+	seq  int64
+	key  string
+	data []byte
+}
+
+// eventKey identifies an event among the others at its seq, since a commit's ops share one
+func eventKey(evt *JetstreamEvent) string {
+	if evt.Commit != nil {
+		return evt.Commit.Collection + "/" + evt.Commit.RKey
+	}
+	return "#" + evt.Kind
+}
+
+func (sub *subscriber) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.closed)
+		sub.conn.Close()
+	})
+}
+
+func (sub *subscriber) wants(did, collection, langs string) bool {
+	if len(sub.dids) > 0 {
+		if _, ok := sub.dids[did]; !ok {
+			return false
+		}
+	}
+
+	if len(sub.langs) > 0 && collection != "" && !langsMatch(langs, sub.langs) {
+		return false
+	}
+
+	if len(sub.collections) == 0 || collection == "" {
+		return true
+	}
+
+	for _, wanted := range sub.collections {
+		if prefix, ok := strings.CutSuffix(wanted, "*"); ok {
+			if strings.HasPrefix(collection, prefix) {
+				return true
+			}
+		} else if wanted == collection {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscribers tracks the connected /subscribe clients
+type subscribers struct {
+	subs map[*subscriber]struct{}
+	lk   sync.RWMutex
+
+	// zstd compresses messages for subscribers that ask for it, if enabled
+	zstd *zstd.Encoder
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		subs: make(map[*subscriber]struct{}),
+	}
+}
+
+func (ss *subscribers) add(sub *subscriber) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+	ss.subs[sub] = struct{}{}
+	subscribersConnected.Set(float64(len(ss.subs)))
+}
+
+func (ss *subscribers) remove(sub *subscriber) {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+	delete(ss.subs, sub)
+	subscribersConnected.Set(float64(len(ss.subs)))
+}
+
+// broadcast sends an event to every subscriber that wants it, disconnecting
+// subscribers whose outbound buffer is full
+func (ss *subscribers) broadcast(evt *JetstreamEvent, collection, langs string) {
+	ss.lk.RLock()
+	defer ss.lk.RUnlock()
+	if len(ss.subs) == 0 {
+		return
+	}
+
+	// Each event is marshaled, and compressed, at most once however many subscribers want it
+	var msg, compressed []byte
+	key := eventKey(evt)
+	for sub := range ss.subs {
+		if !sub.wants(evt.DID, collection, langs) {
+			continue
+		}
+
+		if msg == nil {
+			var err error
+			msg, err = json.Marshal(evt)
+			if err != nil {
+				return
+			}
+		}
+
+		if !sub.zstd {
+			sub.send(outboundMsg{seq: evt.Seq, key: key, data: msg})
+			continue
+		}
+
+		if compressed == nil {
+			compressed = ss.compress(msg)
+		}
+		sub.send(outboundMsg{seq: evt.Seq, key: key, data: compressed})
+	}
+}
+
+// compress zstd compresses a marshaled event
+func (ss *subscribers) compress(msg []byte) []byte {
+	compressed := ss.zstd.EncodeAll(msg, nil)
+	subscribeZstdSaved.Add(float64(len(msg) - len(compressed)))
+	return compressed
+}
+
+// send queues a message for the subscriber, applying its drop policy if it has fallen behind.
+// It never blocks, so one stalled client can't hold up the fan-out to the rest.
+func (sub *subscriber) send(msg outboundMsg) {
+	select {
+	case sub.outbound <- msg:
+		subscriberEventsSent.Inc()
+		return
+	default:
+	}
+
+	switch sub.dropPolicy {
+	case SubscribeDropNewest:
+		// Nothing to do, the message just isn't queued
+	case SubscribeDropOldest:
+		select {
+		case <-sub.outbound:
+		default:
+		}
+		select {
+		case sub.outbound <- msg:
+			subscriberEventsSent.Inc()
+		default:
+		}
+	default:
+		subscribersDropped.Inc()
+		go sub.close()
+		return
+	}
+
+	subscriberEventsDropped.WithLabelValues(sub.dropPolicy).Inc()
+	if dropped := sub.dropped.Add(1); sub.maxDrops > 0 && dropped > sub.maxDrops {
+		subscribersDropped.Inc()
+		go sub.close()
+	}
+}
+
+// emitCommitOp re-emits a single op of an ingested commit to /subscribe clients
+func (s *Stream) emitCommitOp(seq int64, did, rev, action, collection, rkey, cid, langs string, record []byte) {
+	s.subscribers.broadcast(&JetstreamEvent{
+		DID:    did,
+		TimeUS: s.Clock.Now().UnixMicro(),
+		Seq:    seq,
+		Kind:   "commit",
+		Commit: &JetstreamCommit{
+			Rev:        rev,
+			Operation:  action,
+			Collection: collection,
+			RKey:       rkey,
+			Record:     record,
+			CID:        cid,
+		},
+	}, collection, langs)
+}
+
+// emitIdentity re-emits an identity or handle change to /subscribe clients
+func (s *Stream) emitIdentity(seq int64, did, handle string) {
+	s.subscribers.broadcast(&JetstreamEvent{
+		DID:    did,
+		TimeUS: s.Clock.Now().UnixMicro(),
+		Seq:    seq,
+		Kind:   "identity",
+		Identity: &JetstreamIdentity{
+			DID:    did,
+			Handle: handle,
+			Seq:    seq,
+		},
+	}, "", "")
+}
+
+// EnableSubscribeZstd lets /subscribe clients ask for zstd compressed messages with compress=true,
+// like Jetstream. Messages are compressed with dict, a zstd dictionary clients fetch from
+// /subscribe/dictionary, or without one if dict is empty.
+func (s *Stream) EnableSubscribeZstd(dict []byte) error {
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedDefault)}
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+
+	s.subscribers.zstd = enc
+	s.subscribeZstdDict = dict
+	return nil
+}
+
+// HandleGetSubscribeDictionary handles the GET /subscribe/dictionary endpoint, serving the zstd
+// dictionary compressed /subscribe messages are decoded with
+func (s *Stream) HandleGetSubscribeDictionary(c echo.Context) error {
+	if len(s.subscribeZstdDict) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "zstd compression with a dictionary is not enabled on this instance"})
+	}
+	return c.Blob(http.StatusOK, "application/octet-stream", s.subscribeZstdDict)
+}
+
+func (s *Stream) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: s.SubscribeCompression,
+	}
+}
+
+// HandleSubscribe handles the GET /subscribe websocket endpoint, streaming
+// ingested events as Jetstream-style JSON
+func (s *Stream) HandleSubscribe(c echo.Context) error {
+	// Parse the query parameters
+	// wantedCollections - Collection NSIDs or prefixes like app.bsky.feed.* (optional, repeatable)
+	// wantedDids - Repo DIDs (optional, repeatable)
+	// wantedLangs - Language tags, only commits whose record declares one are sent (optional, repeatable)
+	// compress - Send zstd compressed binary messages, decoded with the dictionary at /subscribe/dictionary (optional)
+	// cursor - Replay stored events from this firehose seq before streaming live ones (optional)
+	sub := &subscriber{
+		dids:       make(map[string]struct{}),
+		outbound:   make(chan outboundMsg, s.SubscribeBufferSize),
+		closed:     make(chan struct{}),
+		dropPolicy: s.SubscribeDropPolicy,
+		maxDrops:   s.SubscribeMaxDrops,
+	}
+
+	for _, collection := range c.QueryParams()["wantedCollections"] {
+		if prefix, ok := strings.CutSuffix(collection, ".*"); ok {
+			if _, err := syntax.ParseNSID(prefix + ".x"); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid collection prefix: %s", err)})
+			}
+		} else if _, err := syntax.ParseNSID(collection); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid collection: %s", err)})
+		}
+		sub.collections = append(sub.collections, collection)
+	}
+
+	for _, didParam := range c.QueryParams()["wantedDids"] {
+		did, err := syntax.ParseDID(didParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid DID: %s", err)})
+		}
+		sub.dids[did.String()] = struct{}{}
+	}
+
+	langs, err := parseLangs(c.QueryParams()["wantedLangs"])
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	sub.langs = langs
+
+	if c.QueryParam("compress") == "true" {
+		if s.subscribers.zstd == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "zstd compression is not enabled on this instance"})
+		}
+		sub.zstd = true
+	}
+
+	var replay *subscribeReplay
+	if cursorParam := c.QueryParam("cursor"); cursorParam != "" {
+		cursor, err := strconv.ParseInt(cursorParam, 10, 64)
+		if err != nil || cursor < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid cursor, expected a firehose seq"})
+		}
+		replay = &subscribeReplay{seq: cursor}
+	}
+
+	hc := &hijackCounter{ResponseWriter: c.Response().Writer, metric: subscribeWireBytes}
+	c.Response().Writer = hc
+
+	conn, err := s.upgrader().Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	sub.conn = conn
+
+	// Clients that offered compression get it when it's enabled, unless their messages are
+	// already zstd compressed
+	var compression *compressionStats
+	if sub.zstd {
+		conn.EnableWriteCompression(false)
+	} else if s.SubscribeCompression && compressionNegotiated(c.Request().Header) && hc.conn != nil {
+		if err := conn.SetCompressionLevel(s.SubscribeCompressionLevel); err != nil {
+			return fmt.Errorf("failed to set compression level: %w", err)
+		}
+		compression = &compressionStats{
+			conn:  hc.conn,
+			wire:  func(c *countingConn) int64 { return c.written.Load() },
+			saved: subscribeCompressionSaved,
+		}
+	}
+
+	logger := s.logger.With("source", "subscribe", "remote_addr", c.RealIP())
+	logger.Info("subscriber connected", "collections", sub.collections, "dids", len(sub.dids), "zstd", sub.zstd, "cursor", c.QueryParam("cursor"))
+
+	// The bytes sent over the connection are accounted to the subscriber's API key as they're
+	// written, in batches so busy subscriptions don't take the usage lock for every message
+	var accounted int64
+	accountUsage := func(all bool) {
+		if hc.conn == nil {
+			return
+		}
+		if written := hc.conn.written.Load(); all || written-accounted >= subscribeUsageBatchBytes {
+			addBytesServed(c, written-accounted)
+			accounted = written
+		}
+	}
+
+	defer func() {
+		s.subscribers.remove(sub)
+		sub.close()
+		accountUsage(true)
+		logger.Info("subscriber disconnected")
+	}()
+
+	// Read and discard client messages so we notice when the client goes away
+	go func() {
+		defer sub.close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	msgType := websocket.TextMessage
+	if sub.zstd {
+		msgType = websocket.BinaryMessage
+	}
+
+	write := func(msg []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(msgType, msg); err != nil {
+			return err
+		}
+		if compression != nil {
+			compression.addPayload(int64(len(msg)))
+		}
+		accountUsage(false)
+		return nil
+	}
+
+	if replay != nil {
+		// Catch up from stored events, then start queueing live events and catch up once more to
+		// cover anything stored in between. Live events replayed by that second pass are skipped below.
+		if err := s.replaySubscriber(c.Request().Context(), sub, replay, write); err != nil {
+			logger.Debug("failed to replay to subscriber", "err", err)
+			return nil
+		}
+		replay.trackSent()
+		s.subscribers.add(sub)
+		if err := s.replaySubscriber(c.Request().Context(), sub, replay, write); err != nil {
+			logger.Debug("failed to replay to subscriber", "err", err)
+			return nil
+		}
+		logger.Info("subscriber caught up", "seq", replay.seq)
+	} else {
+		s.subscribers.add(sub)
+	}
+
+	for {
+		select {
+		case <-sub.closed:
+			return nil
+		case msg := <-sub.outbound:
+			if replay != nil && replay.sentLive(msg.seq, msg.key) {
+				continue
+			}
+			if err := write(msg.data); err != nil {
+				logger.Debug("failed to write to subscriber", "err", err)
+				return nil
+			}
+		}
+	}
+}
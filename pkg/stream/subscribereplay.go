@@ -0,0 +1,205 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// subscribeReplayPageSize is how many stored records and identity events are read per replay query
+const subscribeReplayPageSize = 1000
+
+// subscribeReplay tracks how far a /subscribe client has been caught up from stored events
+type subscribeReplay struct {
+	// seq is the highest seq replayed, and keys the events replayed at it, since a commit's ops
+	// may be stored across more than one replay query
+	seq  int64
+	keys map[string]bool
+
+	// sent holds the events replayed once live events started being queued, which is all live
+	// events are checked against. Skipping every live event below seq would lose ones that were
+	// broadcast before being stored, while repeating one replayed earlier is fine for at-least-once
+	// delivery. It's nil until trackSent is called.
+	sent map[sentEvent]struct{}
+}
+
+// sentEvent is an event replayed to a subscriber, by its seq and key
+type sentEvent struct {
+	seq int64
+	key string
+}
+
+// replayed reports whether an event has already been replayed, for events read from the store
+func (r *subscribeReplay) replayed(seq int64, key string) bool {
+	return seq < r.seq || (seq == r.seq && r.keys[key])
+}
+
+func (r *subscribeReplay) mark(seq int64, key string) {
+	if seq > r.seq || r.keys == nil {
+		r.seq = seq
+		r.keys = make(map[string]bool)
+	}
+	r.keys[key] = true
+	if r.sent != nil {
+		r.sent[sentEvent{seq: seq, key: key}] = struct{}{}
+	}
+}
+
+// trackSent starts keeping the events replayed, for when live events are queued alongside them
+func (r *subscribeReplay) trackSent() {
+	r.sent = make(map[sentEvent]struct{})
+}
+
+// sentLive reports whether a live event was already replayed, forgetting it since it's only
+// broadcast once
+func (r *subscribeReplay) sentLive(seq int64, key string) bool {
+	k := sentEvent{seq: seq, key: key}
+	if _, ok := r.sent[k]; !ok {
+		return false
+	}
+	delete(r.sent, k)
+	return true
+}
+
+// replayedIdentity is a stored identity or handle event with the DID's current handle
+type replayedIdentity struct {
+	FirehoseSeq int64
+	Repo        string
+	CreatedAt   time.Time
+	Handle      string
+}
+
+// replaySubscriber sends a subscriber the stored events from its replay position until it's
+// caught up with what's been stored, in seq order. Stored commits don't include their rev or CID,
+// and identity events carry the DID's current handle rather than its handle at the time.
+func (s *Stream) replaySubscriber(ctx context.Context, sub *subscriber, r *subscribeReplay, write func([]byte) error) error {
+	var dids []string
+	for did := range sub.dids {
+		dids = append(dids, did)
+	}
+
+	for {
+		select {
+		case <-sub.closed:
+			return fmt.Errorf("subscriber disconnected")
+		default:
+		}
+
+		recQuery := s.reader.WithContext(ctx).
+			Where("firehose_seq >= ? AND firehose_seq > 0", r.seq).
+			Order("firehose_seq ASC, id ASC").
+			Limit(subscribeReplayPageSize)
+		idQuery := s.reader.WithContext(ctx).Table("events").
+			Select("events.firehose_seq, events.repo, events.created_at, identities.handle").
+			Joins("LEFT JOIN identities ON identities.d_id = events.repo AND identities.deleted_at IS NULL").
+			Where("events.event_type IN ? AND events.firehose_seq >= ? AND events.firehose_seq > 0", []string{"identity", "handle"}, r.seq).
+			Where("events.deleted_at IS NULL").
+			Order("events.firehose_seq ASC").
+			Limit(subscribeReplayPageSize)
+		if len(dids) > 0 {
+			recQuery = recQuery.Where("repo IN ?", dids)
+			idQuery = idQuery.Where("events.repo IN ?", dids)
+		}
+
+		var recs []Record
+		if err := recQuery.Find(&recs).Error; err != nil {
+			return fmt.Errorf("failed to get records to replay: %w", err)
+		}
+		var ids []replayedIdentity
+		if err := idQuery.Scan(&ids).Error; err != nil {
+			return fmt.Errorf("failed to get identity events to replay: %w", err)
+		}
+
+		// A full page may have more events at its last seq on the next one, so only replay up to
+		// the lowest seq both pages are known to be complete through
+		bound := int64(math.MaxInt64)
+		if len(recs) == subscribeReplayPageSize {
+			bound = min(bound, recs[len(recs)-1].FirehoseSeq)
+		}
+		if len(ids) == subscribeReplayPageSize {
+			bound = min(bound, ids[len(ids)-1].FirehoseSeq)
+		}
+
+		events := make([]*JetstreamEvent, 0, len(recs)+len(ids))
+		langs := make(map[*JetstreamEvent]string)
+		for _, rec := range recs {
+			if rec.FirehoseSeq > bound {
+				break
+			}
+			evt := &JetstreamEvent{
+				DID:    rec.Repo,
+				TimeUS: rec.CreatedAt.UnixMicro(),
+				Seq:    rec.FirehoseSeq,
+				Kind:   "commit",
+				Commit: &JetstreamCommit{
+					Operation:  rec.Action,
+					Collection: rec.Collection,
+					RKey:       rec.RKey,
+					Record:     json.RawMessage(rec.Raw),
+				},
+			}
+			events = append(events, evt)
+			langs[evt] = rec.Langs
+		}
+		for _, id := range ids {
+			if id.FirehoseSeq > bound {
+				break
+			}
+			events = append(events, &JetstreamEvent{
+				DID:    id.Repo,
+				TimeUS: id.CreatedAt.UnixMicro(),
+				Seq:    id.FirehoseSeq,
+				Kind:   "identity",
+				Identity: &JetstreamIdentity{
+					DID:    id.Repo,
+					Handle: id.Handle,
+					Seq:    id.FirehoseSeq,
+				},
+			})
+		}
+		slices.SortStableFunc(events, func(a, b *JetstreamEvent) int {
+			switch {
+			case a.Seq < b.Seq:
+				return -1
+			case a.Seq > b.Seq:
+				return 1
+			}
+			return 0
+		})
+
+		for _, evt := range events {
+			key := eventKey(evt)
+			if r.replayed(evt.Seq, key) {
+				continue
+			}
+
+			collection := ""
+			if evt.Commit != nil {
+				collection = evt.Commit.Collection
+			}
+			r.mark(evt.Seq, key)
+			if !sub.wants(evt.DID, collection, langs[evt]) {
+				continue
+			}
+
+			msg, err := json.Marshal(evt)
+			if err != nil {
+				return fmt.Errorf("failed to marshal replayed event: %w", err)
+			}
+			if sub.zstd {
+				msg = s.subscribers.compress(msg)
+			}
+			if err := write(msg); err != nil {
+				return fmt.Errorf("failed to write replayed event: %w", err)
+			}
+			subscriberEventsReplayed.Inc()
+		}
+
+		if bound == math.MaxInt64 {
+			return nil
+		}
+	}
+}
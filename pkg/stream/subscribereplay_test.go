@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestReplayDeliversLiveEventsStoredLate(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateSchema(db); err != nil {
+		t.Fatalf("migrateSchema: %v", err)
+	}
+	ctx := context.Background()
+
+	s := &Stream{reader: db, subscribers: newSubscribers()}
+	sub := &subscriber{closed: make(chan struct{})}
+
+	var sent []int64
+	write := func(msg []byte) error {
+		var evt JetstreamEvent
+		if err := json.Unmarshal(msg, &evt); err != nil {
+			return err
+		}
+		sent = append(sent, evt.Seq)
+		return nil
+	}
+	store := func(seq int64) {
+		t.Helper()
+		rec := &Record{FirehoseSeq: seq, Repo: "did:plc:a", Collection: "app.bsky.feed.post", RKey: "1", Action: "create"}
+		if err := db.Create(rec).Error; err != nil {
+			t.Fatalf("failed to store record: %v", err)
+		}
+	}
+
+	// Seq 10 is stored before the subscriber connects, while seq 9's worker hasn't finished
+	store(10)
+	replay := &subscribeReplay{seq: 1}
+	if err := s.replaySubscriber(ctx, sub, replay, write); err != nil {
+		t.Fatalf("replaySubscriber: %v", err)
+	}
+
+	// Seq 11 is stored before the second pass, and seq 9 only after it
+	replay.trackSent()
+	store(11)
+	if err := s.replaySubscriber(ctx, sub, replay, write); err != nil {
+		t.Fatalf("replaySubscriber: %v", err)
+	}
+	if want := []int64{10, 11}; !slices.Equal(sent, want) {
+		t.Fatalf("replayed seqs %v, want %v", sent, want)
+	}
+
+	// Live events are queued in the order their workers finish
+	key := "app.bsky.feed.post/1"
+	var live []int64
+	for _, seq := range []int64{11, 9, 12} {
+		if !replay.sentLive(seq, key) {
+			live = append(live, seq)
+		}
+	}
+	if want := []int64{9, 12}; !slices.Equal(live, want) {
+		t.Errorf("live seqs sent %v, want %v", live, want)
+	}
+}
@@ -0,0 +1,211 @@
+package stream
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+)
+
+// threadCollection is the collection whose reply references threads are built from
+const threadCollection = "app.bsky.feed.post"
+
+// maxThreadPosts caps how many stored posts a single thread reconstruction loads
+const maxThreadPosts = 2000
+
+// recordReplyRefs returns the root and parent post URIs of a post that's a reply, or empty strings otherwise
+func recordReplyRefs(collection string, rec map[string]any) (root, parent string) {
+	if collection != threadCollection {
+		return "", ""
+	}
+	reply, ok := rec["reply"].(map[string]any)
+	if !ok {
+		return "", ""
+	}
+	if ref, ok := reply["root"].(map[string]any); ok {
+		root, _ = ref["uri"].(string)
+	}
+	if ref, ok := reply["parent"].(map[string]any); ok {
+		parent, _ = ref["uri"].(string)
+	}
+	return root, parent
+}
+
+// recordURI returns the AT-URI of a stored record
+func recordURI(r Record) string {
+	return fmt.Sprintf("at://%s/%s/%s", r.Repo, r.Collection, r.RKey)
+}
+
+// ThreadNode is a post in a reconstructed thread
+type ThreadNode struct {
+	URI    string      `json:"uri"`
+	Record *JSONRecord `json:"record,omitempty"`
+	// Deleted is set for posts whose deletion was seen, Record holds their last stored content
+	Deleted bool `json:"deleted,omitempty"`
+	// Missing is set for posts that are replied to but weren't stored, like ones created before the retention window.
+	// Their own parent is unknown, so they're attached directly to the thread root.
+	Missing bool          `json:"missing,omitempty"`
+	Replies []*ThreadNode `json:"replies,omitempty"`
+}
+
+type ThreadResponse struct {
+	Thread    *ThreadNode `json:"thread,omitempty"`
+	Posts     int         `json:"posts"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// threadRoot finds the URI of the root of the thread a post belongs to, from the post itself
+// or, if it wasn't stored, from any stored reply to it
+func (s *Stream) threadRoot(uri syntax.ATURI) (string, error) {
+	var roots []string
+	if err := s.reader.Model(&Record{}).
+		Where("repo = ? AND collection = ? AND r_key = ? AND reply_root <> ''", uri.Authority().String(), uri.Collection().String(), uri.RecordKey().String()).
+		Order("id DESC").
+		Limit(1).
+		Pluck("reply_root", &roots).Error; err != nil {
+		return "", err
+	}
+	if len(roots) > 0 {
+		return roots[0], nil
+	}
+
+	if err := s.reader.Model(&Record{}).
+		Where("reply_parent = ?", uri.String()).
+		Limit(1).
+		Pluck("reply_root", &roots).Error; err != nil {
+		return "", err
+	}
+	if len(roots) > 0 {
+		return roots[0], nil
+	}
+
+	return uri.String(), nil
+}
+
+// HandleGetThread handles the GET /thread endpoint, rebuilding the thread a post belongs to from
+// the stored reply records, including posts that have since been deleted
+func (s *Stream) HandleGetThread(c echo.Context) error {
+	// Parse the query parameters
+	// uri - AT-URI of a post in the thread
+	resp := ThreadResponse{}
+
+	uri, err := syntax.ParseATURI(c.QueryParam("uri"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid uri: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	if uri.Collection().String() != threadCollection || uri.RecordKey() == "" {
+		resp.Error = fmt.Sprintf("uri must point at a %s record", threadCollection)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	rootURI, err := s.threadRoot(uri)
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	root, err := syntax.ParseATURI(rootURI)
+	if err != nil {
+		resp.Error = fmt.Sprintf("stored thread root %q is not a valid uri", rootURI)
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	// Replies all point at the root, the root itself is looked up by its path
+	var records []Record
+	if err := s.reader.
+		Where("reply_root = ?", rootURI).
+		Or("repo = ? AND collection = ? AND r_key = ?", root.Authority().String(), root.Collection().String(), root.RecordKey().String()).
+		Order("id ASC").
+		Limit(maxThreadPosts + 1).
+		Find(&records).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	if len(records) > maxThreadPosts {
+		records = records[:maxThreadPosts]
+		resp.Truncated = true
+	}
+
+	if len(records) == 0 {
+		resp.Error = "no stored posts in this thread"
+		return c.JSON(http.StatusNotFound, resp)
+	}
+
+	// Deletes carry no content, so they're looked up separately for the posts found
+	var repos, rkeys []string
+	for _, r := range records {
+		repos = append(repos, r.Repo)
+		rkeys = append(rkeys, r.RKey)
+	}
+	var deletes []Record
+	if err := s.reader.
+		Where("collection = ? AND action = ? AND repo IN ? AND r_key IN ?", threadCollection, "delete", repos, rkeys).
+		Find(&deletes).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+	deleted := map[string]bool{}
+	for _, d := range deletes {
+		deleted[recordURI(d)] = true
+	}
+
+	identities, err := s.identitiesForRecords(records)
+	if err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	// Later records (updates, backfills) replace earlier ones for the same post
+	nodes := map[string]*ThreadNode{}
+	parents := map[string]string{}
+	order := []string{}
+	for _, r := range records {
+		if r.Action == "delete" {
+			continue
+		}
+		postURI := recordURI(r)
+		rec := dbRecordIDToJSONRecord(r, identities[r.Repo])
+		if node, ok := nodes[postURI]; ok {
+			node.Record = &rec
+		} else {
+			nodes[postURI] = &ThreadNode{URI: postURI, Record: &rec, Deleted: deleted[postURI]}
+			order = append(order, postURI)
+		}
+		if r.ReplyParent != "" {
+			parents[postURI] = r.ReplyParent
+		}
+	}
+
+	rootNode, ok := nodes[rootURI]
+	if !ok {
+		rootNode = &ThreadNode{URI: rootURI, Missing: true}
+		nodes[rootURI] = rootNode
+	}
+
+	for _, postURI := range order {
+		if postURI == rootURI {
+			continue
+		}
+		parentURI := parents[postURI]
+		if parentURI == "" || parentURI == postURI {
+			parentURI = rootURI
+		}
+		parent, ok := nodes[parentURI]
+		if !ok {
+			parent = &ThreadNode{URI: parentURI, Missing: true}
+			nodes[parentURI] = parent
+			rootNode.Replies = append(rootNode.Replies, parent)
+		}
+		parent.Replies = append(parent.Replies, nodes[postURI])
+	}
+
+	resp.Thread = rootNode
+	resp.Posts = len(order)
+
+	setRowsReturned(c, resp.Posts)
+	return c.JSON(http.StatusOK, resp)
+}
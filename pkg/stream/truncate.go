@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/bluesky-social/indigo/atproto/data"
+)
+
+// Truncation markers stored on a Record when its raw JSON has been cut down
+const (
+	TruncatedFields = "fields"
+	TruncatedRecord = "record"
+	// TruncatedResponse is only set in API responses, when a raw payload was left out to honor max_bytes
+	TruncatedResponse = "response"
+)
+
+// truncateRecord applies the configured field and record size limits to a decoded record.
+// It returns the JSON to store, the size of the JSON before record-level truncation,
+// and a truncation marker ("" if the record was stored in full).
+func (s *Stream) truncateRecord(rec map[string]any) ([]byte, int, string, error) {
+	truncated := ""
+	if s.MaxFieldBytes > 0 && truncateFields(rec, s.MaxFieldBytes) {
+		truncated = TruncatedFields
+		recordsTruncated.WithLabelValues(TruncatedFields).Inc()
+	}
+
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	rawSize := len(recJSON)
+
+	if s.MaxRecordBytes > 0 && rawSize > s.MaxRecordBytes {
+		// Keep only the record type so the row still says what it was
+		stub := map[string]any{}
+		if t, ok := rec["$type"]; ok {
+			stub["$type"] = t
+		}
+		recJSON, err = json.Marshal(stub)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		truncated = TruncatedRecord
+		recordsTruncated.WithLabelValues(TruncatedRecord).Inc()
+	}
+
+	return recJSON, rawSize, truncated, nil
+}
+
+// truncateFields walks a decoded record, cutting any string or bytes values longer than max.
+// It returns true if any field was truncated.
+func truncateFields(v any, max int) bool {
+	truncated := false
+	switch val := v.(type) {
+	case map[string]any:
+		for k, inner := range val {
+			switch field := inner.(type) {
+			case string:
+				if len(field) > max {
+					val[k] = truncateString(field, max)
+					truncated = true
+				}
+			case data.Bytes:
+				if len(field) > max {
+					val[k] = field[:max]
+					truncated = true
+				}
+			default:
+				if truncateFields(field, max) {
+					truncated = true
+				}
+			}
+		}
+	case []any:
+		for i, inner := range val {
+			switch field := inner.(type) {
+			case string:
+				if len(field) > max {
+					val[i] = truncateString(field, max)
+					truncated = true
+				}
+			case data.Bytes:
+				if len(field) > max {
+					val[i] = field[:max]
+					truncated = true
+				}
+			default:
+				if truncateFields(field, max) {
+					truncated = true
+				}
+			}
+		}
+	}
+	return truncated
+}
+
+// truncateString cuts a string to at most max bytes without splitting a UTF-8 sequence
+func truncateString(str string, max int) string {
+	if len(str) <= max {
+		return str
+	}
+	end := max
+	for end > 0 && !utf8.RuneStart(str[end]) {
+		end--
+	}
+	return str[:end]
+}
+
+// truncationError describes a truncation for sinks that only have an error column
+func truncationError(truncated string, rawSize int) string {
+	return fmt.Sprintf("record truncated (%s), original size %d bytes", truncated, rawSize)
+}
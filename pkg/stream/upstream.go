@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstream is a firehose the stream consumes, with its own connection, cursor, and metrics.
+// The primary upstream's events are stored and fanned out, any others are only tracked
+// so their progress and frame counts can be compared against the primary.
+type upstream struct {
+	host  string // Metrics label and cursor key, the host of the first URL
+	relay *relayConn
+
+	lastSeq     int64
+	lastEvtTime time.Time
+	seqLk       sync.RWMutex
+
+	frames   *frameCounter
+	seqGauge prometheus.Gauge
+
+	// compression tracks the savings of the current connection, if it's compressed
+	compression atomic.Pointer[compressionStats]
+
+	// consistency, if set, is compared against another upstream's commits
+	consistency *consistencyChecker
+}
+
+func newUpstream(u *url.URL) *upstream {
+	return &upstream{
+		host:     u.Host,
+		relay:    &relayConn{urls: []*url.URL{u}},
+		frames:   newFrameCounter(),
+		seqGauge: upstreamSeq.WithLabelValues(u.Host),
+	}
+}
+
+func (up *upstream) setSeq(seq int64) {
+	up.seqLk.Lock()
+	defer up.seqLk.Unlock()
+	up.lastSeq = seq
+	up.seqGauge.Set(float64(seq))
+}
+
+func (up *upstream) getSeq() int64 {
+	up.seqLk.RLock()
+	defer up.seqLk.RUnlock()
+	return up.lastSeq
+}
+
+func (up *upstream) setEventTime(t time.Time) {
+	up.seqLk.Lock()
+	defer up.seqLk.Unlock()
+	if t.After(up.lastEvtTime) {
+		up.lastEvtTime = t
+		upstreamEventTime.WithLabelValues(up.host).Set(float64(t.UnixMilli()) / 1000)
+	}
+}
+
+func (up *upstream) getEventTime() time.Time {
+	up.seqLk.RLock()
+	defer up.seqLk.RUnlock()
+	return up.lastEvtTime
+}
+
+// observe advances the upstream's cursor, and its event time if evtTime parses
+func (up *upstream) observe(seq int64, evtTime string) {
+	up.setSeq(seq)
+	if t, err := dateparse.ParseAny(evtTime); err == nil {
+		up.setEventTime(t)
+	}
+}
+
+// trackingCallbacks follow an upstream's cursor without storing its events,
+// frames are already counted per upstream as they're read
+func (up *upstream) trackingCallbacks() *firehoseCallbacks {
+	rsc := &events.RepoStreamCallbacks{
+		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
+			up.observe(evt.Seq, evt.Time)
+			up.consistency.observe(up.host, evt.Repo, evt.Rev)
+			return nil
+		},
+		RepoHandle: func(evt *atproto.SyncSubscribeRepos_Handle) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+		RepoIdentity: func(evt *atproto.SyncSubscribeRepos_Identity) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+		RepoMigrate: func(evt *atproto.SyncSubscribeRepos_Migrate) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+		RepoTombstone: func(evt *atproto.SyncSubscribeRepos_Tombstone) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+		LabelLabels: func(evt *atproto.LabelSubscribeLabels_Labels) error {
+			up.setSeq(evt.Seq)
+			return nil
+		},
+	}
+	return &firehoseCallbacks{
+		RepoStreamCallbacks: rsc,
+		RepoAccount: func(evt *FirehoseAccount) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+		RepoSync: func(evt *FirehoseSync) error {
+			up.observe(evt.Seq, evt.Time)
+			return nil
+		},
+	}
+}
+
+// AddUpstream adds a firehose (another relay, a single PDS, or a labeler) to consume alongside
+// the primary relay. Its cursor is persisted separately and its frames are counted under its
+// own host label, but its events aren't stored. It must be called before the stream is started.
+func (s *Stream) AddUpstream(socketURL string) error {
+	u, err := url.Parse(socketURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse upstream socket url: %w", err)
+	}
+
+	if u.Host == s.primary.host {
+		return fmt.Errorf("upstream %q has the same host as the primary relay", u.Host)
+	}
+	for _, up := range s.upstreams {
+		if up.host == u.Host {
+			return fmt.Errorf("upstream %q is already configured", u.Host)
+		}
+	}
+
+	s.upstreams = append(s.upstreams, newUpstream(u))
+	return nil
+}
+
+// upstream returns the upstream with the given host, or the primary if host is empty
+func (s *Stream) upstream(host string) *upstream {
+	if host == "" || host == s.primary.host {
+		return s.primary
+	}
+	for _, up := range s.upstreams {
+		if up.host == host {
+			return up
+		}
+	}
+	return nil
+}
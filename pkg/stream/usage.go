@@ -0,0 +1,373 @@
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AnonymousUsageKey is the usage key requests without an API key are accounted under
+const AnonymousUsageKey = "anonymous"
+
+// usageFlushInterval is how often accumulated usage is written to the database
+const usageFlushInterval = 30 * time.Second
+
+// usageRowsKey is the echo context key handlers set to the number of rows they returned
+const usageRowsKey = "usage_rows"
+
+// usageBytesKey is the echo context key of the func accounting bytes a handler wrote outside the
+// response, like to a hijacked websocket connection
+const usageBytesKey = "usage_bytes"
+
+// setRowsReturned records how many rows a handler returned, for usage accounting
+func setRowsReturned(c echo.Context, n int) {
+	c.Set(usageRowsKey, n)
+}
+
+// addBytesServed accounts bytes a handler wrote outside the response, which the response size
+// doesn't include, to the request's API key
+func addBytesServed(c echo.Context, n int64) {
+	if add, ok := c.Get(usageBytesKey).(func(int64)); ok && n > 0 {
+		add(n)
+	}
+}
+
+type usageCounts struct {
+	Requests int64
+	Rows     int64
+	Bytes    int64
+}
+
+// usageTracker accounts requests, rows, and bytes to API keys by UTC day
+type usageTracker struct {
+	// keys maps each API key to the name its usage is accounted under
+	keys    map[string]string
+	require bool
+	quota   int64
+
+	lk sync.Mutex
+	// today holds the current day's totals per key, including flushed usage, for quota checks
+	day   string
+	today map[string]*usageCounts
+	// pending holds usage per day and key that hasn't been flushed yet
+	pending map[string]map[string]*usageCounts
+}
+
+// EnableUsageTracking accounts requests, rows returned, and bytes served to the API key presenting
+// them, or to AnonymousUsageKey. Keys are given as name=key, or as a bare key accounted under
+// a prefix of its hash. If requireKey is set, requests without a valid key are rejected, and
+// dailyQuota caps the requests each key can make per UTC day (0 for no limit).
+func (s *Stream) EnableUsageTracking(ctx context.Context, apiKeys []string, requireKey bool, dailyQuota int64) error {
+	u := &usageTracker{
+		keys:    make(map[string]string, len(apiKeys)),
+		require: requireKey,
+		quota:   dailyQuota,
+		today:   make(map[string]*usageCounts),
+		pending: make(map[string]map[string]*usageCounts),
+	}
+
+	for _, k := range apiKeys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(k, "=")
+		if !ok {
+			key = k
+			hash := sha256.Sum256([]byte(k))
+			name = "key-" + hex.EncodeToString(hash[:])[:12]
+		}
+		if name == AnonymousUsageKey {
+			return fmt.Errorf("API key name %q is reserved", AnonymousUsageKey)
+		}
+		u.keys[key] = name
+	}
+	if requireKey && len(u.keys) == 0 {
+		return fmt.Errorf("API keys are required but none are configured")
+	}
+
+	// Load today's usage so quotas carry across restarts
+	u.day = s.Clock.Now().UTC().Format(dumpDayFormat)
+	var rows []APIKeyUsage
+	if err := s.reader.WithContext(ctx).Where("day = ?", u.day).Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to load today's usage: %w", err)
+	}
+	for _, r := range rows {
+		u.today[r.KeyName] = &usageCounts{Requests: r.Requests, Rows: r.RowsReturned, Bytes: r.BytesServed}
+	}
+
+	s.usage = u
+	return nil
+}
+
+// apiKeyFromRequest returns the API key from the Authorization or X-API-Key headers
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// rollover resets the current day's totals at UTC midnight. lk must be held.
+func (u *usageTracker) rollover(day string) {
+	if u.day != day {
+		u.day = day
+		u.today = make(map[string]*usageCounts)
+	}
+}
+
+// admit checks a key's daily quota and counts the request against it, returning how many
+// requests it has left today (-1 if unlimited). The request is counted before it's served, so
+// concurrent and long-lived requests can't overshoot the quota.
+func (u *usageTracker) admit(name, day string) (remaining int64, ok bool) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+	u.rollover(day)
+
+	limited := u.quota > 0 && name != AnonymousUsageKey
+	var used int64
+	if c, ok := u.today[name]; ok {
+		used = c.Requests
+	}
+	if limited && used >= u.quota {
+		return 0, false
+	}
+
+	u.count(name, day, usageCounts{Requests: 1})
+	if !limited {
+		return -1, true
+	}
+	return u.quota - used - 1, true
+}
+
+// add accounts the rows and bytes a request served to its key
+func (u *usageTracker) add(name, day string, rows, bytes int64) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+	u.rollover(day)
+
+	u.count(name, day, usageCounts{Rows: rows, Bytes: bytes})
+}
+
+// count adds usage to a key's totals for the day. lk must be held.
+func (u *usageTracker) count(name, day string, n usageCounts) {
+	for _, counts := range []map[string]*usageCounts{u.today, u.pendingDay(day)} {
+		c, ok := counts[name]
+		if !ok {
+			c = &usageCounts{}
+			counts[name] = c
+		}
+		c.Requests += n.Requests
+		c.Rows += n.Rows
+		c.Bytes += n.Bytes
+	}
+}
+
+// pendingDay returns the unflushed usage of a day. lk must be held.
+func (u *usageTracker) pendingDay(day string) map[string]*usageCounts {
+	p, ok := u.pending[day]
+	if !ok {
+		p = make(map[string]*usageCounts)
+		u.pending[day] = p
+	}
+	return p
+}
+
+// UsageMiddleware authenticates API keys, enforces daily quotas, and accounts each request's
+// rows and bytes to its key. It does nothing unless usage tracking is enabled.
+func (s *Stream) UsageMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u := s.usage
+		path := c.Path()
+		if u == nil || path == "/metrics" || path == "/_health" {
+			return next(c)
+		}
+
+		name := AnonymousUsageKey
+		if key := apiKeyFromRequest(c.Request()); key != "" {
+			var ok bool
+			name, ok = u.keys[key]
+			if !ok {
+				apiKeyRejectedRequests.WithLabelValues("invalid_key").Inc()
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid API key"})
+			}
+		} else if u.require {
+			apiKeyRejectedRequests.WithLabelValues("missing_key").Inc()
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "API key required"})
+		}
+
+		now := s.Clock.Now().UTC()
+		day := now.Format(dumpDayFormat)
+
+		remaining, ok := u.admit(name, day)
+		if !ok {
+			apiKeyRejectedRequests.WithLabelValues("quota").Inc()
+			midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "daily quota exceeded"})
+		}
+		if remaining >= 0 {
+			c.Response().Header().Set("X-Quota-Limit", strconv.FormatInt(u.quota, 10))
+			c.Response().Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		}
+
+		// Bytes written to a hijacked connection are accounted to the day they're written, since
+		// a subscription can outlast the day it started on
+		c.Set(usageBytesKey, func(n int64) {
+			u.add(name, s.Clock.Now().UTC().Format(dumpDayFormat), 0, n)
+		})
+
+		err := next(c)
+
+		var rows int64
+		if n, ok := c.Get(usageRowsKey).(int); ok {
+			rows = int64(n)
+		}
+		u.add(name, day, rows, c.Response().Size)
+
+		return err
+	}
+}
+
+// flushUsage adds the usage accumulated since the last flush to the usage table
+func (s *Stream) flushUsage(ctx context.Context) error {
+	u := s.usage
+	if u == nil {
+		return nil
+	}
+
+	u.lk.Lock()
+	pending := u.pending
+	u.pending = make(map[string]map[string]*usageCounts)
+	u.lk.Unlock()
+
+	var rows []APIKeyUsage
+	for day, keys := range pending {
+		for name, c := range keys {
+			rows = append(rows, APIKeyUsage{KeyName: name, Day: day, Requests: c.Requests, RowsReturned: c.Rows, BytesServed: c.Bytes})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := s.writer.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key_name"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"requests":      gorm.Expr("api_key_usages.requests + excluded.requests"),
+			"rows_returned": gorm.Expr("api_key_usages.rows_returned + excluded.rows_returned"),
+			"bytes_served":  gorm.Expr("api_key_usages.bytes_served + excluded.bytes_served"),
+			"updated_at":    gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&rows).Error
+	if err != nil {
+		// Put the usage back so it's retried on the next flush
+		u.lk.Lock()
+		for _, r := range rows {
+			c, ok := u.pendingDay(r.Day)[r.KeyName]
+			if !ok {
+				c = &usageCounts{}
+				u.pendingDay(r.Day)[r.KeyName] = c
+			}
+			c.Requests += r.Requests
+			c.Rows += r.RowsReturned
+			c.Bytes += r.BytesServed
+		}
+		u.lk.Unlock()
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+
+	return nil
+}
+
+// RunUsage periodically flushes accumulated usage to the database, and once more on shutdown
+func (s *Stream) RunUsage(ctx context.Context) error {
+	if s.usage == nil {
+		return nil
+	}
+
+	logger := s.logger.With("source", "usage")
+
+	ticker := s.Clock.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := s.flushUsage(flushCtx); err != nil {
+				logger.Error("failed to flush usage on shutdown", "err", err)
+			}
+			return nil
+		case <-ticker.C():
+			if err := s.flushUsage(ctx); err != nil {
+				logger.Error("failed to flush usage", "err", err)
+			}
+		}
+	}
+}
+
+type UsageResponse struct {
+	Usage []APIKeyUsage `json:"usage"`
+	Error string        `json:"error,omitempty"`
+}
+
+// HandleGetUsage handles the GET /admin/usage endpoint, listing requests, rows, and bytes served
+// per API key and UTC day, newest first
+func (s *Stream) HandleGetUsage(c echo.Context) error {
+	// Parse the query parameters
+	// key - Only return usage for this key name
+	// since - Only return usage on or after this day (YYYY-MM-DD)
+	// limit - Number of rows to return (default=100)
+	resp := UsageResponse{}
+	if status, msg := s.authorizeAdmin(c); status != 0 {
+		resp.Error = msg
+		return c.JSON(status, resp)
+	}
+
+	if s.usage == nil {
+		resp.Error = "usage tracking is not enabled on this instance"
+		return c.JSON(http.StatusNotImplemented, resp)
+	}
+
+	limit, err := parseLimit(c.QueryParam("limit"))
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid limit: %s", err)
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+
+	ctx := c.Request().Context()
+	if err := s.flushUsage(ctx); err != nil {
+		s.logger.Error("failed to flush usage", "err", err)
+	}
+
+	q := s.reader.WithContext(ctx).Order("day DESC, requests DESC").Limit(limit)
+	if key := c.QueryParam("key"); key != "" {
+		q = q.Where("key_name = ?", key)
+	}
+	if since := c.QueryParam("since"); since != "" {
+		if _, err := time.Parse(dumpDayFormat, since); err != nil {
+			resp.Error = "invalid since, expected YYYY-MM-DD"
+			return c.JSON(http.StatusBadRequest, resp)
+		}
+		q = q.Where("day >= ?", since)
+	}
+
+	if err := q.Find(&resp.Usage).Error; err != nil {
+		resp.Error = err.Error()
+		return c.JSON(http.StatusInternalServerError, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
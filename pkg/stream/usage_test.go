@@ -0,0 +1,40 @@
+package stream
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestUsageAdmitReservesQuota(t *testing.T) {
+	u := &usageTracker{
+		quota:   10,
+		today:   make(map[string]*usageCounts),
+		pending: make(map[string]map[string]*usageCounts),
+	}
+
+	// Requests still being served count against the quota
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := u.admit("key", "2026-10-01"); ok {
+				lk.Lock()
+				admitted++
+				lk.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 10 {
+		t.Errorf("admitted %d concurrent requests, want the quota of 10", admitted)
+	}
+
+	u.add("key", "2026-10-01", 5, 1024)
+	if c := u.pending["2026-10-01"]["key"]; c.Requests != 10 || c.Rows != 5 || c.Bytes != 1024 {
+		t.Errorf("pending usage = %+v, want 10 requests, 5 rows, 1024 bytes", *c)
+	}
+}
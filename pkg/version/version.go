@@ -0,0 +1,79 @@
+// Package version holds the build information embedded at link time, e.g.
+//
+//	go build -ldflags "-X github.com/ericvolp12/atproto.tools/pkg/version.Version=v0.5.0 \
+//	  -X github.com/ericvolp12/atproto.tools/pkg/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/ericvolp12/atproto.tools/pkg/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/mod/semver"
+)
+
+// Set via -ldflags at build time
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Header is the response header carrying the server's version
+const Header = "X-Atproto-Tools-Version"
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+	}
+}
+
+// AtLeast reports whether the running binary is at least version min.
+// Development builds without a semantic version satisfy any minimum.
+func AtLeast(min string) bool {
+	if !semver.IsValid(Version) {
+		return true
+	}
+	return semver.Compare(Version, min) >= 0
+}
+
+// Middleware sets the version header on every response and rejects requests whose
+// min_version query parameter is newer than the running binary, so clients can detect
+// feature availability across instances running different versions
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(Header, Version)
+
+			minVersion := c.QueryParam("min_version")
+			if minVersion == "" {
+				return next(c)
+			}
+
+			if !semver.IsValid(minVersion) {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("invalid min_version %q, expected a semantic version like v1.2.3", minVersion),
+				})
+			}
+
+			if !AtLeast(minVersion) {
+				return c.JSON(http.StatusPreconditionFailed, map[string]string{
+					"error":   fmt.Sprintf("server version %s is older than min_version %s", Version, minVersion),
+					"version": Version,
+				})
+			}
+
+			return next(c)
+		}
+	}
+}